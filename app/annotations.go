@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// reverseDNSKey matches annotation keys in the reverse domain notation the
+// OCI specs recommend, e.g. com.example.build-id.
+var reverseDNSKey = regexp.MustCompile(`^[a-z0-9-]+\.[a-z0-9-]+(\.[A-Za-z0-9_-]+)*$`)
+
+// parseAnnotations parses --annotation key=value flags, later flags winning
+// for the same key. Keys must be non-empty and free of whitespace; keys that
+// aren't in reverse domain notation only draw a warning, since the OCI specs
+// recommend it without requiring it.
+func parseAnnotations(values []string) (map[string]string, error) {
+	annotations := map[string]string{}
+	for _, value := range values {
+		key, v, ok := strings.Cut(value, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid annotation %q: want key=value", value)
+		}
+		if key == "" || strings.ContainsAny(key, " \t\r\n") {
+			return nil, fmt.Errorf("invalid annotation %q: key must be non-empty and contain no whitespace", value)
+		}
+		if !reverseDNSKey.MatchString(key) {
+			fmt.Fprintf(os.Stderr, "Warning: annotation key %q is not in reverse domain notation, e.g. com.example.%s\n", key, key)
+		}
+		annotations[key] = v
+	}
+	return annotations, nil
+}
+
+// imageProvenance is what the predefined org.opencontainers.image.*
+// annotations of the OCI image spec say about an image: what it is, and
+// who built it from what, and when. Images carry them as manifest
+// annotations, config labels, or both.
+type imageProvenance struct {
+	Title         string `json:"Title,omitempty"`
+	Description   string `json:"Description,omitempty"`
+	Version       string `json:"Version,omitempty"`
+	Revision      string `json:"Revision,omitempty"`
+	Source        string `json:"Source,omitempty"`
+	Created       string `json:"Created,omitempty"`
+	Authors       string `json:"Authors,omitempty"`
+	Vendor        string `json:"Vendor,omitempty"`
+	Licenses      string `json:"Licenses,omitempty"`
+	URL           string `json:"URL,omitempty"`
+	Documentation string `json:"Documentation,omitempty"`
+}
+
+// ociImageAnnotationPrefix is the prefix of the predefined annotation keys.
+const ociImageAnnotationPrefix = "org.opencontainers.image."
+
+// newImageProvenance picks the predefined annotations out of labels, the
+// config's labels merged with the manifest's annotations. It returns nil if
+// there are none.
+func newImageProvenance(labels map[string]string) *imageProvenance {
+	var p imageProvenance
+	fields := []struct {
+		key   string
+		value *string
+	}{
+		{"title", &p.Title},
+		{"description", &p.Description},
+		{"version", &p.Version},
+		{"revision", &p.Revision},
+		{"source", &p.Source},
+		{"created", &p.Created},
+		{"authors", &p.Authors},
+		{"vendor", &p.Vendor},
+		{"licenses", &p.Licenses},
+		{"url", &p.URL},
+		{"documentation", &p.Documentation},
+	}
+	found := false
+	for _, f := range fields {
+		if v := labels[ociImageAnnotationPrefix+f.key]; v != "" {
+			*f.value, found = v, true
+		}
+	}
+	if !found {
+		return nil
+	}
+	return &p
+}
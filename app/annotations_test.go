@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewImageProvenance(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   *imageProvenance
+	}{
+		{name: "none"},
+		{name: "others only", labels: map[string]string{"maintainer": "ops", "org.opencontainers.image.base.name": "alpine"}},
+		{name: "empty values", labels: map[string]string{"org.opencontainers.image.title": ""}},
+		{
+			name: "predefined",
+			labels: map[string]string{
+				"org.opencontainers.image.title":         "app",
+				"org.opencontainers.image.description":   "does things",
+				"org.opencontainers.image.version":       "1.2.3",
+				"org.opencontainers.image.revision":      "abc123",
+				"org.opencontainers.image.source":        "https://example.com/app.git",
+				"org.opencontainers.image.created":       "2024-01-02T03:04:05Z",
+				"org.opencontainers.image.authors":       "ops@example.com",
+				"org.opencontainers.image.vendor":        "Example",
+				"org.opencontainers.image.licenses":      "MIT",
+				"org.opencontainers.image.url":           "https://example.com",
+				"org.opencontainers.image.documentation": "https://example.com/docs",
+				"maintainer":                             "ops",
+			},
+			want: &imageProvenance{
+				Title:         "app",
+				Description:   "does things",
+				Version:       "1.2.3",
+				Revision:      "abc123",
+				Source:        "https://example.com/app.git",
+				Created:       "2024-01-02T03:04:05Z",
+				Authors:       "ops@example.com",
+				Vendor:        "Example",
+				Licenses:      "MIT",
+				URL:           "https://example.com",
+				Documentation: "https://example.com/docs",
+			},
+		},
+	}
+	for _, tt := range tests {
+		if got := newImageProvenance(tt.labels); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: newImageProvenance = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestInspectProvenance checks the Provenance section of inspect's output
+// for an image with the predefined annotations in its config's labels and
+// its manifest, the manifest's winning.
+func TestInspectProvenance(t *testing.T) {
+	meta := imageMetadata{
+		Manifest: DockerManifestResponse{
+			SchemaVersion: 2,
+			Annotations: map[string]string{
+				"org.opencontainers.image.revision": "abc123",
+				"org.opencontainers.image.created":  "2024-01-02T03:04:05Z",
+				"org.opencontainers.image.version":  "1.2.3",
+			},
+		},
+		Config: ImageConfig{Config: ContainerConfig{Labels: map[string]string{
+			"org.opencontainers.image.title":   "app",
+			"org.opencontainers.image.source":  "https://example.com/app.git",
+			"org.opencontainers.image.version": "1.2.3-rc1",
+		}}},
+	}
+	data, err := json.MarshalIndent(newImageInspect("app", meta), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `  "Provenance": {
+    "Title": "app",
+    "Version": "1.2.3",
+    "Revision": "abc123",
+    "Source": "https://example.com/app.git",
+    "Created": "2024-01-02T03:04:05Z"
+  }
+}`
+	if !strings.HasSuffix(string(data), want) {
+		t.Errorf("inspect printed\n%s\nwant it to end with\n%s", data, want)
+	}
+
+	// Images without them have no such section.
+	meta = imageMetadata{Config: ImageConfig{Config: ContainerConfig{Labels: map[string]string{"maintainer": "ops"}}}}
+	if data, err := json.Marshal(newImageInspect("app", meta)); err != nil || strings.Contains(string(data), "Provenance") {
+		t.Errorf("inspect printed %s, %v, want no Provenance", data, err)
+	}
+}
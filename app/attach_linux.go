@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// attachedStreams are the container's standard streams -a connects to ours.
+// The others go to /dev/null, though a named or detached container's output
+// is still logged.
+type attachedStreams struct {
+	stdin, stdout, stderr bool
+}
+
+// parseAttach reads the -a values, stdin, stdout or stderr in any case. With
+// none, all three streams are attached.
+func parseAttach(values []string) (attachedStreams, error) {
+	if len(values) == 0 {
+		return attachedStreams{stdin: true, stdout: true, stderr: true}, nil
+	}
+	var a attachedStreams
+	for _, v := range values {
+		switch strings.ToLower(v) {
+		case "stdin":
+			a.stdin = true
+		case "stdout":
+			a.stdout = true
+		case "stderr":
+			a.stderr = true
+		default:
+			return a, fmt.Errorf("-a %q: must be stdin, stdout or stderr", v)
+		}
+	}
+	return a, nil
+}
+
+// teeToLog writes to log, and to w too if the stream is attached.
+func teeToLog(w, log io.Writer) io.Writer {
+	if w == nil {
+		return log
+	}
+	return io.MultiWriter(w, log)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestRunAttach checks which of a container's streams -a connects to ours.
+func TestRunAttach(t *testing.T) {
+	docker, image := runTestImage(t)
+	tests := []struct {
+		flags          []string
+		stdout, stderr string
+		wantErr        string
+	}{
+		{stdout: "out hi\n", stderr: "err\n"},
+		{flags: []string{"-a", "stdout"}, stdout: "out \n"},
+		{flags: []string{"-a", "stderr"}, stderr: "err\n"},
+		{flags: []string{"-a", "stdin", "-a", "stdout"}, stdout: "out hi\n"},
+		{flags: []string{"--attach", "STDERR", "-a", "Stdout"}, stdout: "out \n", stderr: "err\n"},
+		{flags: []string{"-a", "stdio"}, wantErr: `-a "stdio": must be stdin, stdout or stderr`},
+		{flags: []string{"-d", "-a", "stdout"}, wantErr: "-a can't be combined with --detach"},
+	}
+	for _, tt := range tests {
+		args := append(append([]string{"-q", "run", "--rm"}, tt.flags...), image, "/probe", "streams")
+		cmd := docker(args...)
+		cmd.Stdin = strings.NewReader("hi")
+		var stdout, stderr strings.Builder
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		err := cmd.Run()
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(stdout.String()+stderr.String(), tt.wantErr) {
+				t.Errorf("%q: %v, want it to fail with %q\nstdout: %s\nstderr: %s", tt.flags, err, tt.wantErr, stdout.String(), stderr.String())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v\nstderr: %s", tt.flags, err, stderr.String())
+			continue
+		}
+		if stdout.String() != tt.stdout || stderr.String() != tt.stderr {
+			t.Errorf("%q: stdout %q and stderr %q, want %q and %q", tt.flags, stdout.String(), stderr.String(), tt.stdout, tt.stderr)
+		}
+	}
+}
+
+func TestParseAttach(t *testing.T) {
+	tests := []struct {
+		values  []string
+		want    attachedStreams
+		wantErr bool
+	}{
+		{values: nil, want: attachedStreams{stdin: true, stdout: true, stderr: true}},
+		{values: []string{"stdout"}, want: attachedStreams{stdout: true}},
+		{values: []string{"STDIN", "stderr", "stdin"}, want: attachedStreams{stdin: true, stderr: true}},
+		{values: []string{"stdout", ""}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseAttach(tt.values)
+		if (err != nil) != tt.wantErr || err == nil && got != tt.want {
+			t.Errorf("parseAttach(%q) = %+v, %v, want %+v", tt.values, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// With --net bridge, a container gets a network namespace of its own,
+// joined to the others' by the host's bridgeName: a veth pair links its
+// eth0 to the bridge, which has bridgeGateway, the host's address on it.
+// Each container's address in bridgeSubnet is leased to it while it runs,
+// and other containers find it by name at that address, through their
+// /etc/hosts and the resolver served at bridgeGateway (see
+// dns_server_linux.go). The bridge is the only network: containers reach
+// each other and the host, but as nothing is NATed or forwarded, not beyond.
+const (
+	netModeBridge = "bridge"
+	bridgeName    = "dclone0"
+	// The container's end of its veth pair.
+	bridgeContainerLink = "eth0"
+)
+
+var (
+	bridgeGateway = net.IPv4(172, 29, 0, 1).To4()
+	bridgeSubnet  = &net.IPNet{IP: net.IPv4(172, 29, 0, 0).To4(), Mask: net.CIDRMask(16, 32)}
+)
+
+// containerAddressPath is where the address leased to the container key is
+// recorded.
+func containerAddressPath(key string) string {
+	return filepath.Join(containerDir(key), "address")
+}
+
+// leaseBridgeAddress picks the lowest address in bridgeSubnet that no
+// running container has, and records it as the container key's. Leases are
+// taken under a lock, and a container's only counts while it runs, so that
+// one killed without cleaning up frees its address anyway.
+func leaseBridgeAddress(key string) (net.IP, error) {
+	if err := os.MkdirAll(containersDir(), 0o755); err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(filepath.Join(containersDir(), "network.lock"), os.O_CREATE|os.O_RDONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+	if err := lockExclusive(lock); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(containersDir())
+	if err != nil {
+		return nil, err
+	}
+	taken := map[string]bool{bridgeGateway.String(): true}
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == key || !containerRunning(entry.Name()) {
+			continue
+		}
+		if data, err := os.ReadFile(containerAddressPath(entry.Name())); err == nil {
+			taken[strings.TrimSpace(string(data))] = true
+		}
+	}
+	ip, err := freeAddress(bridgeSubnet, taken)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(containerAddressPath(key), []byte(ip.String()+"\n"), 0o644); err != nil {
+		return nil, err
+	}
+	return ip, nil
+}
+
+// freeAddress returns the lowest address of network, past its network
+// address and short of its broadcast address, that isn't taken.
+func freeAddress(network *net.IPNet, taken map[string]bool) (net.IP, error) {
+	base := network.IP.To4()
+	ones, bits := network.Mask.Size()
+	size := uint32(1) << uint(bits-ones)
+	start := uint32(base[0])<<24 | uint32(base[1])<<16 | uint32(base[2])<<8 | uint32(base[3])
+	for i := uint32(1); i < size-1; i++ {
+		n := start + i
+		ip := net.IPv4(byte(n>>24), byte(n>>16), byte(n>>8), byte(n)).To4()
+		if !taken[ip.String()] {
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("no free address left in %s", network)
+}
+
+// bridgeVethName is the host's end of the container key's veth pair. Link
+// names have at most 15 bytes.
+func bridgeVethName(containerID string) string {
+	return "dc" + containerID[:12]
+}
+
+// createBridgeNamespace creates a network namespace for the container with
+// containerID and connects it to the bridge, creating that if need be,
+// with ip as the container's address. It returns the namespace, for the
+// child to join as it would a container's with --net container:. The veth
+// pair goes when the namespace does, once the container has exited and the
+// file is closed.
+func createBridgeNamespace(containerID string, ip net.IP) (*os.File, error) {
+	type created struct {
+		ns   *os.File
+		conn *netlinkConn
+		err  error
+	}
+	// A thread of its own is moved into the new namespace, to open it and
+	// a netlink socket in it. It stays locked, so it exits with the
+	// goroutine rather than going back to run others in the namespace.
+	done := make(chan created, 1)
+	go func() {
+		runtime.LockOSThread()
+		if err := syscall.Unshare(syscall.CLONE_NEWNET); err != nil {
+			done <- created{err: fmt.Errorf("creating a network namespace: %w", err)}
+			return
+		}
+		ns, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", syscall.Gettid()))
+		if err != nil {
+			done <- created{err: err}
+			return
+		}
+		conn, err := openNetlink()
+		if err != nil {
+			ns.Close()
+			done <- created{err: err}
+			return
+		}
+		done <- created{ns: ns, conn: conn}
+	}()
+	c := <-done
+	if c.err != nil {
+		return nil, c.err
+	}
+	defer c.conn.Close()
+	if err := connectBridge(containerID, c.ns, c.conn, ip); err != nil {
+		c.ns.Close()
+		return nil, err
+	}
+	return c.ns, nil
+}
+
+// connectBridge sets up the bridge on the host's side, and the container's
+// end of its veth pair in ns, which inside is configured through.
+func connectBridge(containerID string, ns *os.File, inside *netlinkConn, ip net.IP) error {
+	host, err := openNetlink()
+	if err != nil {
+		return err
+	}
+	defer host.Close()
+	if err := host.createBridge(bridgeName); err != nil {
+		return err
+	}
+	bridge, err := host.linkIndex(bridgeName)
+	if err != nil {
+		return err
+	}
+	if err := host.addAddress(bridge, bridgeGateway, bridgeSubnet); err != nil {
+		return err
+	}
+	if err := host.setLinkUp(bridgeName, 0); err != nil {
+		return err
+	}
+	veth := bridgeVethName(containerID)
+	if err := host.createVeth(veth, bridgeContainerLink, int(ns.Fd())); err != nil {
+		return err
+	}
+	if err := host.setLinkUp(veth, bridge); err != nil {
+		return err
+	}
+
+	if err := inside.setLinkUp("lo", 0); err != nil {
+		return err
+	}
+	eth, err := inside.linkIndex(bridgeContainerLink)
+	if err != nil {
+		return err
+	}
+	if err := inside.addAddress(eth, ip, bridgeSubnet); err != nil {
+		return err
+	}
+	if err := inside.setLinkUp(bridgeContainerLink, 0); err != nil {
+		return err
+	}
+	return inside.addDefaultRoute(eth, bridgeGateway)
+}
+
+// explainBridgeFailure adds what to do about it to an error setting up the
+// bridge network.
+func explainBridgeFailure(err error) error {
+	if errors.Is(err, syscall.EPERM) {
+		return fmt.Errorf("%w; --net bridge needs root, or CAP_NET_ADMIN", err)
+	}
+	return err
+}
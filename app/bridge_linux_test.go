@@ -0,0 +1,166 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestFreeAddress(t *testing.T) {
+	_, small, _ := net.ParseCIDR("10.0.0.0/30")
+	tests := []struct {
+		name    string
+		network *net.IPNet
+		taken   []string
+		want    string
+	}{
+		{name: "first", network: bridgeSubnet, taken: []string{"172.29.0.1"}, want: "172.29.0.2"},
+		{name: "gap", network: bridgeSubnet, taken: []string{"172.29.0.1", "172.29.0.3"}, want: "172.29.0.2"},
+		{name: "past a gap", network: bridgeSubnet, taken: []string{"172.29.0.1", "172.29.0.2", "172.29.0.3"}, want: "172.29.0.4"},
+		{name: "next octet", network: small, taken: []string{"10.0.0.1"}, want: "10.0.0.2"},
+		{name: "full, but for broadcast", network: small, taken: []string{"10.0.0.1", "10.0.0.2"}},
+	}
+	for _, tt := range tests {
+		taken := map[string]bool{}
+		for _, ip := range tt.taken {
+			taken[ip] = true
+		}
+		ip, err := freeAddress(tt.network, taken)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: freeAddress = %s, want an error", tt.name, ip)
+			}
+			continue
+		}
+		if err != nil || ip.String() != tt.want {
+			t.Errorf("%s: freeAddress = %s, %v, want %s", tt.name, ip, err, tt.want)
+		}
+	}
+}
+
+func TestContainerHostsAddresses(t *testing.T) {
+	bridged := containerState{Name: "web", IPAddress: "172.29.0.7", NetworkAliases: []string{"www"}}
+	hosted := containerState{Name: "db"}
+	tests := []struct {
+		name   string
+		viewer containerState
+		want   []string
+	}{
+		{name: "from the bridge", viewer: containerState{IPAddress: "172.29.0.9"}, want: []string{"172.29.0.7\tweb www", "172.29.0.1\tdb"}},
+		{name: "from the host's network", viewer: containerState{}, want: []string{"172.29.0.7\tweb www", "127.0.0.1\tdb"}},
+	}
+	for _, tt := range tests {
+		data, err := containerHosts([]containerState{bridged, hosted}, tt.viewer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range tt.want {
+			if !strings.Contains(string(data), line+"\n") {
+				t.Errorf("%s: hosts file lacks %q:\n%s", tt.name, line, data)
+			}
+		}
+	}
+}
+
+// dnsQuery encodes a query for name's records of qtype.
+func dnsQuery(name string, qtype uint16) []byte {
+	q := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(name, ".") {
+		q = append(q, byte(len(label)))
+		q = append(q, label...)
+	}
+	q = append(q, 0)
+	q = binary.BigEndian.AppendUint16(q, qtype)
+	return binary.BigEndian.AppendUint16(q, dnsClassIN)
+}
+
+func TestDNSServerAnswer(t *testing.T) {
+	s := &dnsServer{lookup: func(name string) (net.IP, bool) {
+		if name == "web" {
+			return net.IPv4(172, 29, 0, 2), true
+		}
+		return nil, false
+	}}
+	const typeAAAA = 28
+	tests := []struct {
+		name    string
+		query   []byte
+		rcode   uint16
+		answers uint16
+		// address is the answer's, if any.
+		address string
+	}{
+		{name: "address", query: dnsQuery("web", dnsTypeA), answers: 1, address: "172.29.0.2"},
+		{name: "any case", query: dnsQuery("WeB", dnsTypeA), answers: 1, address: "172.29.0.2"},
+		{name: "no IPv6 address", query: dnsQuery("web", typeAAAA)},
+		// With no host nameservers to ask.
+		{name: "other names", query: dnsQuery("example.com", dnsTypeA), rcode: dnsServFail},
+		{name: "two questions", query: append(dnsQuery("web", dnsTypeA)[:4], append([]byte{0, 2}, dnsQuery("web", dnsTypeA)[6:]...)...), rcode: dnsNotImpl},
+	}
+	for _, tt := range tests {
+		reply := s.answer(tt.query)
+		if len(reply) < dnsHeaderLen || !bytes.Equal(reply[:2], tt.query[:2]) {
+			t.Errorf("%s: reply %x doesn't answer the query", tt.name, reply)
+			continue
+		}
+		flags := binary.BigEndian.Uint16(reply[2:])
+		if flags&dnsFlagQR == 0 || flags&dnsRcodeMask != tt.rcode {
+			t.Errorf("%s: flags %#x, want a reply with rcode %d", tt.name, flags, tt.rcode)
+		}
+		if got := binary.BigEndian.Uint16(reply[6:]); got != tt.answers {
+			t.Errorf("%s: %d answers, want %d", tt.name, got, tt.answers)
+		}
+		if tt.address != "" {
+			if got := net.IP(reply[len(reply)-4:]).String(); got != tt.address {
+				t.Errorf("%s: answered %s, want %s", tt.name, got, tt.address)
+			}
+		}
+	}
+	if reply := s.answer(dnsQuery("web", dnsTypeA)[:dnsHeaderLen+2]); reply != nil {
+		t.Errorf("truncated query answered with %x", reply)
+	}
+}
+
+// TestBridgeResolvesAliases runs one container on the bridge under an
+// alias, and another that finds it through the bridge's nameserver and
+// connects to it. The image's nsswitch.conf limits the probe to DNS.
+func TestBridgeResolvesAliases(t *testing.T) {
+	if c, err := openNetlink(); err != nil {
+		t.Skip(err)
+	} else {
+		err = c.createBridge(bridgeName)
+		c.Close()
+		if err != nil {
+			t.Skipf("can't create the bridge: %v", err)
+		}
+	}
+
+	docker, image := runTestImage(t,
+		testEntry{name: "etc/", typeflag: tar.TypeDir},
+		testEntry{name: "etc/nsswitch.conf", body: "hosts: dns\n"},
+	)
+	if out, err := docker("run", "-d", "--name", "a", "--net", "bridge", "--network-alias", "web", image, "/probe", "serve", "a").CombinedOutput(); err != nil {
+		t.Fatalf("running the server: %v\n%s", err, out)
+	}
+	t.Cleanup(func() { docker("stop", "a").Run() })
+	state, err := loadContainerState("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bridgeSubnet.Contains(net.ParseIP(state.IPAddress)) {
+		t.Fatalf("server's address %q isn't on the bridge", state.IPAddress)
+	}
+
+	for _, name := range []string{"web", "A"} {
+		out, err := docker("run", "--rm", "--net", "bridge", image, "/probe", "fetch", name).CombinedOutput()
+		if err != nil {
+			t.Fatalf("fetching from %s: %v\n%s", name, err, out)
+		}
+		if want := state.IPAddress + " hello from a\n"; string(out) != want {
+			t.Errorf("fetching from %s: got %q, want %q", name, out, want)
+		}
+	}
+}
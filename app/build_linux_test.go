@@ -0,0 +1,24 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// TestBuildFileList builds the tool the way your_docker.sh does. Naming the
+// files ignores their build constraints, so every file is compiled and no
+// two may declare the same thing.
+func TestBuildFileList(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds docker-clone")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("needs the go tool")
+	}
+	build := exec.Command("sh", "-c", `go build -o "$1" app/*.go`, "sh", filepath.Join(t.TempDir(), "docker-clone"))
+	build.Dir = ".."
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("go build app/*.go: %v\n%s", err, out)
+	}
+}
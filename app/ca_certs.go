@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// registryClient is the HTTP client for everything registry-related, so
+// that connections are pooled across requests and --ca-cert applies to all
+// of them.
+var registryClient = &http.Client{}
+
+// caCertExtensions are the files a --ca-cert directory is searched for.
+var caCertExtensions = []string{".pem", ".crt", ".cert"}
+
+// loadCACerts returns the system's trusted CAs plus the PEM certificates in
+// paths. A directory stands for the certificate files directly in it.
+func loadCACerts(paths []string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	for _, path := range paths {
+		files := []string{path}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			if files, err = caCertFiles(path); err != nil {
+				return nil, err
+			}
+			if len(files) == 0 {
+				return nil, fmt.Errorf("no CA certificates (%s) in %s", strings.Join(caCertExtensions, ", "), path)
+			}
+		}
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("no PEM certificates in %s", file)
+			}
+		}
+	}
+	return pool, nil
+}
+
+func caCertFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		for _, ext := range caCertExtensions {
+			if strings.HasSuffix(entry.Name(), ext) {
+				files = append(files, filepath.Join(dir, entry.Name()))
+				break
+			}
+		}
+	}
+	return files, nil
+}
+
+// useCACerts makes registryClient trust the CAs in paths on top of the
+// system's, or without paths those of the ca-certs setting. Verification
+// stays on; this is for registries whose certificates are signed by a
+// private CA.
+func useCACerts(paths []string) error {
+	option := "--ca-cert"
+	if len(paths) == 0 {
+		option, paths = "ca-certs", globalSettings.CACerts
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	pool, err := loadCACerts(paths)
+	if err != nil {
+		return fmt.Errorf("%s: %w", option, err)
+	}
+	registryTLSConfig().RootCAs = pool
+	return nil
+}
+
+// registryTLSConfig returns the TLS config of registryClient's transport,
+// first giving it one if it has none.
+func registryTLSConfig() *tls.Config {
+	transport := registryTransport()
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	return transport.TLSClientConfig
+}
+
+// useInsecureRegistries turns off the verification of the TLS certificates
+// of hosts, host[:port] names of which only the host is compared. Direct
+// connections to them are made by a TLS dial of our own for that, which
+// takes the transport's dialer, TLS config and handshake timeout as they are
+// at the time, so that --ca-cert and the timeouts still apply.
+func useInsecureRegistries(hosts []string) error {
+	if len(hosts) == 0 {
+		return nil
+	}
+	insecure := map[string]bool{}
+	for _, host := range hosts {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		insecure[strings.Trim(host, "[]")] = true
+	}
+	transport := registryTransport()
+	transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		dial := transport.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		config := &tls.Config{}
+		if transport.TLSClientConfig != nil {
+			config = transport.TLSClientConfig.Clone()
+		}
+		config.ServerName = host
+		config.InsecureSkipVerify = insecure[host]
+		if transport.TLSHandshakeTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, transport.TLSHandshakeTimeout)
+			defer cancel()
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+	return nil
+}
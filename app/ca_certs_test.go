@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCACerts(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
+	}))
+	defer srv.Close()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	caFile := write("ca.pem", ca)
+	write("certs.d/registry.crt", ca)
+	write("certs.d/README", []byte("not a certificate"))
+	write("other/README", []byte("not a certificate"))
+	notPEM := write("bad.pem", []byte("not a certificate"))
+
+	tests := []struct {
+		name        string
+		paths       []string
+		wantTrusted bool
+		wantErr     bool
+	}{
+		{name: "system CAs only", paths: nil},
+		{name: "file", paths: []string{caFile}, wantTrusted: true},
+		{name: "directory", paths: []string{filepath.Join(dir, "certs.d")}, wantTrusted: true},
+		{name: "directory without certificates", paths: []string{filepath.Join(dir, "other")}, wantErr: true},
+		{name: "not PEM", paths: []string{notPEM}, wantErr: true},
+		{name: "missing", paths: []string{filepath.Join(dir, "missing.pem")}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := registryClient
+			registryClient = &http.Client{}
+			t.Cleanup(func() { registryClient = saved })
+
+			err := useCACerts(tt.paths)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := registryClient.Get(srv.URL + "/v2/")
+			if err == nil {
+				closeBody(res.Body)
+			}
+			if trusted := err == nil; trusted != tt.wantTrusted {
+				t.Errorf("GET over TLS: %v, want the server trusted %v", err, tt.wantTrusted)
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Layer cache modes, chosen with --cache-mode.
+const (
+	// cacheModeCompressed keeps layers as downloaded and extracts them again
+	// on every pull, trading CPU for disk.
+	cacheModeCompressed = "compressed"
+	// cacheModeExtracted keeps layers unpacked, each in its own directory
+	// with whiteouts preserved, ready to be applied or used as overlay
+	// lower directories.
+	cacheModeExtracted = "extracted"
+)
+
+// layerCache keeps pulled layers under homeDir()/cache, keyed by digest, so
+// later pulls of the same layer skip the download. Layers are only cached
+// once their content matched the digest. With a maxSize, the least recently
+// used entries are evicted to stay under it. A nil *layerCache caches
+// nothing.
+//
+// Cached blobs are hashed again when used, unless a marker next to them says
+// they were since they last changed; verify, set by --verify-cache, hashes
+// them regardless.
+type layerCache struct {
+	mode    string
+	dir     string
+	maxSize int64
+	verify  bool
+
+	// mu serializes index updates within the process. inUse holds the index
+	// keys of the entries this process has used, which aren't evicted.
+	mu    sync.Mutex
+	inUse map[string]bool
+}
+
+// newLayerCache returns the cache for mode, nil if mode is empty. maxSize is
+// zero for no limit.
+func newLayerCache(mode string, maxSize int64, verify bool) *layerCache {
+	if mode == "" {
+		return nil
+	}
+	return &layerCache{mode: mode, dir: cacheDir(), maxSize: maxSize, verify: verify, inUse: map[string]bool{}}
+}
+
+// verifiedSuffix names the marker next to a cached blob recording the size
+// and modification time it had when its content last matched its digest.
+const verifiedSuffix = ".verified"
+
+func verifiedStamp(info os.FileInfo) []byte {
+	return []byte(fmt.Sprintf("%d %d\n", info.Size(), info.ModTime().UnixNano()))
+}
+
+// checkBlob makes sure the cached blob at path still matches digest. Unless
+// c.verify is set, a marker from an earlier check is trusted as long as the
+// blob's size and modification time haven't changed since.
+func (c *layerCache) checkBlob(path, digest string, buf []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !c.verify {
+		if marker, err := os.ReadFile(path + verifiedSuffix); err == nil && bytes.Equal(marker, verifiedStamp(info)) {
+			return nil
+		}
+	}
+	if err := verifyFile("cached layer", path, digest, buf); err != nil {
+		return err
+	}
+	markVerified(path)
+	return nil
+}
+
+// markVerified records that the cached blob at path matches its digest as it
+// is now. Failing to only means hashing it again next time.
+func markVerified(path string) {
+	if info, err := os.Stat(path); err == nil {
+		writeFileAtomic(path+verifiedSuffix, verifiedStamp(info))
+	}
+}
+
+// path returns where the layer with digest is cached: a blob file in
+// compressed mode, a directory in extracted mode.
+func (c *layerCache) path(digest string) (string, error) {
+	kind := "blobs"
+	if c.mode == cacheModeExtracted {
+		kind = "layers"
+	}
+	return c.entryPath(kind, digest)
+}
+
+func (c *layerCache) entryPath(kind, digest string) (string, error) {
+	if err := validateDigest(digest); err != nil {
+		return "", err
+	}
+	algorithm, hex, _ := strings.Cut(digest, ":")
+	return filepath.Join(c.dir, kind, algorithm, hex), nil
+}
+
+// config returns the image config blob with digest, calling download to
+// get it if it isn't cached yet. Configs are cached as they are in either
+// mode. A nil *layerCache downloads every time.
+func (c *layerCache) config(digest string, download func() ([]byte, error)) ([]byte, error) {
+	if c == nil {
+		return download()
+	}
+	path, err := c.entryPath("configs", digest)
+	if err != nil {
+		return nil, err
+	}
+	// Cached configs are checked again, as that's cheap for something this
+	// small; a damaged entry is simply replaced.
+	if data, err := os.ReadFile(path); err == nil && verifyDigest("image config", data, digest) == nil {
+		c.used("configs", digest)
+		return data, nil
+	}
+	data, err := download()
+	if err != nil {
+		return nil, err
+	}
+	// Failing to cache the config doesn't fail the pull.
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err == nil && writeFileAtomic(path, data) == nil {
+		c.used("configs", digest)
+	}
+	return data, nil
+}
+
+// fetch returns the cached copy of layer, first calling download to fill
+// the cache if the layer isn't in it yet.
+func (c *layerCache) fetch(layer DockerLayer, buf []byte, download func(w io.Writer) error) (localLayer, error) {
+	path, err := c.path(layer.Digest)
+	if err != nil {
+		return localLayer{}, err
+	}
+	_, err = os.Lstat(path)
+	if err == nil && c.mode != cacheModeExtracted {
+		var mismatch *digestMismatchError
+		if err = c.checkBlob(path, layer.Digest, buf); errors.As(err, &mismatch) {
+			fmt.Fprintf(os.Stderr, "Warning: cached layer %s is damaged (%v); downloading it again\n", shortImageID(layer.Digest), err)
+			os.Remove(path + verifiedSuffix)
+			if err = os.Remove(path); err == nil {
+				err = os.ErrNotExist
+			}
+		}
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		if err := c.fill(path, layer, buf, download); err != nil {
+			return localLayer{}, err
+		}
+	} else if err != nil {
+		return localLayer{}, err
+	}
+	kind := "blobs"
+	if c.mode == cacheModeExtracted {
+		kind = "layers"
+	}
+	c.used(kind, layer.Digest)
+	if c.mode == cacheModeExtracted {
+		return localLayer{tree: path}, nil
+	}
+	return localLayer{blob: path}, nil
+}
+
+// fill downloads a layer into the cache at path. Everything is staged next
+// to path and renamed into place, so an entry that exists is complete, and
+// concurrent pulls of the same layer don't see each other's partial work.
+func (c *layerCache) fill(path string, layer DockerLayer, buf []byte, download func(w io.Writer) error) error {
+	parent := filepath.Dir(path)
+	if err := os.MkdirAll(parent, 0o755); err != nil {
+		return err
+	}
+	blob, err := os.CreateTemp(parent, filepath.Base(path)+".download-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(blob.Name())
+	d, err := newDigester("layer", layer.Digest)
+	if err != nil {
+		blob.Close()
+		return err
+	}
+	err = download(io.MultiWriter(blob, d))
+	if closeErr := blob.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := d.verify(); err != nil {
+		return err
+	}
+	if c.mode != cacheModeExtracted {
+		if err := os.Rename(blob.Name(), path); err != nil {
+			return err
+		}
+		markVerified(path)
+		return nil
+	}
+
+	compression, err := layerCompression(layer.MediaType)
+	if err != nil {
+		return err
+	}
+	tree, err := os.MkdirTemp(parent, filepath.Base(path)+".unpack-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tree)
+	f, err := os.Open(blob.Name())
+	if err != nil {
+		return err
+	}
+	// Cached trees are shared by pulls, so nothing left out by an
+	// unprivileged unpack is recorded for any of them.
+	err = unpackLayer(tree, f, compression, layer.DiffID, buf, false, nil)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tree, path); err != nil {
+		if _, statErr := os.Lstat(path); statErr != nil {
+			return err
+		}
+		// Another pull cached the layer first.
+	}
+	return nil
+}
+
+// cacheModeFlag implements --cache-mode.
+type cacheModeFlag string
+
+func (f *cacheModeFlag) String() string { return string(*f) }
+
+func (f *cacheModeFlag) Set(value string) error {
+	switch value {
+	case cacheModeCompressed, cacheModeExtracted:
+		*f = cacheModeFlag(value)
+		return nil
+	}
+	return fmt.Errorf("unknown cache mode %q (want %s or %s)", value, cacheModeCompressed, cacheModeExtracted)
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// cacheKinds are the directories of the layer cache, one per kind of entry.
+var cacheKinds = []string{"blobs", "layers", "configs"}
+
+// cacheIndexEntry is what the cache index keeps about one entry.
+type cacheIndexEntry struct {
+	Size     int64     `json:"size"`
+	LastUsed time.Time `json:"lastUsed"`
+	// Leases are held by the processes using the entry, in pulls that may
+	// not have applied it yet, so that other processes don't evict it.
+	Leases []cacheLease `json:"leases,omitempty"`
+}
+
+// cacheLease records that the process Pid uses an entry. Leases are renewed
+// whenever the process uses the cache, and lapse when it exits, or after
+// cacheLeaseTTL without a renewal, in case the pid was reused.
+type cacheLease struct {
+	Pid     int       `json:"pid"`
+	Renewed time.Time `json:"renewed"`
+}
+
+// cacheLeaseTTL is how long a lease lasts without being renewed.
+const cacheLeaseTTL = 24 * time.Hour
+
+func (l cacheLease) live(now time.Time) bool {
+	return now.Sub(l.Renewed) < cacheLeaseTTL && processAlive(l.Pid)
+}
+
+// leased reports whether a live process other than ours holds a lease on e.
+func (e cacheIndexEntry) leased(now time.Time) bool {
+	for _, l := range e.Leases {
+		if l.Pid != os.Getpid() && l.live(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheIndex records the size and last use of the cache's entries, keyed by
+// their path in the cache directory, e.g. "blobs/sha256/<hex>", so that
+// eviction needn't measure every extracted layer each time. Entries it
+// doesn't know yet, e.g. cached before it existed, are added when it is next
+// loaded, as last used when they were modified.
+type cacheIndex struct {
+	Entries map[string]cacheIndexEntry `json:"entries"`
+}
+
+// updateIndex calls update with the cache index and saves the result. The
+// index lock is held meanwhile, so that concurrent pulls, in this process or
+// others, don't lose each other's updates.
+func (c *layerCache) updateIndex(update func(index *cacheIndex) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(filepath.Join(c.dir, "index.lock"), os.O_CREATE|os.O_RDONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := lockExclusive(lock); err != nil {
+		return err
+	}
+	index, err := c.loadIndex()
+	if err != nil {
+		return err
+	}
+	if err := update(&index); err != nil {
+		return err
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(c.dir, "index.json"), data)
+}
+
+// loadIndex reads the cache index and brings it in line with the entries
+// actually in the cache.
+func (c *layerCache) loadIndex() (cacheIndex, error) {
+	index := cacheIndex{Entries: map[string]cacheIndexEntry{}}
+	data, err := os.ReadFile(filepath.Join(c.dir, "index.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return index, err
+	}
+	var saved cacheIndex
+	if err == nil && json.Unmarshal(data, &saved) != nil {
+		// A damaged index is rebuilt.
+		fmt.Fprintf(os.Stderr, "Warning: rebuilding the layer cache index\n")
+	}
+	for _, kind := range cacheKinds {
+		algorithms, err := os.ReadDir(filepath.Join(c.dir, kind))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return index, err
+		}
+		for _, algorithm := range algorithms {
+			dir := filepath.Join(c.dir, kind, algorithm.Name())
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				return index, err
+			}
+			for _, entry := range entries {
+				// Downloads and unpacks in progress are named
+				// <hex>.<something>.
+				if strings.Contains(entry.Name(), ".") {
+					continue
+				}
+				key := kind + "/" + algorithm.Name() + "/" + entry.Name()
+				if e, ok := saved.Entries[key]; ok {
+					e.Leases = liveLeases(e.Leases, time.Now())
+					index.Entries[key] = e
+					continue
+				}
+				info, err := entry.Info()
+				if err != nil {
+					continue
+				}
+				size, err := diskUsage(filepath.Join(dir, entry.Name()))
+				if err != nil {
+					return index, err
+				}
+				index.Entries[key] = cacheIndexEntry{Size: size, LastUsed: info.ModTime()}
+			}
+		}
+	}
+	return index, nil
+}
+
+// liveLeases returns those of leases that haven't lapsed.
+func liveLeases(leases []cacheLease, now time.Time) []cacheLease {
+	var live []cacheLease
+	for _, l := range leases {
+		if l.live(now) {
+			live = append(live, l)
+		}
+	}
+	return live
+}
+
+// diskUsage adds up the sizes of the files at or under path.
+func diskUsage(path string) (int64, error) {
+	var total int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+// used records that the entry of kind with digest was just used or added,
+// leasing it, and renewing the leases on the others this process uses, and
+// then evicts what the cache has to lose to stay within maxSize. Failing to
+// do either doesn't fail the pull.
+func (c *layerCache) used(kind, digest string) {
+	path, err := c.entryPath(kind, digest)
+	if err != nil {
+		return
+	}
+	key := filepath.ToSlash(strings.TrimPrefix(path, c.dir+string(filepath.Separator)))
+	err = c.updateIndex(func(index *cacheIndex) error {
+		now := time.Now()
+		c.inUse[key] = true
+		if e, ok := index.Entries[key]; ok {
+			e.LastUsed = now
+			index.Entries[key] = e
+		}
+		for key := range c.inUse {
+			if e, ok := index.Entries[key]; ok {
+				e.Leases = renewLease(e.Leases, os.Getpid(), now)
+				index.Entries[key] = e
+			}
+		}
+		if c.maxSize > 0 {
+			c.evict(index)
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: updating the layer cache index: %v\n", err)
+	}
+}
+
+// renewLease returns leases with that of pid renewed as of now, or added.
+func renewLease(leases []cacheLease, pid int, now time.Time) []cacheLease {
+	for i := range leases {
+		if leases[i].Pid == pid {
+			leases[i].Renewed = now
+			return leases
+		}
+	}
+	return append(leases, cacheLease{Pid: pid, Renewed: now})
+}
+
+// evict removes entries from index, and the cache, least recently used
+// first, until the cache is no larger than maxSize. Entries still needed are
+// kept: those this process has used, and those leased by other processes,
+// which pulls in progress may not have applied yet, and the layers and
+// configs of running containers.
+func (c *layerCache) evict(index *cacheIndex) {
+	var total int64
+	keys := make([]string, 0, len(index.Entries))
+	for key, e := range index.Entries {
+		total += e.Size
+		keys = append(keys, key)
+	}
+	if total <= c.maxSize {
+		return
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return index.Entries[keys[i]].LastUsed.Before(index.Entries[keys[j]].LastUsed)
+	})
+	running := runningCacheKeys()
+	now := time.Now()
+	for _, key := range keys {
+		if total <= c.maxSize {
+			return
+		}
+		if c.inUse[key] || running[key] || index.Entries[key].leased(now) {
+			continue
+		}
+		path := filepath.Join(c.dir, filepath.FromSlash(key))
+		if err := os.RemoveAll(path); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: evicting %s from the layer cache: %v\n", key, err)
+			continue
+		}
+		os.Remove(path + verifiedSuffix)
+		total -= index.Entries[key].Size
+		delete(index.Entries, key)
+	}
+	if total <= c.maxSize {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Warning: the layer cache takes %s, over its maximum size of %s, but everything left in it is in use\n", formatSize(total), formatSize(c.maxSize))
+}
+
+// runningCacheKeys returns the index keys of every cache entry the running
+// containers' images are made of, whichever the cache mode.
+func runningCacheKeys() map[string]bool {
+	keys := map[string]bool{}
+	states, _ := listContainers()
+	for _, state := range states {
+		digests := append([]string{state.ImageID}, state.Layers...)
+		for _, digest := range digests {
+			algorithm, hex, ok := strings.Cut(digest, ":")
+			if !ok {
+				continue
+			}
+			for _, kind := range cacheKinds {
+				keys[kind+"/"+algorithm+"/"+hex] = true
+			}
+		}
+	}
+	return keys
+}
+
+func cacheCommand(argv []string) {
+	if len(argv) != 1 || argv[0] != "df" {
+		fmt.Println(cacheUsage)
+		os.Exit(1)
+	}
+	// A zero-value cache is only ever read here, and never evicts.
+	c := &layerCache{dir: cacheDir(), inUse: map[string]bool{}}
+	var index cacheIndex
+	err := c.updateIndex(func(loaded *cacheIndex) error {
+		index = *loaded
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	running := runningCacheKeys()
+	now := time.Now()
+	titles := map[string]string{"blobs": "Layers (compressed)", "layers": "Layers (extracted)", "configs": "Image configs"}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(tw, "TYPE\tENTRIES\tIN USE\tSIZE\tRECLAIMABLE")
+	var total, reclaimable int64
+	for _, kind := range cacheKinds {
+		var entries, inUse int
+		var size, free int64
+		for key, e := range index.Entries {
+			if !strings.HasPrefix(key, kind+"/") {
+				continue
+			}
+			entries++
+			size += e.Size
+			if running[key] || e.leased(now) {
+				inUse++
+			} else {
+				free += e.Size
+			}
+		}
+		total += size
+		reclaimable += free
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\n", titles[kind], entries, inUse, formatSize(size), formatSize(free))
+	}
+	fmt.Fprintf(tw, "Total\t%d\t\t%s\t%s\n", len(index.Entries), formatSize(total), formatSize(reclaimable))
+	tw.Flush()
+}
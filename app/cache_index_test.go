@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvictSkipsLiveLeases(t *testing.T) {
+	t.Setenv("DOCKER_CLONE_HOME", t.TempDir())
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Skip(err)
+	}
+	now := time.Now()
+	other := os.Getppid()
+	tests := []struct {
+		name     string
+		leases   []cacheLease
+		wantKept bool
+	}{
+		{name: "unleased"},
+		{name: "leased by another process", leases: []cacheLease{{Pid: other, Renewed: now}}, wantKept: true},
+		{name: "leased by one that exited", leases: []cacheLease{{Pid: exited.Process.Pid, Renewed: now}}},
+		{name: "lease lapsed", leases: []cacheLease{{Pid: other, Renewed: now.Add(-2 * cacheLeaseTTL)}}},
+		{name: "one live lease of two", leases: []cacheLease{{Pid: exited.Process.Pid, Renewed: now}, {Pid: other, Renewed: now}}, wantKept: true},
+		// What this process uses is kept through inUse instead.
+		{name: "leased by this process", leases: []cacheLease{{Pid: os.Getpid(), Renewed: now}}},
+	}
+	c := &layerCache{dir: filepath.Join(t.TempDir(), "cache"), maxSize: 1, inUse: map[string]bool{}}
+	keys := map[string]string{}
+	for i, tt := range tests {
+		key := "blobs/sha256/" + strings.Repeat(string(rune('a'+i)), 64)
+		keys[tt.name] = key
+		path := filepath.Join(c.dir, filepath.FromSlash(key))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("layer"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Leases are set as they would have been saved, not as loaded.
+	err := c.updateIndex(func(index *cacheIndex) error {
+		for _, tt := range tests {
+			e := index.Entries[keys[tt.name]]
+			e.Leases = tt.leases
+			index.Entries[keys[tt.name]] = e
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.updateIndex(func(index *cacheIndex) error {
+		c.evict(index)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index cacheIndex
+	c.updateIndex(func(loaded *cacheIndex) error {
+		index = *loaded
+		return nil
+	})
+	for _, tt := range tests {
+		_, err := os.Stat(filepath.Join(c.dir, filepath.FromSlash(keys[tt.name])))
+		if kept := err == nil; kept != tt.wantKept {
+			t.Errorf("%s: kept %v, want %v", tt.name, kept, tt.wantKept)
+		}
+		if !tt.wantKept {
+			continue
+		}
+		for _, l := range index.Entries[keys[tt.name]].Leases {
+			if l.Pid != other {
+				t.Errorf("%s: lapsed lease of %d kept", tt.name, l.Pid)
+			}
+		}
+	}
+}
+
+func TestUsedLeasesEntries(t *testing.T) {
+	t.Setenv("DOCKER_CLONE_HOME", t.TempDir())
+	c := &layerCache{mode: cacheModeCompressed, dir: filepath.Join(t.TempDir(), "cache"), inUse: map[string]bool{}}
+	digests := []string{"sha256:" + strings.Repeat("a", 64), "sha256:" + strings.Repeat("b", 64)}
+	for _, digest := range digests {
+		path, err := c.entryPath("blobs", digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.MkdirAll(filepath.Dir(path), 0o755)
+		if err := os.WriteFile(path, []byte("layer"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.used("blobs", digests[0])
+	first := time.Now()
+	c.used("blobs", digests[1])
+	var index cacheIndex
+	c.updateIndex(func(loaded *cacheIndex) error {
+		index = *loaded
+		return nil
+	})
+	for _, digest := range digests {
+		key := "blobs/sha256/" + strings.TrimPrefix(digest, "sha256:")
+		leases := index.Entries[key].Leases
+		if len(leases) != 1 || leases[0].Pid != os.Getpid() {
+			t.Errorf("%s leased by %+v, want this process alone", key, leases)
+			continue
+		}
+		// Using the cache renews the leases on everything used before.
+		if leases[0].Renewed.Before(first) {
+			t.Errorf("%s's lease wasn't renewed", key)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// listTree describes every path under dir by its type, permissions and
+// content or link target.
+func listTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	tree := map[string]string{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		desc := info.Mode().String()
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			desc += " -> " + target
+		case info.Mode().IsRegular():
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			desc += fmt.Sprintf(" %q", data)
+		}
+		tree[filepath.ToSlash(rel)] = desc
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestLayerCacheModesAgree(t *testing.T) {
+	tars := [][]byte{
+		testLayer(t,
+			testEntry{name: "etc/", typeflag: tar.TypeDir},
+			testEntry{name: "etc/conf", body: "bottom"},
+			testEntry{name: "bin/", typeflag: tar.TypeDir},
+			testEntry{name: "bin/tool", mode: 0o755, body: "#!/bin/sh\n"},
+			testEntry{name: "bin/alias", typeflag: tar.TypeSymlink, linkname: "tool"},
+			testEntry{name: "bin/link", typeflag: tar.TypeLink, linkname: "bin/tool"},
+			testEntry{name: "opt/", typeflag: tar.TypeDir},
+			testEntry{name: "opt/old", body: "old"},
+			testEntry{name: "gone", body: "gone"},
+		),
+		testLayer(t,
+			testEntry{name: "etc/conf", mode: 0o600, body: "top"},
+			testEntry{name: "opt/", typeflag: tar.TypeDir},
+			testEntry{name: "opt/.wh..wh..opq"},
+			testEntry{name: "opt/new", body: "new"},
+			testEntry{name: ".wh.gone"},
+			testEntry{name: "bin/alias", typeflag: tar.TypeSymlink, linkname: "link"},
+		),
+	}
+	src := &blobSource{blobs: map[string][]byte{}, requests: map[string]int{}}
+	var layers []DockerLayer
+	for _, layer := range tars {
+		blob := gzipLayer(t, layer)
+		digest := sha256Digest(blob)
+		src.blobs[digest] = blob
+		layers = append(layers, DockerLayer{MediaType: ociLayerMediaType, Digest: digest, Size: int64(len(blob)), DiffID: sha256Digest(layer)})
+	}
+	pull := func(t *testing.T, cache *layerCache) map[string]string {
+		dir := filepath.Join(t.TempDir(), "rootfs")
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		opts := pullOptions{Cache: cache}
+		if err := pullLayers(dir, layers, opts, sourceLayerFetcher(src, opts)); err != nil {
+			t.Fatal(err)
+		}
+		return listTree(t, dir)
+	}
+
+	want := pull(t, nil)
+	for _, mode := range []string{cacheModeCompressed, cacheModeExtracted} {
+		t.Run(mode, func(t *testing.T) {
+			t.Setenv("DOCKER_CLONE_HOME", t.TempDir())
+			for digest := range src.requests {
+				delete(src.requests, digest)
+			}
+			// The first pull fills the cache, the second is served from it.
+			for _, pass := range []string{"filling the cache", "from the cache"} {
+				if got := pull(t, newLayerCache(mode, 0, false)); !reflect.DeepEqual(got, want) {
+					t.Errorf("%s: rootfs %v, want %v", pass, got, want)
+				}
+			}
+			for _, layer := range layers {
+				if n := src.requests[layer.Digest]; n != 1 {
+					t.Errorf("layer %s downloaded %d times, want once", shortImageID(layer.Digest), n)
+				}
+			}
+		})
+	}
+}
+
+// TestCheckBlobVerifiedMarker checks when a cached blob is hashed again: a
+// blob changed behind the cache's back without its size or modification
+// time changing is only caught by hashing it, so it passes exactly when the
+// marker is trusted.
+func TestCheckBlobVerifiedMarker(t *testing.T) {
+	data := gzipLayer(t, testLayer(t, testEntry{name: "f", body: "f"}))
+	digest := sha256Digest(data)
+	tests := []struct {
+		name string
+		// marked writes the marker of the intact blob.
+		marked bool
+		verify bool
+		// touch changes the blob's modification time along with its content.
+		touch   bool
+		wantErr bool
+	}{
+		{name: "marked", marked: true},
+		{name: "marked, --verify-cache", marked: true, verify: true, wantErr: true},
+		{name: "unmarked", wantErr: true},
+		{name: "changed since marked", marked: true, touch: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &layerCache{mode: cacheModeCompressed, dir: t.TempDir(), verify: tt.verify, inUse: map[string]bool{}}
+			path := filepath.Join(c.dir, "blob")
+			if err := os.WriteFile(path, data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if tt.marked {
+				markVerified(path)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			corruptFile(t, path)
+			mtime := info.ModTime()
+			if tt.touch {
+				mtime = mtime.Add(time.Second)
+			}
+			if err := os.Chtimes(path, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+			err = c.checkBlob(path, digest, make([]byte, 4096))
+			var mismatch *digestMismatchError
+			if tt.wantErr != errors.As(err, &mismatch) {
+				t.Fatalf("checkBlob: %v, want a digest mismatch: %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// A blob that checks out is marked, so the next check trusts it.
+	c := &layerCache{mode: cacheModeCompressed, dir: t.TempDir(), inUse: map[string]bool{}}
+	path := filepath.Join(c.dir, "blob")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.checkBlob(path, digest, nil); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if marker, err := os.ReadFile(path + verifiedSuffix); err != nil || string(marker) != string(verifiedStamp(info)) {
+		t.Errorf("marker %q, %v, want %q", marker, err, verifiedStamp(info))
+	}
+}
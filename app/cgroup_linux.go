@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// cgroupRoot is where the cgroup v2 hierarchy is expected to be mounted.
+// Containers get a cgroup of their own under cgroupRoot/cgroupParent.
+var cgroupRoot = "/sys/fs/cgroup"
+
+const cgroupParent = "docker-clone"
+
+// cgroupSetting is a value to write to one of a cgroup's interface files,
+// e.g. cpuset.cpus.
+type cgroupSetting struct {
+	File  string
+	Value string
+}
+
+// createCgroup creates the cgroup of container id and applies settings to
+// it, first enabling the controllers they belong to for the cgroups above
+// it. The container's process joins it with joinCgroup.
+func createCgroup(id string, settings []cgroupSetting) (string, error) {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return "", fmt.Errorf("cgroup v2 is not mounted at %s", cgroupRoot)
+	}
+	var controllers []string
+	seen := map[string]bool{}
+	for _, s := range settings {
+		if controller := strings.SplitN(s.File, ".", 2)[0]; !seen[controller] {
+			seen[controller] = true
+			controllers = append(controllers, "+"+controller)
+		}
+	}
+	parent := filepath.Join(cgroupRoot, cgroupParent)
+	if err := os.MkdirAll(parent, 0o755); err != nil {
+		return "", err
+	}
+	for _, dir := range []string{cgroupRoot, parent} {
+		if err := writeCgroupFile(dir, "cgroup.subtree_control", strings.Join(controllers, " ")); err != nil {
+			return "", err
+		}
+	}
+	path := filepath.Join(parent, id)
+	if err := os.Mkdir(path, 0o755); err != nil {
+		return "", err
+	}
+	for _, s := range settings {
+		if err := writeCgroupFile(path, s.File, s.Value); err != nil {
+			os.Remove(path)
+			return "", err
+		}
+	}
+	return path, nil
+}
+
+// joinCgroup moves the calling process into the cgroup at path. Writing 0
+// names the writer, whatever its PID is in the namespace it runs in.
+func joinCgroup(path string) error {
+	return writeCgroupFile(path, "cgroup.procs", "0")
+}
+
+// removeCgroup removes a cgroup once the processes in it have exited.
+func removeCgroup(path string) error {
+	return os.Remove(path)
+}
+
+func writeCgroupFile(dir, file, value string) error {
+	if err := os.WriteFile(filepath.Join(dir, file), []byte(value), 0o644); err != nil {
+		return fmt.Errorf("writing %q to %s: %w", value, filepath.Join(dir, file), err)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useTestCgroupRoot points cgroupRoot at a directory standing in for the
+// cgroup v2 hierarchy for the rest of the test, and returns it.
+func useTestCgroupRoot(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "cgroup.controllers"), []byte("cpuset cpu io memory pids\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	saved := cgroupRoot
+	cgroupRoot = root
+	t.Cleanup(func() { cgroupRoot = saved })
+	return root
+}
+
+func TestCreateCgroup(t *testing.T) {
+	root := useTestCgroupRoot(t)
+	path, err := createCgroup("c1", []cgroupSetting{{"cpuset.cpus", "0-3,8"}, {"cpuset.mems", "0"}, {"memory.low", "268435456"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"cgroup.subtree_control":              "+cpuset +memory",
+		"docker-clone/cgroup.subtree_control": "+cpuset +memory",
+		"docker-clone/c1/cpuset.cpus":         "0-3,8",
+		"docker-clone/c1/cpuset.mems":         "0",
+		"docker-clone/c1/memory.low":          "268435456",
+	}
+	for file, value := range want {
+		if got, err := os.ReadFile(filepath.Join(root, file)); err != nil || string(got) != value {
+			t.Errorf("%s = %q, %v, want %q", file, got, err, value)
+		}
+	}
+	if path != filepath.Join(root, "docker-clone", "c1") {
+		t.Errorf("cgroup at %s, want it under %s", path, filepath.Join(root, "docker-clone"))
+	}
+	// A container's cgroup is its own.
+	if _, err := createCgroup("c1", nil); err == nil {
+		t.Error("created the cgroup of c1 twice")
+	}
+}
+
+func TestValidateCpuset(t *testing.T) {
+	online := filepath.Join(t.TempDir(), "online")
+	if err := os.WriteFile(online, []byte("0-3,6\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		value   string
+		online  string
+		wantErr string
+	}{
+		{value: "0", online: online},
+		{value: "0-3", online: online},
+		{value: "1,3,6", online: online},
+		{value: "2-3,6", online: online},
+		{value: "4", online: online, wantErr: "4 not available"},
+		{value: "3-5", online: online, wantErr: "4,5 not available"},
+		{value: "3-1", online: online, wantErr: "invalid range"},
+		{value: "0,", online: online, wantErr: "invalid list"},
+		{value: "one", online: online, wantErr: "invalid list"},
+		{value: "-1", online: online, wantErr: "invalid list"},
+		{value: "8191", online: online, wantErr: "8191 not available"},
+		{value: "8192", online: online, wantErr: "past 8191"},
+		{value: "0-50000000", online: online, wantErr: "past 8191"},
+		{value: "50000000-50000001", online: online, wantErr: "past 8191"},
+		// Without the sysfs file there is only node 0.
+		{value: "0", online: filepath.Join(t.TempDir(), "missing")},
+		{value: "1", online: filepath.Join(t.TempDir(), "missing"), wantErr: "1 not available"},
+	}
+	for _, tt := range tests {
+		err := validateCpuset("cpuset-cpus", tt.value, tt.online)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("validateCpuset(%q) = %v", tt.value, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("validateCpuset(%q) = %v, want an error saying %q", tt.value, err, tt.wantErr)
+		}
+	}
+}
+
+// TestRunCpuset checks the container's cgroup holds the --cpuset-cpus and
+// --cpuset-mems settings, read from inside it.
+func TestRunCpuset(t *testing.T) {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		t.Skip("needs cgroup v2")
+	}
+	docker, image := runTestImage(t)
+	out, err := docker("run", "--rm", "--cpuset-cpus", "0", "--cpuset-mems", "0", image, "/probe", "cat", "/sys/fs/cgroup/cpuset.cpus", "/sys/fs/cgroup/cpuset.mems").CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	if want := "/sys/fs/cgroup/cpuset.cpus: 0\n/sys/fs/cgroup/cpuset.mems: 0\n"; string(out) != want {
+		t.Errorf("the container's cgroup has %q, want %q", out, want)
+	}
+}
+
+// TestRunMemoryReservation checks --memory-reservation sets memory.low in
+// the container's cgroup, read from inside it, and that sizes that aren't
+// are refused before the container is run.
+func TestRunMemoryReservation(t *testing.T) {
+	docker, image := runTestImage(t)
+	_, statErr := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	tests := []struct {
+		size    string
+		want    string
+		wantErr bool
+	}{
+		{size: "256m", want: "268435456"},
+		{size: "1g", want: "1073741824"},
+		{size: "1000", want: "1000"},
+		{size: "lots", wantErr: true},
+		{size: "-1m", wantErr: true},
+	}
+	for _, tt := range tests {
+		if !tt.wantErr && statErr != nil {
+			continue
+		}
+		out, err := docker("run", "--rm", "--memory-reservation", tt.size, image, "/probe", "cat", "/sys/fs/cgroup/memory.low").CombinedOutput()
+		if tt.wantErr {
+			if err == nil || strings.Contains(string(out), "memory.low:") {
+				t.Errorf("--memory-reservation %s: %v, want it refused before running\n%s", tt.size, err, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("--memory-reservation %s: %v\n%s", tt.size, err, out)
+		}
+		if want := "/sys/fs/cgroup/memory.low: " + tt.want + "\n"; string(out) != want {
+			t.Errorf("--memory-reservation %s: the container's cgroup has %q, want %q", tt.size, out, want)
+		}
+	}
+	if statErr != nil {
+		t.Skip("needs cgroup v2 for the cgroup's memory.low")
+	}
+}
+
+// TestRunCPUs checks the cpu.max of a container's cgroup.
+func TestRunCPUs(t *testing.T) {
+	docker, image := runTestImage(t)
+	_, statErr := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	tests := []struct {
+		flags   []string
+		want    string
+		wantErr bool
+	}{
+		{flags: []string{"--cpus", "0.5"}, want: "50000 100000"},
+		{flags: []string{"--cpu-period", "50000", "--cpu-quota", "20000"}, want: "20000 50000"},
+		{flags: []string{"--cpus", "0"}, wantErr: true},
+		{flags: []string{"--cpus", "10000"}, wantErr: true},
+		{flags: []string{"--cpus", "0.5", "--cpu-quota", "20000"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if !tt.wantErr && statErr != nil {
+			continue
+		}
+		args := append(append([]string{"run", "--rm"}, tt.flags...), image, "/probe", "cat", "/sys/fs/cgroup/cpu.max")
+		out, err := docker(args...).CombinedOutput()
+		if tt.wantErr {
+			if err == nil || strings.Contains(string(out), "cpu.max:") {
+				t.Errorf("%q: %v, want it refused before running\n%s", tt.flags, err, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %v\n%s", tt.flags, err, out)
+		}
+		if want := "/sys/fs/cgroup/cpu.max: " + tt.want + "\n"; string(out) != want {
+			t.Errorf("%q: the container's cgroup has %q, want %q", tt.flags, out, want)
+		}
+	}
+	if statErr != nil {
+		t.Skip("needs cgroup v2 for the cgroup's cpu.max")
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// specFD is the file descriptor on which the child reads its containerSpec.
+const specFD = 3
+
+// containerSpec is everything the child needs to set up the container. It is
+// passed from the parent as JSON over a pipe.
+type containerSpec struct {
+	Rootfs  string       `json:"rootfs"`
+	Args    []string     `json:"args"`
+	Init    bool         `json:"init"`
+	Mounts  []mountSpec  `json:"mounts,omitempty"`
+	Devices []deviceSpec `json:"devices,omitempty"`
+	Ulimits []ulimitSpec `json:"ulimits,omitempty"`
+	// WorkingDir is the directory in the rootfs the command runs in.
+	WorkingDir string `json:"workingDir,omitempty"`
+	// Env is the command's whole environment; none of ours is passed on.
+	Env []string `json:"env,omitempty"`
+	// NoNewPrivileges sets no_new_privs before the command is executed.
+	NoNewPrivileges bool `json:"noNewPrivileges,omitempty"`
+	// Cgroup is the cgroup the child moves itself into, set up by the
+	// parent.
+	Cgroup string `json:"cgroup,omitempty"`
+	// Hostname and Domainname are set in the child's UTS namespace. Without
+	// one, Hostname is empty and nothing is set.
+	Hostname   string `json:"hostname,omitempty"`
+	Domainname string `json:"domainname,omitempty"`
+	// NoPIDNamespace, NoMountNamespace and NoUTSNamespace run the child in
+	// the host's namespaces of those kinds. Without a mount namespace there
+	// are no Mounts.
+	NoPIDNamespace   bool `json:"-"`
+	NoMountNamespace bool `json:"noMountNamespace,omitempty"`
+	NoUTSNamespace   bool `json:"-"`
+	// CgroupNamespace has the child create a cgroup namespace once in its
+	// cgroup.
+	CgroupNamespace bool `json:"cgroupNamespace,omitempty"`
+	// Groups are the supplementary groups of the child, which it gets as it
+	// is started rather than from the spec.
+	Groups []uint32 `json:"-"`
+	// NetNamespace, if set, is the network namespace the child joins. It is
+	// passed on netNamespaceFD, which JoinNetNamespace tells the child to
+	// expect.
+	NetNamespace     *os.File `json:"-"`
+	JoinNetNamespace bool     `json:"joinNetNamespace,omitempty"`
+	// ReadOnlyRootfs makes the rootfs read-only once the child has set up
+	// its mounts and devices in it.
+	ReadOnlyRootfs bool `json:"readOnlyRootfs,omitempty"`
+	// PIDNamespace, if set, is the PID namespace the child is started in,
+	// instead of a new one, by startContainer.
+	PIDNamespace *os.File `json:"-"`
+}
+
+// containerCommand prepares the re-exec of this binary that will run spec.
+func containerCommand(spec containerSpec) (*exec.Cmd, error) {
+	spec.JoinNetNamespace = spec.NetNamespace != nil
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
+	// The spec is small enough to fit in the pipe buffer, so it can be written
+	// up front without waiting for the child to start reading.
+	if _, err := w.Write(data); err != nil {
+		r.Close()
+		return nil, err
+	}
+	cmd := exec.Command("/proc/self/exe", childCommand)
+	cmd.ExtraFiles = []*os.File{r}
+	if spec.NetNamespace != nil {
+		cmd.ExtraFiles = append(cmd.ExtraFiles, spec.NetNamespace)
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: cloneFlags(spec),
+	}
+	if len(spec.Groups) > 0 {
+		// Only the supplementary groups change; the user and group stay
+		// ours.
+		cmd.SysProcAttr.Credential = &syscall.Credential{
+			Uid:    uint32(os.Getuid()),
+			Gid:    uint32(os.Getgid()),
+			Groups: spec.Groups,
+		}
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd, nil
+}
+
+// runChild is the entry point of the re-exec'd child. It only returns if
+// setting up or starting the command failed.
+func runChild() int {
+	// Namespaces, no_new_privs and the like are set per thread, so
+	// everything from here to the command's exec has to happen on one.
+	runtime.LockOSThread()
+	var spec containerSpec
+	specFile := os.NewFile(specFD, "spec")
+	if err := json.NewDecoder(specFile).Decode(&spec); err != nil {
+		fmt.Fprintf(os.Stderr, "Err reading container spec: %v\n", err)
+		return 1
+	}
+	specFile.Close()
+	if len(spec.Args) == 0 {
+		fmt.Fprintln(os.Stderr, "Err: no command given")
+		return 1
+	}
+
+	// The cgroup is joined before anything else, so that everything the
+	// container does is accounted to it and runs on its CPUs.
+	if spec.Cgroup != "" {
+		if err := joinCgroup(spec.Cgroup); err != nil {
+			fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+			return 1
+		}
+	}
+	if spec.CgroupNamespace {
+		if err := unshareCgroupNamespace(); err != nil {
+			fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+			return 1
+		}
+	}
+	if spec.JoinNetNamespace {
+		if err := joinNetNamespace(netNamespaceFD); err != nil {
+			fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+			return 1
+		}
+	}
+	if spec.Hostname != "" {
+		if err := setHostname(spec.Hostname, spec.Domainname); err != nil {
+			fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+			return 1
+		}
+	}
+	if err := checkRootfsReady(spec.Rootfs); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		return 1
+	}
+	// Without a namespace of our own, setting up mounts would change the
+	// host's.
+	if !spec.NoMountNamespace {
+		if err := setupMounts(spec.Rootfs, spec.Mounts, spec.ReadOnlyRootfs); err != nil {
+			fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+			return 1
+		}
+	}
+	if err := createDevices(spec.Rootfs, spec.Devices); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		return 1
+	}
+	if spec.ReadOnlyRootfs {
+		if err := remountRootReadOnly(spec.Rootfs); err != nil {
+			fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+			return 1
+		}
+	}
+	if err := syscall.Chroot(spec.Rootfs); err != nil {
+		fmt.Fprintf(os.Stderr, "Err Chroot: %v\n", err)
+		return 1
+	}
+	workdir := spec.WorkingDir
+	if workdir == "" {
+		workdir = "/"
+	}
+	if err := os.Chdir(workdir); err != nil {
+		fmt.Fprintf(os.Stderr, "Err Chdir: %v\n", err)
+		return 1
+	}
+
+	if err := applyUlimits(spec.Ulimits); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		return 1
+	}
+	if spec.NoNewPrivileges {
+		if err := setNoNewPrivileges(); err != nil {
+			fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+			return 1
+		}
+	}
+
+	// The command, and PATH lookups for it, see the container's environment
+	// only.
+	os.Clearenv()
+	for _, v := range spec.Env {
+		key, value, _ := strings.Cut(v, "=")
+		os.Setenv(key, value)
+	}
+	path, err := lookPath(spec.Args[0], os.Getenv("PATH"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		return 127
+	}
+	if spec.Init {
+		return runInit(path, spec.Args)
+	}
+	err = syscall.Exec(path, spec.Args, os.Environ())
+	fmt.Fprintf(os.Stderr, "Err exec %s: %v\n", spec.Args[0], err)
+	return 126
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// minChunkSize is the smallest byte range worth a request of its own; layers
+// are split into fewer chunks rather than smaller ones.
+const minChunkSize = 4 << 20
+
+// errRangesUnsupported is returned by BlobRange when the source sent
+// something other than the range asked for.
+var errRangesUnsupported = errors.New("the registry doesn't send byte ranges of blobs")
+
+// rangedSource is a Source that can send part of a blob, so that a layer can
+// be downloaded in several pieces at once.
+type rangedSource interface {
+	Source
+	// BlobRanges returns the size of the blob with digest, and whether it
+	// can be fetched in byte ranges.
+	BlobRanges(digest string) (int64, bool)
+	BlobRange(digest string, offset, length int64) (io.ReadCloser, error)
+}
+
+// downloadChunks downloads layer from src in up to opts.DownloadChunks byte
+// ranges at once, each written straight to its place in a file in dir, and
+// then copies the file, now the whole blob, to w. progress counts the bytes
+// as they arrive, and forgets them if the chunks don't all arrive. done is
+// false, with nothing written to w, if the layer is to be downloaded in one
+// piece instead: src doesn't send ranges, the layer is too small to be worth
+// splitting, or dir hasn't room for both the file and the copy.
+func downloadChunks(src rangedSource, layer DockerLayer, dir string, w io.Writer, progress *layerProgress, opts pullOptions, buf []byte) (done bool, err error) {
+	size, ok := src.BlobRanges(layer.Digest)
+	if !ok || layer.Size > 0 && size != layer.Size {
+		return false, nil
+	}
+	chunks := int64(opts.DownloadChunks)
+	if size/minChunkSize < chunks {
+		chunks = size / minChunkSize
+	}
+	if chunks < 2 {
+		return false, nil
+	}
+	// checkLayerSize made sure of room for the copy; the chunks take as
+	// much again until it is made.
+	if free, ok := freeSpace(dir); ok && 2*size > free {
+		fmt.Fprintf(os.Stderr, "Warning: layer %s: only %s is free in %s, too little to download it in chunks; downloading it in one piece\n", shortImageID(layer.Digest), formatSize(free), dir)
+		return false, nil
+	}
+	f, err := os.CreateTemp(dir, "chunks-")
+	if err != nil {
+		return true, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		return true, err
+	}
+
+	errs := make([]error, chunks)
+	var wg sync.WaitGroup
+	chunkSize := (size + chunks - 1) / chunks
+	for i := int64(0); i < chunks; i++ {
+		offset := i * chunkSize
+		length := chunkSize
+		if offset+length > size {
+			length = size - offset
+		}
+		wg.Add(1)
+		go func(i, offset, length int64) {
+			defer wg.Done()
+			errs[i] = downloadChunk(src, layer.Digest, f, offset, length, progress, opts, len(buf))
+		}(i, offset, length)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			// Whatever comes next starts over from the first byte.
+			progress.reset()
+		}
+		if errors.Is(err, errRangesUnsupported) {
+			fmt.Fprintf(os.Stderr, "Warning: layer %s: %v; downloading it in one piece\n", shortImageID(layer.Digest), err)
+			return false, nil
+		}
+		if err != nil {
+			return true, err
+		}
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return true, err
+	}
+	_, err = copyBuffer(w, f, buf)
+	return true, err
+}
+
+// downloadChunk writes length bytes of the blob with digest, from offset on,
+// to the same place in f.
+func downloadChunk(src rangedSource, digest string, f *os.File, offset, length int64, progress *layerProgress, opts pullOptions, bufferSize int) error {
+	r, err := src.BlobRange(digest, offset, length)
+	if err != nil {
+		return err
+	}
+	if opts.StallTimeout > 0 {
+		r = newStallReader(r, opts.StallTimeout)
+	}
+	defer r.Close()
+	var w io.Writer = &offsetWriter{f: f, offset: offset}
+	if progress != nil {
+		w = io.MultiWriter(w, progress)
+	}
+	n, err := copyBuffer(w, io.LimitReader(limitReader(r, opts.RateLimit), length), make([]byte, bufferSize))
+	if err == nil && n < length {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return fmt.Errorf("bytes %d-%d: %w", offset, offset+length-1, err)
+	}
+	return nil
+}
+
+// offsetWriter writes to f from offset on.
+type offsetWriter struct {
+	f      *os.File
+	offset int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.f.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDownloadChunks(t *testing.T) {
+	data := make([]byte, 4*minChunkSize+1234)
+	for i := range data {
+		data[i] = byte(i * 7 / 3)
+	}
+	digest := sha256Digest(data)
+	small := data[:minChunkSize]
+	smallDigest := sha256Digest(small)
+	tests := []struct {
+		name string
+		blob []byte
+		// serveRange answers a request for a range from offset: true to
+		// send it, false to send the whole blob instead.
+		serveRange func(offset int64) bool
+		// fail answers a request for a range from offset with an error.
+		fail       func(offset int64) bool
+		wantRanges int
+		wantErr    bool
+	}{
+		{name: "in chunks", blob: data, wantRanges: 4},
+		{name: "too small to split", blob: small, wantRanges: 0},
+		{
+			// The first chunk arrives before the others turn out to come
+			// whole; its bytes aren't counted twice.
+			name:       "ranges unsupported after all",
+			blob:       data,
+			serveRange: func(offset int64) bool { return offset == 0 },
+			wantRanges: 4,
+		},
+		{
+			name:       "chunk fails",
+			blob:       data,
+			fail:       func(offset int64) bool { return offset > 0 },
+			wantRanges: 4,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			ranges := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/v2/" {
+					w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
+					return
+				}
+				blob := data
+				if strings.HasSuffix(r.URL.Path, smallDigest) {
+					blob = small
+				}
+				if rng := r.Header.Get("Range"); rng != "" {
+					mu.Lock()
+					ranges++
+					mu.Unlock()
+					var offset int64
+					for _, c := range strings.TrimPrefix(rng, "bytes=") {
+						if c == '-' {
+							break
+						}
+						offset = offset*10 + int64(c-'0')
+					}
+					if tt.fail != nil && tt.fail(offset) {
+						http.Error(w, "broken", http.StatusInternalServerError)
+						return
+					}
+					if tt.serveRange != nil && !tt.serveRange(offset) {
+						w.Write(blob)
+						return
+					}
+				}
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+			}))
+			defer srv.Close()
+			useTestRegistry(t, srv)
+
+			layerDigest := digest
+			if len(tt.blob) == len(small) {
+				layerDigest = smallDigest
+			}
+			layer := DockerLayer{Digest: layerDigest, Size: int64(len(tt.blob))}
+			progress := newPullProgress(io.Discard, false)
+			line := progress.layer(layer.Digest, layer.Size)
+			src := &registrySource{repository: "library/test", auth: &registryAuth{}}
+			opts := pullOptions{DownloadChunks: 4, Progress: progress}
+			local, err := sourceLayerFetcher(src, opts)(layer, t.TempDir(), make([]byte, 32*1024))
+			if ranges != tt.wantRanges {
+				t.Errorf("%d range requests, want %d", ranges, tt.wantRanges)
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if line.current != 0 {
+					t.Errorf("progress counts %d bytes of a failed download", line.current)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(local.blob)
+			if err != nil || !bytes.Equal(got, tt.blob) {
+				t.Errorf("downloaded %d bytes, %v, want the %d of the blob", len(got), err, len(tt.blob))
+			}
+			if line.current != int64(len(tt.blob)) {
+				t.Errorf("progress counts %d bytes, want %d", line.current, len(tt.blob))
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// errNoCommand is returned by resolveCommand when neither the image nor the
+// user gave a command to run.
+var errNoCommand = errors.New("no command specified, and the image has no Entrypoint or Cmd")
+
+// resolveCommand works out the argv of a container the way Docker does. The
+// image's Cmd is the default arguments of its Entrypoint; userArgs, if any,
+// replace Cmd but are still passed to the Entrypoint. entrypoint is
+// --entrypoint, nil if it wasn't given: it replaces the image's Entrypoint,
+// an empty one removing it, and also drops the image's Cmd, which was meant
+// for the old Entrypoint.
+func resolveCommand(config ContainerConfig, userArgs []string, entrypoint *string) ([]string, error) {
+	argv := append([]string{}, config.Entrypoint...)
+	cmd := config.Cmd
+	if entrypoint != nil {
+		argv, cmd = nil, nil
+		if *entrypoint != "" {
+			argv = []string{*entrypoint}
+		}
+	}
+	if len(userArgs) > 0 {
+		cmd = userArgs
+	}
+	argv = append(argv, cmd...)
+	if len(argv) == 0 {
+		return nil, errNoCommand
+	}
+	return argv, nil
+}
+
+// executableNotFoundError reports a command found in none of the directories
+// of the container's PATH.
+type executableNotFoundError struct {
+	Name string
+	Dirs []string
+}
+
+func (e *executableNotFoundError) Error() string {
+	if len(e.Dirs) == 0 {
+		return fmt.Sprintf("executable %q not found: the container has no PATH to search", e.Name)
+	}
+	return fmt.Sprintf("executable %q not found in the container's PATH (searched %s)", e.Name, strings.Join(e.Dirs, ", "))
+}
+
+// lookPath finds the executable name, a command without a "/", in the
+// directories of pathList, the container's PATH, as the shell would. It is
+// called once in the container's root, so that the image's executables are
+// found rather than the host's. Names with a "/" are returned as they are.
+func lookPath(name, pathList string) (string, error) {
+	if strings.Contains(name, "/") {
+		return name, nil
+	}
+	var dirs []string
+	for _, dir := range filepath.SplitList(pathList) {
+		if dir == "" {
+			// An empty entry is the working directory.
+			dir = "."
+		}
+		dirs = append(dirs, dir)
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() && info.Mode()&0o111 != 0 {
+			if !filepath.IsAbs(path) {
+				path = "./" + path
+			}
+			return path, nil
+		}
+	}
+	return "", &executableNotFoundError{Name: name, Dirs: dirs}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestResolveCommand(t *testing.T) {
+	image := ContainerConfig{Entrypoint: []string{"/entry", "-x"}, Cmd: []string{"default"}}
+	str := func(s string) *string { return &s }
+	tests := []struct {
+		name       string
+		config     ContainerConfig
+		userArgs   []string
+		entrypoint *string
+		want       []string
+		wantErr    error
+	}{
+		{name: "image's", config: image, want: []string{"/entry", "-x", "default"}},
+		{name: "args replace Cmd", config: image, userArgs: []string{"a", "b"}, want: []string{"/entry", "-x", "a", "b"}},
+		{name: "Cmd alone", config: ContainerConfig{Cmd: []string{"/bin/sh"}}, want: []string{"/bin/sh"}},
+		{name: "new entrypoint drops Cmd", config: image, entrypoint: str("/other"), want: []string{"/other"}},
+		{name: "new entrypoint with args", config: image, userArgs: []string{"a"}, entrypoint: str("/other"), want: []string{"/other", "a"}},
+		{name: "empty entrypoint runs args", config: image, userArgs: []string{"/bin/sh", "-c", "true"}, entrypoint: str(""), want: []string{"/bin/sh", "-c", "true"}},
+		{name: "empty entrypoint without args", config: image, entrypoint: str(""), wantErr: errNoCommand},
+		{name: "Entrypoint alone", config: ContainerConfig{Entrypoint: []string{"/entry"}}, want: []string{"/entry"}},
+		{name: "args to Entrypoint alone", config: ContainerConfig{Entrypoint: []string{"/entry"}}, userArgs: []string{"a"}, want: []string{"/entry", "a"}},
+		{name: "args replace Cmd alone", config: ContainerConfig{Cmd: []string{"/bin/sh"}}, userArgs: []string{"/bin/ls", "-l"}, want: []string{"/bin/ls", "-l"}},
+		{name: "args without an image command", userArgs: []string{"/bin/sh"}, want: []string{"/bin/sh"}},
+		{name: "new entrypoint, none before", config: ContainerConfig{Cmd: []string{"/bin/sh"}}, entrypoint: str("/other"), want: []string{"/other"}},
+		{name: "empty entrypoint drops Cmd alone", config: ContainerConfig{Cmd: []string{"/bin/sh"}}, entrypoint: str(""), wantErr: errNoCommand},
+		{name: "new entrypoint without an image command", entrypoint: str("/other"), want: []string{"/other"}},
+		// --entrypoint is one executable, never split like a shell would.
+		{name: "entrypoint with spaces", config: image, entrypoint: str("/bin/sh -c"), want: []string{"/bin/sh -c"}},
+		// A shell form Entrypoint gets Cmd as arguments regardless.
+		{name: "shell form Entrypoint", config: ContainerConfig{Entrypoint: []string{"/bin/sh", "-c", "exec app"}, Cmd: []string{"x"}}, want: []string{"/bin/sh", "-c", "exec app", "x"}},
+		{name: "empty args keep Cmd", config: image, userArgs: []string{}, want: []string{"/entry", "-x", "default"}},
+		{name: "nothing", wantErr: errNoCommand},
+	}
+	for _, tt := range tests {
+		got, err := resolveCommand(tt.config, tt.userArgs, tt.entrypoint)
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("%s: resolveCommand = %q, %v, want %v", tt.name, got, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: resolveCommand = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+	if image.Entrypoint[1] != "-x" || len(image.Entrypoint) != 2 {
+		t.Errorf("the image's Entrypoint was changed to %q", image.Entrypoint)
+	}
+}
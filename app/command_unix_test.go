@@ -0,0 +1,87 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLookPath(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []struct {
+		name string
+		mode os.FileMode
+	}{
+		{"a/tool", 0o644},
+		{"b/tool", 0o755},
+		{"c/tool", 0o755},
+		{"a/dir/x", 0o755},
+	} {
+		path := filepath.Join(dir, f.name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, f.mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, b, c := filepath.Join(dir, "a"), filepath.Join(dir, "b"), filepath.Join(dir, "c")
+	tests := []struct {
+		name, path string
+		want       string
+		// wantDirs, if not nil, are the directories the error must say
+		// were searched.
+		wantDirs []string
+	}{
+		{name: "tool", path: b + ":" + c, want: filepath.Join(b, "tool")},
+		// Files that can't be executed, and directories, are passed over.
+		{name: "tool", path: a + ":" + c, want: filepath.Join(c, "tool")},
+		{name: "dir", path: a + ":" + b, wantDirs: []string{a, b}},
+		{name: "other", path: a + "::" + b, wantDirs: []string{a, ".", b}},
+		{name: "tool", path: "", wantDirs: []string{}},
+		// Names with a slash aren't looked for.
+		{name: "./tool", path: b, want: "./tool"},
+		{name: "/bin/missing", path: b, want: "/bin/missing"},
+	}
+	for _, tt := range tests {
+		got, err := lookPath(tt.name, tt.path)
+		if tt.wantDirs != nil {
+			var notFound *executableNotFoundError
+			if !errors.As(err, &notFound) {
+				t.Errorf("lookPath(%q, %q) = %q, %v, want it not found", tt.name, tt.path, got, err)
+				continue
+			}
+			if notFound.Name != tt.name || len(notFound.Dirs) != len(tt.wantDirs) {
+				t.Errorf("lookPath(%q, %q): %v, want %q searched", tt.name, tt.path, err, tt.wantDirs)
+				continue
+			}
+			for i, dir := range tt.wantDirs {
+				if notFound.Dirs[i] != dir {
+					t.Errorf("lookPath(%q, %q): %v, want %q searched", tt.name, tt.path, err, tt.wantDirs)
+					break
+				}
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("lookPath(%q, %q) = %q, %v, want %q", tt.name, tt.path, got, err, tt.want)
+		}
+	}
+
+	// An empty entry is the working directory, and what's found there is
+	// named relative to it.
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(b); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	if got, err := lookPath("tool", a+":"); err != nil || got != "./tool" {
+		t.Errorf("lookPath in the working directory = %q, %v, want ./tool", got, err)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const (
+	ociImageConfigMediaType = "application/vnd.oci.image.config.v1+json"
+	ociLayerMediaType       = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+// ociLayerMediaTypes maps Docker layer media types to their OCI equivalents,
+// for base layers listed in a committed image's manifest.
+var ociLayerMediaTypes = map[string]string{
+	"application/vnd.docker.image.rootfs.diff.tar.gzip":         ociLayerMediaType,
+	"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip": "application/vnd.oci.image.layer.nondistributable.v1.tar+gzip",
+}
+
+// explorerPath is where run copies docker-explorer into every rootfs. It
+// isn't part of the container's changes.
+const explorerPath = "usr/local/bin/docker-explorer"
+
+// ociManifest is an OCI image manifest, as written by commit.
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	Config        ociDescriptor     `json:"config"`
+	Layers        []ociDescriptor   `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// commitContainer stores the image made from the container's filesystem in
+// the OCI image layout at layout and returns its manifest's descriptor. The
+// container's image is pulled again into work, to diff against and to copy
+// its layers from.
+func commitContainer(state containerState, layout, work, message, scopeActions string) (ociDescriptor, error) {
+	var meta imageMetadata
+	base, err := prepareRootfs(work, func(staging string) error {
+		var err error
+		meta, err = pullDockerImage(staging, state.Image, pullOptions{ScopeActions: scopeActions, KeepBlobs: layout})
+		return err
+	})
+	if err != nil {
+		return ociDescriptor{}, fmt.Errorf("pulling %s: %w", state.Image, err)
+	}
+	if meta.Manifest.Config.Digest == "" {
+		return ociDescriptor{}, fmt.Errorf("%s has no image config to build on", state.Image)
+	}
+	if state.ImageID != "" && meta.Manifest.Config.Digest != state.ImageID {
+		return ociDescriptor{}, fmt.Errorf("%s no longer refers to the image the container was run from (%s)", state.Image, state.ImageID)
+	}
+	rawConfig, err := fetchRawImageConfig(state.Image, scopeActions)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	if err := verifyDigest("image config", rawConfig, meta.Manifest.Config.Digest); err != nil {
+		return ociDescriptor{}, err
+	}
+
+	layer, diffID, err := writeDiffLayer(layout, base, state.Rootfs)
+	if err != nil {
+		return ociDescriptor{}, fmt.Errorf("diffing the container's filesystem: %w", err)
+	}
+	config, err := commitConfig(rawConfig, diffID, message)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	configDesc, err := writeOCIBlob(layout, ociImageConfigMediaType, config)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	manifest := ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		Config:        configDesc,
+		Annotations:   state.Annotations,
+	}
+	for _, l := range meta.Manifest.Layers {
+		desc, err := baseLayerDescriptor(layout, l)
+		if err != nil {
+			return ociDescriptor{}, err
+		}
+		manifest.Layers = append(manifest.Layers, desc)
+	}
+	manifest.Layers = append(manifest.Layers, layer)
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	return writeOCIBlob(layout, ociManifestMediaType, data)
+}
+
+// baseLayerDescriptor describes a base image layer kept in layout.
+func baseLayerDescriptor(layout string, layer DockerLayer) (ociDescriptor, error) {
+	path, err := ociBlobPath(layout, layer.Digest)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	mediaType := layer.MediaType
+	if oci, ok := ociLayerMediaTypes[mediaType]; ok {
+		mediaType = oci
+	}
+	if mediaType == "" {
+		mediaType = ociLayerMediaType
+	}
+	return ociDescriptor{MediaType: mediaType, Digest: layer.Digest, Size: info.Size()}, nil
+}
+
+// writeDiffLayer stores the changes from base to rootfs as a gzipped layer
+// blob of layout. It returns the layer's descriptor and its diff ID, the
+// digest of the uncompressed tarball.
+func writeDiffLayer(layout, base, rootfs string) (ociDescriptor, string, error) {
+	f, err := os.CreateTemp(filepath.Join(layout, "blobs", "sha256"), "layer-")
+	if err != nil {
+		return ociDescriptor{}, "", err
+	}
+	defer os.Remove(f.Name())
+	compressed, uncompressed := sha256.New(), sha256.New()
+	gz := gzip.NewWriter(io.MultiWriter(f, compressed))
+	err = writeRootfsDiff(base, rootfs, io.MultiWriter(gz, uncompressed), func(rel string) bool {
+		return rel == filepath.FromSlash(explorerPath)
+	})
+	if err == nil {
+		err = gz.Close()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return ociDescriptor{}, "", err
+	}
+	info, err := os.Stat(f.Name())
+	if err != nil {
+		return ociDescriptor{}, "", err
+	}
+	desc := ociDescriptor{
+		MediaType: ociLayerMediaType,
+		Digest:    "sha256:" + hex.EncodeToString(compressed.Sum(nil)),
+		Size:      info.Size(),
+	}
+	path, err := ociBlobPath(layout, desc.Digest)
+	if err != nil {
+		return ociDescriptor{}, "", err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return ociDescriptor{}, "", err
+	}
+	return desc, "sha256:" + hex.EncodeToString(uncompressed.Sum(nil)), nil
+}
+
+// commitConfig derives the committed image's config from the base image's
+// raw config, adding the new layer. Fields we don't know are kept as they
+// are.
+func commitConfig(raw []byte, diffID, message string) ([]byte, error) {
+	var config map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, fmt.Errorf("decoding image config: %w", err)
+	}
+	var rootfs struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	}
+	var history []json.RawMessage
+	if data, ok := config["rootfs"]; ok {
+		if err := json.Unmarshal(data, &rootfs); err != nil {
+			return nil, fmt.Errorf("decoding image config rootfs: %w", err)
+		}
+	}
+	if data, ok := config["history"]; ok {
+		if err := json.Unmarshal(data, &history); err != nil {
+			return nil, fmt.Errorf("decoding image config history: %w", err)
+		}
+	}
+	created := time.Now().UTC()
+	rootfs.Type = "layers"
+	rootfs.DiffIDs = append(rootfs.DiffIDs, diffID)
+	entry, err := json.Marshal(struct {
+		Created   time.Time `json:"created"`
+		CreatedBy string    `json:"created_by"`
+		Comment   string    `json:"comment,omitempty"`
+	}{created, "docker-clone commit", message})
+	if err != nil {
+		return nil, err
+	}
+	history = append(history, entry)
+	for key, v := range map[string]interface{}{"created": created, "rootfs": rootfs, "history": history} {
+		if config[key], err = json.Marshal(v); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(config)
+}
+
+func commitCommand(argv []string) {
+	flags := flag.NewFlagSet("commit", flag.ExitOnError)
+	message := flags.String("m", "", "commit `message`, recorded in the image history")
+	scopeActions := flags.String("registry-scope", defaultScopeActions, "comma-separated `actions` to request in the registry token scope")
+	var caCerts stringsFlag
+	flags.Var(&caCerts, "ca-cert", "also trust the CA certificates in PEM `file`, or in the .pem/.crt/.cert files of a directory, for registry TLS (repeatable)")
+	timeouts := httpTimeoutFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), commitUsage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(argv)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	if err := useCACerts(caCerts); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	if err := useHTTPTimeouts(timeouts); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	key := flags.Arg(0)
+	repository, tag, err := parseLocalImageRef(flags.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	if !validContainerName(key) {
+		fmt.Fprintf(os.Stderr, "Err: no such container: %s\n", key)
+		os.Exit(1)
+	}
+	state, err := loadContainerState(key)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err: no such container: %s\n", key)
+		os.Exit(1)
+	}
+	if containerRunning(key) {
+		fmt.Fprintf(os.Stderr, "Err: container %s is still running\n", key)
+		os.Exit(1)
+	}
+	if state.Rootfs == "" {
+		fmt.Fprintf(os.Stderr, "Err: container %s has no kept filesystem; run it with --rm=false\n", key)
+		os.Exit(1)
+	}
+	if err := checkRootfsReady(state.Rootfs); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+
+	cleanup := &teardownStack{}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		sig := <-signals
+		cleanup.exit(128 + int(sig.(syscall.Signal)))
+	}()
+	workDir, err := os.MkdirTemp("", "commit")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err MkdirTemp: %v\n", err)
+		os.Exit(1)
+	}
+	cleanup.push("commit dir "+workDir, func() error { return os.RemoveAll(workDir) })
+	layout := localImageLayout(repository)
+	if err := initOCILayout(layout); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		cleanup.exit(1)
+	}
+	desc, err := commitContainer(state, layout, workDir, *message, *scopeActions)
+	if err == nil {
+		err = tagOCIManifest(layout, desc, tag)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err committing %s: %v\n", key, err)
+		cleanup.exit(1)
+	}
+	fmt.Println(desc.Digest)
+	if !quiet {
+		fmt.Fprintf(os.Stderr, "Committed %s as %s%s:%s\n", key, ociLayoutPrefix, layout, tag)
+	}
+	cleanup.run()
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestCommitContainer commits a container that created and removed files,
+// and runs the committed image.
+func TestCommitContainer(t *testing.T) {
+	docker, image := runTestImage(t, testEntry{name: "old", body: "old"}, testEntry{name: "kept", body: "kept"})
+	for _, args := range [][]string{
+		{"run", "--name", "c1", "--rm=false", image, "/probe", "write", "/made", "in the container"},
+		{"commit", "c1", "app:v1"},
+		{"run", "--name", "c2", "--rm=false", "app:v1", "/probe", "remove", "/old"},
+		{"commit", "c2", "app:v2"},
+	} {
+		if out, err := docker(args...).CombinedOutput(); err != nil {
+			t.Fatalf("%q: %v\n%s", args, err, out)
+		}
+	}
+	tests := []struct {
+		image string
+		want  []string
+	}{
+		{image: "app:v1", want: []string{"/made: in the container", "/old: old", "/kept: kept"}},
+		{image: "app:v2", want: []string{"/made: in the container", "open /old: no such file or directory", "/kept: kept"}},
+	}
+	for _, tt := range tests {
+		out, err := docker("run", "--rm", tt.image, "/probe", "cat", "/made", "/old", "/kept").CombinedOutput()
+		if err != nil {
+			t.Fatalf("running %s: %v\n%s", tt.image, err, out)
+		}
+		if got := strings.Split(strings.TrimSpace(string(out)), "\n"); strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%s holds %q, want %q", tt.image, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Levels of log-level. warn is what --quiet asks for.
+const (
+	logLevelInfo = "info"
+	logLevelWarn = "warn"
+)
+
+// settings are the defaults that apply to every command. Each is taken from,
+// in order of precedence, a global option, a DOCKER_CLONE_* environment
+// variable, the config file, and otherwise left at its built-in default,
+// which is the zero value.
+type settings struct {
+	// RegistryMirror is the base URL, e.g. https://mirror.example.com,
+	// of a registry that stands in for Docker Hub.
+	RegistryMirror string `json:"registry-mirror,omitempty"`
+	// InsecureRegistries are the hosts whose TLS certificates aren't
+	// verified, for mirrors with self-signed ones.
+	InsecureRegistries []string `json:"insecure-registries,omitempty"`
+	// CACerts are the --ca-cert files and directories used when a command
+	// isn't given any.
+	CACerts []string `json:"ca-certs,omitempty"`
+	// CacheDir is where the layer cache is, homeDir()/cache by default.
+	CacheDir string `json:"cache-dir,omitempty"`
+	// LogLevel is info, the default, or warn to leave out progress and
+	// informational messages as --quiet does.
+	LogLevel string `json:"log-level,omitempty"`
+	// Platform is the --platform default, the host's if empty.
+	Platform string `json:"platform,omitempty"`
+}
+
+// globalSettings are the settings in effect, resolved at startup.
+var globalSettings settings
+
+// The environment variables of the config file and of the settings. List
+// values are separated by commas, paths by the system's path list separator.
+const (
+	configEnv             = "DOCKER_CLONE_CONFIG"
+	registryMirrorEnv     = "DOCKER_CLONE_REGISTRY_MIRROR"
+	insecureRegistriesEnv = "DOCKER_CLONE_INSECURE_REGISTRIES"
+	caCertsEnv            = "DOCKER_CLONE_CA_CERTS"
+	cacheDirEnv           = "DOCKER_CLONE_CACHE_DIR"
+	logLevelEnv           = "DOCKER_CLONE_LOG_LEVEL"
+	platformEnv           = "DOCKER_CLONE_PLATFORM"
+)
+
+// configPath is the config file, homeDir()/config.json unless
+// DOCKER_CLONE_CONFIG names another.
+func configPath() string {
+	if path := os.Getenv(configEnv); path != "" {
+		return path
+	}
+	return filepath.Join(homeDir(), "config.json")
+}
+
+// readConfigFile reads the settings in the config file at path, which need
+// not exist. Unknown keys are rejected, so that a misspelt one isn't silently
+// ignored. Relative paths in the file are relative to its directory.
+func readConfigFile(path string) (settings, error) {
+	var s settings
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&s); err != nil {
+		return s, fmt.Errorf("%s: %w", path, err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return s, fmt.Errorf("%s: unexpected data after the settings object", path)
+	}
+	dir := filepath.Dir(path)
+	for i, p := range s.CACerts {
+		s.CACerts[i] = resolvePath(dir, p)
+	}
+	s.CacheDir = resolvePath(dir, s.CacheDir)
+	if err := s.validate(); err != nil {
+		return s, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+// resolvePath makes a relative path relative to dir.
+func resolvePath(dir, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// settingsFromEnv returns the settings lookup, such as os.LookupEnv, has
+// environment variables for.
+func settingsFromEnv(lookup func(string) (string, bool)) settings {
+	var s settings
+	get := func(key string) string {
+		value, _ := lookup(key)
+		return value
+	}
+	s.RegistryMirror = get(registryMirrorEnv)
+	s.InsecureRegistries = splitList(get(insecureRegistriesEnv), ",")
+	s.CACerts = splitList(get(caCertsEnv), string(os.PathListSeparator))
+	s.CacheDir = get(cacheDirEnv)
+	s.LogLevel = get(logLevelEnv)
+	s.Platform = get(platformEnv)
+	return s
+}
+
+// splitList splits value at sep, leaving out empty elements.
+func splitList(value, sep string) []string {
+	var list []string
+	for _, v := range strings.Split(value, sep) {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// override returns s with the settings o sets replacing its own.
+func (s settings) override(o settings) settings {
+	if o.RegistryMirror != "" {
+		s.RegistryMirror = o.RegistryMirror
+	}
+	if len(o.InsecureRegistries) > 0 {
+		s.InsecureRegistries = o.InsecureRegistries
+	}
+	if len(o.CACerts) > 0 {
+		s.CACerts = o.CACerts
+	}
+	if o.CacheDir != "" {
+		s.CacheDir = o.CacheDir
+	}
+	if o.LogLevel != "" {
+		s.LogLevel = o.LogLevel
+	}
+	if o.Platform != "" {
+		s.Platform = o.Platform
+	}
+	return s
+}
+
+// validate checks the values of the settings s sets, and normalizes the
+// registry mirror's URL.
+func (s *settings) validate() error {
+	if s.RegistryMirror != "" {
+		u, err := url.Parse(s.RegistryMirror)
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" || strings.Trim(u.Path, "/") != "" || u.RawQuery != "" {
+			return fmt.Errorf("registry-mirror %q: must be an http or https URL without a path", s.RegistryMirror)
+		}
+		s.RegistryMirror = u.Scheme + "://" + u.Host
+	}
+	for _, host := range s.InsecureRegistries {
+		if !domainRegexp.MatchString(host) {
+			return fmt.Errorf("insecure-registries: %q is not a host[:port]", host)
+		}
+	}
+	switch s.LogLevel {
+	case "", logLevelInfo, logLevelWarn:
+	default:
+		return fmt.Errorf("log-level %q: must be %s or %s", s.LogLevel, logLevelInfo, logLevelWarn)
+	}
+	if s.Platform != "" {
+		if _, err := parsePlatform(s.Platform); err != nil {
+			return fmt.Errorf("platform: %w", err)
+		}
+	}
+	return nil
+}
+
+// resolveSettings combines the config file, the environment lookup gives
+// and the global options in flags, each overriding the one before.
+func resolveSettings(path string, lookup func(string) (string, bool), flags settings) (settings, error) {
+	s, err := readConfigFile(path)
+	if err != nil {
+		return s, err
+	}
+	s = s.override(settingsFromEnv(lookup)).override(flags)
+	if err := s.validate(); err != nil {
+		return s, err
+	}
+	if s.CacheDir != "" {
+		if s.CacheDir, err = filepath.Abs(s.CacheDir); err != nil {
+			return s, err
+		}
+	}
+	return s, nil
+}
+
+// useSettings puts s into effect.
+func useSettings(s settings) error {
+	globalSettings = s
+	quiet = s.LogLevel == logLevelWarn
+	if err := useInsecureRegistries(s.InsecureRegistries); err != nil {
+		return err
+	}
+	return usePlatform(s.Platform)
+}
+
+// options returns the global options giving the settings s sets, for
+// running ourselves again with the same ones.
+func (s settings) options() []string {
+	var args []string
+	if s.LogLevel != "" {
+		args = append(args, "--log-level="+s.LogLevel)
+	}
+	if s.RegistryMirror != "" {
+		args = append(args, "--registry-mirror="+s.RegistryMirror)
+	}
+	for _, host := range s.InsecureRegistries {
+		args = append(args, "--insecure-registry="+host)
+	}
+	if s.CacheDir != "" {
+		args = append(args, "--cache-dir="+s.CacheDir)
+	}
+	return args
+}
+
+// registryBase is the base URL of Docker Hub's API, or of the registry
+// mirror standing in for it.
+func registryBase() string {
+	if globalSettings.RegistryMirror != "" {
+		return globalSettings.RegistryMirror
+	}
+	return dockerHubRegistry
+}
+
+// cacheDir is where the layer cache is.
+func cacheDir() string {
+	if globalSettings.CacheDir != "" {
+		return globalSettings.CacheDir
+	}
+	return filepath.Join(homeDir(), "cache")
+}
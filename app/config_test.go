@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolveSettings(t *testing.T) {
+	dir := t.TempDir()
+	file := `{
+		"registry-mirror": "https://file.example.com/",
+		"insecure-registries": ["file.example.com:5000"],
+		"ca-certs": ["certs/file.pem", "/etc/ca.pem"],
+		"cache-dir": "cache",
+		"log-level": "warn",
+		"platform": "linux/arm64"
+	}`
+	config := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(config, []byte(file), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fromFile := settings{
+		RegistryMirror:     "https://file.example.com",
+		InsecureRegistries: []string{"file.example.com:5000"},
+		CACerts:            []string{filepath.Join(dir, "certs/file.pem"), "/etc/ca.pem"},
+		CacheDir:           filepath.Join(dir, "cache"),
+		LogLevel:           logLevelWarn,
+		Platform:           "linux/arm64",
+	}
+	tests := []struct {
+		name    string
+		path    string
+		env     map[string]string
+		flags   settings
+		want    settings
+		wantErr string
+	}{
+		{name: "built-in defaults", path: filepath.Join(dir, "missing.json"), want: settings{}},
+		{name: "file", path: config, want: fromFile},
+		{
+			name: "env over file",
+			path: config,
+			env: map[string]string{
+				registryMirrorEnv:     "http://env.example.com",
+				insecureRegistriesEnv: "a.example.com, b.example.com:5000,",
+				caCertsEnv:            "/env/a.pem" + string(os.PathListSeparator) + "/env/b.pem",
+				logLevelEnv:           logLevelInfo,
+			},
+			want: settings{
+				RegistryMirror:     "http://env.example.com",
+				InsecureRegistries: []string{"a.example.com", "b.example.com:5000"},
+				CACerts:            []string{"/env/a.pem", "/env/b.pem"},
+				CacheDir:           fromFile.CacheDir,
+				LogLevel:           logLevelInfo,
+				Platform:           "linux/arm64",
+			},
+		},
+		{
+			name:  "flags over env over file",
+			path:  config,
+			env:   map[string]string{registryMirrorEnv: "http://env.example.com", cacheDirEnv: "/env/cache", platformEnv: "linux/amd64"},
+			flags: settings{RegistryMirror: "https://flag.example.com", Platform: "linux/arm/v7"},
+			want: settings{
+				RegistryMirror:     "https://flag.example.com",
+				InsecureRegistries: fromFile.InsecureRegistries,
+				CACerts:            fromFile.CACerts,
+				CacheDir:           "/env/cache",
+				LogLevel:           logLevelWarn,
+				Platform:           "linux/arm/v7",
+			},
+		},
+		{name: "bad flag", path: config, flags: settings{LogLevel: "debug"}, wantErr: `log-level "debug"`},
+		{name: "bad env", path: config, env: map[string]string{registryMirrorEnv: "ftp://env.example.com"}, wantErr: `registry-mirror "ftp://env.example.com"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lookup := func(key string) (string, bool) {
+				value, ok := tt.env[key]
+				return value, ok
+			}
+			s, err := resolveSettings(tt.path, lookup, tt.flags)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("resolveSettings: %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(s, tt.want) {
+				t.Errorf("resolveSettings = %+v, want %+v", s, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		file    string
+		wantErr string
+	}{
+		{file: `{"registry_mirror": "https://example.com"}`, wantErr: `unknown field "registry_mirror"`},
+		{file: `{"insecure-registries": "example.com"}`, wantErr: "cannot unmarshal"},
+		{file: `{} {}`, wantErr: "unexpected data after the settings object"},
+		{file: `{"registry-mirror": "https://example.com/v2/"}`, wantErr: "must be an http or https URL without a path"},
+		{file: `{"insecure-registries": ["https://example.com"]}`, wantErr: "is not a host[:port]"},
+		{file: `{"log-level": "debug"}`, wantErr: "must be info or warn"},
+		{file: `{"platform": "linux/"}`, wantErr: "platform:"},
+		{file: `{`, wantErr: "unexpected EOF"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, []byte(tt.file), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readConfigFile(path); err == nil || !strings.Contains(err.Error(), tt.wantErr) || !strings.Contains(err.Error(), path) {
+			t.Errorf("%s: %v, want an error about %s containing %q", tt.file, err, path, tt.wantErr)
+		}
+	}
+}
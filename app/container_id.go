@@ -0,0 +1,37 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+// generateContainerID returns a random 64 character hex ID, the same shape as
+// Docker's container IDs.
+func generateContainerID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// createCIDFile claims path for a new container, refusing to clobber the
+// cidfile of a container that may still be running.
+func createCIDFile(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if os.IsExist(err) {
+		return fmt.Errorf("container ID file found, make sure the other container isn't running or delete %s", path)
+	}
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeCIDFile writes the container ID to a cidfile claimed by createCIDFile.
+// Like Docker, the file holds just the ID without a trailing newline.
+func writeCIDFile(path, id string) error {
+	return os.WriteFile(path, []byte(id), 0o644)
+}
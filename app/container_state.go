@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// containerState is what we record about a container while it runs, in
+// ~/.docker-clone/containers/<name or id>/state.json.
+type containerState struct {
+	ID      string            `json:"id"`
+	Name    string            `json:"name,omitempty"`
+	Image   string            `json:"image"`
+	Command []string          `json:"command"`
+	Pid     int               `json:"pid"`
+	Created time.Time         `json:"created"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	// Annotations are the --annotation values, kept for images made from
+	// the container.
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// ImageID is the digest of the image's config, pinning the image the
+	// container was run from.
+	ImageID string `json:"imageId,omitempty"`
+	// Layers are the digests of the image's layers, which the layer cache
+	// keeps while the container runs.
+	Layers []string `json:"layers,omitempty"`
+	// Rootfs is set for containers run with --rm=false, whose filesystem
+	// and state are kept after they exit.
+	Rootfs string `json:"rootfs,omitempty"`
+	// StopSignal is the signal stop sends the container first.
+	StopSignal int `json:"stopSignal,omitempty"`
+	// NetworkAliases are the --network-alias names other containers find
+	// the container by, besides its name.
+	NetworkAliases []string `json:"networkAliases,omitempty"`
+	// IPAddress is the container's address on the bridge, for those run
+	// with --net bridge or sharing such a one's network. Others have the
+	// host's network.
+	IPAddress string `json:"ipAddress,omitempty"`
+}
+
+// containerNamePattern is what --name accepts, as in Docker.
+const containerNamePattern = `[a-zA-Z0-9][a-zA-Z0-9_.-]*`
+
+var containerNameRegexp = regexp.MustCompile(`^` + containerNamePattern + `$`)
+
+// key names the container's directory: its name if it has one, so that the
+// directory and the logs in it can be found again by name, else its ID.
+func (s containerState) key() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return s.ID
+}
+
+func containersDir() string {
+	return filepath.Join(homeDir(), "containers")
+}
+
+func containerDir(key string) string {
+	return filepath.Join(containersDir(), key)
+}
+
+func containerStatePath(key string) string {
+	return filepath.Join(containerDir(key), "state.json")
+}
+
+// containerLogPath is where the named container key's stream ("stdout" or
+// "stderr") is logged.
+func containerLogPath(key, stream string) string {
+	return filepath.Join(containerDir(key), stream+".log")
+}
+
+// createContainerLogs opens fresh log files for the named container key,
+// rotated as opts say. Unrotated logs are the files themselves.
+func createContainerLogs(key string, opts logOptions) (stdout, stderr io.WriteCloser, err error) {
+	open := func(stream string) (io.WriteCloser, error) {
+		path := containerLogPath(key, stream)
+		removeRotatedLogs(path)
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		if opts.MaxSize == 0 {
+			return f, nil
+		}
+		return newRotatingLog(path, f, opts), nil
+	}
+	if stdout, err = open("stdout"); err != nil {
+		return nil, nil, err
+	}
+	if stderr, err = open("stderr"); err != nil {
+		stdout.Close()
+		return nil, nil, err
+	}
+	return stdout, stderr, nil
+}
+
+// A container holds an exclusive lock on a file in its directory while it
+// runs. As with volumes, nothing goes stale if the container is killed.
+func containerLockPath(key string) string {
+	return filepath.Join(containerDir(key), ".lock")
+}
+
+func validContainerName(name string) bool {
+	return containerNameRegexp.MatchString(name)
+}
+
+// claimContainer creates the directory of the container key and marks it
+// running for as long as the returned file stays open.
+func claimContainer(key string) (*os.File, error) {
+	if err := os.MkdirAll(containerDir(key), 0o755); err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(containerLockPath(key), os.O_CREATE|os.O_RDONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := tryLockExclusive(lock); err != nil {
+		lock.Close()
+		if err == errLocked {
+			return nil, fmt.Errorf("container name %q is already in use", key)
+		}
+		return nil, err
+	}
+	return lock, nil
+}
+
+// containerRunning reports whether the container key is running.
+func containerRunning(key string) bool {
+	lock, err := os.Open(containerLockPath(key))
+	if err != nil {
+		return false
+	}
+	defer lock.Close()
+	return tryLockExclusive(lock) == errLocked
+}
+
+// saveContainerState writes the state file atomically, so readers never see
+// a partially written one.
+func saveContainerState(state containerState) error {
+	if err := os.MkdirAll(containerDir(state.key()), 0o755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := containerStatePath(state.key())
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func loadContainerState(key string) (containerState, error) {
+	var state containerState
+	data, err := os.ReadFile(containerStatePath(key))
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+// removeContainerState forgets a container once it has exited. A named
+// container's directory is kept, since its logs stay readable afterwards,
+// and a container with a preserved rootfs is kept whole.
+func removeContainerState(state containerState) error {
+	if state.Rootfs != "" {
+		return nil
+	}
+	if state.Name != "" {
+		err := os.Remove(containerStatePath(state.key()))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return os.RemoveAll(containerDir(state.key()))
+}
+
+// listContainers returns the running containers, oldest first. State left
+// behind by containers that were killed before cleaning up is skipped.
+func listContainers() ([]containerState, error) {
+	entries, err := os.ReadDir(containersDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var states []containerState
+	for _, entry := range entries {
+		if !entry.IsDir() || !containerRunning(entry.Name()) {
+			continue
+		}
+		state, err := loadContainerState(entry.Name())
+		if err != nil {
+			continue
+		}
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Created.Before(states[j].Created) })
+	return states, nil
+}
+
+// runningContainer finds a running container by name or ID.
+func runningContainer(nameOrID string) (containerState, bool) {
+	if !validContainerName(nameOrID) || !containerRunning(nameOrID) {
+		return containerState{}, false
+	}
+	state, err := loadContainerState(nameOrID)
+	return state, err == nil
+}
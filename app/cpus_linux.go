@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// CFS bandwidth bounds, in microseconds. The period defaults to the kernel's
+// and Docker's 100ms; the kernel rejects periods outside 1ms-1s and quotas
+// under 1ms.
+const (
+	defaultCPUPeriod = 100000
+	minCPUPeriod     = 1000
+	maxCPUPeriod     = 1000000
+	minCPUQuota      = 1000
+)
+
+// cpuMax returns the contents of cpu.max, "quota period", for --cpus,
+// --cpu-period and --cpu-quota, or "" if none of them is set. --cpus is a
+// number of CPUs, possibly fractional, and becomes a quota of that many
+// periods, so 1.5 is "150000 100000". period and quota are zero when unset;
+// a quota of -1 means no limit. numCPU bounds --cpus.
+func cpuMax(cpus string, period, quota int64, numCPU int) (string, error) {
+	if cpus == "" && period == 0 && quota == 0 {
+		return "", nil
+	}
+	if cpus != "" && quota != 0 {
+		return "", fmt.Errorf("--cpus and --cpu-quota both set the quota; use one of them")
+	}
+	if period == 0 {
+		period = defaultCPUPeriod
+	} else if period < minCPUPeriod || period > maxCPUPeriod {
+		return "", fmt.Errorf("--cpu-period %d: must be between %d and %d microseconds", period, minCPUPeriod, maxCPUPeriod)
+	}
+
+	if cpus != "" {
+		n, err := strconv.ParseFloat(cpus, 64)
+		if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+			return "", fmt.Errorf("--cpus %q: not a number", cpus)
+		}
+		if n <= 0 {
+			return "", fmt.Errorf("--cpus %s: must be more than 0", cpus)
+		}
+		if n > float64(numCPU) {
+			return "", fmt.Errorf("--cpus %s: only %d CPUs are available", cpus, numCPU)
+		}
+		quota = int64(math.Round(n * float64(period)))
+		if quota < minCPUQuota {
+			return "", fmt.Errorf("--cpus %s: too small, the quota would be under %dus per %dus period", cpus, minCPUQuota, period)
+		}
+	}
+	switch {
+	case quota == 0 || quota == -1:
+		return fmt.Sprintf("max %d", period), nil
+	case quota < minCPUQuota:
+		return "", fmt.Errorf("--cpu-quota %d: must be at least %d microseconds, or -1 for no limit", quota, minCPUQuota)
+	}
+	return fmt.Sprintf("%d %d", quota, period), nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestCPUMax(t *testing.T) {
+	tests := []struct {
+		cpus          string
+		period, quota int64
+		want          string
+		wantErr       bool
+	}{
+		{want: ""},
+		{cpus: "1.5", want: "150000 100000"},
+		{cpus: "1", want: "100000 100000"},
+		{cpus: "0.5", want: "50000 100000"},
+		{cpus: "0.01", want: "1000 100000"},
+		{cpus: "0.333", want: "33300 100000"},
+		{cpus: "4", want: "400000 100000"},
+		{cpus: "1.5", period: 50000, want: "75000 50000"},
+		{cpus: "0.0015", period: 1000000, want: "1500 1000000"},
+		{period: 50000, want: "max 50000"},
+		{quota: 25000, want: "25000 100000"},
+		{quota: -1, want: "max 100000"},
+		{period: 20000, quota: 30000, want: "30000 20000"},
+		{cpus: "0", wantErr: true},
+		{cpus: "-1", wantErr: true},
+		{cpus: "one", wantErr: true},
+		{cpus: "NaN", wantErr: true},
+		{cpus: "Inf", wantErr: true},
+		{cpus: "4.5", wantErr: true},
+		// Under the kernel's 1ms minimum quota.
+		{cpus: "0.005", wantErr: true},
+		{cpus: "1", quota: 50000, wantErr: true},
+		{period: 999, wantErr: true},
+		{period: 1000001, wantErr: true},
+		{quota: 999, wantErr: true},
+		{quota: -2, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := cpuMax(tt.cpus, tt.period, tt.quota, 4)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("cpuMax(%q, %d, %d) = %q, want an error", tt.cpus, tt.period, tt.quota, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("cpuMax(%q, %d, %d) = %q, %v, want %q", tt.cpus, tt.period, tt.quota, got, err, tt.want)
+		}
+	}
+}
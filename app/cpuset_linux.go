@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The host's CPUs and memory nodes, in the same list format as cpuset.cpus
+// and cpuset.mems.
+const (
+	onlineCPUsPath  = "/sys/devices/system/cpu/online"
+	onlineNodesPath = "/sys/devices/system/node/online"
+)
+
+// maxCPUListID bounds the numbers in a list, so that a range such as
+// 0-50000000 is refused instead of taking seconds to expand. Kernels can be
+// built for at most 8192 CPUs (NR_CPUS), and for fewer memory nodes.
+const maxCPUListID = 8191
+
+// parseCPUList parses a list such as "0-3,8", returning the numbers in it.
+func parseCPUList(list string) (map[int]bool, error) {
+	ids := map[int]bool{}
+	for _, part := range strings.Split(strings.TrimSpace(list), ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		lo, err := strconv.Atoi(first)
+		if err != nil || lo < 0 {
+			return nil, fmt.Errorf("invalid list %q", list)
+		}
+		hi := lo
+		if isRange {
+			if hi, err = strconv.Atoi(last); err != nil || hi < lo {
+				return nil, fmt.Errorf("invalid range %q in %q", part, list)
+			}
+		}
+		if hi > maxCPUListID {
+			return nil, fmt.Errorf("%q in %q is past %d, the largest number a kernel supports", part, list, maxCPUListID)
+		}
+		for id := lo; id <= hi; id++ {
+			ids[id] = true
+		}
+	}
+	return ids, nil
+}
+
+// validateCpuset checks that value, given to flag, only lists CPUs or memory
+// nodes that are in the list read from the sysfs file online. Without that
+// file, as for memory nodes on kernels without NUMA, there is only node 0.
+func validateCpuset(flag, value, online string) error {
+	requested, err := parseCPUList(value)
+	if err != nil {
+		return fmt.Errorf("--%s: %w", flag, err)
+	}
+	available := "0"
+	if data, err := os.ReadFile(online); err == nil {
+		available = strings.TrimSpace(string(data))
+	}
+	have, err := parseCPUList(available)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", online, err)
+	}
+	var missing []int
+	for id := range requested {
+		if !have[id] {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Ints(missing)
+		return fmt.Errorf("--%s %s: %s not available on this host (available: %s)", flag, value, joinInts(missing), available)
+	}
+	return nil
+}
+
+func joinInts(ids []int) string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = strconv.Itoa(id)
+	}
+	return strings.Join(s, ",")
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Registry credentials come from the environment, for CI jobs and the like
+// that can't log in interactively or mount a credentials file. Credentials
+// scoped to the registry in use, DOCKER_CLONE_<HOST>_USERNAME and
+// DOCKER_CLONE_<HOST>_PASSWORD, take precedence over DOCKER_CLONE_USERNAME
+// and DOCKER_CLONE_PASSWORD, which are used for any registry. <HOST> is the
+// registry's host, and port if any, upper-cased with everything but letters
+// and digits made underscores: DOCKER_CLONE_GHCR_IO_USERNAME for ghcr.io,
+// and DOCKER_CLONE_REGISTRY_1_DOCKER_IO_USERNAME for Docker Hub.
+// There are no credential flags or credentials file yet; flags would take
+// precedence over the environment, and the environment over a file, as they
+// do for the settings. Without credentials, tokens are asked for
+// anonymously.
+const (
+	usernameEnv = "DOCKER_CLONE_USERNAME"
+	passwordEnv = "DOCKER_CLONE_PASSWORD"
+)
+
+// registryCredentials are a username and password to get tokens with.
+type registryCredentials struct {
+	Username string
+	Password string
+	// Source names the environment variables they were taken from, for
+	// messages.
+	Source string
+}
+
+// String describes c without its password, so that credentials printed by
+// mistake don't leak it.
+func (c registryCredentials) String() string {
+	return fmt.Sprintf("%s:<redacted> (from %s)", c.Username, c.Source)
+}
+
+// GoString is String, for %#v.
+func (c registryCredentials) GoString() string {
+	return c.String()
+}
+
+// credentialsEnvPrefix is the prefix of the environment variables with
+// credentials scoped to the registry at base, e.g. DOCKER_CLONE_GHCR_IO_ for
+// https://ghcr.io.
+func credentialsEnvPrefix(base string) string {
+	host := base
+	if u, err := url.Parse(base); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	scoped := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, host)
+	return "DOCKER_CLONE_" + scoped + "_"
+}
+
+// credentialsFromEnv returns the credentials lookup, such as os.LookupEnv,
+// has for the registry at base, if any. A username without a password, or
+// the other way around, is an error rather than a silently anonymous pull.
+func credentialsFromEnv(base string, lookup func(string) (string, bool)) (registryCredentials, bool, error) {
+	prefix := credentialsEnvPrefix(base)
+	for _, names := range [][2]string{
+		{prefix + "USERNAME", prefix + "PASSWORD"},
+		{usernameEnv, passwordEnv},
+	} {
+		username, hasUsername := lookup(names[0])
+		password, hasPassword := lookup(names[1])
+		if !hasUsername && !hasPassword {
+			continue
+		}
+		if username == "" || password == "" {
+			return registryCredentials{}, false, fmt.Errorf("%s and %s must be set together", names[0], names[1])
+		}
+		return registryCredentials{Username: username, Password: password, Source: names[0] + "/" + names[1]}, true, nil
+	}
+	return registryCredentials{}, false, nil
+}
+
+// currentCredentials returns the credentials for the registry in use.
+func currentCredentials() (registryCredentials, bool, error) {
+	return credentialsFromEnv(registryBase(), os.LookupEnv)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCredentialsFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    string
+		env     map[string]string
+		want    registryCredentials
+		found   bool
+		wantErr bool
+	}{
+		{name: "none", base: "https://ghcr.io"},
+		{
+			name:  "any registry",
+			base:  "https://ghcr.io",
+			env:   map[string]string{"DOCKER_CLONE_USERNAME": "ci", "DOCKER_CLONE_PASSWORD": "secret"},
+			want:  registryCredentials{Username: "ci", Password: "secret", Source: "DOCKER_CLONE_USERNAME/DOCKER_CLONE_PASSWORD"},
+			found: true,
+		},
+		{
+			name: "registry's first",
+			base: "https://ghcr.io",
+			env: map[string]string{
+				"DOCKER_CLONE_USERNAME": "ci", "DOCKER_CLONE_PASSWORD": "secret",
+				"DOCKER_CLONE_GHCR_IO_USERNAME": "gh", "DOCKER_CLONE_GHCR_IO_PASSWORD": "token",
+			},
+			want:  registryCredentials{Username: "gh", Password: "token", Source: "DOCKER_CLONE_GHCR_IO_USERNAME/DOCKER_CLONE_GHCR_IO_PASSWORD"},
+			found: true,
+		},
+		{
+			name:  "another registry's ignored",
+			base:  "https://quay.io",
+			env:   map[string]string{"DOCKER_CLONE_GHCR_IO_USERNAME": "gh", "DOCKER_CLONE_GHCR_IO_PASSWORD": "token"},
+			found: false,
+		},
+		{
+			name:  "Docker Hub",
+			base:  dockerHubRegistry,
+			env:   map[string]string{"DOCKER_CLONE_REGISTRY_1_DOCKER_IO_USERNAME": "me", "DOCKER_CLONE_REGISTRY_1_DOCKER_IO_PASSWORD": "pat"},
+			want:  registryCredentials{Username: "me", Password: "pat", Source: "DOCKER_CLONE_REGISTRY_1_DOCKER_IO_USERNAME/DOCKER_CLONE_REGISTRY_1_DOCKER_IO_PASSWORD"},
+			found: true,
+		},
+		{
+			name:  "with a port",
+			base:  "http://localhost:5000",
+			env:   map[string]string{"DOCKER_CLONE_LOCALHOST_5000_USERNAME": "me", "DOCKER_CLONE_LOCALHOST_5000_PASSWORD": "pw"},
+			want:  registryCredentials{Username: "me", Password: "pw", Source: "DOCKER_CLONE_LOCALHOST_5000_USERNAME/DOCKER_CLONE_LOCALHOST_5000_PASSWORD"},
+			found: true,
+		},
+		{name: "username alone", base: "https://ghcr.io", env: map[string]string{"DOCKER_CLONE_USERNAME": "ci"}, wantErr: true},
+		{name: "empty password", base: "https://ghcr.io", env: map[string]string{"DOCKER_CLONE_USERNAME": "ci", "DOCKER_CLONE_PASSWORD": ""}, wantErr: true},
+		// A registry's half set doesn't fall back to the others.
+		{
+			name:    "registry's password alone",
+			base:    "https://ghcr.io",
+			env:     map[string]string{"DOCKER_CLONE_GHCR_IO_PASSWORD": "token", "DOCKER_CLONE_USERNAME": "ci", "DOCKER_CLONE_PASSWORD": "secret"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		lookup := func(name string) (string, bool) {
+			v, ok := tt.env[name]
+			return v, ok
+		}
+		got, found, err := credentialsFromEnv(tt.base, lookup)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: credentialsFromEnv = %v, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || found != tt.found || got != tt.want {
+			t.Errorf("%s: credentialsFromEnv = %#v, %v, %v, want %#v, %v", tt.name, got, found, err, tt.want, tt.found)
+		}
+	}
+}
+
+// TestFetchTokenCredentials asks a registry that checks the credentials of
+// token requests for tokens, with and without credentials in the
+// environment, and checks the password shows nowhere.
+func TestFetchTokenCredentials(t *testing.T) {
+	var mu sync.Mutex
+	// users are who the tokens were asked for by, "" for anonymous.
+	var users []string
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+srv.URL+`/token",service="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		case "/token":
+			user, password, ok := r.BasicAuth()
+			mu.Lock()
+			users = append(users, user)
+			mu.Unlock()
+			if ok && password != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(DockerTokenResponse{Token: "token for " + user})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	useTestRegistry(t, srv)
+	scoped := credentialsEnvPrefix(srv.URL)
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		// want is the token handed out, and who asked for it.
+		want     string
+		wantUser string
+		// noRequest is set if no token is to be asked for at all.
+		noRequest bool
+		wantErr   string
+	}{
+		{name: "anonymous", want: "token for "},
+		{
+			name:     "any registry's",
+			env:      map[string]string{usernameEnv: "ci", passwordEnv: "secret"},
+			want:     "token for ci",
+			wantUser: "ci",
+		},
+		{
+			name:     "this registry's",
+			env:      map[string]string{usernameEnv: "ci", passwordEnv: "wrong", scoped + "USERNAME": "deploy", scoped + "PASSWORD": "secret"},
+			want:     "token for deploy",
+			wantUser: "deploy",
+		},
+		{
+			name:     "rejected",
+			env:      map[string]string{usernameEnv: "ci", passwordEnv: "hunter2"},
+			wantUser: "ci",
+			wantErr:  "the credentials of user ci from DOCKER_CLONE_USERNAME/DOCKER_CLONE_PASSWORD were rejected",
+		},
+		{name: "half set", env: map[string]string{usernameEnv: "ci"}, noRequest: true, wantErr: "must be set together"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Every case asks for a token of its own: an anonymous one
+			// isn't one of the user's.
+			useTestTokens(t, "")
+			for _, name := range []string{usernameEnv, passwordEnv, scoped + "USERNAME", scoped + "PASSWORD"} {
+				if v, ok := tt.env[name]; ok {
+					t.Setenv(name, v)
+				}
+			}
+			mu.Lock()
+			users = nil
+			mu.Unlock()
+			var auth *registryAuth
+			var err error
+			stderr := captureStderr(t, func() { auth, err = newRegistryAuth("library/app", "") })
+			for _, name := range []string{passwordEnv, scoped + "PASSWORD"} {
+				password := tt.env[name]
+				if password != "" && (err != nil && strings.Contains(err.Error(), password) || strings.Contains(stderr, password)) {
+					t.Errorf("the password shows in %v, %q", err, stderr)
+				}
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("newRegistryAuth: %v, want an error saying %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if token, _ := auth.current(); token != tt.want {
+				t.Errorf("got %q, want %q", token, tt.want)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if tt.noRequest {
+				if len(users) != 0 {
+					t.Errorf("tokens asked for by %q, want none", users)
+				}
+			} else if len(users) != 1 || users[0] != tt.wantUser {
+				t.Errorf("tokens asked for by %q, want %q", users, tt.wantUser)
+			}
+		})
+	}
+
+	// An anonymous token isn't reused for the user, nor the other way
+	// around.
+	useTestTokens(t, "")
+	users = nil
+	for _, user := range []string{"", "ci", "", "ci"} {
+		// Set with t.Setenv first, for them to be restored once unset.
+		t.Setenv(usernameEnv, user)
+		t.Setenv(passwordEnv, "secret")
+		if user == "" {
+			os.Unsetenv(usernameEnv)
+			os.Unsetenv(passwordEnv)
+		}
+		if _, err := newRegistryAuth("library/app", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"", "ci"}; !reflect.DeepEqual(users, want) {
+		t.Errorf("tokens asked for by %q, want %q", users, want)
+	}
+
+	// Nor is one registry's token reused for another with the same
+	// service.
+	useTestTokens(t, "")
+	registries := []*tokenRegistry{newTokenRegistry(t, 300, nil), newTokenRegistry(t, 300, nil)}
+	for _, r := range append(registries, registries...) {
+		useTestRegistry(t, r.Server)
+		if _, err := newRegistryAuth("library/app", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, r := range registries {
+		if got := r.tokenRequests(); len(got) != 1 {
+			t.Errorf("registry %d asked for tokens for %q, want one", i, got)
+		}
+	}
+}
+
+func TestRegistryCredentialsRedacted(t *testing.T) {
+	creds := registryCredentials{Username: "ci", Password: "hunter2", Source: "DOCKER_CLONE_USERNAME/DOCKER_CLONE_PASSWORD"}
+	for _, format := range []string{"%v", "%+v", "%#v", "%s"} {
+		got := fmt.Sprintf(format, creds)
+		if strings.Contains(got, "hunter2") {
+			t.Errorf("%s prints the password: %s", format, got)
+		}
+		if !strings.Contains(got, "ci:<redacted>") {
+			t.Errorf("%s prints %s, want the user with the password redacted", format, got)
+		}
+	}
+	// As a field of something else printed, too.
+	if got := fmt.Sprintf("%+v", struct{ Creds registryCredentials }{creds}); strings.Contains(got, "hunter2") {
+		t.Errorf("%%+v of a struct prints the password: %s", got)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Levels of --mounts-default, the kernel filesystems a container gets
+// without asking for them.
+const (
+	// mountsNone mounts nothing, which is all a statically linked binary in
+	// a scratch image needs.
+	mountsNone = "none"
+	// mountsMinimal mounts /proc, which ps, shells and most runtimes expect.
+	mountsMinimal = "minimal"
+	// mountsFull mounts /proc, a read-only /sys with the cgroup hierarchy at
+	// /sys/fs/cgroup, and a /dev of its own with the standard device nodes,
+	// /dev/pts and /dev/shm.
+	mountsFull = "full"
+)
+
+// Mount types of the default mounts. Unlike the others they can't be asked
+// for with -v or --mount.
+const (
+	mountTypeProc   = "proc"
+	mountTypeSysfs  = "sysfs"
+	mountTypeCgroup = "cgroup2"
+	mountTypeDev    = "dev"
+	mountTypeDevpts = "devpts"
+)
+
+// standardDevices are the nodes a /dev of the container's own gets, bind
+// mounted from the host's: creating them takes privileges that mounting them
+// doesn't.
+var standardDevices = []string{"null", "zero", "full", "random", "urandom", "tty"}
+
+// standardDevLinks are the symlinks a /dev of the container's own gets.
+var standardDevLinks = map[string]string{
+	"fd":     "/proc/self/fd",
+	"stdin":  "/proc/self/fd/0",
+	"stdout": "/proc/self/fd/1",
+	"stderr": "/proc/self/fd/2",
+	"ptmx":   "pts/ptmx",
+}
+
+// defaultMounts returns the mounts of level, a --mounts-default value, with
+// /dev/shm shmSize big. Those at a target in userMounts are left out: the
+// user's mount replaces them.
+func defaultMounts(level string, shmSize int64, userMounts []mountSpec) ([]mountSpec, error) {
+	var mounts []mountSpec
+	switch level {
+	case mountsNone:
+	case mountsMinimal:
+		mounts = []mountSpec{{Type: mountTypeProc, Target: "/proc"}}
+	case mountsFull:
+		mounts = []mountSpec{
+			{Type: mountTypeProc, Target: "/proc"},
+			{Type: mountTypeSysfs, Target: "/sys", ReadOnly: true},
+			{Type: mountTypeCgroup, Target: "/sys/fs/cgroup", ReadOnly: true},
+			{Type: mountTypeDev, Target: "/dev"},
+			{Type: mountTypeDevpts, Target: "/dev/pts"},
+			shmMount(shmSize),
+		}
+	default:
+		return nil, fmt.Errorf("--mounts-default %q: must be %s, %s or %s", level, mountsNone, mountsMinimal, mountsFull)
+	}
+	var kept []mountSpec
+	for _, m := range mounts {
+		if !hasMountAt(userMounts, m.Target) {
+			kept = append(kept, m)
+		}
+	}
+	return kept, nil
+}
+
+// kernelMount mounts a filesystem of type fstype at m.Target in rootfs.
+func kernelMount(rootfs string, m mountSpec, fstype string, flags uintptr, data string) error {
+	target, err := resolveInRoot(rootfs, m.Target)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(target, 0o755); err != nil {
+		return err
+	}
+	if m.ReadOnly {
+		flags |= syscall.MS_RDONLY
+	}
+	return syscall.Mount(fstype, target, fstype, flags, data)
+}
+
+// devMount mounts a tmpfs at m.Target in rootfs and fills it with the
+// standard device nodes and symlinks.
+func devMount(rootfs string, m mountSpec) error {
+	err := kernelMount(rootfs, m, "tmpfs", syscall.MS_NOSUID|syscall.MS_STRICTATIME, "mode=755,size=65536k")
+	if err != nil {
+		return err
+	}
+	target, err := resolveInRoot(rootfs, m.Target)
+	if err != nil {
+		return err
+	}
+	for _, name := range standardDevices {
+		host := filepath.Join("/dev", name)
+		if _, err := os.Stat(host); err != nil {
+			continue
+		}
+		node := filepath.Join(target, name)
+		if err := createMountPoint(node, false); err != nil {
+			return err
+		}
+		if err := syscall.Mount(host, node, "", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("%s: %w", host, err)
+		}
+	}
+	for name, dest := range standardDevLinks {
+		if err := os.Symlink(dest, filepath.Join(target, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDefaultMounts(t *testing.T) {
+	tests := []struct {
+		level      string
+		userMounts []mountSpec
+		want       string
+		wantErr    bool
+	}{
+		{level: mountsNone, want: ""},
+		{level: mountsMinimal, want: "proc /proc"},
+		{level: mountsFull, want: "proc /proc, sysfs /sys ro, cgroup2 /sys/fs/cgroup ro, dev /dev, devpts /dev/pts, tmpfs /dev/shm"},
+		// What the user mounts replaces ours.
+		{level: mountsFull, userMounts: []mountSpec{{Type: mountTypeBind, Source: "/tmp", Target: "/dev/shm"}}, want: "proc /proc, sysfs /sys ro, cgroup2 /sys/fs/cgroup ro, dev /dev, devpts /dev/pts"},
+		{level: mountsMinimal, userMounts: []mountSpec{{Type: mountTypeTmpfs, Target: "/proc/"}}, want: ""},
+		{level: "all", wantErr: true},
+		{level: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		mounts, err := defaultMounts(tt.level, defaultShmSize, tt.userMounts)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("defaultMounts(%q) = %v, want an error", tt.level, mounts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("defaultMounts(%q): %v", tt.level, err)
+		}
+		var got []string
+		for _, m := range mounts {
+			s := m.Type + " " + m.Target
+			if m.ReadOnly {
+				s += " ro"
+			}
+			got = append(got, s)
+		}
+		if strings.Join(got, ", ") != tt.want {
+			t.Errorf("defaultMounts(%q, %v) = %s, want %s", tt.level, tt.userMounts, strings.Join(got, ", "), tt.want)
+		}
+	}
+}
+
+// TestRunMountsDefault checks which of the kernel filesystems a container
+// has mounted at each --mounts-default level.
+func TestRunMountsDefault(t *testing.T) {
+	docker, image := runTestImage(t)
+	// The statfs types of the filesystems, from <linux/magic.h>.
+	const (
+		proc   = "0x9fa0"
+		sysfs  = "0x62656572"
+		tmpfs  = "0x1021994"
+		devpts = "0x1cd1"
+	)
+	paths := []string{"/proc", "/sys", "/dev", "/dev/pts", "/dev/shm"}
+	tests := []struct {
+		flags []string
+		// want are the types of paths' mounts, "-" for none.
+		want    []string
+		wantErr bool
+	}{
+		{flags: nil, want: []string{proc, "-", "-", "-", "-"}},
+		{flags: []string{"--mounts-default=minimal"}, want: []string{proc, "-", "-", "-", "-"}},
+		{flags: []string{"--mounts-default=full"}, want: []string{proc, sysfs, tmpfs, devpts, tmpfs}},
+		{flags: []string{"--mounts-default", "none"}, want: []string{"-", "-", "-", "-", "-"}},
+		{flags: []string{"--mounts-default=none", "--no-mount-namespace", "--no-pid-namespace"}, want: []string{"-", "-", "-", "-", "-"}},
+		{flags: []string{"--mounts-default=full", "--no-mount-namespace"}, wantErr: true},
+		{flags: []string{"--mounts-default=some"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		args := append(append(append([]string{"run", "--rm"}, tt.flags...), image, "/probe", "mounts"), paths...)
+		// Only stdout, as running without a PID namespace is warned about.
+		out, err := docker(args...).Output()
+		if tt.wantErr {
+			if err == nil || strings.Contains(string(out), "/proc ") {
+				t.Errorf("%q: %v, want it refused before running\n%s", tt.flags, err, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v\n%s", tt.flags, err, out)
+			continue
+		}
+		var want strings.Builder
+		for i, path := range paths {
+			fmt.Fprintln(&want, path, tt.want[i])
+		}
+		if string(out) != want.String() {
+			t.Errorf("%q: the container has\n%s\nwant\n%s", tt.flags, out, want.String())
+		}
+	}
+}
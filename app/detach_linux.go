@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// detachedEnv marks the background run started by run --detach, which goes
+// on to supervise the container after the foreground run has returned.
+const detachedEnv = "DOCKER_CLONE_DETACHED"
+
+// readyFD is the file descriptor on which a detached run reports that its
+// container started, by writing the container's ID.
+const readyFD = 3
+
+// startDetached runs run with argv again in the background, in a session of
+// its own so that closing the terminal doesn't take the container with it,
+// and waits for the container to start. It then prints the container's ID
+// and exits. Until then the background run shares our stdio, so if it fails
+// its errors are shown and its exit code becomes ours.
+func startDetached(argv []string) {
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	args := append(append(globalSettings.options(), "run"), argv...)
+	cmd := exec.Command(exe, args...)
+	cmd.Env = append(os.Environ(), detachedEnv+"=1")
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	w.Close()
+	id, _ := io.ReadAll(r)
+	if len(id) > 0 {
+		fmt.Println(string(id))
+		cmd.Process.Release()
+		os.Exit(0)
+	}
+	if err := cmd.Wait(); err != nil && cmd.ProcessState != nil {
+		os.Exit(cmd.ProcessState.ExitCode())
+	}
+	os.Exit(1)
+}
+
+// detachedReadyPipe returns the pipe to report on if this is the background
+// run of run --detach, or nil.
+func detachedReadyPipe() *os.File {
+	if os.Getenv(detachedEnv) == "" {
+		return nil
+	}
+	// Neither the container nor anything else we start should see these.
+	os.Unsetenv(detachedEnv)
+	syscall.CloseOnExec(readyFD)
+	return os.NewFile(readyFD, "ready")
+}
+
+// reportDetached tells the foreground run that the container started, which
+// makes it return, and stops using its stdio: the container's output goes to
+// its logs, and nothing we print later has anyone to read it.
+func reportDetached(ready *os.File, id string) error {
+	_, err := io.WriteString(ready, id)
+	ready.Close()
+	devNull, openErr := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if openErr != nil {
+		return openErr
+	}
+	defer devNull.Close()
+	for _, fd := range []int{1, 2} {
+		if dupErr := syscall.Dup3(int(devNull.Fd()), fd, 0); err == nil {
+			err = dupErr
+		}
+	}
+	return err
+}
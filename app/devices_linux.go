@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// deviceSpec is a host device node to recreate inside the container.
+type deviceSpec struct {
+	HostPath string `json:"host_path"`
+	Path     string `json:"path"`
+	// Mode is the full st_mode of the host node, including its type bits.
+	Mode        uint32 `json:"mode"`
+	Rdev        uint64 `json:"rdev"`
+	Uid         uint32 `json:"uid"`
+	Gid         uint32 `json:"gid"`
+	Permissions string `json:"permissions"`
+}
+
+// parseDeviceFlag parses `--device host[:container][:rwm]` the way Docker
+// does and checks that the host path is a character or block device.
+func parseDeviceFlag(value string) (deviceSpec, error) {
+	parts := strings.Split(value, ":")
+	d := deviceSpec{HostPath: parts[0], Permissions: "rwm"}
+	switch len(parts) {
+	case 1:
+		d.Path = d.HostPath
+	case 2:
+		if validDevicePermissions(parts[1]) {
+			d.Path, d.Permissions = d.HostPath, parts[1]
+		} else {
+			d.Path = parts[1]
+		}
+	case 3:
+		d.Path, d.Permissions = parts[1], parts[2]
+	default:
+		return d, fmt.Errorf("invalid device %q: expected host[:container][:permissions]", value)
+	}
+	if !validDevicePermissions(d.Permissions) {
+		return d, fmt.Errorf("invalid device %q: permissions must be a combination of r, w and m", value)
+	}
+	// Nothing restricts access to a device node but its mode, so a device
+	// asked for as :r would be writable all the same.
+	if !strings.ContainsRune(d.Permissions, 'r') || !strings.ContainsRune(d.Permissions, 'w') || !strings.ContainsRune(d.Permissions, 'm') {
+		return d, fmt.Errorf("device %q: permissions %q can't be enforced, as containers get no device access rules; only rwm is supported", value, d.Permissions)
+	}
+	if !filepath.IsAbs(d.HostPath) || !filepath.IsAbs(d.Path) {
+		return d, fmt.Errorf("invalid device %q: paths must be absolute", value)
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(d.HostPath, &st); err != nil {
+		return d, fmt.Errorf("device %s: %w", d.HostPath, err)
+	}
+	if format := st.Mode & syscall.S_IFMT; format != syscall.S_IFCHR && format != syscall.S_IFBLK {
+		return d, fmt.Errorf("device %s is not a character or block device", d.HostPath)
+	}
+	d.Mode, d.Rdev, d.Uid, d.Gid = st.Mode, st.Rdev, st.Uid, st.Gid
+	return d, nil
+}
+
+func validDevicePermissions(perms string) bool {
+	if perms == "" {
+		return false
+	}
+	for _, c := range perms {
+		if !strings.ContainsRune("rwm", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// createDevices recreates the requested device nodes inside rootfs, with the
+// host node's type, number, mode and ownership.
+func createDevices(rootfs string, devices []deviceSpec) error {
+	for _, d := range devices {
+		target, err := resolveInRoot(rootfs, d.Path)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+		if err := syscall.Mknod(target, d.Mode, int(d.Rdev)); err != nil {
+			return fmt.Errorf("creating device %s: %w", d.Path, err)
+		}
+		if err := os.Chown(target, int(d.Uid), int(d.Gid)); err != nil {
+			return err
+		}
+		// Mknod is subject to the umask; restore the host node's exact mode.
+		if err := syscall.Chmod(target, d.Mode&07777); err != nil {
+			return err
+		}
+	}
+	return nil
+}
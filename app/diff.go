@@ -0,0 +1,112 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// writeRootfsDiff writes the changes that turn the tree at base into the tree
+// at root to w, as a layer tarball: entries that are new or changed in root
+// are written out, and entries missing from root become whiteouts. Paths for
+// which skip returns true are left out of the comparison altogether.
+//
+// Like Docker's naive differ, a file counts as changed when its metadata
+// does; contents aren't compared, so a rewrite that keeps the size and the
+// modification time goes unnoticed.
+func writeRootfsDiff(base, root string, w io.Writer, skip func(rel string) bool) error {
+	t := newRootfsTarWriter(root, w)
+	// Deletions first: a whiteout only hides lower layers' entries, so it
+	// can't take anything written by this layer with it.
+	err := filepath.Walk(base, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(base, path)
+		if err != nil || rel == "." || skip(rel) {
+			return err
+		}
+		current, err := os.Lstat(filepath.Join(root, rel))
+		switch {
+		case err != nil:
+			// Whatever was below a deleted directory goes with it.
+			if err := t.whiteout(rel); err != nil {
+				return err
+			}
+		case current.IsDir() == info.IsDir():
+			return nil
+		}
+		// An entry replaced by one of another type is written out in the
+		// second walk, replacing the lower one along with its contents.
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if skip(rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		changed, err := entryChanged(filepath.Join(base, rel), path, info)
+		if err != nil || !changed {
+			return err
+		}
+		return t.add(path, info)
+	})
+	if err != nil {
+		return err
+	}
+	return t.close()
+}
+
+// entryChanged reports whether the entry at path, described by info, differs
+// from the one at basePath, or is new.
+func entryChanged(basePath, path string, info os.FileInfo) (bool, error) {
+	baseInfo, err := os.Lstat(basePath)
+	if err != nil {
+		return true, nil
+	}
+	hdr, err := entryHeader(path, info)
+	if err != nil {
+		return false, err
+	}
+	baseHdr, err := entryHeader(basePath, baseInfo)
+	if err != nil {
+		return false, err
+	}
+	return hdr.Typeflag != baseHdr.Typeflag ||
+		hdr.Mode != baseHdr.Mode ||
+		hdr.Uid != baseHdr.Uid ||
+		hdr.Gid != baseHdr.Gid ||
+		hdr.Size != baseHdr.Size ||
+		!hdr.ModTime.Equal(baseHdr.ModTime) ||
+		hdr.Linkname != baseHdr.Linkname ||
+		hdr.Devmajor != baseHdr.Devmajor ||
+		hdr.Devminor != baseHdr.Devminor, nil
+}
+
+// entryHeader describes the entry at path the way it would be archived.
+func entryHeader(path string, info os.FileInfo) (*tar.Header, error) {
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return nil, err
+		}
+	}
+	return tar.FileInfoHeader(info, link)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"os"
+	"strings"
+)
+
+// digestMismatchError reports content that doesn't hash to the digest it was
+// requested or referenced by, i.e. corrupted or tampered content.
+type digestMismatchError struct {
+	What     string
+	Expected string
+	Actual   string
+}
+
+func (e *digestMismatchError) Error() string {
+	return fmt.Sprintf("%s digest mismatch: expected %s, got %s", e.What, e.Expected, e.Actual)
+}
+
+// verifyDigest checks that data hashes to digest. what names the content in
+// the error, e.g. "image config".
+func verifyDigest(what string, data []byte, digest string) error {
+	d, err := newDigester(what, digest)
+	if err != nil {
+		return err
+	}
+	d.Write(data)
+	return d.verify()
+}
+
+// digestHashes are the digest algorithms content can be verified with.
+var digestHashes = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// digester verifies streamed content: it hashes everything written to it,
+// and verify then compares the result with the expected digest.
+type digester struct {
+	what      string
+	digest    string
+	algorithm string
+	hash      hash.Hash
+}
+
+func newDigester(what, digest string) (*digester, error) {
+	algorithm, _, ok := strings.Cut(digest, ":")
+	newHash, known := digestHashes[algorithm]
+	if !ok || !known {
+		return nil, fmt.Errorf("%s: unsupported digest algorithm in %q", what, digest)
+	}
+	return &digester{what: what, digest: digest, algorithm: algorithm, hash: newHash()}, nil
+}
+
+func (d *digester) Write(p []byte) (int, error) {
+	return d.hash.Write(p)
+}
+
+// sum returns the digest of what has been written so far.
+func (d *digester) sum() string {
+	return d.algorithm + ":" + hex.EncodeToString(d.hash.Sum(nil))
+}
+
+func (d *digester) verify() error {
+	if actual := d.sum(); actual != d.digest {
+		return &digestMismatchError{What: d.what, Expected: d.digest, Actual: actual}
+	}
+	return nil
+}
+
+// verifyFile checks that the file at path hashes to digest, using buf as the
+// copy buffer.
+func verifyFile(what, path, digest string, buf []byte) error {
+	d, err := newDigester(what, digest)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := copyBuffer(d, f, buf); err != nil {
+		return err
+	}
+	return d.verify()
+}
+
+// sha256Digest returns the digest content is addressed by.
+func sha256Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
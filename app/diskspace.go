@@ -0,0 +1,8 @@
+package main
+
+// freeSpace returns how many bytes an unprivileged user can still write to
+// the filesystem of dir, and whether it could tell. Platforms that can tell
+// replace this in init.
+var freeSpace = func(dir string) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,17 @@
+//go:build linux || darwin
+
+package main
+
+import "syscall"
+
+func init() {
+	freeSpace = statfsFreeSpace
+}
+
+func statfsFreeSpace(dir string) (int64, bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, false
+	}
+	return int64(st.Bavail) * int64(st.Bsize), true
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// hostResolvConf is the host's resolver configuration. Containers share the
+// host's network, so its nameservers work from inside them too, which those
+// of the image's own resolv.conf, if it has one, usually don't.
+const hostResolvConf = "/etc/resolv.conf"
+
+// validateDNSServers checks that each --dns value is an IP address.
+func validateDNSServers(servers []string) error {
+	for _, server := range servers {
+		if net.ParseIP(server) == nil {
+			return fmt.Errorf("--dns %q: not an IP address", server)
+		}
+	}
+	return nil
+}
+
+// resolvConfMount bind mounts the resolv.conf at source read-only over the
+// container's.
+func resolvConfMount(source string) mountSpec {
+	return mountSpec{Type: mountTypeBind, Source: source, Target: "/etc/resolv.conf", ReadOnly: true}
+}
+
+// resolvConfSuffix names the resolv.conf written next to a rootfs for --dns,
+// which is mounted over the container's like the host's would be. Keeping it
+// out of the rootfs keeps it out of images committed from the container.
+const resolvConfSuffix = ".resolv.conf"
+
+// resolvConf returns a resolv.conf naming servers as its nameservers. The
+// host's search and options lines are kept, as Docker does, so that short
+// names resolve the same way.
+func resolvConf(servers []string) ([]byte, error) {
+	host, err := os.ReadFile(hostResolvConf)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var b bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(host))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if fields := strings.Fields(line); len(fields) > 0 && (fields[0] == "search" || fields[0] == "options") {
+			fmt.Fprintln(&b, line)
+		}
+	}
+	for _, server := range servers {
+		fmt.Fprintf(&b, "nameserver %s\n", server)
+	}
+	return b.Bytes(), nil
+}
+
+// copyResolvConf writes the resolv.conf at source into rootfs's
+// /etc/resolv.conf, for containers without a mount namespace to mount it in.
+func copyResolvConf(rootfs, source string) error {
+	data, err := os.ReadFile(source)
+	if err != nil {
+		return err
+	}
+	path, err := resolveInRoot(rootfs, "/etc/resolv.conf")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
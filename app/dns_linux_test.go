@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestRunResolvConf checks the resolver configuration containers sharing
+// the host's network get, and that names resolve with it.
+func TestRunResolvConf(t *testing.T) {
+	docker, image := runTestImage(t, testEntry{name: "etc/resolv.conf", body: "nameserver 192.0.2.53\n"})
+	host, err := os.ReadFile(hostResolvConf)
+	if err != nil {
+		t.Skip("needs the host's resolv.conf")
+	}
+	// A nameserver for the containers to ask, at an address of the host's
+	// network that resolv.conf can name: it has no room for a port.
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:53")
+	if err != nil {
+		t.Skipf("serving names: %v", err)
+	}
+	s := &dnsServer{conn: conn, lookup: func(name string) (net.IP, bool) {
+		return net.IPv4(192, 0, 2, 1), name == "resolver-test.example"
+	}}
+	go s.serve()
+	defer s.Close()
+
+	tests := []struct {
+		name    string
+		flags   []string
+		probe   []string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "host's by default",
+			probe: []string{"cat", "/etc/resolv.conf"},
+			want:  "/etc/resolv.conf: " + string(host) + "\n",
+		},
+		{
+			name:  "resolving with --dns",
+			flags: []string{"--dns", "127.0.0.1"},
+			probe: []string{"resolve", "resolver-test.example"},
+			want:  "resolver-test.example [192.0.2.1]\n",
+		},
+		{
+			name:  "image's with --no-resolv-mount",
+			flags: []string{"--no-resolv-mount"},
+			probe: []string{"cat", "/etc/resolv.conf"},
+			want:  "/etc/resolv.conf: nameserver 192.0.2.53\n\n",
+		},
+		{name: "not an address", flags: []string{"--dns", "ns.example"}, probe: []string{"cat", "/etc/resolv.conf"}, wantErr: true},
+		{name: "--dns without the mount", flags: []string{"--dns", "127.0.0.1", "--no-resolv-mount"}, probe: []string{"cat", "/etc/resolv.conf"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append(append(append([]string{"run", "--rm"}, tt.flags...), image, "/probe"), tt.probe...)
+			out, err := docker(args...).CombinedOutput()
+			if tt.wantErr {
+				if err == nil || strings.Contains(string(out), "/etc/resolv.conf:") {
+					t.Errorf("%v, want it refused before running\n%s", err, out)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("%v\n%s", err, out)
+			}
+			if string(out) != tt.want {
+				t.Errorf("the container has %q, want %q", out, tt.want)
+			}
+		})
+	}
+}
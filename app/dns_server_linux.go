@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Containers on the bridge resolve names through a nameserver at
+// bridgeGateway, which answers for the running containers' names and
+// aliases with their addresses, and passes every other question on to the
+// host's nameservers. Each bridge container's run process serves it, on a
+// socket shared with the others' through SO_REUSEPORT, so it is there as
+// long as any of them runs; they answer alike, from the containers' state.
+
+// dnsPort is where the nameserver listens.
+const dnsPort = 53
+
+// containerDNSTTL is how long, in seconds, answers naming containers may be
+// cached. Short, as containers come and go.
+const containerDNSTTL = 5
+
+// soReusePort is SO_REUSEPORT, which package syscall lacks, as
+// <asm-generic/socket.h> has it: mips, parisc and sparc number it otherwise.
+const soReusePort = 15
+
+// dnsForwardTimeout is how long a host nameserver gets to answer.
+const dnsForwardTimeout = 2 * time.Second
+
+// DNS message values, from RFC 1035.
+const (
+	dnsHeaderLen  = 12
+	dnsTypeA      = 1
+	dnsClassIN    = 1
+	dnsFlagQR     = 1 << 15
+	dnsFlagAA     = 1 << 10
+	dnsFlagRD     = 1 << 8
+	dnsFlagRA     = 1 << 7
+	dnsRcodeMask  = 0xf
+	dnsServFail   = 2
+	dnsNotImpl    = 4
+	dnsOpcodeMask = 0xf << 11
+)
+
+// dnsServer is the nameserver on the bridge.
+type dnsServer struct {
+	conn net.PacketConn
+	// lookup returns the address of the container called name, if any.
+	lookup func(name string) (net.IP, bool)
+	// upstream are the nameservers questions about other names go to.
+	upstream []string
+}
+
+// serveBridgeDNS starts serving the bridge's nameserver, until it is closed.
+func serveBridgeDNS() (*dnsServer, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}}
+	conn, err := lc.ListenPacket(context.Background(), "udp4", net.JoinHostPort(bridgeGateway.String(), strconv.Itoa(dnsPort)))
+	if err != nil {
+		return nil, err
+	}
+	upstream, err := hostNameservers()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s := &dnsServer{conn: conn, lookup: lookupContainerAddress, upstream: upstream}
+	go s.serve()
+	return s, nil
+}
+
+func (s *dnsServer) Close() error {
+	return s.conn.Close()
+}
+
+func (s *dnsServer) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if reply := s.answer(query); reply != nil {
+				s.conn.WriteTo(reply, addr)
+			}
+		}()
+	}
+}
+
+// answer returns the reply to query, nil for one not worth replying to.
+func (s *dnsServer) answer(query []byte) []byte {
+	if len(query) < dnsHeaderLen {
+		return nil
+	}
+	flags := binary.BigEndian.Uint16(query[2:])
+	if flags&dnsFlagQR != 0 {
+		return nil
+	}
+	if flags&dnsOpcodeMask != 0 || binary.BigEndian.Uint16(query[4:]) != 1 {
+		return dnsError(query, dnsNotImpl)
+	}
+	name, qtype, end, err := parseDNSQuestion(query)
+	if err != nil {
+		return nil
+	}
+	if ip, ok := s.lookup(name); ok {
+		return dnsAnswer(query[:end], qtype, ip)
+	}
+	if reply, err := s.forward(query); err == nil {
+		return reply
+	}
+	return dnsError(query, dnsServFail)
+}
+
+// forward asks the host's nameservers, in turn, and returns the first reply.
+func (s *dnsServer) forward(query []byte) ([]byte, error) {
+	err := errors.New("no nameservers")
+	for _, server := range s.upstream {
+		var reply []byte
+		if reply, err = exchangeDNS(server, query); err == nil {
+			return reply, nil
+		}
+	}
+	return nil, err
+}
+
+// exchangeDNS sends query to the nameserver at server and waits for its
+// reply.
+func exchangeDNS(server string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", net.JoinHostPort(server, strconv.Itoa(dnsPort)), dnsForwardTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsForwardTimeout))
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Replies to other queries, late ones to an earlier try, aren't ours.
+		if n >= dnsHeaderLen && bytes.Equal(buf[:2], query[:2]) {
+			return buf[:n], nil
+		}
+	}
+}
+
+// parseDNSQuestion returns the name, in lower case and without the trailing
+// dot, and type that the single question of query asks about, and where the
+// question ends.
+func parseDNSQuestion(query []byte) (name string, qtype uint16, end int, err error) {
+	var labels []string
+	i := dnsHeaderLen
+	for {
+		if i >= len(query) {
+			return "", 0, 0, errors.New("truncated question")
+		}
+		n := int(query[i])
+		i++
+		if n == 0 {
+			break
+		}
+		// Questions come first, so there is nothing earlier to point at.
+		if n&0xc0 != 0 || i+n > len(query) {
+			return "", 0, 0, errors.New("malformed question name")
+		}
+		labels = append(labels, string(query[i:i+n]))
+		i += n
+	}
+	if i+4 > len(query) {
+		return "", 0, 0, errors.New("truncated question")
+	}
+	qtype = binary.BigEndian.Uint16(query[i:])
+	return strings.ToLower(strings.Join(labels, ".")), qtype, i + 4, nil
+}
+
+// dnsReply returns the header and question of a reply to question, a query
+// up to the end of its first question or its header, with rcode and ancount
+// answers to follow.
+func dnsReply(question []byte, rcode, ancount uint16) []byte {
+	reply := append([]byte(nil), question...)
+	qdcount := uint16(0)
+	if len(question) > dnsHeaderLen {
+		qdcount = 1
+	}
+	binary.BigEndian.PutUint16(reply[4:], qdcount)
+	flags := binary.BigEndian.Uint16(question[2:])
+	flags = dnsFlagQR | flags&(dnsOpcodeMask|dnsFlagRD) | dnsFlagRA | rcode&dnsRcodeMask
+	binary.BigEndian.PutUint16(reply[2:], flags)
+	binary.BigEndian.PutUint16(reply[6:], ancount)
+	binary.BigEndian.PutUint16(reply[8:], 0)
+	binary.BigEndian.PutUint16(reply[10:], 0)
+	return reply
+}
+
+// dnsError returns a reply to query with rcode and no answers. The question
+// goes back with it if it can be read.
+func dnsError(query []byte, rcode uint16) []byte {
+	if _, _, end, err := parseDNSQuestion(query); err == nil {
+		return dnsReply(query[:end], rcode, 0)
+	}
+	return dnsReply(query[:dnsHeaderLen], rcode, 0)
+}
+
+// dnsAnswer returns the reply to question, about a container at ip: its
+// address if qtype asks for one, else no records but no error either, since
+// the name exists.
+func dnsAnswer(question []byte, qtype uint16, ip net.IP) []byte {
+	if qtype != dnsTypeA {
+		return dnsReply(question, 0, 0)
+	}
+	reply := dnsReply(question, 0, 1)
+	flags := binary.BigEndian.Uint16(reply[2:])
+	binary.BigEndian.PutUint16(reply[2:], flags|dnsFlagAA)
+	// The answer names the question's name by pointing at it.
+	reply = append(reply, 0xc0, dnsHeaderLen)
+	reply = binary.BigEndian.AppendUint16(reply, dnsTypeA)
+	reply = binary.BigEndian.AppendUint16(reply, dnsClassIN)
+	reply = binary.BigEndian.AppendUint32(reply, containerDNSTTL)
+	reply = binary.BigEndian.AppendUint16(reply, net.IPv4len)
+	return append(reply, ip.To4()...)
+}
+
+// lookupContainerAddress finds the running container called name, by name
+// or network alias, and returns where containers on the bridge reach it:
+// at its address on the bridge, or at the host's there if it shares the
+// host's network.
+func lookupContainerAddress(name string) (net.IP, bool) {
+	running, err := listContainers()
+	if err != nil {
+		return nil, false
+	}
+	for _, state := range running {
+		for _, n := range state.hostNames() {
+			if strings.EqualFold(n, name) {
+				return net.ParseIP(state.peerAddress(true)), true
+			}
+		}
+	}
+	return nil, false
+}
+
+// hostNameservers returns the nameservers of the host's resolv.conf.
+// Questions are passed on from the host's network, so those on its
+// loopback, such as a local caching resolver, work too.
+func hostNameservers() ([]string, error) {
+	data, err := os.ReadFile(hostResolvConf)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var servers []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers, nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// dockerArchivePrefix marks an image reference as a `docker save` tarball.
+const dockerArchivePrefix = "docker-archive:"
+
+// parseDockerArchiveRef splits "docker-archive:/path/image.tar[:tag]" into
+// the tarball's path and the tag, which may be empty, or a whole
+// repository:tag as listed in the tarball. The path ends at the first colon
+// that leaves a file behind it.
+func parseDockerArchiveRef(image string) (file, tag string) {
+	file = strings.TrimPrefix(image, dockerArchivePrefix)
+	if _, err := os.Stat(file); err == nil {
+		return file, ""
+	}
+	for i := 0; i < len(file); i++ {
+		if file[i] != ':' {
+			continue
+		}
+		if info, err := os.Stat(file[:i]); err == nil && !info.IsDir() {
+			return file[:i], file[i+1:]
+		}
+	}
+	return file, ""
+}
+
+// dockerArchiveManifest is the manifest.json of a `docker save` tarball,
+// which lists each saved image's config and layer tarballs by file name.
+type dockerArchiveManifest []struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// archiveMember locates a file's content within a tarball.
+type archiveMember struct {
+	offset, size int64
+	// link is the target of a symlink, which `docker save` uses for layers
+	// several images share.
+	link string
+}
+
+// dockerArchiveSource pulls from a `docker save` tarball, which must not be
+// compressed so that its files can be read in place. Manifest turns an entry
+// of its manifest.json into an OCI image manifest.
+type dockerArchiveSource struct {
+	path     string
+	members  map[string]archiveMember
+	manifest dockerArchiveManifest
+	// blobs maps the digests Manifest handed out to the files they are in.
+	blobs map[string]string
+}
+
+// openDockerArchive indexes the files of the tarball at file and reads its
+// manifest.json.
+func openDockerArchive(file string) (*dockerArchiveSource, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if magic, _ := bufio.NewReader(f).Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return nil, fmt.Errorf("%s is compressed; decompress it first", file)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	s := &dockerArchiveSource{path: file, members: map[string]archiveMember{}, blobs: map[string]string{}}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", file, err)
+		}
+		name := archiveMemberName(hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			// tar.Reader reads headers without buffering, so the file is
+			// positioned at the content.
+			offset, err := f.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+			s.members[name] = archiveMember{offset: offset, size: hdr.Size}
+		case tar.TypeSymlink:
+			s.members[name] = archiveMember{link: archiveMemberName(path.Join(path.Dir(name), hdr.Linkname))}
+		}
+	}
+	data, err := s.readMember("manifest.json")
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a docker save archive: %w", file, err)
+	}
+	if err := json.Unmarshal(data, &s.manifest); err != nil {
+		return nil, fmt.Errorf("parsing manifest.json: %w", err)
+	}
+	return s, nil
+}
+
+func archiveMemberName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// member looks up the file name, following symlinks within the archive.
+func (s *dockerArchiveSource) member(name string) (archiveMember, error) {
+	for i := 0; i < 8; i++ {
+		m, ok := s.members[name]
+		if !ok {
+			return m, fmt.Errorf("%s not found in archive", name)
+		}
+		if m.link == "" {
+			return m, nil
+		}
+		name = m.link
+	}
+	return archiveMember{}, fmt.Errorf("%s: too many levels of symbolic links", name)
+}
+
+func (s *dockerArchiveSource) openMember(name string) (io.ReadCloser, int64, error) {
+	m, err := s.member(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, 0, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(f, m.offset, m.size), f}, m.size, nil
+}
+
+func (s *dockerArchiveSource) readMember(name string) ([]byte, error) {
+	r, _, err := s.openMember(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// Manifest returns a manifest for the saved image tagged ref, which may be
+// empty if the archive holds a single image. Layers saved under
+// blobs/<algorithm>/<hex> are named by that digest; older archives save
+// each layer uncompressed as <id>/layer.tar, whose digest is then the
+// layer's diff ID from the config.
+func (s *dockerArchiveSource) Manifest(ref string) ([]byte, string, error) {
+	entry := -1
+	for i, image := range s.manifest {
+		for _, tag := range image.RepoTags {
+			if tag == ref || strings.HasSuffix(tag, ":"+ref) {
+				if entry >= 0 && entry != i {
+					return nil, "", fmt.Errorf("tag %q names several images in the archive", ref)
+				}
+				entry = i
+			}
+		}
+	}
+	if ref == "" && len(s.manifest) == 1 {
+		entry = 0
+	}
+	if entry < 0 {
+		if ref == "" {
+			return nil, "", fmt.Errorf("the archive holds %d images; name one by tag", len(s.manifest))
+		}
+		return nil, "", fmt.Errorf("tag %q not found in archive", ref)
+	}
+	image := s.manifest[entry]
+
+	config, err := s.readMember(image.Config)
+	if err != nil {
+		return nil, "", err
+	}
+	var rootfs struct {
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	if err := json.Unmarshal(config, &rootfs); err != nil {
+		return nil, "", fmt.Errorf("parsing image config: %w", err)
+	}
+	if len(rootfs.RootFS.DiffIDs) != len(image.Layers) {
+		return nil, "", fmt.Errorf("image config lists %d layers, manifest.json %d", len(rootfs.RootFS.DiffIDs), len(image.Layers))
+	}
+	manifest := DockerManifestResponse{
+		SchemaVersion: 2,
+		Config:        DockerLayer{MediaType: ociImageConfigMediaType, Digest: sha256Digest(config), Size: int64(len(config))},
+	}
+	s.blobs[manifest.Config.Digest] = image.Config
+	for i, name := range image.Layers {
+		m, err := s.member(name)
+		if err != nil {
+			return nil, "", err
+		}
+		layer := DockerLayer{Digest: rootfs.RootFS.DiffIDs[i], Size: m.size}
+		if blob := strings.TrimPrefix(name, "blobs/"); blob != name {
+			// Content-addressed blobs may be compressed, which the
+			// extractor detects.
+			layer.Digest = strings.Replace(blob, "/", ":", 1)
+		} else {
+			layer.MediaType = "application/vnd.oci.image.layer.v1.tar"
+		}
+		s.blobs[layer.Digest] = name
+		manifest.Layers = append(manifest.Layers, layer)
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, ociManifestMediaType, nil
+}
+
+// Blob opens a blob of an image Manifest returned.
+func (s *dockerArchiveSource) Blob(digest string) (io.ReadCloser, error) {
+	name, ok := s.blobs[digest]
+	if !ok {
+		return nil, fmt.Errorf("blob %s not found in archive", digest)
+	}
+	r, _, err := s.openMember(name)
+	return r, err
+}
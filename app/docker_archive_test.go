@@ -0,0 +1,217 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// savedImage is an image of a test `docker save` archive, of layers,
+// uncompressed tars.
+type savedImage struct {
+	tags   []string
+	layers [][]byte
+}
+
+// writeDockerArchive writes a `docker save` archive of images to file. A
+// legacy archive saves each layer as <id>/layer.tar, repeating a layer
+// shared with an earlier image as a symlink to its first copy, as Docker
+// before 25 did; a newer one saves every file once, as blobs/sha256/<hex>.
+func writeDockerArchive(t *testing.T, file string, legacy bool, images ...savedImage) {
+	t.Helper()
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	write := func(hdr *tar.Header, data []byte) {
+		t.Helper()
+		hdr.Size = int64(len(data))
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// saved maps the digests of the files written to their names.
+	saved := map[string]string{}
+	save := func(name string, data []byte) string {
+		t.Helper()
+		digest := sha256Digest(data)
+		if first, ok := saved[digest]; ok {
+			if !legacy {
+				return first
+			}
+			write(&tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: "../" + first, Mode: 0o777}, nil)
+			return name
+		}
+		write(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644}, data)
+		saved[digest] = name
+		return name
+	}
+	blobName := func(data []byte) string {
+		return "blobs/sha256/" + strings.TrimPrefix(sha256Digest(data), "sha256:")
+	}
+
+	var manifest dockerArchiveManifest
+	for i, image := range images {
+		var diffIDs, layers []string
+		for j, layer := range image.layers {
+			diffIDs = append(diffIDs, sha256Digest(layer))
+			name := blobName(layer)
+			if legacy {
+				name = filepath.Join(strings.Repeat("0", 62)+string(rune('a'+i))+string(rune('a'+j)), "layer.tar")
+			}
+			layers = append(layers, save(name, layer))
+		}
+		config, err := json.Marshal(map[string]interface{}{
+			"architecture": runtime.GOARCH,
+			"os":           "linux",
+			"config":       map[string]interface{}{"Env": []string{"PATH=/bin:/usr/bin"}},
+			"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := blobName(config)
+		if legacy {
+			name = strings.TrimPrefix(sha256Digest(config), "sha256:") + ".json"
+		}
+		manifest = append(manifest, struct {
+			Config   string   `json:"Config"`
+			RepoTags []string `json:"RepoTags"`
+			Layers   []string `json:"Layers"`
+		}{Config: save(name, config), RepoTags: image.tags, Layers: layers})
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(&tar.Header{Name: "manifest.json", Typeflag: tar.TypeReg, Mode: 0o644}, data)
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, b.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPullFromDockerArchive(t *testing.T) {
+	base := testLayer(t, testEntry{name: "etc/", typeflag: tar.TypeDir}, testEntry{name: "etc/os-release", body: "ID=test\n"})
+	images := []savedImage{
+		{tags: []string{"app:a", "registry.example.com/app:latest"}, layers: [][]byte{base, testLayer(t, testEntry{name: "f", body: "a"})}},
+		// Shares its first layer with app:a.
+		{tags: []string{"app:b"}, layers: [][]byte{base, testLayer(t, testEntry{name: "f", body: "b"})}},
+	}
+	tests := []struct {
+		ref     string
+		want    map[string]string
+		wantErr string
+	}{
+		{ref: "app:a", want: map[string]string{"etc/os-release": "ID=test\n", "f": "a"}},
+		{ref: "b", want: map[string]string{"etc/os-release": "ID=test\n", "f": "b"}},
+		{ref: "registry.example.com/app:latest", want: map[string]string{"f": "a"}},
+		{ref: "latest", want: map[string]string{"f": "a"}},
+		{ref: "", wantErr: "holds 2 images"},
+		{ref: "c", wantErr: `tag "c" not found`},
+	}
+	for _, legacy := range []bool{true, false} {
+		archive := filepath.Join(t.TempDir(), "image.tar")
+		writeDockerArchive(t, archive, legacy, images...)
+		for _, tt := range tests {
+			name := "blobs/" + tt.ref
+			if legacy {
+				name = "legacy/" + tt.ref
+			}
+			t.Run(name, func(t *testing.T) {
+				src, err := openDockerArchive(archive)
+				if err != nil {
+					t.Fatal(err)
+				}
+				dir := filepath.Join(t.TempDir(), "rootfs")
+				if err := os.Mkdir(dir, 0o755); err != nil {
+					t.Fatal(err)
+				}
+				meta, err := pullFromSource(dir, src, tt.ref, pullOptions{})
+				if tt.wantErr != "" {
+					if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+						t.Fatalf("pull: %v, want an error containing %q", err, tt.wantErr)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(meta.Config.Config.Env) != 1 || meta.Config.Config.Env[0] != "PATH=/bin:/usr/bin" {
+					t.Errorf("config Env %q, want the image's", meta.Config.Config.Env)
+				}
+				wantTree(t, dir, tt.want)
+			})
+		}
+	}
+
+	// An archive of a single image needs no tag.
+	archive := filepath.Join(t.TempDir(), "single.tar")
+	writeDockerArchive(t, archive, false, images[1])
+	dir := t.TempDir()
+	if _, err := pullDockerImage(dir, dockerArchivePrefix+archive, pullOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	wantTree(t, dir, map[string]string{"f": "b"})
+}
+
+func TestOpenDockerArchiveErrors(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"compressed.tar.gz": gzipLayer(t, testLayer(t, testEntry{name: "manifest.json", body: "[]"})),
+		"not-saved.tar":     testLayer(t, testEntry{name: "f", body: "f"}),
+		"bad-manifest.tar":  testLayer(t, testEntry{name: "manifest.json", body: "{"}),
+	}
+	want := map[string]string{
+		"compressed.tar.gz": "is compressed",
+		"not-saved.tar":     "is not a docker save archive",
+		"bad-manifest.tar":  "parsing manifest.json",
+		"missing.tar":       "no such file",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, wantErr := range want {
+		if _, err := openDockerArchive(filepath.Join(dir, name)); err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("%s: %v, want an error containing %q", name, err, wantErr)
+		}
+	}
+}
+
+func TestParseDockerArchiveRef(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "image.tar")
+	if err := os.WriteFile(archive, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// A file whose name has a colon in it.
+	colon := filepath.Join(dir, "app:v1.tar")
+	if err := os.WriteFile(colon, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		image, file, tag string
+	}{
+		{image: "docker-archive:" + archive, file: archive},
+		{image: "docker-archive:" + archive + ":v1", file: archive, tag: "v1"},
+		{image: "docker-archive:" + archive + ":app:v1", file: archive, tag: "app:v1"},
+		{image: "docker-archive:" + colon, file: colon},
+		{image: "docker-archive:" + colon + ":v2", file: colon, tag: "v2"},
+		{image: "docker-archive:" + dir + "/missing.tar:v1", file: dir + "/missing.tar:v1"},
+	}
+	for _, tt := range tests {
+		if file, tag := parseDockerArchiveRef(tt.image); file != tt.file || tag != tt.tag {
+			t.Errorf("parseDockerArchiveRef(%q) = %q, %q, want %q, %q", tt.image, file, tag, tt.file, tt.tag)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// defaultPath is the PATH of containers whose image sets none, as in Docker.
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// parseUserEnv builds the user-supplied environment from --env-file files
+// and -e flags, in that order, so that a -e comes after, and so overrides,
+// the same variable from a file. As in Docker, a bare KEY is passed through
+// from our own environment, and left out if we don't have it.
+func parseUserEnv(vars, files []string) ([]string, error) {
+	var env []string
+	for _, path := range files {
+		fileEnv, err := readEnvFile(path)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, fileEnv...)
+	}
+	for _, v := range vars {
+		v, ok, err := expandEnvVar(v)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			env = append(env, v)
+		}
+	}
+	return env, nil
+}
+
+// readEnvFile reads KEY=value and KEY lines. Blank lines and lines starting
+// with # are ignored. Values are taken as they are, quotes included.
+func readEnvFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var env []string
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimLeft(scanner.Text(), " \t")
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		v, ok, err := expandEnvVar(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if ok {
+			env = append(env, v)
+		}
+	}
+	return env, scanner.Err()
+}
+
+// expandEnvVar turns a bare KEY into KEY=value with our own value for it. ok
+// is false if we don't have one.
+func expandEnvVar(v string) (string, bool, error) {
+	key, _, hasValue := strings.Cut(v, "=")
+	if key == "" || strings.ContainsAny(key, " \t") {
+		return "", false, fmt.Errorf("invalid environment variable %q", v)
+	}
+	if hasValue {
+		return v, true, nil
+	}
+	value, ok := os.LookupEnv(key)
+	return key + "=" + value, ok, nil
+}
+
+// mergeEnv combines the image config's Env with the user's, later values
+// for a variable replacing earlier ones, the user's last. Each variable
+// keeps the place it first appeared at, so the result only depends on the
+// inputs. A PATH is added if neither sets one.
+func mergeEnv(imageEnv, userEnv []string) []string {
+	var merged []string
+	index := map[string]int{}
+	for _, v := range append(append([]string(nil), imageEnv...), userEnv...) {
+		key, _, _ := strings.Cut(v, "=")
+		if i, ok := index[key]; ok {
+			merged[i] = v
+			continue
+		}
+		index[key] = len(merged)
+		merged = append(merged, v)
+	}
+	if _, ok := index["PATH"]; !ok {
+		merged = append(merged, "PATH="+defaultPath)
+	}
+	return merged
+}
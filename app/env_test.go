@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMergeEnv(t *testing.T) {
+	tests := []struct {
+		name     string
+		imageEnv []string
+		userEnv  []string
+		want     []string
+	}{
+		{
+			name:     "user's override the image's in place",
+			imageEnv: []string{"PATH=/bin", "A=image", "B=image"},
+			userEnv:  []string{"B=user", "C=user", "A=user"},
+			want:     []string{"PATH=/bin", "A=user", "B=user", "C=user"},
+		},
+		{
+			name:    "the last of the user's wins",
+			userEnv: []string{"A=file", "A=flag"},
+			want:    []string{"A=flag", "PATH=" + defaultPath},
+		},
+		{
+			name:     "duplicates in the image",
+			imageEnv: []string{"A=1", "PATH=/bin", "A=2"},
+			want:     []string{"A=2", "PATH=/bin"},
+		},
+		{
+			name:     "empty values are values",
+			imageEnv: []string{"PATH=/bin", "A=image"},
+			userEnv:  []string{"A="},
+			want:     []string{"PATH=/bin", "A="},
+		},
+		{
+			name:    "user's PATH",
+			userEnv: []string{"PATH=/opt/bin"},
+			want:    []string{"PATH=/opt/bin"},
+		},
+		{name: "none", want: []string{"PATH=" + defaultPath}},
+	}
+	for _, tt := range tests {
+		if got := mergeEnv(tt.imageEnv, tt.userEnv); strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: mergeEnv(%q, %q) = %q, want %q", tt.name, tt.imageEnv, tt.userEnv, got, tt.want)
+		}
+	}
+}
+
+func TestParseUserEnv(t *testing.T) {
+	t.Setenv("FROM_HOST", "host")
+	// Restored after the test by Setenv.
+	t.Setenv("NOT_ON_HOST", "")
+	os.Unsetenv("NOT_ON_HOST")
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.env":   "# comment\n\nA=file a\nB=\"quoted\"\n  FROM_HOST\nNOT_ON_HOST\n",
+		"b.env":   "A=file b\nC=file b\n",
+		"bad.env": "A=1\nNOT VALID\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file := func(name string) string { return filepath.Join(dir, name) }
+	tests := []struct {
+		name    string
+		vars    []string
+		files   []string
+		want    string
+		wantErr string
+	}{
+		{name: "flags", vars: []string{"A=1", "B=", "C=x=y"}, want: "A=1 B= C=x=y"},
+		{name: "passthrough", vars: []string{"FROM_HOST", "NOT_ON_HOST"}, want: "FROM_HOST=host"},
+		{name: "file", files: []string{file("a.env")}, want: `A=file a B="quoted" FROM_HOST=host`},
+		{name: "later files", files: []string{file("a.env"), file("b.env")}, want: `A=file a B="quoted" FROM_HOST=host A=file b C=file b`},
+		{name: "flags after files", vars: []string{"A=flag"}, files: []string{file("b.env")}, want: "A=file b C=file b A=flag"},
+		{name: "bad line", files: []string{file("bad.env")}, wantErr: "bad.env:2: invalid environment variable"},
+		{name: "bad flag", vars: []string{"=x"}, wantErr: "invalid environment variable"},
+		{name: "missing file", files: []string{file("missing.env")}, wantErr: "no such file"},
+	}
+	for _, tt := range tests {
+		env, err := parseUserEnv(tt.vars, tt.files)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: %v, want an error containing %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := strings.Join(env, " "); got != tt.want {
+			t.Errorf("%s: parseUserEnv = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// Merged, a -e beats a file, which beats the image.
+	env, err := parseUserEnv([]string{"A=flag"}, []string{file("b.env")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "PATH=/bin A=flag C=file b D=image"
+	if got := strings.Join(mergeEnv([]string{"PATH=/bin", "A=image", "C=image", "D=image"}, env), " "); got != want {
+		t.Errorf("merged %q, want %q", got, want)
+	}
+}
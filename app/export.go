@@ -0,0 +1,349 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+type fileInode struct{ dev, ino uint64 }
+
+// hardLinkInode returns the inode of a file that has more than one name.
+// Unix replaces this in init; elsewhere it always fails, so hard links are
+// exported as copies.
+var hardLinkInode = func(info os.FileInfo) (fileInode, bool) {
+	return fileInode{}, false
+}
+
+// rootfsTarWriter writes entries of the filesystem tree at root to a tar
+// archive, preserving ownership, modes, symlinks, hard links and device nodes.
+type rootfsTarWriter struct {
+	root string
+	tw   *tar.Writer
+	// Hard links are recorded by inode so that later names are written as
+	// links to the first one instead of as copies.
+	seen map[fileInode]string
+	// owners, by container path, are the owners files should have had
+	// where root's ownership file says so.
+	owners map[string]ownershipEntry
+}
+
+func newRootfsTarWriter(root string, w io.Writer) *rootfsTarWriter {
+	return &rootfsTarWriter{root: root, tw: tar.NewWriter(w), seen: map[fileInode]string{}}
+}
+
+// add writes the entry at path, described by info, and a regular file's
+// contents.
+func (t *rootfsTarWriter) add(path string, info os.FileInfo) error {
+	rel, err := filepath.Rel(t.root, path)
+	if err != nil || rel == "." {
+		return err
+	}
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = filepath.ToSlash(rel)
+	if e, ok := t.owners["/"+hdr.Name]; ok && e.Device == "" {
+		hdr.Uid, hdr.Gid = e.Uid, e.Gid
+	}
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	// Host user and group names mean nothing inside the image.
+	hdr.Uname, hdr.Gname = "", ""
+	if key, ok := hardLinkInode(info); ok && info.Mode().IsRegular() {
+		if first, ok := t.seen[key]; ok {
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, first, 0
+		} else {
+			t.seen[key] = hdr.Name
+		}
+	}
+	if err := t.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(t.tw, f)
+	return err
+}
+
+// whiteout writes a whiteout for rel, the path of a deleted entry relative
+// to root.
+func (t *rootfsTarWriter) whiteout(rel string) error {
+	dir, name := filepath.Split(filepath.ToSlash(rel))
+	return t.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     dir + whiteoutPrefix + name,
+		Mode:     0o644,
+	})
+}
+
+func (t *rootfsTarWriter) close() error {
+	return t.tw.Close()
+}
+
+// writeRootfsTar writes the filesystem tree at root to w as a tar archive.
+// If root was extracted without root privileges, the ownership and device
+// nodes its ownership file records are put back in the archive.
+func writeRootfsTar(root string, w io.Writer) error {
+	t := newRootfsTarWriter(root, w)
+	owners, devices, err := readOwnership(root)
+	if err != nil {
+		return err
+	}
+	t.owners = owners
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Name() == whiteoutOpaque && !info.IsDir() {
+			return nil
+		}
+		if err := t.add(path, info); err != nil {
+			return err
+		}
+		// An opaque whiteout goes first in its directory so that, when the
+		// archive is applied as a layer, it only hides lower layers' entries
+		// and not siblings that sort before it.
+		if info.IsDir() {
+			marker := filepath.Join(path, whiteoutOpaque)
+			if mi, err := os.Lstat(marker); err == nil && !mi.IsDir() {
+				return t.add(marker, mi)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, e := range devices {
+		if err := t.addDevice(e); err != nil {
+			return err
+		}
+	}
+	return t.close()
+}
+
+// addDevice writes a device node that is recorded in root's ownership file
+// instead of existing, unless its directory doesn't exist either.
+func (t *rootfsTarWriter) addDevice(e ownershipEntry) error {
+	parent, err := resolveInRoot(t.root, filepath.Dir(e.Path))
+	if err != nil || !isDir(parent) {
+		return err
+	}
+	typeflag := byte(tar.TypeChar)
+	if e.Device == "block" {
+		typeflag = tar.TypeBlock
+	}
+	return t.tw.WriteHeader(&tar.Header{
+		Typeflag: typeflag,
+		Name:     strings.TrimPrefix(e.Path, "/"),
+		Mode:     e.Mode,
+		Uid:      e.Uid,
+		Gid:      e.Gid,
+		Devmajor: e.Major,
+		Devminor: e.Minor,
+	})
+}
+
+// splitWriter writes a stream into numbered files of at most size bytes each
+// (base.000, base.001, ...), so that concatenating them in order yields the
+// original stream.
+type splitWriter struct {
+	base    string
+	size    int64
+	part    int
+	written int64
+	current *os.File
+}
+
+func (s *splitWriter) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		if s.current == nil || s.written == s.size {
+			if err := s.next(); err != nil {
+				return total, err
+			}
+		}
+		chunk := p
+		if room := s.size - s.written; int64(len(chunk)) > room {
+			chunk = chunk[:room]
+		}
+		n, err := s.current.Write(chunk)
+		total += n
+		s.written += int64(n)
+		if err != nil {
+			return total, err
+		}
+		p = p[n:]
+	}
+	return total, nil
+}
+
+func (s *splitWriter) next() error {
+	if err := s.Close(); err != nil {
+		return err
+	}
+	f, err := os.Create(fmt.Sprintf("%s.%03d", s.base, s.part))
+	if err != nil {
+		return err
+	}
+	s.part++
+	s.current, s.written = f, 0
+	return nil
+}
+
+func (s *splitWriter) Close() error {
+	if s.current == nil {
+		return nil
+	}
+	err := s.current.Close()
+	s.current = nil
+	return err
+}
+
+func exportCommand(argv []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	output := flags.String("o", "", "write to `file` instead of stdout")
+	useGzip := flags.Bool("gzip", false, "gzip the exported tar")
+	var splitSize sizeFlag
+	flags.Var(&splitSize, "split-size", "split the output into numbered parts of at most `size` bytes (requires -o)")
+	maxDownloads := flags.Int("max-concurrent-downloads", defaultConcurrentDownloads, "maximum number of layers to download at once")
+	maxExtractions := flags.Int("max-concurrent-extractions", defaultConcurrentExtractions, "maximum number of layers to extract at once")
+	var cacheMode cacheModeFlag
+	flags.Var(&cacheMode, "cache-mode", "cache pulled layers as downloaded (`compressed`) or unpacked (extracted)")
+	verifyCache := flags.Bool("verify-cache", false, "hash cached layers again even if they were verified since they last changed")
+	var cacheMaxSize sizeFlag
+	flags.Var(&cacheMaxSize, "cache-max-size", "evict the least recently used cached layers to keep the cache under `size`, e.g. 10g; those of running containers are kept")
+	downloadChunks := flags.Int("download-chunks", 1, "download each layer in up to `n` byte ranges at once, where the registry allows it")
+	retries := flags.Int("pull-retries", 0, "attempt a pull that failed up to `n` more times, reusing the layers earlier attempts got")
+	var caCerts stringsFlag
+	flags.Var(&caCerts, "ca-cert", "also trust the CA certificates in PEM `file`, or in the .pem/.crt/.cert files of a directory, for registry TLS (repeatable)")
+	timeouts := httpTimeoutFlags(flags)
+	platform := flags.String("platform", targetPlatform.String(), "pick the image for `os/arch[/variant]` from multi-platform images")
+	rootfsDir := flags.String("rootfs-dir", "", "extract the image into `dir` and keep it there, instead of in a temporary directory; it must be empty or not exist")
+	force := flags.Bool("force", false, "with --rootfs-dir, replace the contents of a directory that isn't empty")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), exportUsage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(argv)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	if err := useCACerts(caCerts); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	if err := useHTTPTimeouts(timeouts); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	if err := usePlatform(*platform); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	if splitSize > 0 && *output == "" {
+		fmt.Fprintln(os.Stderr, "Err: --split-size requires -o")
+		os.Exit(1)
+	}
+	if *rootfsDir != "" {
+		dir, err := rootfsDirPath(*rootfsDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+			os.Exit(1)
+		}
+		*rootfsDir = dir
+	}
+
+	cleanup := &teardownStack{}
+	signals := make(chan os.Signal, 1)
+	// With SIGPIPE handled, writing to a closed stdout pipe fails with EPIPE
+	// instead of killing us before the rootfs is cleaned up.
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGPIPE)
+	go func() {
+		for sig := range signals {
+			if sig != syscall.SIGPIPE {
+				cleanup.exit(128 + int(sig.(syscall.Signal)))
+			}
+		}
+	}()
+	pull := func(dir string) error {
+		_, err := pullDockerImage(dir, flags.Arg(0), pullOptions{
+			Cache:                    newLayerCache(string(cacheMode), int64(cacheMaxSize), *verifyCache),
+			MaxConcurrentDownloads:   *maxDownloads,
+			MaxConcurrentExtractions: *maxExtractions,
+			Progress:                 stderrProgress(true),
+			Retries:                  *retries,
+			DownloadChunks:           *downloadChunks,
+		})
+		return err
+	}
+	var rootfs string
+	var err error
+	if *rootfsDir != "" {
+		rootfs, err = *rootfsDir, populateRootfsDir(*rootfsDir, *force, pull)
+	} else {
+		var workDir string
+		if workDir, err = os.MkdirTemp("", "export"); err != nil {
+			fmt.Fprintf(os.Stderr, "Err MkdirTemp: %v\n", err)
+			os.Exit(1)
+		}
+		cleanup.push("export dir "+workDir, func() error { return os.RemoveAll(workDir) })
+		rootfs, err = prepareRootfs(workDir, pull)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err on pulling image: %v\n", err)
+		cleanup.exit(1)
+	}
+
+	var out io.WriteCloser = os.Stdout
+	switch {
+	case splitSize > 0:
+		out = &splitWriter{base: *output, size: int64(splitSize)}
+	case *output != "":
+		if out, err = os.Create(*output); err != nil {
+			fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+			cleanup.exit(1)
+		}
+	}
+	w := io.Writer(out)
+	var gz *gzip.Writer
+	if *useGzip {
+		gz = gzip.NewWriter(out)
+		w = gz
+	}
+	err = writeRootfsTar(rootfs, w)
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err exporting: %v\n", err)
+		cleanup.exit(1)
+	}
+	cleanup.run()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSplitWriter(t *testing.T) {
+	data := []byte(strings.Repeat("0123456789", 10))
+	tests := []struct {
+		name   string
+		size   int64
+		writes []int
+		parts  int
+	}{
+		{name: "one part", size: 1000, writes: []int{100}, parts: 1},
+		{name: "uneven", size: 30, writes: []int{100}, parts: 4},
+		// No empty part follows a full one.
+		{name: "exact", size: 25, writes: []int{100}, parts: 4},
+		{name: "small writes", size: 30, writes: []int{7, 7, 7, 7, 7, 7, 7, 51}, parts: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := filepath.Join(t.TempDir(), "out.tar")
+			w := &splitWriter{base: base, size: tt.size}
+			rest := data
+			for _, n := range tt.writes {
+				if written, err := w.Write(rest[:n]); err != nil || written != n {
+					t.Fatalf("Write = %d, %v, want %d", written, err, n)
+				}
+				rest = rest[n:]
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			got, parts := joinParts(t, base)
+			if parts != tt.parts {
+				t.Errorf("%d parts, want %d", parts, tt.parts)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("parts join to %q, want %q", got, data)
+			}
+		})
+	}
+}
+
+// joinParts concatenates the parts of a splitWriter's output at base, and
+// counts them, checking none is empty.
+func joinParts(t *testing.T, base string) ([]byte, int) {
+	t.Helper()
+	var joined []byte
+	parts := 0
+	for ; ; parts++ {
+		data, err := os.ReadFile(fmt.Sprintf("%s.%03d", base, parts))
+		if os.IsNotExist(err) {
+			return joined, parts
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) == 0 {
+			t.Errorf("part %d is empty", parts)
+		}
+		joined = append(joined, data...)
+	}
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	root := extractTestLayers(t, testLayer(t,
+		testEntry{name: "etc/", typeflag: tar.TypeDir},
+		testEntry{name: "etc/os-release", body: "ID=test\n"},
+		testEntry{name: "bin/", typeflag: tar.TypeDir},
+		testEntry{name: "bin/tool", mode: 0o755, body: strings.Repeat("binary", 1000)},
+		testEntry{name: "bin/alias", typeflag: tar.TypeLink, mode: 0o755, linkname: "bin/tool"},
+		testEntry{name: "usr/", typeflag: tar.TypeDir},
+		testEntry{name: "usr/bin", typeflag: tar.TypeSymlink, linkname: "../bin"},
+	))
+	base := filepath.Join(t.TempDir(), "export.tar.gz")
+	parts := &splitWriter{base: base, size: 64}
+	gz := gzip.NewWriter(parts)
+	if err := writeRootfsTar(root, gz); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := parts.Close(); err != nil {
+		t.Fatal(err)
+	}
+	joined, n := joinParts(t, base)
+	if n < 2 {
+		t.Fatalf("%d parts, want the export split", n)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(joined))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(t.TempDir(), "imported")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := extractLayer(dir, zr, nil); err != nil {
+		t.Fatal(err)
+	}
+	wantTree(t, dir, map[string]string{
+		"etc/os-release": "ID=test\n",
+		"bin/tool":       strings.Repeat("binary", 1000),
+		"bin/alias":      strings.Repeat("binary", 1000),
+		"usr/bin":        "->../bin",
+	})
+	tool, err := os.Stat(filepath.Join(dir, "bin/tool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tool.Mode().Perm() != 0o755 {
+		t.Errorf("bin/tool mode %v, want 0755", tool.Mode())
+	}
+	if alias, err := os.Stat(filepath.Join(dir, "bin/alias")); err != nil || !os.SameFile(tool, alias) {
+		t.Errorf("bin/alias isn't a hard link of bin/tool: %v", err)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+func init() {
+	hardLinkInode = unixHardLinkInode
+}
+
+func unixHardLinkInode(info os.FileInfo) (fileInode, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink <= 1 {
+		return fileInode{}, false
+	}
+	return fileInode{uint64(st.Dev), uint64(st.Ino)}, true
+}
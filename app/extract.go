@@ -0,0 +1,552 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Layer compressions, as told by layerCompression.
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+	// compressionDetect is for layers without a media type, such as those
+	// of schema 1 manifests: gzip is recognised by its magic number.
+	compressionDetect = ""
+	// compressionZstd is only ever detected, to tell what a layer that
+	// can't be extracted is.
+	compressionZstd = "zstd"
+)
+
+// sniffCompression tells a layer's compression from its first bytes.
+func sniffCompression(magic []byte) string {
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return compressionGzip
+	case bytes.HasPrefix(magic, zstdMagic):
+		return compressionZstd
+	}
+	return compressionNone
+}
+
+func describeCompression(compression string) string {
+	if compression == compressionNone {
+		return "uncompressed"
+	}
+	return compression + "-compressed"
+}
+
+// layerCompressions maps the layer media types we can extract to their
+// compression.
+var layerCompressions = map[string]string{
+	"application/vnd.docker.image.rootfs.diff.tar.gzip":            compressionGzip,
+	"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip":    compressionGzip,
+	"application/vnd.oci.image.layer.v1.tar":                       compressionNone,
+	"application/vnd.oci.image.layer.v1.tar+gzip":                  compressionGzip,
+	"application/vnd.oci.image.layer.nondistributable.v1.tar":      compressionNone,
+	"application/vnd.oci.image.layer.nondistributable.v1.tar+gzip": compressionGzip,
+}
+
+// layerCompression returns how a layer of mediaType is compressed, or an
+// error naming the media type if we can't extract such layers.
+func layerCompression(mediaType string) (string, error) {
+	if mediaType == "" {
+		return compressionDetect, nil
+	}
+	if compression, ok := layerCompressions[mediaType]; ok {
+		return compression, nil
+	}
+	if strings.HasSuffix(mediaType, "+zstd") {
+		return "", fmt.Errorf("layer media type %s: zstd-compressed layers are not supported", mediaType)
+	}
+	return "", fmt.Errorf("unsupported layer media type %s", mediaType)
+}
+
+// extractLayerFile applies a downloaded layer blob on top of the rootfs at dir.
+// buf is used as the copy buffer; a nil buf allocates one per file. What an
+// unprivileged extraction leaves out is recorded in owners.
+func extractLayerFile(dir, path, compression, diffID string, buf []byte, owners *ownershipLog) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return unpackLayer(dir, f, compression, diffID, buf, true, owners)
+}
+
+// unpackLayerFile is extractLayerFile for unpackLayer, keeping whiteouts.
+func unpackLayerFile(dir, path, compression, diffID string, buf []byte, owners *ownershipLog) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return unpackLayer(dir, f, compression, diffID, buf, false, owners)
+}
+
+// extractLayer applies an uncompressed layer tarball on top of the rootfs at
+// dir, honouring OCI whiteouts. Entries from this layer replace whatever a
+// lower layer left at the same path, even if it was of a different type, e.g.
+// a directory being replaced by a symlink.
+func extractLayer(dir string, r io.Reader, buf []byte) error {
+	return unpackLayer(dir, r, compressionNone, "", buf, true, nil)
+}
+
+// unpackLayer is extractLayer, except that with applyWhiteouts false the
+// whiteout markers are kept as the empty files they are in the tarball. The
+// result is then an unpacked copy of the layer itself, which can be applied on
+// top of a rootfs later. Parent directories the tarball doesn't list become
+// real directories in the copy; layer diffs list them anyway, since adding a
+// file changes its parent.
+//
+// Users other than root can't set owners or create device nodes, so for them
+// files keep their owner, devices are skipped, and both go to owners, if set,
+// instead.
+//
+// Unless diffID is empty, the uncompressed tarball has to hash to it. A
+// mismatch is only found at the end, once everything has been extracted, so
+// dir is then to be thrown away.
+func unpackLayer(dir string, r io.Reader, compression, diffID string, buf []byte, applyWhiteouts bool, owners *ownershipLog) error {
+	br := bufio.NewReader(r)
+	if buf != nil {
+		br = bufio.NewReaderSize(r, len(buf))
+	}
+	var stream io.Reader = br
+	// The content decides: builders have been known to label plain tarballs
+	// as gzip and the other way round.
+	magic, _ := br.Peek(len(zstdMagic))
+	actual := sniffCompression(magic)
+	if compression != compressionDetect && compression != actual {
+		fmt.Fprintf(os.Stderr, "Warning: layer labelled %s is actually %s\n", describeCompression(compression), describeCompression(actual))
+	}
+	compression = actual
+	if compression == compressionZstd {
+		return fmt.Errorf("layer is zstd-compressed, which is not supported")
+	}
+	if compression == compressionGzip {
+		gz, err := newGzipMembers(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		stream = gz
+	}
+	var d *digester
+	if diffID != "" {
+		var err error
+		if d, err = newDigester("layer diff_id", diffID); err != nil {
+			return err
+		}
+		stream = io.TeeReader(stream, d)
+	}
+
+	u := &layerUnpacker{root: dir, buf: buf, applyWhiteouts: applyWhiteouts, written: map[string]bool{}, owners: owners}
+	tr := tar.NewReader(stream)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			if d == nil {
+				return nil
+			}
+			// The diff_id covers the padding after the end of the archive,
+			// too.
+			if _, err := io.Copy(io.Discard, stream); err != nil {
+				return err
+			}
+			return d.verify()
+		}
+		if err != nil {
+			return err
+		}
+		if err := u.extractEntry(hdr, tr); err != nil {
+			return explainNoSpace(dir, fmt.Errorf("extracting %s: %w", abbreviatePath(hdr.Name), err))
+		}
+	}
+}
+
+// explainNoSpace adds what to do about it to an error from running out of
+// disk space while extracting into dir. Other errors are returned as they
+// are.
+func explainNoSpace(dir string, err error) error {
+	if !errors.Is(err, syscall.ENOSPC) {
+		return err
+	}
+	return fmt.Errorf("%w; free some space on the filesystem of %s, e.g. by removing cached layers under %s, or set cache-dir to a filesystem with more room", err, dir, cacheDir())
+}
+
+// mknodEntry creates the device node or FIFO hdr describes at target. Linux
+// replaces this in init.
+var mknodEntry = func(target string, hdr *tar.Header) error {
+	return fmt.Errorf("device nodes and FIFOs can't be created on this platform")
+}
+
+// retryEINTR calls op until it fails with something other than EINTR, which
+// a signal arriving mid-call can cause. The os package already does this for
+// its own calls; this is for the rest.
+func retryEINTR(op func() error) error {
+	for {
+		if err := op(); !errors.Is(err, syscall.EINTR) {
+			return err
+		}
+	}
+}
+
+// gzipMembers decompresses the gzip members at the start of br as one
+// stream, like gzip.Reader in multistream mode, except that whatever follows
+// the last member is ignored. Some registries pad layer blobs, and
+// gzip.Reader fails on the padding with ErrHeader.
+type gzipMembers struct {
+	br *bufio.Reader
+	gz *gzip.Reader
+}
+
+func newGzipMembers(br *bufio.Reader) (*gzipMembers, error) {
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, err
+	}
+	gz.Multistream(false)
+	return &gzipMembers{br: br, gz: gz}, nil
+}
+
+func (g *gzipMembers) Read(p []byte) (int, error) {
+	for {
+		n, err := g.gz.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		// A member ended; only a gzip header makes what follows another one.
+		if magic, _ := g.br.Peek(len(gzipMagic)); !bytes.Equal(magic, gzipMagic) {
+			return n, io.EOF
+		}
+		if err := g.gz.Reset(g.br); err != nil {
+			return n, err
+		}
+		g.gz.Multistream(false)
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (g *gzipMembers) Close() error {
+	return g.gz.Close()
+}
+
+// layerUnpacker applies the entries of one layer tarball.
+type layerUnpacker struct {
+	root           string
+	buf            []byte
+	applyWhiteouts bool
+	// written holds the host paths this layer has created so far, which its
+	// opaque whiteouts must not hide however the tarball orders them.
+	written map[string]bool
+	owners  *ownershipLog
+}
+
+func (u *layerUnpacker) extractEntry(hdr *tar.Header, r io.Reader) error {
+	// Names past the length of a tar header's name field come in PAX or
+	// GNU long name headers, which archive/tar has already read into hdr.
+	name := filepath.Clean("/" + hdr.Name)
+	if name == "/" {
+		return nil
+	}
+	if err := checkPathLength(u.root + name); err != nil {
+		return err
+	}
+	parent, err := resolveInRoot(u.root, filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	base := filepath.Base(name)
+
+	if u.applyWhiteouts {
+		if base == whiteoutOpaque {
+			return u.hideLower(parent)
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			target, err := whiteoutTarget(u.root, parent, base)
+			if err != nil {
+				return err
+			}
+			u.owners.removed(filepath.Join(filepath.Dir(name), strings.TrimPrefix(base, whiteoutPrefix)))
+			return os.RemoveAll(target)
+		}
+	}
+
+	if err := os.MkdirAll(parent, 0o755); err != nil {
+		return err
+	}
+	target := filepath.Join(parent, base)
+	// Symlinks lower layers left on the way to parent may have made it
+	// longer.
+	if err := checkPathLength(target); err != nil {
+		return err
+	}
+	u.written[target] = true
+	if err := removeConflicting(target, hdr.Typeflag == tar.TypeDir); err != nil {
+		return err
+	}
+
+	mode := os.FileMode(hdr.Mode).Perm()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(target, mode); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+		if err != nil {
+			return err
+		}
+		_, err = copyBuffer(f, r, u.buf)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if len(hdr.Linkname) >= maxPathLength {
+			return fmt.Errorf("symlink target is %d bytes long, past the %d bytes Linux allows for one (PATH_MAX)", len(hdr.Linkname), maxPathLength-1)
+		}
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		if err := checkPathLength(u.root + filepath.Clean("/"+hdr.Linkname)); err != nil {
+			return fmt.Errorf("hard link to %s: %w", abbreviatePath(hdr.Linkname), err)
+		}
+		source, err := resolveInRoot(u.root, filepath.Clean("/"+hdr.Linkname))
+		if err != nil {
+			return err
+		}
+		if err := os.Link(source, target); err != nil {
+			return err
+		}
+	case tar.TypeChar, tar.TypeBlock:
+		if unprivilegedExtraction() {
+			u.owners.device(name, hdr)
+			return nil
+		}
+		fallthrough
+	case tar.TypeFifo:
+		if err := retryEINTR(func() error { return mknodEntry(target, hdr) }); err != nil {
+			return err
+		}
+	default:
+		// Unknown entry types (e.g. GNU sparse headers already folded into
+		// regular files by archive/tar) carry nothing we can materialise.
+		return nil
+	}
+	if unprivilegedExtraction() {
+		u.owners.owner(name, hdr)
+	}
+	return applyMetadata(target, hdr)
+}
+
+// Linux's NAME_MAX and PATH_MAX: the longest name of a file, and the
+// longest path, its terminating NUL included, that system calls take.
+const (
+	maxFileNameLength = 255
+	maxPathLength     = 4096
+)
+
+// checkPathLength fails for a host path that couldn't be created for being
+// too long, or having too long a name in it, saying so rather than leaving
+// it to a system call's ENAMETOOLONG, which doesn't say which limit it was.
+func checkPathLength(path string) error {
+	for _, part := range strings.Split(path, "/") {
+		if len(part) > maxFileNameLength {
+			return fmt.Errorf("name %s is %d bytes long, past the %d bytes Linux allows for a file name (NAME_MAX)", abbreviatePath(part), len(part), maxFileNameLength)
+		}
+	}
+	if len(path) >= maxPathLength {
+		return fmt.Errorf("path is %d bytes long in the rootfs, past the %d bytes Linux allows for a path (PATH_MAX)", len(path), maxPathLength-1)
+	}
+	return nil
+}
+
+// abbreviatePath shortens a path too long to read in a message to its
+// start and end.
+func abbreviatePath(path string) string {
+	if len(path) <= 120 {
+		return path
+	}
+	return path[:60] + "..." + path[len(path)-40:]
+}
+
+// removeConflicting deletes whatever a lower layer left at target before the
+// incoming entry is written. Only a directory replacing a directory is kept,
+// so the lower layer's children survive; its mode and owner are then updated
+// to this layer's values. Files are removed rather than truncated in place,
+// since the old file may be a hard link whose other names must keep the
+// lower layer's content. dir says whether the incoming entry is a directory.
+func removeConflicting(target string, dir bool) error {
+	existing, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if dir && existing.IsDir() {
+		return nil
+	}
+	return os.RemoveAll(target)
+}
+
+func applyMetadata(target string, hdr *tar.Header) error {
+	if !unprivilegedExtraction() {
+		if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+	if hdr.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	// Chmod after chown, since chown clears the setuid and setgid bits.
+	if err := os.Chmod(target, tarFileMode(hdr)); err != nil {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeDir {
+		return nil
+	}
+	return retryEINTR(func() error { return os.Chtimes(target, hdr.AccessTime, hdr.ModTime) })
+}
+
+func tarFileMode(hdr *tar.Header) os.FileMode {
+	mode := os.FileMode(hdr.Mode).Perm()
+	if hdr.Mode&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if hdr.Mode&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if hdr.Mode&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// whiteoutTarget returns what the whiteout named base in parent, a directory
+// inside root, removes. It must name an entry of parent: one trimming to "",
+// "." or "..", as ".wh..." does, would remove parent or the directory holding
+// it, which for the top of the rootfs is outside root.
+func whiteoutTarget(root, parent, base string) (string, error) {
+	hidden := strings.TrimPrefix(base, whiteoutPrefix)
+	if hidden == "" || hidden == "." || hidden == ".." || strings.ContainsAny(hidden, "/"+string(filepath.Separator)) {
+		return "", fmt.Errorf("whiteout %s names no entry to remove", abbreviatePath(base))
+	}
+	target := filepath.Join(parent, hidden)
+	if rel, err := filepath.Rel(root, target); err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("whiteout %s is outside the rootfs", abbreviatePath(base))
+	}
+	return target, nil
+}
+
+// hideLower implements an opaque whiteout: it removes everything lower
+// layers left inside dir, keeping dir itself and whatever this layer already
+// wrote there.
+func (u *layerUnpacker) hideLower(dir string) error {
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir || u.written[path] {
+			return nil
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// maxSymlinkHops mirrors the kernel's MAXSYMLINKS.
+const maxSymlinkHops = 40
+
+// resolveInRoot resolves the absolute container path name to a host path
+// inside root, following symlinks as if root were "/". An absolute symlink
+// such as /lib -> /usr/lib left by a lower layer must resolve to
+// root/usr/lib, never to the host's /usr/lib.
+func resolveInRoot(root, name string) (string, error) {
+	resolved := root
+	remaining := strings.Split(strings.TrimPrefix(filepath.Clean("/"+name), "/"), "/")
+	hops := 0
+	for len(remaining) > 0 {
+		part := remaining[0]
+		remaining = remaining[1:]
+		if part == "" || part == "." {
+			continue
+		}
+		if part == ".." {
+			if resolved != root {
+				resolved = filepath.Dir(resolved)
+			}
+			continue
+		}
+		next := filepath.Join(resolved, part)
+		// Symlinks followed on the way may have made the path too long
+		// for the system calls here, which wouldn't say which limit it is.
+		if err := checkPathLength(next); err != nil {
+			return "", err
+		}
+		info, err := os.Lstat(next)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		hops++
+		if hops > maxSymlinkHops {
+			return "", errors.New("too many levels of symbolic links")
+		}
+		link, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(link) {
+			resolved = root
+		}
+		remaining = append(strings.Split(link, "/"), remaining...)
+	}
+	return resolved, nil
+}
+
+// copyBuffer is io.CopyBuffer, except that it always copies through buf.
+// *os.File implements io.ReaderFrom, which io.CopyBuffer would otherwise
+// prefer; for non-file sources that falls back to io.Copy's own small buffer.
+func copyBuffer(dst io.Writer, src io.Reader, buf []byte) (int64, error) {
+	if buf == nil {
+		return io.Copy(dst, src)
+	}
+	return io.CopyBuffer(struct{ io.Writer }{dst}, src, buf)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"archive/tar"
+	"syscall"
+)
+
+func init() {
+	mknodEntry = linuxMknodEntry
+}
+
+func linuxMknodEntry(target string, hdr *tar.Header) error {
+	mode := uint32(hdr.Mode & 07777)
+	switch hdr.Typeflag {
+	case tar.TypeChar:
+		mode |= syscall.S_IFCHR
+	case tar.TypeBlock:
+		mode |= syscall.S_IFBLK
+	case tar.TypeFifo:
+		mode |= syscall.S_IFIFO
+	}
+	return syscall.Mknod(target, mode, int(mkdev(hdr.Devmajor, hdr.Devminor)))
+}
+
+// mkdev encodes a device number the way glibc's makedev does.
+func mkdev(major, minor int64) uint64 {
+	ma, mi := uint64(major), uint64(minor)
+	return (ma&0xfff)<<8 | (mi & 0xff) | (mi&^0xff)<<12 | (ma&^0xfff)<<32
+}
@@ -0,0 +1,596 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// extractTestLayers applies layers, uncompressed tars, in order onto a new
+// rootfs, which it returns.
+func extractTestLayers(t *testing.T, layers ...[]byte) string {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "rootfs")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for i, layer := range layers {
+		if err := extractLayer(dir, bytes.NewReader(layer), nil); err != nil {
+			t.Fatalf("layer %d: %v", i, err)
+		}
+	}
+	return dir
+}
+
+// wantTree checks the files under dir: each path of want maps to a regular
+// file's content, "->target" for a symlink, "/" for a directory, or "" for
+// nothing being there.
+func wantTree(t *testing.T, dir string, want map[string]string) {
+	t.Helper()
+	for path, content := range want {
+		full := filepath.Join(dir, path)
+		info, err := os.Lstat(full)
+		switch {
+		case content == "":
+			if err == nil {
+				t.Errorf("%s is there, want it gone", path)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", path, err)
+		case content == "/":
+			if !info.IsDir() {
+				t.Errorf("%s is %v, want a directory", path, info.Mode())
+			}
+		case strings.HasPrefix(content, "->"):
+			if target, err := os.Readlink(full); err != nil || target != content[2:] {
+				t.Errorf("%s links to %q, %v, want %q", path, target, err, content[2:])
+			}
+		default:
+			if got, err := os.ReadFile(full); err != nil || string(got) != content {
+				t.Errorf("%s = %q, %v, want %q", path, got, err, content)
+			}
+		}
+	}
+}
+
+func TestExtractLayerReplacesTypes(t *testing.T) {
+	tests := []struct {
+		name   string
+		layers [][]byte
+		want   map[string]string
+	}{
+		{
+			// As when an image moves /lib to /usr/lib.
+			name: "directory by symlink",
+			layers: [][]byte{
+				testLayer(t, testEntry{name: "lib/", typeflag: tar.TypeDir}, testEntry{name: "lib/a", body: "a"}),
+				testLayer(t, testEntry{name: "usr/lib/", typeflag: tar.TypeDir}, testEntry{name: "usr/lib/b", body: "b"}, testEntry{name: "lib", typeflag: tar.TypeSymlink, linkname: "usr/lib"}),
+			},
+			want: map[string]string{"lib": "->usr/lib", "lib/b": "b", "usr/lib/a": ""},
+		},
+		{
+			name: "symlink by directory",
+			layers: [][]byte{
+				testLayer(t, testEntry{name: "usr/lib/", typeflag: tar.TypeDir}, testEntry{name: "usr/lib/b", body: "b"}, testEntry{name: "lib", typeflag: tar.TypeSymlink, linkname: "usr/lib"}),
+				testLayer(t, testEntry{name: "lib/", typeflag: tar.TypeDir}, testEntry{name: "lib/a", body: "a"}),
+			},
+			want: map[string]string{"lib": "/", "lib/a": "a", "lib/b": "", "usr/lib/b": "b", "usr/lib/a": ""},
+		},
+		{
+			name: "file by directory",
+			layers: [][]byte{
+				testLayer(t, testEntry{name: "x", body: "file"}),
+				testLayer(t, testEntry{name: "x/", typeflag: tar.TypeDir}, testEntry{name: "x/y", body: "y"}),
+			},
+			want: map[string]string{"x": "/", "x/y": "y"},
+		},
+		{
+			name: "directory by file",
+			layers: [][]byte{
+				testLayer(t, testEntry{name: "x/", typeflag: tar.TypeDir}, testEntry{name: "x/y", body: "y"}),
+				testLayer(t, testEntry{name: "x", body: "file"}),
+			},
+			want: map[string]string{"x": "file"},
+		},
+		{
+			// A later layer's files go where a lower layer's symlink
+			// points, inside the rootfs even for absolute ones.
+			name: "through an absolute symlink",
+			layers: [][]byte{
+				testLayer(t, testEntry{name: "usr/lib/", typeflag: tar.TypeDir}, testEntry{name: "lib", typeflag: tar.TypeSymlink, linkname: "/usr/lib"}),
+				testLayer(t, testEntry{name: "lib/c", body: "c"}),
+			},
+			want: map[string]string{"lib": "->/usr/lib", "usr/lib/c": "c"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wantTree(t, extractTestLayers(t, tt.layers...), tt.want)
+		})
+	}
+}
+
+func TestExtractLayerOverExistingPaths(t *testing.T) {
+	lower := testLayer(t,
+		testEntry{name: "etc/", typeflag: tar.TypeDir, mode: 0o755},
+		testEntry{name: "etc/passwd", body: "root:x:0:0::/root:/bin/sh\n"},
+		testEntry{name: "etc/lower", body: "lower"},
+		testEntry{name: "etc/link", typeflag: tar.TypeLink, linkname: "etc/lower"},
+	)
+	upper := testLayer(t,
+		testEntry{name: "etc/", typeflag: tar.TypeDir, mode: 0o700},
+		testEntry{name: "etc/passwd", mode: 0o600, body: "root:x:0:0::/root:/bin/bash\n"},
+		testEntry{name: "etc/lower", body: "upper"},
+		testEntry{name: "etc/upper", body: "upper"},
+	)
+	dir := extractTestLayers(t, lower, upper)
+	wantTree(t, dir, map[string]string{
+		"etc":        "/",
+		"etc/passwd": "root:x:0:0::/root:/bin/bash\n",
+		"etc/lower":  "upper",
+		"etc/upper":  "upper",
+		// The other name of the replaced file keeps the lower content.
+		"etc/link": "lower",
+	})
+	// The directory takes the upper layer's mode, the file its own.
+	for path, want := range map[string]os.FileMode{"etc": 0o700, "etc/passwd": 0o600} {
+		if info, err := os.Lstat(filepath.Join(dir, path)); err != nil || info.Mode().Perm() != want {
+			t.Errorf("%s: %v, %v, want mode %v", path, info.Mode(), err, want)
+		}
+	}
+	// Extracting the same layers again onto the result changes nothing.
+	for _, layer := range [][]byte{lower, upper} {
+		if err := extractLayer(dir, bytes.NewReader(layer), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantTree(t, dir, map[string]string{"etc/passwd": "root:x:0:0::/root:/bin/bash\n", "etc/lower": "upper", "etc/link": "lower"})
+}
+
+// TestMaliciousWhiteouts checks whiteouts that name no entry of their
+// directory are refused, wherever the layer is applied, instead of removing
+// the directory or what holds the rootfs.
+func TestMaliciousWhiteouts(t *testing.T) {
+	apply := map[string]func(dir string, layer []byte) error{
+		"extracted": func(dir string, layer []byte) error {
+			return extractLayer(dir, bytes.NewReader(layer), nil)
+		},
+		"unpacked and moved": func(dir string, layer []byte) error {
+			tree := filepath.Join(filepath.Dir(dir), "tree")
+			if err := os.Mkdir(tree, 0o755); err != nil {
+				return err
+			}
+			if err := unpackLayer(tree, bytes.NewReader(layer), compressionNone, "", nil, false, nil); err != nil {
+				t.Fatalf("unpacking: %v", err)
+			}
+			return moveLayerTree(dir, tree)
+		},
+	}
+	for _, name := range []string{".wh...", ".wh..", ".wh.", "etc/.wh...", "etc/.wh..", "etc/.wh."} {
+		for how, apply := range apply {
+			t.Run(name+" "+how, func(t *testing.T) {
+				dir := extractTestLayers(t, testLayer(t,
+					testEntry{name: "etc/", typeflag: tar.TypeDir},
+					testEntry{name: "etc/conf", body: "conf"},
+				))
+				neighbour := filepath.Join(filepath.Dir(dir), "neighbour")
+				if err := os.WriteFile(neighbour, []byte("outside"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				if err := apply(dir, testLayer(t, testEntry{name: name})); err == nil {
+					t.Error("applied the whiteout")
+				}
+				wantTree(t, dir, map[string]string{"etc/conf": "conf"})
+				wantTree(t, filepath.Dir(dir), map[string]string{"neighbour": "outside"})
+			})
+		}
+	}
+}
+
+func TestExtractLayerGzipMembers(t *testing.T) {
+	layer := testLayer(t,
+		testEntry{name: "a", body: strings.Repeat("a", 3000)},
+		testEntry{name: "b/", typeflag: tar.TypeDir},
+		testEntry{name: "b/c", body: "c"},
+	)
+	// members gzips each part of layer, split at the offsets given, as a
+	// gzip member of its own.
+	members := func(offsets ...int) []byte {
+		var blob []byte
+		start := 0
+		for _, end := range append(offsets, len(layer)) {
+			blob = append(blob, gzipLayer(t, layer[start:end])...)
+			start = end
+		}
+		return blob
+	}
+	tests := []struct {
+		name string
+		blob []byte
+	}{
+		{name: "one member", blob: members()},
+		// The first member ends inside a's content, the second inside
+		// b/c's header.
+		{name: "two members", blob: members(1000, 3600)},
+		{name: "with an empty member", blob: members(512, 512)},
+		{name: "zero padding", blob: append(members(1000), make([]byte, 1000)...)},
+		{name: "trailing garbage", blob: append(members(), "not gzip"...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			// The diff_id only verifies if every member was read.
+			if err := unpackLayer(dir, bytes.NewReader(tt.blob), compressionGzip, sha256Digest(layer), nil, true, nil); err != nil {
+				t.Fatal(err)
+			}
+			wantTree(t, dir, map[string]string{"a": strings.Repeat("a", 3000), "b": "/", "b/c": "c"})
+		})
+	}
+}
+
+func TestLayerCompression(t *testing.T) {
+	layer := testLayer(t, testEntry{name: "f", body: "f"})
+	tests := []struct {
+		mediaType string
+		want      string
+		wantErr   string
+	}{
+		{mediaType: "application/vnd.docker.image.rootfs.diff.tar.gzip", want: compressionGzip},
+		{mediaType: "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip", want: compressionGzip},
+		{mediaType: "application/vnd.oci.image.layer.v1.tar", want: compressionNone},
+		{mediaType: "application/vnd.oci.image.layer.v1.tar+gzip", want: compressionGzip},
+		{mediaType: "application/vnd.oci.image.layer.nondistributable.v1.tar", want: compressionNone},
+		{mediaType: "application/vnd.oci.image.layer.nondistributable.v1.tar+gzip", want: compressionGzip},
+		// Schema 1 layers have no media type.
+		{mediaType: "", want: compressionDetect},
+		{mediaType: "application/vnd.oci.image.layer.v1.tar+zstd", wantErr: "zstd-compressed layers are not supported"},
+		{mediaType: "application/vnd.example.layer.squashfs", wantErr: "unsupported layer media type application/vnd.example.layer.squashfs"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mediaType, func(t *testing.T) {
+			got, err := layerCompression(tt.mediaType)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("layerCompression = %q, %v, want an error containing %q", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("layerCompression = %q, %v, want %q", got, err, tt.want)
+			}
+			// A blob of that compression extracts without a warning.
+			blob := layer
+			if got == compressionGzip || got == compressionDetect {
+				blob = gzipLayer(t, layer)
+			}
+			dir := t.TempDir()
+			stderr := captureStderr(t, func() {
+				err = unpackLayer(dir, bytes.NewReader(blob), got, "", nil, true, nil)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stderr != "" {
+				t.Errorf("warned %q", stderr)
+			}
+			wantTree(t, dir, map[string]string{"f": "f"})
+		})
+	}
+}
+
+func TestExtractMislabeledLayer(t *testing.T) {
+	layer := testLayer(t, testEntry{name: "f", body: "f"})
+	zstd := append(append([]byte{}, zstdMagic...), "frame"...)
+	tests := []struct {
+		name        string
+		compression string
+		blob        []byte
+		wantWarning string
+		wantErr     bool
+	}{
+		{name: "tar labelled gzip", compression: compressionGzip, blob: layer, wantWarning: "Warning: layer labelled gzip-compressed is actually uncompressed\n"},
+		{name: "gzip labelled tar", compression: compressionNone, blob: gzipLayer(t, layer), wantWarning: "Warning: layer labelled uncompressed is actually gzip-compressed\n"},
+		{name: "zstd labelled gzip", compression: compressionGzip, blob: zstd, wantWarning: "Warning: layer labelled gzip-compressed is actually zstd-compressed\n", wantErr: true},
+		{name: "gzip labelled gzip", compression: compressionGzip, blob: gzipLayer(t, layer)},
+		// Without a media type there is no label to contradict.
+		{name: "gzip unlabelled", compression: compressionDetect, blob: gzipLayer(t, layer)},
+		{name: "tar unlabelled", compression: compressionDetect, blob: layer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			var err error
+			stderr := captureStderr(t, func() {
+				err = unpackLayer(dir, bytes.NewReader(tt.blob), tt.compression, sha256Digest(layer), nil, true, nil)
+			})
+			if stderr != tt.wantWarning {
+				t.Errorf("warned %q, want %q", stderr, tt.wantWarning)
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantTree(t, dir, map[string]string{"f": "f"})
+		})
+	}
+}
+
+// failingReader reads r until n bytes are read, then fails with err.
+type failingReader struct {
+	r   io.Reader
+	n   int
+	err error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.n <= 0 {
+		return 0, f.err
+	}
+	if len(p) > f.n {
+		p = p[:f.n]
+	}
+	n, err := f.r.Read(p)
+	f.n -= n
+	return n, err
+}
+
+// TestExtractIOError fails reading a layer partway through a large file's
+// content, as a failing disk would, and checks nothing is left of the
+// rootfs and that running out of space is explained.
+func TestExtractIOError(t *testing.T) {
+	blob := gzipLayer(t, testLayer(t,
+		testEntry{name: "etc/", typeflag: tar.TypeDir},
+		testEntry{name: "etc/passwd", body: "root:x:0:0::/root:/bin/sh\n"},
+		testEntry{name: "big", body: string(bytes.Repeat([]byte("0123456789abcdef"), 1<<14))},
+	))
+	tests := []struct {
+		err      error
+		wantText string
+	}{
+		{err: syscall.EIO},
+		{err: syscall.ENOSPC, wantText: "free some space"},
+	}
+	for _, tt := range tests {
+		parent := t.TempDir()
+		_, err := prepareRootfs(parent, func(staging string) error {
+			return unpackLayer(staging, &failingReader{r: bytes.NewReader(blob), n: len(blob) / 2, err: tt.err}, compressionGzip, "", nil, true, nil)
+		})
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%v: prepareRootfs = %v, want that error", tt.err, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), tt.wantText) {
+			t.Errorf("%v: %q doesn't say %q", tt.err, err, tt.wantText)
+		}
+		if tt.wantText == "" && err != nil && strings.Contains(err.Error(), "free some space") {
+			t.Errorf("%v: %q is explained as running out of space", tt.err, err)
+		}
+		if entries, _ := os.ReadDir(parent); len(entries) > 0 {
+			t.Errorf("%v: left %s behind", tt.err, entries[0].Name())
+		}
+	}
+}
+
+func TestRetryEINTR(t *testing.T) {
+	tests := []struct {
+		errs      []error
+		wantErr   error
+		wantCalls int
+	}{
+		{errs: []error{nil}, wantCalls: 1},
+		{errs: []error{syscall.EINTR, syscall.EINTR, nil}, wantCalls: 3},
+		{errs: []error{syscall.EINTR, &os.PathError{Op: "chtimes", Path: "f", Err: syscall.EINTR}, syscall.EIO}, wantErr: syscall.EIO, wantCalls: 3},
+		{errs: []error{syscall.ENOSPC}, wantErr: syscall.ENOSPC, wantCalls: 1},
+	}
+	for _, tt := range tests {
+		calls := 0
+		err := retryEINTR(func() error {
+			calls++
+			return tt.errs[calls-1]
+		})
+		if err != tt.wantErr || calls != tt.wantCalls {
+			t.Errorf("retryEINTR(%v) = %v after %d calls, want %v after %d", tt.errs, err, calls, tt.wantErr, tt.wantCalls)
+		}
+	}
+}
+
+// benchmarkLayer returns the uncompressed tar of a layer shaped like a
+// distribution's base image: many small files and a few large ones, of
+// text that compresses about as well as binaries do.
+func benchmarkLayer(b *testing.B, seed int64) []byte {
+	b.Helper()
+	r := rand.New(rand.NewSource(seed))
+	body := func(n int) string {
+		const alphabet = "abcdefghijklmnopqrstuvwxyz0123456789 \n\x00\x01\x02\xff"
+		p := make([]byte, n)
+		for i := range p {
+			p[i] = alphabet[r.Intn(len(alphabet))]
+		}
+		return string(p)
+	}
+	var entries []testEntry
+	for i := 0; i < 500; i++ {
+		entries = append(entries, testEntry{name: fmt.Sprintf("usr/share/doc/%d", i), body: body(4 << 10)})
+	}
+	for i := 0; i < 8; i++ {
+		entries = append(entries, testEntry{name: fmt.Sprintf("usr/lib/lib%d.so", i), mode: 0o755, body: body(2 << 20)})
+	}
+	return testLayer(b, entries...)
+}
+
+// BenchmarkExtractLayer measures extraction throughput, in uncompressed
+// bytes, of a gzipped layer at a range of --buffer-size values.
+func BenchmarkExtractLayer(b *testing.B) {
+	layer := benchmarkLayer(b, 1)
+	blob := filepath.Join(b.TempDir(), "layer.tar.gz")
+	if err := os.WriteFile(blob, gzipLayer(b, layer), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	for _, size := range []int{32 << 10, 256 << 10, 1 << 20, 4 << 20} {
+		b.Run(fmt.Sprintf("%dKiB", size>>10), func(b *testing.B) {
+			buf := make([]byte, size)
+			b.SetBytes(int64(len(layer)))
+			dir := filepath.Join(b.TempDir(), "rootfs")
+			for i := 0; i < b.N; i++ {
+				if err := os.Mkdir(dir, 0o755); err != nil {
+					b.Fatal(err)
+				}
+				if err := extractLayerFile(dir, blob, compressionGzip, "", buf, nil); err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				os.RemoveAll(dir)
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+// TestExtractLongNames extracts entries whose names only fit PAX or GNU
+// long name headers, and ones too long for Linux to create.
+func TestExtractLongNames(t *testing.T) {
+	// deep is a path of n directories with 50-byte names, and name in the
+	// last of them.
+	deep := func(n int, name string) string {
+		return strings.Repeat(strings.Repeat("d", 49)+"/", n) + name
+	}
+	long := deep(8, "file") // 404 bytes: past a header's 100-byte name field.
+	tests := []struct {
+		name    string
+		format  tar.Format
+		hdrs    []*tar.Header
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:   "PAX long name",
+			format: tar.FormatPAX,
+			hdrs:   []*tar.Header{{Name: long, Typeflag: tar.TypeReg}},
+			want:   map[string]string{long: "data"},
+		},
+		{
+			name:   "PAX long link names",
+			format: tar.FormatPAX,
+			hdrs: []*tar.Header{
+				{Name: long, Typeflag: tar.TypeReg},
+				{Name: long + "-hard", Typeflag: tar.TypeLink, Linkname: long},
+				{Name: "sym", Typeflag: tar.TypeSymlink, Linkname: "/" + long},
+			},
+			want: map[string]string{long: "data", long + "-hard": "data", "sym": "->/" + long},
+		},
+		{
+			name:   "GNU long names",
+			format: tar.FormatGNU,
+			hdrs: []*tar.Header{
+				{Name: long, Typeflag: tar.TypeReg},
+				{Name: "sym", Typeflag: tar.TypeSymlink, Linkname: long},
+			},
+			want: map[string]string{long: "data", "sym": "->" + long},
+		},
+		{
+			name:    "name past NAME_MAX",
+			format:  tar.FormatPAX,
+			hdrs:    []*tar.Header{{Name: "dir/" + strings.Repeat("n", 256), Typeflag: tar.TypeReg}},
+			wantErr: "past the 255 bytes Linux allows for a file name (NAME_MAX)",
+		},
+		{
+			name:    "path past PATH_MAX",
+			format:  tar.FormatPAX,
+			hdrs:    []*tar.Header{{Name: deep(82, "file"), Typeflag: tar.TypeReg}},
+			wantErr: "past the 4095 bytes Linux allows for a path (PATH_MAX)",
+		},
+		{
+			name:    "symlink target past PATH_MAX",
+			format:  tar.FormatPAX,
+			hdrs:    []*tar.Header{{Name: "sym", Typeflag: tar.TypeSymlink, Linkname: deep(82, "file")}},
+			wantErr: "past the 4095 bytes Linux allows for one (PATH_MAX)",
+		},
+		{
+			name:    "hard link target past PATH_MAX",
+			format:  tar.FormatPAX,
+			hdrs:    []*tar.Header{{Name: "hard", Typeflag: tar.TypeLink, Linkname: deep(82, "file")}},
+			wantErr: "past the 4095 bytes Linux allows for a path (PATH_MAX)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			tw := tar.NewWriter(&b)
+			for _, hdr := range tt.hdrs {
+				hdr.Format, hdr.Mode = tt.format, 0o644
+				var body []byte
+				if hdr.Typeflag == tar.TypeReg {
+					body = []byte("data")
+					hdr.Size = int64(len(body))
+				}
+				if err := tw.WriteHeader(hdr); err != nil {
+					t.Fatal(err)
+				}
+				tw.Write(body)
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			dir := filepath.Join(t.TempDir(), "rootfs")
+			if err := os.Mkdir(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			err := extractLayer(dir, &b, nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("extractLayer = %v, want an error saying %q", err, tt.wantErr)
+				}
+				// The error is short enough to read.
+				if len(err.Error()) > 400 {
+					t.Errorf("the error is %d bytes long: %v", len(err.Error()), err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantTree(t, dir, tt.want)
+		})
+	}
+
+	// A name that is short in the layer can be too long once a symlink a
+	// lower layer left on the way is followed.
+	lower := tarLayer(t, tar.FormatPAX,
+		&tar.Header{Name: deep(79, "f"), Typeflag: tar.TypeReg, Mode: 0o644},
+		&tar.Header{Name: "l", Typeflag: tar.TypeSymlink, Linkname: "/" + deep(79, "")},
+	)
+	dir := extractTestLayers(t, lower)
+	err := extractLayer(dir, bytes.NewReader(tarLayer(t, tar.FormatPAX, &tar.Header{Name: "l/" + deep(3, "file"), Typeflag: tar.TypeReg, Mode: 0o644})), nil)
+	if err == nil || !strings.Contains(err.Error(), "(PATH_MAX)") || len(err.Error()) > 400 {
+		t.Errorf("extracting through the symlink: %v, want it past PATH_MAX, briefly", err)
+	}
+}
+
+// tarLayer writes hdrs, in format, as a layer of empty files.
+func tarLayer(t *testing.T, format tar.Format, hdrs ...*tar.Header) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, hdr := range hdrs {
+		hdr.Format = format
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,13 @@
+package main
+
+import "strings"
+
+// stringsFlag is a repeatable string flag, e.g. `-v a:/a -v b:/b`.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// resolveGroups turns --group-add values, group IDs or names, into group IDs.
+// Names are looked up in the /etc/group of the container's rootfs, not the
+// host's. Duplicates are dropped, keeping the first occurrence's place.
+func resolveGroups(rootfs string, values []string) ([]uint32, error) {
+	var groups []uint32
+	seen := map[uint32]bool{}
+	var byName map[string]uint32
+	for _, value := range values {
+		gid, err := strconv.ParseUint(value, 10, 32)
+		// (gid_t)-1 means "unchanged" to the kernel, so it can't be a
+		// group.
+		if err == nil && gid == math.MaxUint32 {
+			return nil, fmt.Errorf("invalid group ID %s", value)
+		}
+		if err != nil {
+			if value == "" || strings.ContainsAny(value, ":\n") {
+				return nil, fmt.Errorf("invalid group %q", value)
+			}
+			if byName == nil {
+				if byName, err = readGroupFile(rootfs); err != nil {
+					return nil, fmt.Errorf("resolving group %q: %w", value, err)
+				}
+			}
+			id, ok := byName[value]
+			if !ok {
+				return nil, fmt.Errorf("group %q not found in the container's /etc/group", value)
+			}
+			gid = uint64(id)
+		}
+		if !seen[uint32(gid)] {
+			seen[uint32(gid)] = true
+			groups = append(groups, uint32(gid))
+		}
+	}
+	return groups, nil
+}
+
+// readGroupFile maps the group names in rootfs's /etc/group to their IDs.
+// The first entry for a name wins, as with getgrnam.
+func readGroupFile(rootfs string) (map[string]uint32, error) {
+	path, err := resolveInRoot(rootfs, "/etc/group")
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	groups := map[string]uint32{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// name:password:gid:members
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 3 || fields[0] == "" || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		gid, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			continue
+		}
+		if _, ok := groups[fields[0]]; !ok {
+			groups[fields[0]] = uint32(gid)
+		}
+	}
+	return groups, scanner.Err()
+}
+
+// passwdEntry is the part of an /etc/passwd entry a user is resolved with.
+type passwdEntry struct {
+	name     string
+	uid, gid uint32
+}
+
+// readPasswdFile returns the entries of rootfs's /etc/passwd, in the file's
+// order, which decides between entries for the same name or ID: the first
+// wins, as with getpwnam and getpwuid.
+func readPasswdFile(rootfs string) ([]passwdEntry, error) {
+	path, err := resolveInRoot(rootfs, "/etc/passwd")
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var users []passwdEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// name:password:uid:gid:gecos:home:shell
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 4 || fields[0] == "" || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		uid, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			continue
+		}
+		gid, err := strconv.ParseUint(fields[3], 10, 32)
+		if err != nil {
+			continue
+		}
+		users = append(users, passwdEntry{name: fields[0], uid: uint32(uid), gid: uint32(gid)})
+	}
+	return users, scanner.Err()
+}
+
+// resolveUser turns an image's User, user[:group] by name or ID, into the
+// user and group IDs it names, looking names up in rootfs's /etc/passwd and
+// /etc/group as Docker does. Without a group, the user's primary group in
+// /etc/passwd is taken, or, for a user ID that isn't there, group 0. An
+// empty User is root.
+func resolveUser(rootfs, user string) (uid, gid uint32, err error) {
+	if user == "" {
+		return 0, 0, nil
+	}
+	name, group, hasGroup := strings.Cut(user, ":")
+	if name == "" || strings.ContainsAny(name, "\n") {
+		return 0, 0, fmt.Errorf("invalid user %q", user)
+	}
+	id, numericErr := strconv.ParseUint(name, 10, 32)
+	if numericErr == nil && id == math.MaxUint32 {
+		return 0, 0, fmt.Errorf("invalid user ID %s", name)
+	}
+	// A user ID needn't be in the file, unless its primary group is needed.
+	users, err := readPasswdFile(rootfs)
+	if err != nil && (numericErr != nil || !hasGroup && !os.IsNotExist(err)) {
+		return 0, 0, fmt.Errorf("resolving user %q: %w", name, err)
+	}
+	found := false
+	for _, entry := range users {
+		if numericErr == nil && entry.uid == uint32(id) || numericErr != nil && entry.name == name {
+			uid, gid, found = entry.uid, entry.gid, true
+			break
+		}
+	}
+	switch {
+	case numericErr == nil && !found:
+		uid = uint32(id)
+	case !found:
+		return 0, 0, fmt.Errorf("user %q not found in the container's /etc/passwd", name)
+	}
+	if hasGroup {
+		groups, err := resolveGroups(rootfs, []string{group})
+		if err != nil {
+			return 0, 0, err
+		}
+		gid = groups[0]
+	}
+	return uid, gid, nil
+}
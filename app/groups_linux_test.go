@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestResolveGroups(t *testing.T) {
+	rootfs := testRootfs(t)
+	tests := []struct {
+		name    string
+		values  []string
+		want    []uint32
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "ids", values: []string{"10", "0", "4294967294"}, want: []uint32{10, 0, 4294967294}},
+		{name: "names", values: []string{"video", "app"}, want: []uint32{44, 1001}},
+		// The first occurrence keeps its place.
+		{name: "duplicates", values: []string{"video", "10", "44", "10", "video"}, want: []uint32{44, 10}},
+		{name: "unknown name", values: []string{"video", "docker"}, wantErr: true},
+		{name: "(gid_t)-1", values: []string{"4294967295"}, wantErr: true},
+		{name: "out of range", values: []string{"4294967296"}, wantErr: true},
+		{name: "empty", values: []string{""}, wantErr: true},
+		{name: "colon", values: []string{"video:x"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := resolveGroups(rootfs, tt.values)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: resolveGroups(%q) = %v, want an error", tt.name, tt.values, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: resolveGroups(%q) = %v, %v, want %v", tt.name, tt.values, got, err, tt.want)
+		}
+	}
+
+	// IDs need no /etc/group, names do.
+	empty := t.TempDir()
+	if got, err := resolveGroups(empty, []string{"44"}); err != nil || !reflect.DeepEqual(got, []uint32{44}) {
+		t.Errorf("resolveGroups without /etc/group = %v, %v, want [44]", got, err)
+	}
+	if _, err := resolveGroups(empty, []string{"video"}); err == nil {
+		t.Error("resolved a name without /etc/group")
+	}
+}
+
+func TestReadGroupFile(t *testing.T) {
+	rootfs := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	content := "# comment\nvideo:x:44:app\n\nbroken\nbad:x:gid:\nvideo:x:45:\naudio:x:29\n"
+	if err := os.WriteFile(filepath.Join(rootfs, "etc/group"), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readGroupFile(rootfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]uint32{"video": 44, "audio": 29}; !reflect.DeepEqual(got, want) {
+		t.Errorf("readGroupFile = %v, want %v", got, want)
+	}
+}
+
+// TestRunGroupAdd checks the supplementary groups of a container's process.
+func TestRunGroupAdd(t *testing.T) {
+	docker, image := runTestImage(t, testEntry{name: "etc/group", body: "root:x:0:\nvideo:x:44:\ndocker:x:999:\n"})
+	tests := []struct {
+		flags []string
+		want  string
+	}{
+		{want: "groups []\n"},
+		{flags: []string{"--group-add", "video", "--group-add", "4242", "--group-add", "44", "--group-add", "docker"}, want: "groups [44 999 4242]\n"},
+	}
+	for _, tt := range tests {
+		args := append(append([]string{"run", "--rm"}, tt.flags...), image, "/probe", "groups")
+		out, err := docker(args...).CombinedOutput()
+		if err != nil {
+			t.Errorf("%q: %v\n%s", tt.flags, err, out)
+			continue
+		}
+		if string(out) != tt.want {
+			t.Errorf("%q: %q, want %q", tt.flags, out, tt.want)
+		}
+	}
+}
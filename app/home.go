@@ -0,0 +1,19 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// homeDir returns the directory where docker-clone keeps its persistent
+// state, ~/.docker-clone by default. DOCKER_CLONE_HOME overrides it.
+func homeDir() string {
+	if dir := os.Getenv("DOCKER_CLONE_HOME"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = os.TempDir()
+	}
+	return filepath.Join(home, ".docker-clone")
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// maxHostnameLength is the kernel's HOST_NAME_MAX, which bounds domain names
+// as well.
+const maxHostnameLength = 64
+
+// validateHostname checks that name, given with flag, is something resolvers
+// and the kernel accept: dot-separated labels of letters, digits and hyphens,
+// none of them starting or ending with a hyphen.
+func validateHostname(flag, name string) error {
+	if len(name) > maxHostnameLength {
+		return fmt.Errorf("--%s %q: longer than %d characters", flag, name, maxHostnameLength)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return fmt.Errorf("--%s %q: not a valid hostname", flag, name)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return fmt.Errorf("--%s %q: not a valid hostname", flag, name)
+			}
+		}
+	}
+	return nil
+}
+
+// writeHostnameFile makes rootfs's /etc/hostname agree with the hostname the
+// container gets, replacing whatever the image had there.
+func writeHostnameFile(rootfs, hostname string) error {
+	path, err := resolveInRoot(rootfs, "/etc/hostname")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(hostname+"\n"), 0o644)
+}
+
+// setHostname sets the hostname, and the domain name unless it is empty, of
+// the child's UTS namespace.
+func setHostname(hostname, domainname string) error {
+	if err := syscall.Sethostname([]byte(hostname)); err != nil {
+		return fmt.Errorf("setting the hostname: %w", err)
+	}
+	if domainname == "" {
+		return nil
+	}
+	if err := syscall.Setdomainname([]byte(domainname)); err != nil {
+		return fmt.Errorf("setting the domain name: %w", err)
+	}
+	return nil
+}
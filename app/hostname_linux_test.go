@@ -0,0 +1,70 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestValidateHostname(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{name: "web"},
+		{name: "web-1.example.com"},
+		{name: "0123456789ab"},
+		{name: strings.Repeat("a", maxHostnameLength)},
+		{name: strings.Repeat("a", maxHostnameLength+1), wantErr: true},
+		{name: "-web", wantErr: true},
+		{name: "web-", wantErr: true},
+		{name: "web..example", wantErr: true},
+		{name: "web.", wantErr: true},
+		{name: "web_1", wantErr: true},
+		{name: "web 1", wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := validateHostname("hostname", tt.name); (err != nil) != tt.wantErr {
+			t.Errorf("validateHostname(%q) = %v, want an error: %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+// TestRunHostname checks the hostname and domain name a container has, and
+// that its /etc/hostname agrees.
+func TestRunHostname(t *testing.T) {
+	docker, image := runTestImage(t)
+	tests := []struct {
+		flags []string
+		// hostname and domainname are patterns the container's must match.
+		hostname, domainname string
+		wantErr              bool
+	}{
+		{flags: []string{"--hostname", "web"}, hostname: "web", domainname: `\(none\)`},
+		{flags: []string{"--hostname", "web", "--domainname", "example.com"}, hostname: "web", domainname: `example\.com`},
+		// Like Docker's, the short container ID.
+		{hostname: "[0-9a-f]{12}", domainname: `\(none\)`},
+		{flags: []string{"--hostname", "web_1"}, wantErr: true},
+		{flags: []string{"--hostname", "web", "--no-uts-namespace"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		args := append(append([]string{"run", "--rm"}, tt.flags...), image, "/probe", "cat", "/etc/hostname", "/proc/sys/kernel/hostname", "/proc/sys/kernel/domainname")
+		out, err := docker(args...).CombinedOutput()
+		if tt.wantErr {
+			if err == nil || strings.Contains(string(out), "/etc/hostname:") {
+				t.Errorf("%q: %v, want it refused before running\n%s", tt.flags, err, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %v\n%s", tt.flags, err, out)
+		}
+		want := regexp.MustCompile(`^/etc/hostname: (` + tt.hostname + `)\n\n/proc/sys/kernel/hostname: (` + tt.hostname + `)\n\n/proc/sys/kernel/domainname: ` + tt.domainname + `\n\n$`)
+		m := want.FindStringSubmatch(string(out))
+		if m == nil {
+			t.Errorf("%q: the container has\n%s\nwant it to match %s", tt.flags, out, want)
+		} else if m[1] != m[2] {
+			t.Errorf("%q: /etc/hostname says %s, but the hostname is %s", tt.flags, m[1], m[2])
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// For containers to find each other by name, each gets an /etc/hosts of its
+// own, the host's plus a line per running container naming it, by its
+// --name and its --network-alias values, at the address it is reached at
+// from the container: its own on the bridge if it has one (see
+// bridge_linux.go), else, sharing the host's network, the loopback address,
+// or the host's on the bridge from containers there. The file is kept in the
+// container's state directory, bind mounted over the image's, and rewritten
+// in place, which the mount keeps seeing, whenever a container starts or
+// exits, so names resolve as long as their containers run. Containers on
+// the bridge can also ask its nameserver; see dns_server_linux.go.
+
+// hostHosts is the host's hosts file, which names what the container, on
+// the host's network, can reach by those names too.
+const hostHosts = "/etc/hosts"
+
+// loopbackAddress is where a container on the host's network is reached
+// from others there.
+const loopbackAddress = "127.0.0.1"
+
+// networkAliasRegexp is what --network-alias accepts: a host name.
+var networkAliasRegexp = regexp.MustCompile(`^[a-zA-Z0-9](?:[a-zA-Z0-9.-]*[a-zA-Z0-9])?$`)
+
+// validateNetworkAliases checks that each --network-alias value is a host
+// name.
+func validateNetworkAliases(aliases []string) error {
+	for _, alias := range aliases {
+		if !networkAliasRegexp.MatchString(alias) {
+			return fmt.Errorf("--network-alias %q: not a valid host name", alias)
+		}
+	}
+	return nil
+}
+
+// containerHostsPath is the hosts file of the container key.
+func containerHostsPath(key string) string {
+	return filepath.Join(containerDir(key), "hosts")
+}
+
+// hostsMount bind mounts the hosts file at source read-only over the
+// container's.
+func hostsMount(source string) mountSpec {
+	return mountSpec{Type: mountTypeBind, Source: source, Target: "/etc/hosts", ReadOnly: true}
+}
+
+// hostNames are the names other containers find s by.
+func (s containerState) hostNames() []string {
+	var names []string
+	if s.Name != "" {
+		names = append(names, s.Name)
+	}
+	return append(names, s.NetworkAliases...)
+}
+
+// peerAddress is where s is reached from containers on the bridge, if
+// onBridge, or else from those on the host's network.
+func (s containerState) peerAddress(onBridge bool) string {
+	switch {
+	case s.IPAddress != "":
+		return s.IPAddress
+	case onBridge:
+		return bridgeGateway.String()
+	default:
+		return loopbackAddress
+	}
+}
+
+// containerHosts returns the hosts file of the container viewer, which sees
+// those in running.
+func containerHosts(running []containerState, viewer containerState) ([]byte, error) {
+	data, err := os.ReadFile(hostHosts)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var b bytes.Buffer
+	b.Write(data)
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		b.WriteByte('\n')
+	}
+	b.WriteString("# Running containers, kept up to date by docker-clone\n")
+	for _, state := range running {
+		if names := state.hostNames(); len(names) > 0 {
+			fmt.Fprintf(&b, "%s\t%s\n", state.peerAddress(viewer.IPAddress != ""), strings.Join(names, " "))
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// writeContainerHosts writes the hosts file at path for a container that is
+// about to start as self, seeing the running containers and itself.
+func writeContainerHosts(path string, self containerState) error {
+	running, err := listContainers()
+	if err != nil {
+		return err
+	}
+	data, err := containerHosts(append(running, self), self)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// refreshHostsFiles rewrites the hosts files of the running containers, but
+// for except, which is exiting, to list the containers running now. Those
+// run without a mount namespace, or with a mount of the user's at
+// /etc/hosts, have none.
+func refreshHostsFiles(except string) error {
+	if err := os.MkdirAll(containersDir(), 0o755); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(filepath.Join(containersDir(), "hosts.lock"), os.O_CREATE|os.O_RDONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := lockExclusive(lock); err != nil {
+		return err
+	}
+	containers, err := listContainers()
+	if err != nil {
+		return err
+	}
+	var running []containerState
+	for _, state := range containers {
+		if state.key() != except {
+			running = append(running, state)
+		}
+	}
+	for _, state := range running {
+		data, err := containerHosts(running, state)
+		if err != nil {
+			return err
+		}
+		// Truncated and written rather than replaced, so that the bind
+		// mount of the file shows the new content.
+		f, err := os.OpenFile(containerHostsPath(state.key()), os.O_WRONLY|os.O_TRUNC, 0)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
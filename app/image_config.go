@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// dockerImageConfigMediaType is the config media type of Docker images. OCI
+// images have ociImageConfigMediaType.
+const dockerImageConfigMediaType = "application/vnd.docker.container.image.v1+json"
+
+// artifactType returns what manifest is an artifact of, if it isn't a
+// container image: its artifactType, else its config's media type. Helm
+// charts, for instance, have a config of media type
+// application/vnd.cncf.helm.config.v1+json. Schema 1 manifests have no
+// config and are always images.
+func artifactType(manifest DockerManifestResponse) (string, bool) {
+	if manifest.ArtifactType != "" {
+		return manifest.ArtifactType, true
+	}
+	switch manifest.Config.MediaType {
+	case "", dockerImageConfigMediaType, ociImageConfigMediaType:
+		return "", false
+	}
+	return manifest.Config.MediaType, true
+}
+
+// checkRunnable refuses manifests of artifacts, whose config isn't an image
+// config and whose layers aren't filesystem layers.
+func checkRunnable(manifest DockerManifestResponse) error {
+	if kind, ok := artifactType(manifest); ok {
+		return fmt.Errorf("this is not a runnable container image (artifact type: %s)", kind)
+	}
+	return nil
+}
+
+// ImageConfig is the image configuration blob referenced by a manifest's
+// config descriptor.
+type ImageConfig struct {
+	Architecture string          `json:"architecture"`
+	OS           string          `json:"os"`
+	Config       ContainerConfig `json:"config"`
+	RootFS       ImageRootFS     `json:"rootfs"`
+}
+
+// ImageRootFS lists the layers of an image by their DiffIDs, the digests of
+// their uncompressed tarballs, in order.
+type ImageRootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// ContainerConfig holds the defaults an image sets for containers run from it.
+type ContainerConfig struct {
+	User         string              `json:"User,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	Entrypoint   []string            `json:"Entrypoint,omitempty"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	WorkingDir   string              `json:"WorkingDir,omitempty"`
+	StopSignal   string              `json:"StopSignal,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	Healthcheck  *HealthcheckConfig  `json:"Healthcheck,omitempty"`
+}
+
+// HealthcheckConfig is an image's HEALTHCHECK. Durations are stored as
+// nanoseconds, which is how time.Duration decodes from JSON.
+type HealthcheckConfig struct {
+	Test        []string      `json:"Test,omitempty"`
+	Interval    time.Duration `json:"Interval,omitempty"`
+	Timeout     time.Duration `json:"Timeout,omitempty"`
+	StartPeriod time.Duration `json:"StartPeriod,omitempty"`
+	Retries     int           `json:"Retries,omitempty"`
+}
+
+// imageMetadata is what we know about an image apart from its layer
+// contents: its manifest and its config.
+type imageMetadata struct {
+	Manifest DockerManifestResponse
+	Config   ImageConfig
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testImageConfig is an image config blob as a registry serves it, in
+// Docker's format with fields ImageConfig leaves out.
+const testImageConfig = `{"architecture":"amd64","config":{"User":"app:app","Env":["PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin","LANG=C.UTF-8"],` +
+	`"Entrypoint":["/docker-entrypoint.sh"],"Cmd":["serve","--port","8080"],"WorkingDir":"/srv","StopSignal":"SIGQUIT",` +
+	`"Labels":{"org.opencontainers.image.source":"https://example.com/app"},"ExposedPorts":{"8080/tcp":{}},` +
+	`"Healthcheck":{"Test":["CMD","/healthcheck"],"Interval":30000000000,"Timeout":5000000000,"Retries":3},"ArgsEscaped":true,"OnBuild":null},` +
+	`"created":"2024-05-01T12:00:00Z","history":[{"created":"2024-05-01T12:00:00Z","created_by":"ADD rootfs.tar.gz / # buildkit"}],` +
+	`"os":"linux","rootfs":{"type":"layers","diff_ids":["sha256:5d20c808ce198565ff70b3ed23a991dd49afac45dece63474b27ce6ed036adc6"]}}`
+
+func TestFetchConfig(t *testing.T) {
+	want := ImageConfig{
+		Architecture: "amd64",
+		OS:           "linux",
+		Config: ContainerConfig{
+			User:         "app:app",
+			Env:          []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin", "LANG=C.UTF-8"},
+			Entrypoint:   []string{"/docker-entrypoint.sh"},
+			Cmd:          []string{"serve", "--port", "8080"},
+			WorkingDir:   "/srv",
+			StopSignal:   "SIGQUIT",
+			Labels:       map[string]string{"org.opencontainers.image.source": "https://example.com/app"},
+			ExposedPorts: map[string]struct{}{"8080/tcp": {}},
+			Healthcheck:  &HealthcheckConfig{Test: []string{"CMD", "/healthcheck"}, Interval: 30 * time.Second, Timeout: 5 * time.Second, Retries: 3},
+		},
+		RootFS: ImageRootFS{Type: "layers", DiffIDs: []string{"sha256:5d20c808ce198565ff70b3ed23a991dd49afac45dece63474b27ce6ed036adc6"}},
+	}
+	digest := sha256Digest([]byte(testImageConfig))
+	manifest := DockerManifestResponse{Config: DockerLayer{MediaType: dockerImageConfigMediaType, Digest: digest}}
+	tests := []struct {
+		name string
+		// served is the blob the source has for digest.
+		served       string
+		cached       bool
+		wantMismatch bool
+	}{
+		{name: "fetched", served: testImageConfig},
+		{name: "cached", served: testImageConfig, cached: true},
+		{name: "tampered", served: testImageConfig[:len(testImageConfig)-1] + ` }`, wantMismatch: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DOCKER_CLONE_HOME", t.TempDir())
+			src := &blobSource{blobs: map[string][]byte{digest: []byte(tt.served)}, requests: map[string]int{}}
+			var cache *layerCache
+			if tt.cached {
+				cache = newLayerCache(cacheModeCompressed, 0, false)
+			}
+			for i := 0; i < 2; i++ {
+				config, err := fetchConfig(src, manifest, cache)
+				if tt.wantMismatch {
+					var mismatch *digestMismatchError
+					if !errors.As(err, &mismatch) {
+						t.Fatalf("err = %v, want a digest mismatch", err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(config, want) {
+					t.Errorf("config %+v, want %+v", config, want)
+				}
+			}
+			// Without a cache the config is fetched every time.
+			wantRequests := 2
+			if tt.cached {
+				wantRequests = 1
+			}
+			if src.requests[digest] != wantRequests {
+				t.Errorf("%d requests for the config, want %d", src.requests[digest], wantRequests)
+			}
+		})
+	}
+}
+
+func TestFetchConfigSchema1(t *testing.T) {
+	want := ImageConfig{Architecture: "amd64", OS: "linux", Config: ContainerConfig{Cmd: []string{"sh"}}}
+	src := &blobSource{blobs: map[string][]byte{}, requests: map[string]int{}}
+	config, err := fetchConfig(src, DockerManifestResponse{schema1Config: &want}, nil)
+	if err != nil || !reflect.DeepEqual(config, want) {
+		t.Errorf("fetchConfig = %+v, %v, want the manifest's %+v", config, err, want)
+	}
+	if len(src.requests) > 0 {
+		t.Errorf("requested %v, want nothing fetched", src.requests)
+	}
+}
+
+// TestArtifacts stores manifests of an image and of artifacts, and checks
+// only the image is pulled and run, while all of them can be inspected.
+func TestArtifacts(t *testing.T) {
+	layout := filepath.Join(t.TempDir(), "layout")
+	if err := initOCILayout(layout); err != nil {
+		t.Fatal(err)
+	}
+	layer := testLayer(t, testEntry{name: "f", body: "f"})
+	imageConfig := []byte(`{"architecture":"` + runtime.GOARCH + `","os":"linux","rootfs":{"type":"layers","diff_ids":["` + sha256Digest(layer) + `"]}}`)
+	tests := []struct {
+		tag             string
+		artifactType    string
+		configMediaType string
+		config          []byte
+		want            string
+	}{
+		{tag: "docker-image", configMediaType: dockerImageConfigMediaType, config: imageConfig},
+		{tag: "oci-image", configMediaType: ociImageConfigMediaType, config: imageConfig},
+		{
+			tag:             "helm-chart",
+			configMediaType: "application/vnd.cncf.helm.config.v1+json",
+			config:          []byte(`{"name":"chart","version":"1.0.0"}`),
+			want:            "application/vnd.cncf.helm.config.v1+json",
+		},
+		{
+			tag:             "sbom",
+			artifactType:    "application/spdx+json",
+			configMediaType: "application/vnd.oci.empty.v1+json",
+			config:          []byte(`{}`),
+			want:            "application/spdx+json",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tag, func(t *testing.T) {
+			config, err := writeOCIBlob(layout, tt.configMediaType, tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			blob, err := writeOCIBlob(layout, ociLayerMediaType, gzipLayer(t, layer))
+			if err != nil {
+				t.Fatal(err)
+			}
+			manifest := map[string]interface{}{"schemaVersion": 2, "mediaType": ociManifestMediaType, "config": config, "layers": []ociDescriptor{blob}}
+			if tt.artifactType != "" {
+				manifest["artifactType"] = tt.artifactType
+			}
+			data, err := json.Marshal(manifest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			desc, err := writeOCIBlob(layout, ociManifestMediaType, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tagOCIManifest(layout, desc, tt.tag); err != nil {
+				t.Fatal(err)
+			}
+			image := ociLayoutPrefix + layout + ":" + tt.tag
+
+			meta, err := fetchImageMetadata(image, "pull")
+			if err != nil {
+				t.Fatalf("inspecting: %v", err)
+			}
+			if got := newImageInspect(image, meta).ArtifactType; got != tt.want {
+				t.Errorf("inspect shows artifact type %q, want %q", got, tt.want)
+			}
+
+			dir := t.TempDir()
+			_, err = pullDockerImage(dir, image, pullOptions{})
+			if tt.want == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				wantTree(t, dir, map[string]string{"f": "f"})
+				return
+			}
+			if want := "this is not a runnable container image (artifact type: " + tt.want + ")"; err == nil || !strings.Contains(err.Error(), want) {
+				t.Fatalf("pull: %v, want an error containing %q", err, want)
+			}
+			wantTree(t, dir, map[string]string{"f": ""})
+		})
+	}
+}
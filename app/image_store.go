@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// The local image store holds the images made by commit and tag, one OCI
+// image layout per repository under localImagesDir. Images in it are run by
+// name without touching the network, before any registry is asked.
+
+func localImagesDir() string {
+	return filepath.Join(homeDir(), "images")
+}
+
+// localImageLayout is the OCI image layout holding the local images of
+// repository, which can also be run as oci:<layout>:<tag>.
+func localImageLayout(repository string) string {
+	return filepath.Join(localImagesDir(), filepath.FromSlash(repository))
+}
+
+// parseLocalImageRef splits "repository[:tag]", defaulting to "latest".
+func parseLocalImageRef(image string) (repository, tag string, err error) {
+	repository, tag = image, "latest"
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		repository, tag = image[:i], image[i+1:]
+	}
+	if !repositoryNameRegexp.MatchString(repository) {
+		return "", "", fmt.Errorf("invalid repository name %q", repository)
+	}
+	if !tagRegexp.MatchString(tag) {
+		return "", "", fmt.Errorf("invalid tag %q", tag)
+	}
+	return repository, tag, nil
+}
+
+// resolveLocalImage returns the oci: reference of image if the local store
+// has it. Anything that isn't a plain repository[:tag], such as a digest
+// reference, is never local.
+func resolveLocalImage(image string) (string, bool) {
+	if strings.HasPrefix(image, ociLayoutPrefix) || strings.HasPrefix(image, dockerArchivePrefix) {
+		return "", false
+	}
+	repository, tag, err := parseLocalImageRef(image)
+	if err != nil {
+		return "", false
+	}
+	layout := localImageLayout(repository)
+	if _, err := resolveOCILayoutDescriptor(layout, tag); err != nil {
+		return "", false
+	}
+	return ociLayoutPrefix + layout + ":" + tag, true
+}
+
+// importImage copies image's manifest, config and layer blobs into the OCI
+// image layout at layout, unchanged so that the manifest keeps its digest,
+// and returns the manifest's descriptor.
+func importImage(image, layout string, opts pullOptions) (ociDescriptor, error) {
+	if local, ok := resolveLocalImage(image); ok {
+		image = local
+	}
+	if strings.HasPrefix(image, ociLayoutPrefix) {
+		return importOCILayoutImage(image, layout, opts)
+	}
+	return importSourceImage(image, layout, opts)
+}
+
+func importOCILayoutImage(image, layout string, opts pullOptions) (ociDescriptor, error) {
+	src, tag := parseOCILayoutRef(image)
+	desc, err := resolveOCILayoutDescriptor(src, tag)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	data, err := readOCIBlob(src, desc.Digest)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	var manifest DockerManifestResponse
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return ociDescriptor{}, fmt.Errorf("parsing manifest: %w", err)
+	}
+	buf := make([]byte, defaultBufferSize)
+	digests := []string{manifest.Config.Digest}
+	for _, layer := range manifest.Layers {
+		digests = append(digests, layer.Digest)
+	}
+	for _, digest := range digests {
+		path, err := ociBlobPath(src, digest)
+		if err != nil {
+			return ociDescriptor{}, err
+		}
+		if err := storeOCIBlobFile(layout, digest, path, buf); err != nil {
+			return ociDescriptor{}, err
+		}
+	}
+	return writeOCIBlob(layout, desc.MediaType, data)
+}
+
+func importSourceImage(image, layout string, opts pullOptions) (ociDescriptor, error) {
+	src, ref, err := openSource(image, opts.ScopeActions)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	data, kind, err := resolveManifest(src, ref)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	if kind == dockerManifestV1MediaType || kind == dockerManifestV1SignedMediaType {
+		return ociDescriptor{}, fmt.Errorf("%s is a schema 1 image, which can't be stored locally", image)
+	}
+	var manifest DockerManifestResponse
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return ociDescriptor{}, fmt.Errorf("parsing manifest (%s): %w", kind, err)
+	}
+	config, err := readSourceBlob(src, "image config", manifest.Config.Digest)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	if _, err := writeOCIBlob(layout, ociImageConfigMediaType, config); err != nil {
+		return ociDescriptor{}, err
+	}
+	work, err := os.MkdirTemp("", "import")
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	defer os.RemoveAll(work)
+	fetch := sourceLayerFetcher(src, opts)
+	buf := make([]byte, defaultBufferSize)
+	for _, layer := range manifest.Layers {
+		// Layers an earlier import that was interrupted, or another image,
+		// already stored aren't fetched again.
+		if hasOCIBlob(layout, layer.Digest, buf) {
+			continue
+		}
+		local, err := fetch(layer, work, buf)
+		if err == nil {
+			err = keepLayerBlob(layout, layer, local, buf)
+		}
+		if local.temporary {
+			os.Remove(local.blob)
+		}
+		if err != nil {
+			return ociDescriptor{}, fmt.Errorf("layer %s: %w", layer.Digest, err)
+		}
+	}
+	return writeOCIBlob(layout, kind, data)
+}
+
+func tagCommand(argv []string) {
+	flags := flag.NewFlagSet("tag", flag.ExitOnError)
+	scopeActions := flags.String("registry-scope", defaultScopeActions, "comma-separated `actions` to request in the registry token scope")
+	var caCerts stringsFlag
+	flags.Var(&caCerts, "ca-cert", "also trust the CA certificates in PEM `file`, or in the .pem/.crt/.cert files of a directory, for registry TLS (repeatable)")
+	timeouts := httpTimeoutFlags(flags)
+	platform := flags.String("platform", targetPlatform.String(), "pick the image for `os/arch[/variant]` from multi-platform images")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), tagUsage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(argv)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	if err := useCACerts(caCerts); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	if err := useHTTPTimeouts(timeouts); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	if err := usePlatform(*platform); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	repository, tag, err := parseLocalImageRef(flags.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	layout := localImageLayout(repository)
+	if err := initOCILayout(layout); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	desc, err := importImage(flags.Arg(0), layout, pullOptions{ScopeActions: *scopeActions})
+	if err == nil {
+		err = tagOCIManifest(layout, desc, tag)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err tagging %s: %v\n", flags.Arg(0), err)
+		os.Exit(1)
+	}
+}
+
+// localImage is an entry of the local store, as listed by images.
+type localImage struct {
+	Repository string
+	Tag        string
+	ID         string
+	Size       int64
+}
+
+// listLocalImages returns the images in the local store, sorted by
+// repository and tag.
+func listLocalImages() ([]localImage, error) {
+	var images []localImage
+	root := localImagesDir()
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return nil, nil
+	}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if info.Name() == "blobs" {
+			return filepath.SkipDir
+		}
+		if _, err := os.Stat(filepath.Join(path, "oci-layout")); err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		found, err := listLayoutImages(path, filepath.ToSlash(rel))
+		images = append(images, found...)
+		return err
+	})
+	sort.Slice(images, func(i, j int) bool {
+		if images[i].Repository != images[j].Repository {
+			return images[i].Repository < images[j].Repository
+		}
+		return images[i].Tag < images[j].Tag
+	})
+	return images, err
+}
+
+func listLayoutImages(layout, repository string) ([]localImage, error) {
+	data, err := os.ReadFile(filepath.Join(layout, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+	var index ociIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", filepath.Join(layout, "index.json"), err)
+	}
+	var images []localImage
+	for _, desc := range index.Manifests {
+		image := localImage{Repository: repository, Tag: desc.Annotations[ociRefNameAnnotation]}
+		var manifest DockerManifestResponse
+		if err := readOCIBlobJSON(layout, desc.Digest, &manifest); err != nil {
+			return nil, err
+		}
+		image.ID = manifest.Config.Digest
+		for _, layer := range manifest.Layers {
+			image.Size += layer.Size
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+func imagesCommand(argv []string) {
+	flags := flag.NewFlagSet("images", flag.ExitOnError)
+	quiet := flags.Bool("q", false, "only print image IDs")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), imagesUsage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(argv)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	images, err := listLocalImages()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	if *quiet {
+		for _, image := range images {
+			fmt.Println(image.ID)
+		}
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(tw, "REPOSITORY\tTAG\tIMAGE ID\tSIZE")
+	for _, image := range images {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", image.Repository, image.Tag, shortImageID(image.ID), formatSize(image.Size))
+	}
+	tw.Flush()
+}
+
+// shortImageID abbreviates an image ID the way `docker images` does.
+func shortImageID(id string) string {
+	id = strings.TrimPrefix(id, "sha256:")
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// removeLocalImage untags image in the local store and deletes the blobs no
+// other tag of its repository still needs, printing what it did. Unless force
+// is set, an image a running container was run from is kept.
+//
+// Blobs are counted per repository, as each has a layout of its own: a layer
+// that images of two repositories share is stored in both, and removing one
+// image only ever deletes from its own layout. That costs the space of the
+// second copy, but keeps every layout self-contained, runnable and copyable
+// as oci:<layout> on its own, with no store-wide count to keep in step. A
+// running container is matched to the image by config digest alone, so it
+// keeps any tag of the same image from being removed, whichever it was run by.
+func removeLocalImage(image string, force bool) error {
+	repository, tag, err := parseLocalImageRef(image)
+	if err != nil {
+		return err
+	}
+	layout := localImageLayout(repository)
+	desc, err := resolveOCILayoutDescriptor(layout, tag)
+	if err != nil {
+		return fmt.Errorf("no such image: %s:%s", repository, tag)
+	}
+	var manifest DockerManifestResponse
+	if err := readOCIBlobJSON(layout, desc.Digest, &manifest); err != nil {
+		return err
+	}
+	if !force {
+		containers, err := listContainers()
+		if err != nil {
+			return err
+		}
+		for _, state := range containers {
+			if state.ImageID == manifest.Config.Digest {
+				return fmt.Errorf("image %s:%s is in use by running container %s (use --force to remove it anyway)", repository, tag, state.key())
+			}
+		}
+	}
+	if err := untagOCIManifest(layout, tag); err != nil {
+		return err
+	}
+	fmt.Printf("Untagged: %s:%s\n", repository, tag)
+	pruned, err := pruneOCIBlobs(layout)
+	for _, digest := range pruned {
+		fmt.Printf("Deleted: %s\n", digest)
+	}
+	if err != nil {
+		return err
+	}
+	index, err := readOCIIndex(layout)
+	if err != nil || len(index.Manifests) > 0 {
+		return err
+	}
+	return removeLocalImageLayout(layout)
+}
+
+// removeLocalImageLayout deletes a layout left without images, and the
+// directories above it that it leaves empty, up to localImagesDir.
+func removeLocalImageLayout(layout string) error {
+	if err := os.RemoveAll(layout); err != nil {
+		return err
+	}
+	root := localImagesDir()
+	for dir := filepath.Dir(layout); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func rmiCommand(argv []string) {
+	flags := flag.NewFlagSet("rmi", flag.ExitOnError)
+	force := flags.Bool("force", false, "remove images even if running containers were run from them")
+	flags.BoolVar(force, "f", false, "shorthand for --force")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), rmiUsage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(argv)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	failed := false
+	for _, image := range flags.Args() {
+		if err := removeLocalImage(image, *force); err != nil {
+			fmt.Fprintf(os.Stderr, "Err removing %s: %v\n", image, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRemoveLocalImage(t *testing.T) {
+	shared := testLayer(t, testEntry{name: "shared", body: "in both images"})
+	onlyA := testLayer(t, testEntry{name: "a", body: "only in a"})
+	onlyB := testLayer(t, testEntry{name: "b", body: "only in b"})
+	tests := []struct {
+		name string
+		// running is the image, if any, a running container was run from.
+		running string
+		force   bool
+		remove  string
+		wantErr bool
+		// kept and gone are images, by repository:tag, expected to be in
+		// the store afterwards or not.
+		kept, gone []string
+		// The layers expected in the layout of repository app afterwards
+		// or not.
+		keptLayers, goneLayers [][]byte
+	}{
+		{
+			name:       "shared layer kept",
+			remove:     "app:a",
+			kept:       []string{"app:b", "other:latest"},
+			gone:       []string{"app:a"},
+			keptLayers: [][]byte{shared, onlyB},
+			goneLayers: [][]byte{onlyA},
+		},
+		{
+			name:       "in use",
+			running:    "app:a",
+			remove:     "app:a",
+			wantErr:    true,
+			kept:       []string{"app:a", "app:b"},
+			keptLayers: [][]byte{shared, onlyA, onlyB},
+		},
+		{
+			name:       "in use, forced",
+			running:    "app:a",
+			force:      true,
+			remove:     "app:a",
+			kept:       []string{"app:b"},
+			gone:       []string{"app:a"},
+			keptLayers: [][]byte{shared, onlyB},
+			goneLayers: [][]byte{onlyA},
+		},
+		{
+			name:    "other image in use",
+			running: "app:b",
+			remove:  "app:a",
+			kept:    []string{"app:b"},
+			gone:    []string{"app:a"},
+		},
+		{
+			name:    "no such image",
+			remove:  "app:c",
+			wantErr: true,
+			kept:    []string{"app:a", "app:b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DOCKER_CLONE_HOME", t.TempDir())
+			images := map[string]ociDescriptor{
+				"app:a":        writeTestImage(t, localImageLayout("app"), "a", shared, onlyA),
+				"app:b":        writeTestImage(t, localImageLayout("app"), "b", shared, onlyB),
+				"other:latest": writeTestImage(t, localImageLayout("other"), "latest", shared),
+			}
+			if tt.running != "" {
+				var manifest ociManifest
+				if err := readOCIBlobJSON(localImageLayout("app"), images[tt.running].Digest, &manifest); err != nil {
+					t.Fatal(err)
+				}
+				lock, err := claimContainer("c")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer lock.Close()
+				if err := saveContainerState(containerState{ID: "c", Name: "c", ImageID: manifest.Config.Digest}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := removeLocalImage(tt.remove, tt.force)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("removeLocalImage(%q) = %v, want error %v", tt.remove, err, tt.wantErr)
+			}
+			for _, image := range tt.kept {
+				if _, ok := resolveLocalImage(image); !ok {
+					t.Errorf("%s was removed", image)
+				}
+			}
+			for _, image := range tt.gone {
+				if _, ok := resolveLocalImage(image); ok {
+					t.Errorf("%s is still there", image)
+				}
+			}
+			for _, layer := range tt.keptLayers {
+				if !hasLayerBlob(t, "app", layer) {
+					t.Errorf("layer %s was deleted", shortImageID(sha256Digest(layer)))
+				}
+			}
+			for _, layer := range tt.goneLayers {
+				if hasLayerBlob(t, "app", layer) {
+					t.Errorf("layer %s was kept", shortImageID(sha256Digest(layer)))
+				}
+			}
+			// Each repository keeps its own copy of what it shares.
+			if !hasLayerBlob(t, "other", shared) {
+				t.Error("removing from app deleted other's copy of the shared layer")
+			}
+		})
+	}
+}
+
+func TestRemoveLastLocalImage(t *testing.T) {
+	t.Setenv("DOCKER_CLONE_HOME", t.TempDir())
+	writeTestImage(t, localImageLayout("team/app"), "latest", testLayer(t, testEntry{name: "f", body: "x"}))
+	if err := removeLocalImage("team/app", false); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing is left of the layout, nor of the directory above it.
+	if _, err := os.Stat(localImageLayout("team")); !os.IsNotExist(err) {
+		t.Errorf("layout left behind: %v", err)
+	}
+}
+
+// hasLayerBlob reports whether the layout of repository has the blob of
+// layer, an uncompressed tar, as writeTestImage stored it.
+func hasLayerBlob(t *testing.T, repository string, layer []byte) bool {
+	t.Helper()
+	return hasOCIBlob(localImageLayout(repository), sha256Digest(gzipLayer(t, layer)), nil)
+}
+
+func TestParseLocalImageRef(t *testing.T) {
+	tests := []struct {
+		image, repository, tag string
+		wantErr                bool
+	}{
+		{image: "app", repository: "app", tag: "latest"},
+		{image: "app:v1", repository: "app", tag: "v1"},
+		{image: "team/app:v1.2", repository: "team/app", tag: "v1.2"},
+		// Local images are named by repository alone, without a registry.
+		{image: "localhost:5000/app", wantErr: true},
+		{image: "App:v1", wantErr: true},
+		{image: "app:", wantErr: true},
+		{image: "app@sha256:" + strings.Repeat("0", 64), wantErr: true},
+	}
+	for _, tt := range tests {
+		repository, tag, err := parseLocalImageRef(tt.image)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseLocalImageRef(%q) = %q, %q, want an error", tt.image, repository, tag)
+			}
+			continue
+		}
+		if err != nil || repository != tt.repository || tag != tt.tag {
+			t.Errorf("parseLocalImageRef(%q) = %q, %q, %v, want %q, %q", tt.image, repository, tag, err, tt.repository, tt.tag)
+		}
+	}
+}
+
+// TestTagImages tags images from an OCI layout, a registry and the local
+// store itself, and checks they all resolve locally and are listed.
+func TestTagImages(t *testing.T) {
+	t.Setenv("DOCKER_CLONE_HOME", t.TempDir())
+	layout := filepath.Join(t.TempDir(), "layout")
+	layer := testLayer(t, testEntry{name: "f", body: "tagged"})
+	writeTestImage(t, layout, "latest", layer)
+	useTestRegistry(t, serveOCILayout(t, layout))
+
+	tag := func(src, dest string) {
+		t.Helper()
+		repository, tag, err := parseLocalImageRef(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := initOCILayout(localImageLayout(repository)); err != nil {
+			t.Fatal(err)
+		}
+		desc, err := importImage(src, localImageLayout(repository), pullOptions{})
+		if err == nil {
+			err = tagOCIManifest(localImageLayout(repository), desc, tag)
+		}
+		if err != nil {
+			t.Fatalf("tagging %s as %s: %v", src, dest, err)
+		}
+	}
+	tag(ociLayoutPrefix+layout, "team/app:v1")
+	tag("library/app", "mirrored:latest")
+	tag("team/app:v1", "alias:stable")
+
+	images, err := listLocalImages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed []string
+	for _, image := range images {
+		listed = append(listed, image.Repository+":"+image.Tag)
+		if image.ID != images[0].ID || image.Size != int64(len(gzipLayer(t, layer))) {
+			t.Errorf("%s:%s is %+v, want the image of the layout", image.Repository, image.Tag, image)
+		}
+	}
+	if want := []string{"alias:stable", "mirrored:latest", "team/app:v1"}; !reflect.DeepEqual(listed, want) {
+		t.Errorf("images %q, want %q", listed, want)
+	}
+
+	// Tagged images are run from the store, whatever the registry has.
+	empty := httptest.NewServer(http.NotFoundHandler())
+	defer empty.Close()
+	useTestRegistry(t, empty)
+	for _, image := range []string{"team/app:v1", "mirrored", "alias:stable"} {
+		dir := filepath.Join(t.TempDir(), "rootfs")
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pullDockerImage(dir, image, pullOptions{}); err != nil {
+			t.Errorf("pulling %s: %v", image, err)
+			continue
+		}
+		wantTree(t, dir, map[string]string{"f": "tagged"})
+	}
+	if _, ok := resolveLocalImage("team/app:v2"); ok {
+		t.Error("team/app:v2, never tagged, resolves locally")
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+// runInit runs as PID 1 inside the container's PID namespace when --init is
+// given. It starts the real command, forwards every signal it receives to it
+// and reaps any orphaned children that get reparented to it. It returns the
+// exit code of the real command, executed from path, once it has exited.
+func runInit(path string, argv []string) int {
+	// Subscribe before starting the child so a SIGCHLD for a command that
+	// exits immediately isn't missed.
+	signals := make(chan os.Signal, 32)
+	signal.Notify(signals)
+
+	cmd := &exec.Cmd{Path: path, Args: argv}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "init: %v\n", err)
+		return 127
+	}
+	child := cmd.Process.Pid
+
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGCHLD:
+		case syscall.SIGURG:
+			// Used internally by the Go runtime for goroutine preemption.
+			continue
+		default:
+			_ = syscall.Kill(child, sig.(syscall.Signal))
+			continue
+		}
+		if status, exited := reapChildren(child); exited {
+			return exitCodeFromStatus(status)
+		}
+	}
+	return 0
+}
+
+// reapChildren collects every child that has exited so far. It reports the
+// wait status of the main child if it was among them.
+//
+// cmd.Wait isn't used for the main child because waiting on any pid here
+// would race with it for the same exit status.
+func reapChildren(main int) (syscall.WaitStatus, bool) {
+	var mainStatus syscall.WaitStatus
+	mainExited := false
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || pid <= 0 {
+			return mainStatus, mainExited
+		}
+		if pid == main {
+			mainStatus = status
+			mainExited = true
+		}
+	}
+}
+
+func exitCodeFromStatus(status syscall.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
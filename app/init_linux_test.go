@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestInitReapsOrphans(t *testing.T) {
+	docker, image := runTestImage(t)
+	tests := []struct {
+		flags []string
+		want  string
+	}{
+		{flags: []string{"--init"}, want: "0 zombies\n"},
+		// The probe, as PID 1, doesn't reap the orphan.
+		{want: "1 zombies\n"},
+	}
+	for _, tt := range tests {
+		args := append(append([]string{"run", "--rm"}, tt.flags...), image, "/probe", "orphan")
+		out, err := docker(args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%q: %v\n%s", args, err, out)
+		}
+		if string(out) != tt.want {
+			t.Errorf("%q: got %q, want %q", args, out, tt.want)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// fetchImageMetadata resolves an image's manifest and config without
+// downloading any layers. The config of an artifact other than an image is
+// left empty: it is of some other kind.
+func fetchImageMetadata(image, scopeActions string) (imageMetadata, error) {
+	var meta imageMetadata
+	src, ref, err := openSource(image, scopeActions)
+	if err != nil {
+		return meta, err
+	}
+	if meta.Manifest, err = fetchManifest(src, ref); err != nil {
+		return meta, err
+	}
+	if _, ok := artifactType(meta.Manifest); ok {
+		return meta, nil
+	}
+	meta.Config, err = fetchConfig(src, meta.Manifest, nil)
+	return meta, err
+}
+
+// fetchRawImageConfig returns the image's config blob exactly as stored,
+// verified against the manifest's config digest.
+func fetchRawImageConfig(image, scopeActions string) ([]byte, error) {
+	src, ref, err := openSource(image, scopeActions)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := fetchManifest(src, ref)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.Config.Digest == "" {
+		return nil, fmt.Errorf("manifest of %s has no config", image)
+	}
+	return readSourceBlob(src, "image config", manifest.Config.Digest)
+}
+
+// imageInspect is the output of `inspect`.
+type imageInspect struct {
+	Name         string            `json:"Name"`
+	Architecture string            `json:"Architecture"`
+	Os           string            `json:"Os"`
+	Config       ContainerConfig   `json:"Config"`
+	Layers       []string          `json:"Layers"`
+	Annotations  map[string]string `json:"Annotations,omitempty"`
+	// Labels are the image config's labels merged with the manifest's
+	// annotations, annotations taking precedence.
+	Labels map[string]string `json:"Labels,omitempty"`
+	// ArtifactType is set for artifacts other than container images, such
+	// as Helm charts, which can be inspected but not run.
+	ArtifactType string `json:"ArtifactType,omitempty"`
+	// Provenance has the predefined org.opencontainers.image.* labels and
+	// annotations, by friendly name.
+	Provenance *imageProvenance `json:"Provenance,omitempty"`
+}
+
+func newImageInspect(name string, meta imageMetadata) imageInspect {
+	manifest, config := meta.Manifest, meta.Config
+	out := imageInspect{
+		Name:         name,
+		Architecture: config.Architecture,
+		Os:           config.OS,
+		Config:       config.Config,
+		Layers:       []string{},
+		Annotations:  manifest.Annotations,
+	}
+	for _, layer := range manifest.Layers {
+		out.Layers = append(out.Layers, layer.Digest)
+	}
+	if labels := mergeLabels(config.Config.Labels, manifest.Annotations); len(labels) > 0 {
+		out.Labels = labels
+		out.Provenance = newImageProvenance(labels)
+	}
+	out.ArtifactType, _ = artifactType(manifest)
+	return out
+}
+
+// imageTemplateData is what `inspect --format` templates see of an image.
+// Unlike the JSON output, layers come with their sizes:
+//
+//	.Name                     the image as given
+//	.ID                       the image ID, i.e. the config digest
+//	.Architecture, .Os        the platform
+//	.Config                   the container defaults: .Env, .Cmd, .Entrypoint,
+//	                          .User, .WorkingDir, .Labels, .ExposedPorts, ...
+//	.Layers                   each with .Digest, .Size and .MediaType
+//	.Size                     the layers' total size, as downloaded
+//	.Labels, .Annotations     as in the JSON output
+//	.ArtifactType             what the image is if it isn't a container image
+//	.Provenance               .Title, .Version, .Revision, .Source, .Created,
+//	                          ... from the org.opencontainers.image.* labels
+//	                          and annotations, nil if there are none
+type imageTemplateData struct {
+	Name         string
+	ID           string
+	Architecture string
+	Os           string
+	Config       ContainerConfig
+	Layers       []DockerLayer
+	Size         int64
+	Labels       map[string]string
+	Annotations  map[string]string
+	ArtifactType string
+	Provenance   *imageProvenance
+}
+
+func newImageTemplateData(name string, meta imageMetadata) imageTemplateData {
+	inspect := newImageInspect(name, meta)
+	data := imageTemplateData{
+		Name:         name,
+		ID:           meta.Manifest.Config.Digest,
+		Architecture: inspect.Architecture,
+		Os:           inspect.Os,
+		Config:       inspect.Config,
+		Layers:       meta.Manifest.Layers,
+		Labels:       inspect.Labels,
+		Annotations:  inspect.Annotations,
+		ArtifactType: inspect.ArtifactType,
+		Provenance:   inspect.Provenance,
+	}
+	for _, layer := range meta.Manifest.Layers {
+		data.Size += layer.Size
+	}
+	return data
+}
+
+// inspectTemplateFuncs are available to --format templates, along with the
+// text/template builtins.
+var inspectTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"join":  strings.Join,
+	"split": strings.Split,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	// size renders a byte count the way `images` does.
+	"size": formatSize,
+	// short abbreviates a digest to an ID the way `images` does.
+	"short": shortImageID,
+}
+
+// parseInspectFormat parses a --format template.
+func parseInspectFormat(format string) (*template.Template, error) {
+	tmpl, err := template.New("format").Funcs(inspectTemplateFuncs).Parse(format)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --format template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// printFormatted executes tmpl on data and prints the result on a line of
+// its own. Nothing is printed if the template fails.
+func printFormatted(tmpl *template.Template, data interface{}) error {
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return fmt.Errorf("executing --format template: %w", err)
+	}
+	out.WriteByte('\n')
+	_, err := out.WriteTo(os.Stdout)
+	return err
+}
+
+func inspectCommand(argv []string) {
+	flags := flag.NewFlagSet("inspect", flag.ExitOnError)
+	scopeActions := flags.String("registry-scope", defaultScopeActions, "comma-separated `actions` to request in the registry token scope")
+	var caCerts stringsFlag
+	flags.Var(&caCerts, "ca-cert", "also trust the CA certificates in PEM `file`, or in the .pem/.crt/.cert files of a directory, for registry TLS (repeatable)")
+	timeouts := httpTimeoutFlags(flags)
+	platform := flags.String("platform", targetPlatform.String(), "pick the image for `os/arch[/variant]` from multi-platform images")
+	rawConfig := flags.Bool("config", false, "print the raw image config JSON as served, after verifying its digest")
+	format := flags.String("format", "", "print the result of a Go `template` instead of JSON; images have .Name, .ID, .Architecture, .Os, .Config, .Layers (with .Digest and .Size), .Size, .Labels, .Annotations, .ArtifactType and .Provenance, and json, join, split, lower, upper, size and short are available as functions")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), inspectUsage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(argv)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	if err := useCACerts(caCerts); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	if err := useHTTPTimeouts(timeouts); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	if err := usePlatform(*platform); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	var tmpl *template.Template
+	if *format != "" {
+		if *rawConfig {
+			fmt.Fprintln(os.Stderr, "Err: --format and --config can't be used together")
+			os.Exit(1)
+		}
+		var err error
+		if tmpl, err = parseInspectFormat(*format); err != nil {
+			fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if state, ok := runningContainer(flags.Arg(0)); ok && !*rawConfig {
+		if tmpl != nil {
+			if err := printFormatted(tmpl, state); err != nil {
+				fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(state); err != nil {
+			fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *rawConfig {
+		data, err := fetchRawImageConfig(flags.Arg(0), *scopeActions)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+			os.Exit(1)
+		}
+		var out bytes.Buffer
+		if err := json.Indent(&out, data, "", "  "); err != nil {
+			fmt.Fprintf(os.Stderr, "Err: image config is not valid JSON: %v\n", err)
+			os.Exit(1)
+		}
+		out.WriteByte('\n')
+		out.WriteTo(os.Stdout)
+		return
+	}
+	meta, err := fetchImageMetadata(flags.Arg(0), *scopeActions)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	if tmpl != nil {
+		if err := printFormatted(tmpl, newImageTemplateData(flags.Arg(0), meta)); err != nil {
+			fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(newImageInspect(flags.Arg(0), meta)); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFetchRawImageConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		// tamper rewrites the stored config blob, given its contents.
+		tamper       func(config []byte) []byte
+		wantMismatch bool
+	}{
+		{name: "intact"},
+		{
+			name:         "altered",
+			tamper:       func(config []byte) []byte { return bytes.Replace(config, []byte("/bin"), []byte("/sbin"), 1) },
+			wantMismatch: true,
+		},
+		{
+			// Whitespace changes the digest too: the config is shown as served.
+			name:         "reformatted",
+			tamper:       func(config []byte) []byte { return append(config, '\n') },
+			wantMismatch: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layout := filepath.Join(t.TempDir(), "layout")
+			desc := writeTestImage(t, layout, "latest", testLayer(t, testEntry{name: "f"}))
+			data, err := readOCIBlob(layout, desc.Digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var manifest ociManifest
+			if err := json.Unmarshal(data, &manifest); err != nil {
+				t.Fatal(err)
+			}
+			config, err := readOCIBlob(layout, manifest.Config.Digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.tamper != nil {
+				path, err := ociBlobPath(layout, manifest.Config.Digest)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, tt.tamper(config), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := fetchRawImageConfig(ociLayoutPrefix+layout+":latest", "pull")
+			if tt.wantMismatch {
+				var mismatch *digestMismatchError
+				if !errors.As(err, &mismatch) {
+					t.Fatalf("err = %v, want a digest mismatch", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, config) {
+				t.Errorf("config = %s, want it as stored: %s", got, config)
+			}
+		})
+	}
+}
+
+func TestInspectFormat(t *testing.T) {
+	layer1, layer2 := "sha256:"+strings.Repeat("1", 64), "sha256:"+strings.Repeat("2", 64)
+	meta := imageMetadata{
+		Manifest: DockerManifestResponse{
+			SchemaVersion: 2,
+			Config:        DockerLayer{Digest: "sha256:" + strings.Repeat("c", 64)},
+			Layers: []DockerLayer{
+				{MediaType: ociLayerMediaType, Digest: layer1, Size: 5_610_000},
+				{MediaType: ociLayerMediaType, Digest: layer2, Size: 1000},
+			},
+			Annotations: map[string]string{"org.opencontainers.image.revision": "abc123"},
+		},
+		Config: ImageConfig{
+			Architecture: "arm64",
+			OS:           "linux",
+			Config: ContainerConfig{
+				Env:          []string{"PATH=/bin", "LANG=C"},
+				Entrypoint:   []string{"/entrypoint.sh"},
+				Cmd:          []string{"serve", "--port", "80"},
+				Labels:       map[string]string{"maintainer": "ops", "org.opencontainers.image.version": "1.2"},
+				ExposedPorts: map[string]struct{}{"80/tcp": {}, "443/tcp": {}},
+			},
+		},
+	}
+	data := newImageTemplateData("app:1.2", meta)
+	tests := []struct {
+		format   string
+		want     string
+		parseErr bool
+		execErr  bool
+	}{
+		{format: "{{.Name}} {{.Architecture}}/{{.Os}}", want: "app:1.2 arm64/linux"},
+		{format: "{{range .Layers}}{{.Digest}} {{.Size}}\n{{end}}", want: layer1 + " 5610000\n" + layer2 + " 1000\n"},
+		{format: "{{len .Layers}} layers, {{size .Size}}", want: "2 layers, 5.61MB"},
+		{format: "{{short .ID}}", want: strings.Repeat("c", 12)},
+		{format: "{{join .Config.Entrypoint \" \"}} {{join .Config.Cmd \" \"}}", want: "/entrypoint.sh serve --port 80"},
+		{format: "{{json .Config.Env}}", want: `["PATH=/bin","LANG=C"]`},
+		// Maps range in key order.
+		{format: "{{range $p, $_ := .Config.ExposedPorts}}{{$p}} {{end}}", want: "443/tcp 80/tcp "},
+		{format: `{{index .Labels "maintainer"}}`, want: "ops"},
+		{format: `{{index .Config.Labels "maintainer" | upper}}`, want: "OPS"},
+		{format: "{{.Provenance.Version}} {{.Provenance.Revision}}", want: "1.2 abc123"},
+		{format: `{{if eq .Os "linux"}}linux{{else}}other{{end}}`, want: "linux"},
+		{format: `{{index (split "a=b" "=") 1}}`, want: "b"},
+		{format: "{{.Name", parseErr: true},
+		{format: "{{nosuchfunc .Name}}", parseErr: true},
+		{format: "{{.NoSuchField}}", execErr: true},
+		{format: "{{index .Layers 5}}", execErr: true},
+	}
+	for _, tt := range tests {
+		tmpl, err := parseInspectFormat(tt.format)
+		if tt.parseErr {
+			if err == nil || !strings.Contains(err.Error(), "invalid --format template") {
+				t.Errorf("parseInspectFormat(%q) = %v, want a parse error", tt.format, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseInspectFormat(%q): %v", tt.format, err)
+			continue
+		}
+		var out bytes.Buffer
+		err = tmpl.Execute(&out, data)
+		if tt.execErr {
+			if err == nil {
+				t.Errorf("%q = %q, want an error", tt.format, out.String())
+			}
+			if err := printFormatted(tmpl, data); err == nil || !strings.Contains(err.Error(), "executing --format template") {
+				t.Errorf("printFormatted(%q) = %v, want an execution error", tt.format, err)
+			}
+			continue
+		}
+		if err != nil || out.String() != tt.want {
+			t.Errorf("%q = %q, %v, want %q", tt.format, out.String(), err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// parseLabels builds the user-supplied labels from --label-file files and
+// --label flags. Files are read in order and flags are applied last, so a
+// --label always overrides the same key from a file.
+func parseLabels(labels, files []string) (map[string]string, error) {
+	result := map[string]string{}
+	for _, path := range files {
+		if err := readLabelFile(path, result); err != nil {
+			return nil, err
+		}
+	}
+	for _, label := range labels {
+		if err := addLabel(result, label); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// readLabelFile reads key=value lines into labels. Blank lines and lines
+// starting with # are ignored.
+func readLabelFile(path string, labels map[string]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if err := addLabel(labels, text); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// addLabel adds a "key=value" label. Like Docker, a bare "key" is a label
+// with an empty value.
+func addLabel(labels map[string]string, label string) error {
+	key, value, _ := strings.Cut(label, "=")
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return fmt.Errorf("invalid label %q: empty key", label)
+	}
+	labels[key] = value
+	return nil
+}
+
+// mergeLabels combines label sets, with later sets taking precedence. The
+// effective labels of a container are, from lowest to highest precedence,
+// the image config's labels, the manifest's annotations and the user's
+// --label-file and --label values.
+func mergeLabels(sets ...map[string]string) map[string]string {
+	merged := map[string]string{}
+	for _, set := range sets {
+		for k, v := range set {
+			merged[k] = v
+		}
+	}
+	return merged
+}
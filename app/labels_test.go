@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseLabels(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	first := write("first", "# team labels\n\nteam=infra\ntier=backend\nbare\nurl=https://x/?a=b\n")
+	second := write("second", "team=platform\n")
+	bad := write("bad", "ok=1\n=oops\n")
+	tests := []struct {
+		name    string
+		labels  []string
+		files   []string
+		want    map[string]string
+		wantErr string
+	}{
+		{name: "none", want: map[string]string{}},
+		{name: "flags", labels: []string{"a=1", "b", "c="}, want: map[string]string{"a": "1", "b": "", "c": ""}},
+		{name: "file", files: []string{first}, want: map[string]string{"team": "infra", "tier": "backend", "bare": "", "url": "https://x/?a=b"}},
+		{name: "later file wins", files: []string{first, second}, want: map[string]string{"team": "platform", "tier": "backend", "bare": "", "url": "https://x/?a=b"}},
+		{name: "flag wins over files", labels: []string{"team=mine"}, files: []string{first, second}, want: map[string]string{"team": "mine", "tier": "backend", "bare": "", "url": "https://x/?a=b"}},
+		{name: "later flag wins", labels: []string{"a=1", "a=2"}, want: map[string]string{"a": "2"}},
+		{name: "empty key", labels: []string{"=1"}, wantErr: `invalid label "=1": empty key`},
+		{name: "empty key in a file", files: []string{bad}, wantErr: bad + `:2: invalid label "=oops": empty key`},
+		{name: "missing file", files: []string{filepath.Join(dir, "missing")}, wantErr: "open " + filepath.Join(dir, "missing") + ": no such file or directory"},
+	}
+	for _, tt := range tests {
+		got, err := parseLabels(tt.labels, tt.files)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("%s: parseLabels = %v, %v, want error %q", tt.name, got, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: parseLabels = %v, %v, want %v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestMergeLabels(t *testing.T) {
+	image := map[string]string{"version": "1.0", "vendor": "image", "org.opencontainers.image.title": "from config"}
+	annotations := map[string]string{"org.opencontainers.image.title": "from manifest", "vendor": "manifest"}
+	user := map[string]string{"vendor": "user"}
+	got := mergeLabels(image, annotations, user)
+	want := map[string]string{"version": "1.0", "vendor": "user", "org.opencontainers.image.title": "from manifest"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mergeLabels = %v, want %v", got, want)
+	}
+	if image["vendor"] != "image" {
+		t.Error("mergeLabels changed the image's labels")
+	}
+	if got := mergeLabels(nil, nil); len(got) != 0 {
+		t.Errorf("mergeLabels of nothing = %v", got)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for --max-concurrent-downloads and --max-concurrent-extractions.
+// A single extraction applies each layer straight onto the rootfs.
+const (
+	defaultConcurrentDownloads   = 3
+	defaultConcurrentExtractions = 1
+)
+
+// localLayer is a layer made available on disk by a layerFetcher: either
+// a layer tarball or a layer unpacked by unpackLayer. Temporary ones belong
+// to the pull and may be consumed by it.
+type localLayer struct {
+	blob      string
+	tree      string
+	temporary bool
+}
+
+// layerFetcher makes layer available on disk, using work for any temporary
+// files and buf as its copy buffer.
+type layerFetcher func(layer DockerLayer, work string, buf []byte) (localLayer, error)
+
+// layerJob tracks one layer through pullLayers.
+type layerJob struct {
+	layer       DockerLayer
+	compression string
+	timing      *layerTiming
+	progress    *layerProgress
+	local       localLayer
+	err         error
+	done        chan struct{}
+}
+
+// pullLayers applies layers onto the rootfs at dir, in order. Up to
+// MaxConcurrentDownloads layers are fetched at once. With more than one
+// concurrent extraction, fetched layers are unpacked into directories of
+// their own in parallel, and only moving them onto the rootfs, which is
+// cheap, happens in layer order.
+func pullLayers(dir string, layers []DockerLayer, opts pullOptions, fetch layerFetcher) error {
+	downloads, extractions := opts.MaxConcurrentDownloads, opts.MaxConcurrentExtractions
+	if downloads <= 0 {
+		downloads = defaultConcurrentDownloads
+	}
+	if extractions <= 0 {
+		extractions = defaultConcurrentExtractions
+	}
+	bufferSize := opts.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultBufferSize
+	}
+	buffers := sync.Pool{New: func() interface{} { return make([]byte, bufferSize) }}
+
+	// Temporary files live next to the rootfs rather than in it, where a
+	// layer's whiteouts could remove them, but on the same filesystem so
+	// unpacked layers can be moved into place.
+	work := dir + ".layers"
+	if err := os.MkdirAll(work, 0o755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(work)
+
+	downloadSlots := make(chan struct{}, downloads)
+	extractSlots := make(chan struct{}, extractions)
+	abort := make(chan struct{})
+	jobs := make([]*layerJob, len(layers))
+	for i, layer := range layers {
+		// A layer we can't extract fails the pull before anything is
+		// downloaded.
+		compression, err := layerCompression(layer.MediaType)
+		if err != nil {
+			return fmt.Errorf("layer %s: %w", layer.Digest, err)
+		}
+		jobs[i] = &layerJob{
+			layer:       layer,
+			compression: compression,
+			timing:      opts.Timings.layer(layer.Digest),
+			progress:    opts.Progress.layer(layer.Digest, layer.Size),
+			done:        make(chan struct{}),
+		}
+	}
+	var owners *ownershipLog
+	if unprivilegedExtraction() {
+		var err error
+		if owners, err = createOwnershipLog(dir + ownershipSuffix); err != nil {
+			return err
+		}
+		// The record has to be in layer order.
+		extractions = 1
+	}
+	start := time.Now()
+	var wg sync.WaitGroup
+	wg.Add(len(jobs))
+	// Download slots are handed out in layer order. Layers are applied in
+	// that order, so a slot taken by a later layer while an earlier one waits
+	// would only delay the first extraction.
+	go func() {
+		for _, job := range jobs {
+			job := job
+			if !acquireSlot(downloadSlots, abort) {
+				close(job.done)
+				wg.Done()
+				continue
+			}
+			go func() {
+				defer wg.Done()
+				defer close(job.done)
+				buf := buffers.Get().([]byte)
+				defer buffers.Put(buf)
+				start := time.Now()
+				job.local, job.err = fetch(job.layer, work, buf)
+				if job.err == nil && opts.KeepBlobs != "" {
+					job.err = keepLayerBlob(opts.KeepBlobs, job.layer, job.local, buf)
+				}
+				<-downloadSlots
+				if job.timing != nil {
+					job.timing.Download = time.Since(start)
+				}
+				if job.err != nil || extractions == 1 || job.local.blob == "" {
+					return
+				}
+				if !acquireSlot(extractSlots, abort) {
+					return
+				}
+				start = time.Now()
+				job.progress.set("Extracting")
+				job.err = unpackLocalLayer(&job.local, work, job.compression, job.layer.DiffID, buf)
+				<-extractSlots
+				if job.timing != nil {
+					job.timing.Extract = time.Since(start)
+				}
+			}()
+		}
+	}()
+	buf := buffers.Get().([]byte)
+	err := applyLayerJobs(dir, jobs, buf, owners, func() {
+		if opts.Timings != nil {
+			opts.Timings.FirstLayer = time.Since(start)
+		}
+	})
+	if err != nil {
+		close(abort)
+	}
+	// Wait for jobs still in flight before work is removed.
+	wg.Wait()
+	if err != nil {
+		owners.discard()
+		return err
+	}
+	return owners.finish()
+}
+
+// keepLayerBlob stores a fetched layer's blob in the OCI image layout at
+// layout, as a hard link if it can.
+func keepLayerBlob(layout string, layer DockerLayer, local localLayer, buf []byte) error {
+	if local.blob == "" {
+		return fmt.Errorf("the layer was taken unpacked from the cache, so its blob can't be kept")
+	}
+	return storeOCIBlobFile(layout, layer.Digest, local.blob, buf)
+}
+
+// acquireSlot takes a slot from the semaphore slots, unless the pull is
+// aborted first.
+func acquireSlot(slots chan struct{}, abort chan struct{}) bool {
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-abort:
+		return false
+	}
+}
+
+// applyLayerJobs applies each job's layer onto dir as soon as it and all the
+// layers below it are available, calling firstApplied once the first one is.
+// However the downloads and unpacking finish, layers are applied strictly in
+// the manifest's order, bottom first, so that a path more than one layer
+// writes ends up with the topmost layer's version of it.
+func applyLayerJobs(dir string, jobs []*layerJob, buf []byte, owners *ownershipLog, firstApplied func()) error {
+	for i, job := range jobs {
+		<-job.done
+		if job.err != nil {
+			return fmt.Errorf("layer %s: %w", job.layer.Digest, job.err)
+		}
+		start := time.Now()
+		job.progress.set("Extracting")
+		err := applyLocalLayer(dir, job.local, job.compression, job.layer.DiffID, buf, owners)
+		if job.timing != nil {
+			job.timing.Extract += time.Since(start)
+		}
+		if err != nil {
+			return fmt.Errorf("layer %s: %w", job.layer.Digest, err)
+		}
+		job.progress.done("Pull complete")
+		if i == 0 {
+			firstApplied()
+		}
+	}
+	return nil
+}
+
+// unpackLocalLayer replaces a fetched layer tarball with the layer unpacked
+// into a temporary directory in work.
+func unpackLocalLayer(local *localLayer, work, compression, diffID string, buf []byte) error {
+	tree, err := os.MkdirTemp(work, "unpack-")
+	if err != nil {
+		return err
+	}
+	if err := unpackLayerFile(tree, local.blob, compression, diffID, buf, nil); err != nil {
+		return err
+	}
+	if local.temporary {
+		os.Remove(local.blob)
+	}
+	*local = localLayer{tree: tree, temporary: true}
+	return nil
+}
+
+// applyLocalLayer applies a fetched layer onto dir. compression and diffID
+// only matter for a layer tarball, and owners only for one that is extracted
+// straight on. Unpacked trees were checked against diffID when unpacked.
+func applyLocalLayer(dir string, local localLayer, compression, diffID string, buf []byte, owners *ownershipLog) error {
+	switch {
+	case local.tree != "" && local.temporary:
+		return moveLayerTree(dir, local.tree)
+	case local.tree != "":
+		return applyLayerTree(dir, local.tree, buf)
+	}
+	err := extractLayerFile(dir, local.blob, compression, diffID, buf, owners)
+	if local.temporary {
+		os.Remove(local.blob)
+	}
+	return err
+}
+
+// applyLayerTree applies a layer unpacked by unpackLayer on top of the rootfs
+// at dir, with the same semantics as extracting the original tarball.
+func applyLayerTree(dir, tree string, buf []byte) error {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(writeRootfsTar(tree, w))
+	}()
+	err := extractLayer(dir, r, buf)
+	r.CloseWithError(io.ErrClosedPipe)
+	return err
+}
+
+// moveLayerTree is applyLayerTree for a tree that may be consumed: entries
+// are renamed into place instead of being copied, so tree must be on the
+// same filesystem as dir. Hard links survive, since renaming keeps inodes.
+func moveLayerTree(dir, tree string) error {
+	u := &layerUnpacker{root: dir, applyWhiteouts: true, written: map[string]bool{}}
+	return filepath.Walk(tree, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(tree, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		name := filepath.Clean("/" + filepath.ToSlash(rel))
+		parent, err := resolveInRoot(dir, filepath.Dir(name))
+		if err != nil {
+			return err
+		}
+		base := info.Name()
+		if base == whiteoutOpaque {
+			return u.hideLower(parent)
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			target, err := whiteoutTarget(dir, parent, base)
+			if err != nil {
+				return err
+			}
+			return os.RemoveAll(target)
+		}
+		if err := os.MkdirAll(parent, 0o755); err != nil {
+			return err
+		}
+		target := filepath.Join(parent, base)
+		u.written[target] = true
+		if err := removeConflicting(target, info.IsDir()); err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return os.Rename(path, target)
+		}
+		// Directories are merged with what lower layers left, so only their
+		// metadata is taken over; their entries follow in the walk.
+		if err := os.Mkdir(target, info.Mode().Perm()); err != nil && !os.IsExist(err) {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		return applyMetadata(target, hdr)
+	})
+}
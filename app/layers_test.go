@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// delayedFetcher fetches layers from blobs, each taking the delay given for
+// it, and records the order the fetches finish in.
+type delayedFetcher struct {
+	blobs  map[string][]byte
+	delays map[string]time.Duration
+
+	mu       sync.Mutex
+	finished []string
+}
+
+func (f *delayedFetcher) fetch(layer DockerLayer, work string, buf []byte) (localLayer, error) {
+	time.Sleep(f.delays[layer.Digest])
+	data, ok := f.blobs[layer.Digest]
+	if !ok {
+		return localLayer{}, errors.New("blob unknown")
+	}
+	file, err := os.CreateTemp(work, "blob-")
+	if err != nil {
+		return localLayer{}, err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	f.mu.Lock()
+	f.finished = append(f.finished, layer.Digest)
+	f.mu.Unlock()
+	return localLayer{blob: file.Name(), temporary: true}, err
+}
+
+func TestPullLayersAppliesInManifestOrder(t *testing.T) {
+	// Each layer writes f; the middle one adds g, which the top one
+	// deletes again.
+	tars := [][]byte{
+		testLayer(t, testEntry{name: "f", body: "bottom"}),
+		testLayer(t, testEntry{name: "f", body: "middle"}, testEntry{name: "g", body: "middle"}),
+		testLayer(t, testEntry{name: "f", body: "top"}, testEntry{name: ".wh.g"}),
+	}
+	tests := []struct {
+		name        string
+		extractions int
+		// delays are how long each layer takes to arrive, bottom first.
+		delays []time.Duration
+	}{
+		{name: "bottom layer last", extractions: 1, delays: []time.Duration{150 * time.Millisecond, 50 * time.Millisecond, 0}},
+		{name: "top layer first", extractions: 1, delays: []time.Duration{50 * time.Millisecond, 100 * time.Millisecond, 0}},
+		{name: "unpacked in parallel", extractions: 3, delays: []time.Duration{150 * time.Millisecond, 50 * time.Millisecond, 0}},
+		{name: "in order", extractions: 1, delays: []time.Duration{0, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetcher := &delayedFetcher{blobs: map[string][]byte{}, delays: map[string]time.Duration{}}
+			var layers []DockerLayer
+			for i, data := range tars {
+				digest := sha256Digest(data)
+				fetcher.blobs[digest] = data
+				fetcher.delays[digest] = tt.delays[i]
+				layers = append(layers, DockerLayer{
+					MediaType: "application/vnd.oci.image.layer.v1.tar",
+					Digest:    digest,
+					Size:      int64(len(data)),
+					DiffID:    digest,
+				})
+			}
+			dir := filepath.Join(t.TempDir(), "rootfs")
+			if err := os.Mkdir(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			opts := pullOptions{MaxConcurrentDownloads: len(layers), MaxConcurrentExtractions: tt.extractions}
+			if err := pullLayers(dir, layers, opts, fetcher.fetch); err != nil {
+				t.Fatal(err)
+			}
+			if tt.delays[0] > 0 && fetcher.finished[0] == layers[0].Digest {
+				t.Fatal("the bottom layer arrived first; the test proves nothing")
+			}
+			if got, err := os.ReadFile(filepath.Join(dir, "f")); err != nil || string(got) != "top" {
+				t.Errorf("f = %q, %v, want the top layer's", got, err)
+			}
+			if _, err := os.Lstat(filepath.Join(dir, "g")); !os.IsNotExist(err) {
+				t.Errorf("g, which the top layer deletes, is there: %v", err)
+			}
+		})
+	}
+}
+
+func TestPullLayersFailureStopsApplying(t *testing.T) {
+	good := testLayer(t, testEntry{name: "f", body: "bottom"})
+	above := testLayer(t, testEntry{name: "h", body: "above"})
+	fetcher := &delayedFetcher{blobs: map[string][]byte{sha256Digest(good): good, sha256Digest(above): above}, delays: map[string]time.Duration{}}
+	layers := []DockerLayer{
+		{MediaType: "application/vnd.oci.image.layer.v1.tar", Digest: sha256Digest(good), DiffID: sha256Digest(good)},
+		{MediaType: "application/vnd.oci.image.layer.v1.tar", Digest: sha256Digest([]byte("missing"))},
+		{MediaType: "application/vnd.oci.image.layer.v1.tar", Digest: sha256Digest(above), DiffID: sha256Digest(above)},
+	}
+	dir := filepath.Join(t.TempDir(), "rootfs")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := pullLayers(dir, layers, pullOptions{MaxConcurrentDownloads: 3}, fetcher.fetch); err == nil {
+		t.Fatal("expected an error")
+	}
+	// Nothing above the missing layer is applied, however early it came.
+	if _, err := os.Lstat(filepath.Join(dir, "h")); !os.IsNotExist(err) {
+		t.Errorf("a layer above the missing one was applied: %v", err)
+	}
+}
+
+// BenchmarkPullLayers pulls a six-layer image whose layers each take a while
+// to arrive, unpacking them one at a time and in parallel.
+func BenchmarkPullLayers(b *testing.B) {
+	fetcher := &delayedFetcher{blobs: map[string][]byte{}, delays: map[string]time.Duration{}}
+	var layers []DockerLayer
+	var size int64
+	for i := int64(0); i < 6; i++ {
+		layer := benchmarkLayer(b, i)
+		blob := gzipLayer(b, layer)
+		digest := sha256Digest(blob)
+		fetcher.blobs[digest] = blob
+		fetcher.delays[digest] = 50 * time.Millisecond
+		layers = append(layers, DockerLayer{MediaType: ociLayerMediaType, Digest: digest, Size: int64(len(blob)), DiffID: sha256Digest(layer)})
+		size += int64(len(layer))
+	}
+	for _, extractions := range []int{1, 3, 6} {
+		b.Run(fmt.Sprintf("%d extractions", extractions), func(b *testing.B) {
+			opts := pullOptions{MaxConcurrentDownloads: len(layers), MaxConcurrentExtractions: extractions}
+			b.SetBytes(size)
+			dir := filepath.Join(b.TempDir(), "rootfs")
+			for i := 0; i < b.N; i++ {
+				if err := os.Mkdir(dir, 0o755); err != nil {
+					b.Fatal(err)
+				}
+				if err := pullLayers(dir, layers, opts, fetcher.fetch); err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				os.RemoveAll(dir)
+				b.StartTimer()
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// logOptions are a container's --log-opt settings, as Docker's json-file
+// log driver takes them. A zero MaxSize keeps each log in a single file that
+// grows without bound.
+type logOptions struct {
+	// MaxSize is how big a stream's log file may grow before it's rotated.
+	MaxSize int64
+	// MaxFile is how many files of a stream's log are kept, the one being
+	// written included. Older ones are removed as logs rotate.
+	MaxFile int
+}
+
+// parseLogOpts parses --log-opt key=value flags.
+func parseLogOpts(values []string) (logOptions, error) {
+	opts := logOptions{MaxFile: 1}
+	maxFileSet := false
+	for _, value := range values {
+		key, v, ok := strings.Cut(value, "=")
+		if !ok {
+			return opts, fmt.Errorf("invalid --log-opt %q: want key=value", value)
+		}
+		switch key {
+		case "max-size":
+			size, err := parseSize(v)
+			if err != nil || size <= 0 {
+				return opts, fmt.Errorf("invalid --log-opt max-size %q: want a positive size, e.g. 10m", v)
+			}
+			opts.MaxSize = size
+		case "max-file":
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return opts, fmt.Errorf("invalid --log-opt max-file %q: want a number of files, at least 1", v)
+			}
+			opts.MaxFile, maxFileSet = n, true
+		default:
+			return opts, fmt.Errorf("unknown --log-opt %q: want max-size or max-file", key)
+		}
+	}
+	if maxFileSet && opts.MaxSize == 0 {
+		return opts, fmt.Errorf("--log-opt max-file needs max-size")
+	}
+	return opts, nil
+}
+
+// rotatedLogPath is the log at path as it was n rotations ago.
+func rotatedLogPath(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// rotatedLogFiles returns the files the log at path is in, the rotated ones
+// first, oldest first, and path last.
+func rotatedLogFiles(path string) []string {
+	var files []string
+	for n := 1; ; n++ {
+		if _, err := os.Stat(rotatedLogPath(path, n)); err != nil {
+			break
+		}
+		files = append([]string{rotatedLogPath(path, n)}, files...)
+	}
+	return append(files, path)
+}
+
+// removeRotatedLogs removes what an earlier container of the same name left
+// of the log at path.
+func removeRotatedLogs(path string) {
+	for _, file := range rotatedLogFiles(path) {
+		if file != path {
+			os.Remove(file)
+		}
+	}
+}
+
+// rotatingLog writes a log to path, rotating it once it would grow past the
+// maximum size: path becomes path.1, path.1 becomes path.2 and so on, and
+// what would be past opts.MaxFile files is removed. Lines are never split,
+// so a file only grows past the size by a line that doesn't fit in any.
+type rotatingLog struct {
+	mu   sync.Mutex
+	path string
+	opts logOptions
+	file *os.File
+	size int64
+}
+
+func newRotatingLog(path string, file *os.File, opts logOptions) *rotatingLog {
+	return &rotatingLog{path: path, opts: opts, file: file}
+}
+
+func (l *rotatingLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	written := 0
+	// The output of a container comes through a pipe, so a write may be
+	// several lines, which are rotated one by one.
+	for len(p) > 0 {
+		line := p
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			line = p[:i+1]
+		}
+		if l.size > 0 && l.size+int64(len(line)) > l.opts.MaxSize {
+			if err := l.rotate(); err != nil {
+				return written, err
+			}
+		}
+		n, err := l.file.Write(line)
+		l.size += int64(n)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(line):]
+	}
+	return written, nil
+}
+
+func (l *rotatingLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	// With a single file, the log starts over in it.
+	if l.opts.MaxFile > 1 {
+		os.Remove(rotatedLogPath(l.path, l.opts.MaxFile-1))
+		for n := l.opts.MaxFile - 2; n >= 1; n-- {
+			os.Rename(rotatedLogPath(l.path, n), rotatedLogPath(l.path, n+1))
+		}
+		if err := os.Rename(l.path, rotatedLogPath(l.path, 1)); err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	l.file, l.size = file, 0
+	return nil
+}
+
+func (l *rotatingLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
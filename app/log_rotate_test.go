@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLogOpts(t *testing.T) {
+	tests := []struct {
+		values  []string
+		want    logOptions
+		wantErr bool
+	}{
+		{values: nil, want: logOptions{MaxFile: 1}},
+		{values: []string{"max-size=10m"}, want: logOptions{MaxSize: 10 << 20, MaxFile: 1}},
+		{values: []string{"max-size=1k", "max-file=3"}, want: logOptions{MaxSize: 1 << 10, MaxFile: 3}},
+		{values: []string{"max-file=3"}, wantErr: true},
+		{values: []string{"max-size=0"}, wantErr: true},
+		{values: []string{"max-size=1k", "max-file=0"}, wantErr: true},
+		{values: []string{"max-size"}, wantErr: true},
+		{values: []string{"mode=non-blocking"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseLogOpts(tt.values)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseLogOpts(%q) = %+v, want an error", tt.values, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseLogOpts(%q) = %+v, %v, want %+v", tt.values, got, err, tt.want)
+		}
+	}
+}
+
+func TestRotatingLog(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   logOptions
+		writes []string
+		// files are the contents expected of the log, path.1, path.2 and
+		// so on, and no more files.
+		files []string
+	}{
+		{
+			name:   "under the size",
+			opts:   logOptions{MaxSize: 10, MaxFile: 3},
+			writes: []string{"abc\n", "def\n"},
+			files:  []string{"abc\ndef\n"},
+		},
+		{
+			name:   "past the size",
+			opts:   logOptions{MaxSize: 10, MaxFile: 3},
+			writes: []string{"line 1\n", "line 2\n", "line 3\n"},
+			files:  []string{"line 3\n", "line 2\n", "line 1\n"},
+		},
+		{
+			name:   "oldest removed",
+			opts:   logOptions{MaxSize: 10, MaxFile: 2},
+			writes: []string{"line 1\n", "line 2\n", "line 3\n"},
+			files:  []string{"line 3\n", "line 2\n"},
+		},
+		{
+			name:   "single file starts over",
+			opts:   logOptions{MaxSize: 10, MaxFile: 1},
+			writes: []string{"line 1\n", "line 2\n"},
+			files:  []string{"line 2\n"},
+		},
+		{
+			// A pipe delivers lines in batches, rotated line by line.
+			name:   "lines of one write",
+			opts:   logOptions{MaxSize: 14, MaxFile: 3},
+			writes: []string{"line 1\nline 2\nline 3\n"},
+			files:  []string{"line 3\n", "line 1\nline 2\n"},
+		},
+		{
+			name:   "long line kept whole",
+			opts:   logOptions{MaxSize: 4, MaxFile: 3},
+			writes: []string{"ab\n", "a longer line\n"},
+			files:  []string{"a longer line\n", "ab\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "stdout.log")
+			f, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l := newRotatingLog(path, f, tt.opts)
+			for _, w := range tt.writes {
+				if n, err := l.Write([]byte(w)); err != nil || n != len(w) {
+					t.Fatalf("Write(%q) = %d, %v", w, n, err)
+				}
+			}
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+			for i, want := range tt.files {
+				p := path
+				if i > 0 {
+					p = rotatedLogPath(path, i)
+				}
+				got, err := os.ReadFile(p)
+				if err != nil || string(got) != want {
+					t.Errorf("%s = %q, %v, want %q", filepath.Base(p), got, err, want)
+				}
+			}
+			if _, err := os.Stat(rotatedLogPath(path, len(tt.files))); err == nil {
+				t.Errorf("%s kept, want %d files", filepath.Base(rotatedLogPath(path, len(tt.files))), len(tt.files))
+			}
+		})
+	}
+}
+
+func TestCopyLogAcrossRotations(t *testing.T) {
+	t.Setenv("DOCKER_CLONE_HOME", t.TempDir())
+	path := filepath.Join(t.TempDir(), "stdout.log")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newRotatingLog(path, f, logOptions{MaxSize: 9, MaxFile: 5})
+	var all []string
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n", "six\n"} {
+		if _, err := l.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, line)
+	}
+	l.Close()
+	// one two | three | four | five six
+	if len(rotatedLogFiles(path)) != 4 {
+		t.Fatalf("log in %q, want it rotated into 4 files", rotatedLogFiles(path))
+	}
+	tests := []struct {
+		tail int
+		want string
+	}{
+		{tail: -1, want: strings.Join(all, "")},
+		{tail: 0, want: ""},
+		{tail: 1, want: "six\n"},
+		{tail: 3, want: "four\nfive\nsix\n"},
+		{tail: 5, want: "two\nthree\nfour\nfive\nsix\n"},
+		{tail: 100, want: strings.Join(all, "")},
+	}
+	for _, tt := range tests {
+		var b bytes.Buffer
+		if err := copyLog(&b, "gone", path, tt.tail, false); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != tt.want {
+			t.Errorf("tail %d: got %q, want %q", tt.tail, b.String(), tt.want)
+		}
+	}
+}
+
+func TestCopyLogFollowsRotation(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the log to be followed")
+	}
+	t.Setenv("DOCKER_CLONE_HOME", t.TempDir())
+	lock, err := claimContainer("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := containerLogPath("c", "stdout")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newRotatingLog(path, f, logOptions{MaxSize: 9, MaxFile: 2})
+	l.Write([]byte("one\n"))
+	var b bytes.Buffer
+	done := make(chan error, 1)
+	go func() { done <- copyLog(&b, "c", path, -1, true) }()
+	// A round of following apart, each line rotates the log.
+	for _, line := range []string{"two\n", "three\n", "four\n", "five\n"} {
+		time.Sleep(2 * followInterval)
+		l.Write([]byte(line))
+	}
+	time.Sleep(2 * followInterval)
+	l.Close()
+	lock.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if want := "one\ntwo\nthree\nfour\nfive\n"; b.String() != want {
+		t.Errorf("followed %q, want %q", b.String(), want)
+	}
+}
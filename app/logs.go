@@ -0,0 +1,205 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// followInterval is how often logs --follow checks for new output.
+const followInterval = 250 * time.Millisecond
+
+// tailOffset returns the offset at which the last n lines of f start, and
+// how many lines, up to n, there are from there: fewer only if f has fewer.
+// A trailing newline ends the last line rather than starting another one.
+func tailOffset(f *os.File, n int) (int64, int, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	size := info.Size()
+	if n == 0 || size == 0 {
+		return size, 0, nil
+	}
+	buf := make([]byte, 32*1024)
+	newlines := 0
+	for pos := size; pos > 0; {
+		chunk := int64(len(buf))
+		if chunk > pos {
+			chunk = pos
+		}
+		pos -= chunk
+		if _, err := f.ReadAt(buf[:chunk], pos); err != nil {
+			return 0, 0, err
+		}
+		for i := chunk - 1; i >= 0; i-- {
+			if buf[i] != '\n' || pos+i == size-1 {
+				continue
+			}
+			newlines++
+			if newlines == n {
+				return pos + i + 1, n, nil
+			}
+		}
+	}
+	return 0, newlines + 1, nil
+}
+
+// parseTail parses --tail: a number of lines, or "all" (-1).
+func parseTail(value string) (int, error) {
+	if value == "all" {
+		return -1, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid --tail %q: want a number of lines or \"all\"", value)
+	}
+	return n, nil
+}
+
+// copyLog writes the log at path to w, starting at its last tail lines (all
+// of it if tail is negative), including what was rotated out of it. With
+// follow, it keeps copying new output for as long as the container key is
+// running, going on in the new file whenever the log is rotated.
+func copyLog(w io.Writer, key, path string, tail int, follow bool) error {
+	files := rotatedLogFiles(path)
+	// The newest files' lines are counted until there are tail of them.
+	first, offset := 0, int64(0)
+	for i, remaining := len(files)-1, tail; i >= 0 && tail >= 0; i-- {
+		f, err := os.Open(files[i])
+		if err != nil {
+			return err
+		}
+		var lines int
+		offset, lines, err = tailOffset(f, remaining)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		first, remaining = i, remaining-lines
+		if remaining == 0 {
+			break
+		}
+	}
+	for _, file := range files[first : len(files)-1] {
+		if err := copyLogFile(w, file, offset); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		offset = 0
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { f.Close() }()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	for {
+		// Check before copying, so that output written just before the
+		// container exited is still copied on the last round.
+		running := follow && containerRunning(key)
+		if _, err := io.Copy(w, f); err != nil {
+			return err
+		}
+		// Once the file has been rotated, what is left of it has just
+		// been copied, and the log goes on in a new one at path.
+		if next, err := os.Open(path); err == nil {
+			if rotated(f, next) {
+				f.Close()
+				f = next
+				continue
+			}
+			next.Close()
+		}
+		// With a single file the log is rotated by starting it over.
+		if info, err := f.Stat(); err == nil {
+			if pos, err := f.Seek(0, io.SeekCurrent); err == nil && info.Size() < pos {
+				f.Seek(0, io.SeekStart)
+				continue
+			}
+		}
+		if !running {
+			return nil
+		}
+		time.Sleep(followInterval)
+	}
+}
+
+// rotated reports whether the log open in f has been rotated out of the
+// way of next, the file at its path now.
+func rotated(f, next *os.File) bool {
+	a, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	b, err := next.Stat()
+	return err == nil && !os.SameFile(a, b)
+}
+
+// copyLogFile writes the log file at path to w from offset on.
+func copyLogFile(w io.Writer, path string, offset int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func logsCommand(argv []string) {
+	flags := flag.NewFlagSet("logs", flag.ExitOnError)
+	follow := flags.Bool("follow", false, "keep printing output until the container exits")
+	flags.BoolVar(follow, "f", false, "shorthand for --follow")
+	tailFlag := flags.String("tail", "all", "only show the last `n` lines of each stream")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), logsUsage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(argv)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	name := flags.Arg(0)
+	tail, err := parseTail(*tailFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	if !containerNameRegexp.MatchString(name) {
+		fmt.Fprintf(os.Stderr, "Err: no such container: %s\n", name)
+		os.Exit(1)
+	}
+	if _, err := os.Stat(containerLogPath(name, "stdout")); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: no logs for container %s; only containers run with --name or --detach are logged\n", name)
+		os.Exit(1)
+	}
+
+	var wg sync.WaitGroup
+	var stdoutErr, stderrErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		stdoutErr = copyLog(os.Stdout, name, containerLogPath(name, "stdout"), tail, *follow)
+	}()
+	go func() {
+		defer wg.Done()
+		stderrErr = copyLog(os.Stderr, name, containerLogPath(name, "stderr"), tail, *follow)
+	}()
+	wg.Wait()
+	for _, err := range []error{stdoutErr, stderrErr} {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCopyLogTail(t *testing.T) {
+	// A line longer than tailOffset's buffer makes the search span reads.
+	long := strings.Repeat("x", 40*1024) + "\n"
+	tests := []struct {
+		name string
+		log  string
+		tail int
+		want string
+	}{
+		{name: "all", log: "a\nb\nc\n", tail: -1, want: "a\nb\nc\n"},
+		{name: "none", log: "a\nb\nc\n", tail: 0, want: ""},
+		{name: "last", log: "a\nb\nc\n", tail: 1, want: "c\n"},
+		{name: "last two", log: "a\nb\nc\n", tail: 2, want: "b\nc\n"},
+		{name: "exactly all", log: "a\nb\nc\n", tail: 3, want: "a\nb\nc\n"},
+		{name: "more than there are", log: "a\nb\nc\n", tail: 10, want: "a\nb\nc\n"},
+		// An unfinished last line counts as a line.
+		{name: "no final newline", log: "a\nb\nc", tail: 1, want: "c"},
+		{name: "no final newline, two", log: "a\nb\nc", tail: 2, want: "b\nc"},
+		{name: "empty lines", log: "a\n\n\n", tail: 2, want: "\n\n"},
+		{name: "empty log", log: "", tail: 5, want: ""},
+		{name: "long line", log: "a\n" + long + "b\n", tail: 2, want: long + "b\n"},
+		{name: "long line, all", log: "a\n" + long + "b\n", tail: 3, want: "a\n" + long + "b\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "stdout.log")
+			if err := os.WriteFile(path, []byte(tt.log), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			var b bytes.Buffer
+			if err := copyLog(&b, "gone", path, tt.tail, false); err != nil {
+				t.Fatal(err)
+			}
+			if got := b.String(); got != tt.want {
+				if len(got) > 40 || len(tt.want) > 40 {
+					t.Errorf("got %d bytes, want %d", len(got), len(tt.want))
+				} else {
+					t.Errorf("got %q, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseTail(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{value: "all", want: -1},
+		{value: "0", want: 0},
+		{value: "25", want: 25},
+		{value: "-1", wantErr: true},
+		{value: "ten", wantErr: true},
+		{value: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTail(tt.value)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseTail(%q) = %d, want an error", tt.value, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseTail(%q) = %d, %v, want %d", tt.value, got, err, tt.want)
+		}
+	}
+}
@@ -1,16 +1,12 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"io"
-	"log"
 	"net/http"
 	"os"
-	"os/exec"
-	"path/filepath"
 	"strings"
-	"syscall"
+	"sync"
+	"time"
 )
 
 type DockerTokenResponse struct {
@@ -21,14 +17,31 @@ type DockerTokenResponse struct {
 }
 
 type DockerLayer struct {
-	Digest string `json:"digest"`
+	MediaType string `json:"mediaType,omitempty"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size,omitempty"`
+	// URLs lists external locations of a foreign layer, whose content isn't
+	// stored in the registry itself.
+	URLs []string `json:"urls,omitempty"`
+	// DiffID is the digest of the layer's tarball uncompressed, from the
+	// image config's rootfs.diff_ids. It isn't part of the descriptor.
+	DiffID string `json:"-"`
 }
 
 type DockerManifestResponse struct {
 	SchemaVersion int           `json:"schemaVersion"`
 	Name          string        `json:"name"`
 	Tag           string        `json:"tag"`
+	Config        DockerLayer   `json:"config"`
 	Layers        []DockerLayer `json:"layers"`
+	// Annotations are only set on OCI manifests.
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// ArtifactType is set on OCI manifests of artifacts other than images
+	// whose config doesn't say what they are.
+	ArtifactType string `json:"artifactType,omitempty"`
+	// schema1Config is the image config embedded in a schema 1 manifest,
+	// which has no config blob.
+	schema1Config *ImageConfig
 }
 
 // Helper function to handle errors
@@ -38,155 +51,332 @@ func must(err error) {
 	}
 }
 
-func fetchDockerRegistryToken(repository string) (DockerTokenResponse, error) {
-	var token DockerTokenResponse
-	res, err := http.Get(fmt.Sprintf("https://auth.docker.io/token?service=registry.docker.io&scope=repository:%s:pull", repository))
+const manifestMediaType = "application/vnd.docker.distribution.manifest.v2+json"
+
+// resolveManifestDigest asks the registry which digest a tag currently points
+// at, without downloading the manifest itself.
+func resolveManifestDigest(repository, tag string, auth *registryAuth) (string, error) {
+	req, err := http.NewRequest("HEAD", fmt.Sprintf("%s/v2/%s/manifests/%s", registryBase(), repository, tag), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", manifestAcceptAll)
+	res, err := auth.do(registryClient, req)
 	if err != nil {
-		log.Fatalln(err)
-		return token, err
+		return "", err
 	}
-	defer res.Body.Close()
-	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
-		log.Fatalln(err)
-		return token, err
+	defer closeBody(res.Body)
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("resolving %s:%s: unexpected status %s", repository, tag, res.Status)
 	}
-	return token, nil
+	digest := res.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("resolving %s:%s: registry did not return a digest", repository, tag)
+	}
+	return digest, nil
 }
 
-func fetchDockerManifest(repository, tag, token string) (DockerManifestResponse, error) {
-	var manifest DockerManifestResponse
-	req, err := http.NewRequest("GET", fmt.Sprintf("https://registry-1.docker.io/v2/%s/manifests/%s", repository, tag), nil)
-	if err != nil {
-		log.Fatalln(err)
-		return manifest, err
-	}
-	req.Header.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
-	client := &http.Client{}
-	res, err := client.Do(req)
-	if err != nil {
-		log.Fatalln(err)
-		return manifest, err
+// defaultBufferSize is the default copy buffer used when downloading and
+// extracting layers. It is much larger than io.Copy's 32KB default, which
+// leaves throughput on the table with fast disks and networks.
+const defaultBufferSize = 1 << 20
+
+// pullOptions tunes how an image is pulled.
+type pullOptions struct {
+	// Timings, if set, receives a breakdown of where the pull spent its time.
+	Timings *pullTimings
+	// BufferSize is the size of the copy buffer used for layer downloads and
+	// extraction. Zero means defaultBufferSize.
+	BufferSize int
+	// ScopeActions are the actions requested in the token scope, "pull" if
+	// empty.
+	ScopeActions string
+	// RateLimit, if set, caps the aggregate bandwidth of layer downloads.
+	RateLimit *rateLimiter
+	// Cache, if set, keeps registry layers for later pulls.
+	Cache *layerCache
+	// MaxConcurrentDownloads and MaxConcurrentExtractions bound how many
+	// layers are fetched and extracted at once. Zero means the defaults.
+	MaxConcurrentDownloads   int
+	MaxConcurrentExtractions int
+	// StallTimeout, if set, is how long a layer download may go without
+	// receiving anything before it is retried.
+	StallTimeout time.Duration
+	// Progress, if set, reports each layer's progress.
+	Progress *pullProgress
+	// KeepBlobs, if set, is an OCI image layout that every layer blob is
+	// also stored in, as it was pulled.
+	KeepBlobs string
+	// DownloadChunks, above 1, is how many byte ranges of a layer are
+	// downloaded at once, from sources that send them.
+	DownloadChunks int
+	// Retries is how many more times a pull that failed is attempted.
+	Retries int
+	// Report, if set, records which layers came from the cache.
+	Report *pullReport
+}
+
+// pullReport records, for one attempt at a pull, which layers were taken from
+// the cache and which were fetched. All methods are safe to call on a nil
+// receiver, which records nothing.
+type pullReport struct {
+	mu      sync.Mutex
+	reused  int
+	fetched []string
+}
+
+func (r *pullReport) layer(digest string, reused bool) {
+	if r == nil {
+		return
 	}
-	defer res.Body.Close()
-	if err := json.NewDecoder(res.Body).Decode(&manifest); err != nil {
-		log.Fatalln(err)
-		return manifest, err
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if reused {
+		r.reused++
+	} else {
+		r.fetched = append(r.fetched, shortImageID(digest))
 	}
-	return manifest, nil
 }
 
-func downloadAndExtractLayer(dir string, repository string, layer DockerLayer, token string) error {
-	req, err := http.NewRequest("GET", fmt.Sprintf("https://registry-1.docker.io/v2/%s/blobs/%s", repository, layer.Digest), nil)
-	if err != nil {
-		log.Fatalln(err)
-		return err
+// pullDockerImage extracts image, from wherever openSource finds it, into
+// dir and returns its manifest and config. A pull that fails is attempted
+// again, from scratch, up to opts.Retries times; layers earlier attempts got
+// are taken from the cache rather than fetched again. A pull without a cache
+// gets a temporary one for that.
+func pullDockerImage(dir, image string, opts pullOptions) (imageMetadata, error) {
+	if opts.Retries <= 0 {
+		return pullDockerImageOnce(dir, image, opts)
 	}
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Fatalln(err)
-		return err
+	if opts.Cache == nil {
+		tmp := dir + ".cache"
+		defer os.RemoveAll(tmp)
+		opts.Cache = &layerCache{mode: cacheModeCompressed, dir: tmp, inUse: map[string]bool{}}
 	}
-	defer resp.Body.Close()
-	filePath := filepath.Join(dir, layer.Digest+".tar")
-	file, err := os.Create(filePath)
-	if err != nil {
-		log.Fatalln(err)
-		return err
+	for attempt := 1; ; attempt++ {
+		report := &pullReport{}
+		opts.Report = report
+		opts.Timings.newAttempt()
+		meta, err := pullDockerImageOnce(dir, image, opts)
+		if err == nil {
+			if attempt > 1 && !quiet {
+				fetched := ""
+				if len(report.fetched) > 0 {
+					fetched = " (" + strings.Join(report.fetched, ", ") + ")"
+				}
+				fmt.Fprintf(os.Stderr, "Pulled %s on attempt %d: %d layers reused from earlier attempts, %d fetched again%s\n", image, attempt, report.reused, len(report.fetched), fetched)
+			}
+			return meta, nil
+		}
+		if attempt > opts.Retries {
+			return meta, err
+		}
+		fmt.Fprintf(os.Stderr, "Warning: pull attempt %d of %d failed: %v; retrying\n", attempt, opts.Retries+1, err)
+		if err := emptyDir(dir); err != nil {
+			return meta, err
+		}
+		time.Sleep(time.Duration(attempt) * time.Second)
 	}
-	defer file.Close()
-	_, err = io.Copy(file, resp.Body)
+}
+
+// pullDockerImageOnce is one attempt of pullDockerImage.
+func pullDockerImageOnce(dir, image string, opts pullOptions) (imageMetadata, error) {
+	pullStart := time.Now()
+	src, ref, err := openSource(image, opts.ScopeActions)
 	if err != nil {
-		log.Fatalln(err)
-		return err
+		return imageMetadata{}, err
 	}
-	cmd := exec.Command("tar", "-xvf", filePath, "-C", dir)
-	err = cmd.Run()
-	if err != nil {
-		log.Fatalln(err)
-		return err
+	if _, ok := src.(*registrySource); ok && opts.Timings != nil {
+		opts.Timings.Token = time.Since(pullStart)
 	}
-	// Remove the tar file after extraction
-	err = os.Remove(filePath)
+	meta, err := pullFromSource(dir, src, ref, opts)
 	if err != nil {
-		log.Fatalln(err)
-		return err
+		return meta, err
 	}
-	return nil
+	if opts.Timings != nil {
+		opts.Timings.Total = time.Since(pullStart)
+	}
+	return meta, nil
 }
 
-func pullDockerImage(dir, image string) error {
-	token, err := fetchDockerRegistryToken("library/" + image)
+// warnOnTagDigestMismatch checks whether the tag of a tag@digest reference
+// still resolves to the pinned digest. The digest always wins; a mismatch only
+// means the tag has moved on since the reference was written.
+func warnOnTagDigestMismatch(ref imageRef, auth *registryAuth) {
+	current, err := resolveManifestDigest(ref.Repository, ref.Tag, auth)
 	if err != nil {
-		log.Fatalln(err)
-		return err
-	}
-	tag := "latest"
-	if strings.Contains(image, ":") {
-		parts := strings.Split(image, ":")
-		image = parts[0]
-		tag = parts[1]
+		fmt.Fprintf(os.Stderr, "Warning: could not verify tag %q: %v\n", ref.Tag, err)
+		return
 	}
-	manifest, err := fetchDockerManifest("library/"+image, tag, token.Token)
-	if err != nil {
-		log.Fatalln(err)
-		return err
+	if current != ref.Digest {
+		fmt.Fprintf(os.Stderr, "Warning: tag %q now resolves to %s, using pinned digest %s\n", ref.Tag, current, ref.Digest)
 	}
-	for _, layer := range manifest.Layers {
-		err := downloadAndExtractLayer(dir, "library/"+image, layer, token.Token)
+}
+
+const (
+	runUsage       = "Usage: your_docker.sh run [options] <image[:tag|@digest]|oci:/layout[:tag]|docker-archive:/file.tar[:tag]> [command] [arg...]"
+	tagsUsage      = "Usage: your_docker.sh tags [options] <repository>"
+	volumeUsage    = "Usage: your_docker.sh volume ls | create <name> | rm <name>..."
+	exportUsage    = "Usage: your_docker.sh export [options] <image>"
+	inspectUsage   = "Usage: your_docker.sh inspect [options] <image|container>"
+	logsUsage      = "Usage: your_docker.sh logs [options] <name>"
+	psUsage        = "Usage: your_docker.sh ps [options]"
+	commitUsage    = "Usage: your_docker.sh commit [options] <container> <repository[:tag]>"
+	tagUsage       = "Usage: your_docker.sh tag [options] <image> <repository[:tag]>"
+	imagesUsage    = "Usage: your_docker.sh images [options]"
+	rmiUsage       = "Usage: your_docker.sh rmi [options] <repository[:tag]>..."
+	pullUsage      = "Usage: your_docker.sh pull [options] <image[:tag|@digest]>..."
+	stopUsage      = "Usage: your_docker.sh stop [options] <container>..."
+	verifyUsage    = "Usage: your_docker.sh verify [options] <image>..."
+	cacheUsage     = "Usage: your_docker.sh cache df"
+	referrersUsage = "Usage: your_docker.sh referrers [options] <image[:tag|@digest]>"
+	saveUsage      = "Usage: your_docker.sh save --oci-layout <dir> [options] <image>"
+	usage          = `Usage: your_docker.sh run [options] <image> [command] [arg...]
+       your_docker.sh tags [options] <repository>
+       your_docker.sh volume ls | create <name> | rm <name>...
+       your_docker.sh export [options] <image>
+       your_docker.sh inspect [options] <image|container>
+       your_docker.sh logs [options] <name>
+       your_docker.sh ps [options]
+       your_docker.sh commit [options] <container> <repository[:tag]>
+       your_docker.sh tag [options] <image> <repository[:tag]>
+       your_docker.sh images [options]
+       your_docker.sh rmi [options] <repository[:tag]>...
+       your_docker.sh pull [options] <image>...
+       your_docker.sh stop [options] <container>...
+       your_docker.sh verify [options] <image>...
+       your_docker.sh cache df
+       your_docker.sh referrers [options] <image>
+       your_docker.sh save --oci-layout <dir> [options] <image>
+
+Global options, given before the command:
+  -q, --quiet                 print no progress or informational messages,
+                              only results, warnings and errors; pull prints
+                              just the image digest (--log-level warn)
+  --log-level <info|warn>     how much to print, info by default
+  --registry-mirror <url>     send Docker Hub requests to the registry at url
+  --insecure-registry <host>  don't verify the TLS certificate of host
+                              (repeatable)
+  --cache-dir <dir>           keep the layer cache in dir
+
+Each global option, and the --ca-cert and --platform defaults, can also be
+set in the JSON config file, ~/.docker-clone/config.json or $DOCKER_CLONE_CONFIG,
+as "log-level", "registry-mirror", "insecure-registries", "cache-dir",
+"ca-certs" and "platform", or in the environment, as DOCKER_CLONE_LOG_LEVEL,
+DOCKER_CLONE_REGISTRY_MIRROR, DOCKER_CLONE_INSECURE_REGISTRIES,
+DOCKER_CLONE_CACHE_DIR, DOCKER_CLONE_CA_CERTS and DOCKER_CLONE_PLATFORM.
+Options override the environment, which overrides the file.
+
+Registry tokens are asked for with the credentials in DOCKER_CLONE_USERNAME
+and DOCKER_CLONE_PASSWORD, or, taking precedence, those for the registry in
+use, e.g. DOCKER_CLONE_GHCR_IO_USERNAME and DOCKER_CLONE_GHCR_IO_PASSWORD
+for ghcr.io, and anonymously if there are none. Passwords are never printed.`
+)
+
+// quiet is set by the global --quiet flag, or log-level warn. Progress and
+// informational messages are then left out, so that only what a script would
+// capture is printed. Warnings and errors still are.
+var quiet bool
+
+// parseGlobalOptions returns the settings the global options at the start of
+// args set, and the rest of args, which starts with the command. Options
+// with a value take it as the next argument or after an "=".
+func parseGlobalOptions(args []string) (settings, []string, error) {
+	var s settings
+	for len(args) > 0 {
+		name, value, hasValue := strings.Cut(args[0], "=")
+		name = "-" + strings.TrimLeft(name, "-")
+		takeValue := func() (string, error) {
+			if hasValue {
+				return value, nil
+			}
+			if len(args) < 2 {
+				return "", fmt.Errorf("global option %s needs a value", args[0])
+			}
+			args = args[1:]
+			return args[0], nil
+		}
+		var err error
+		switch name {
+		case "-q", "-quiet":
+			s.LogLevel = logLevelWarn
+		case "-log-level":
+			s.LogLevel, err = takeValue()
+		case "-registry-mirror":
+			s.RegistryMirror, err = takeValue()
+		case "-insecure-registry":
+			var host string
+			host, err = takeValue()
+			s.InsecureRegistries = append(s.InsecureRegistries, host)
+		case "-cache-dir":
+			s.CacheDir, err = takeValue()
+		default:
+			return s, args, nil
+		}
 		if err != nil {
-			fmt.Println("Error downloading layer:", err)
+			return s, nil, err
 		}
+		args = args[1:]
 	}
-	return nil
+	return s, args, nil
 }
 
 func main() {
-	if len(os.Args) < 4 {
-		fmt.Println("Usage: your_docker.sh run <image> <command> <arg1> <arg2> ...")
-		os.Exit(1)
+	runtime := newRuntime()
+	if len(os.Args) > 1 && os.Args[1] == childCommand {
+		os.Exit(runtime.Child())
 	}
-	image := os.Args[2]
-	command := os.Args[3]
-	args := os.Args[4:len(os.Args)]
-
-	sandboxDir, err := os.MkdirTemp("", "chroot")
-	if err != nil {
-		fmt.Printf("Err MkdirTemp: %v", err)
-		os.Exit(1)
+	options, args, err := parseGlobalOptions(os.Args[1:])
+	if err == nil {
+		var s settings
+		if s, err = resolveSettings(configPath(), os.LookupEnv, options); err == nil {
+			err = useSettings(s)
+		}
 	}
-	defer os.RemoveAll(sandboxDir)
-
-	err = pullDockerImage(sandboxDir, image)
 	if err != nil {
-		fmt.Printf("Err on pulling image: %v", err)
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
 		os.Exit(1)
 	}
-
-	cmd := exec.Command("/bin/sh", "-c", fmt.Sprintf("mkdir -p %s/usr/local/bin && cp /usr/local/bin/docker-explorer %s/usr/local/bin/docker-explorer", sandboxDir, sandboxDir))
-	err = cmd.Run()
-	if err != nil {
-		fmt.Printf("Err on setting up sandbox: %v", err)
+	if len(args) < 1 {
+		fmt.Println(usage)
 		os.Exit(1)
 	}
-
-	if err := syscall.Chroot(sandboxDir); err != nil {
-		fmt.Printf("Err Chroot: %v", err)
+	switch args[0] {
+	case "run":
+		runtime.Run(args[1:])
+	case "tags":
+		tagsCommand(args[1:])
+	case "volume":
+		volumeCommand(args[1:])
+	case "export":
+		exportCommand(args[1:])
+	case "inspect":
+		inspectCommand(args[1:])
+	case "logs":
+		logsCommand(args[1:])
+	case "ps":
+		psCommand(args[1:])
+	case "commit":
+		commitCommand(args[1:])
+	case "tag":
+		tagCommand(args[1:])
+	case "images":
+		imagesCommand(args[1:])
+	case "rmi":
+		rmiCommand(args[1:])
+	case "pull":
+		pullCommand(args[1:])
+	case "stop":
+		runtime.Stop(args[1:])
+	case "verify":
+		verifyCommand(args[1:])
+	case "cache":
+		cacheCommand(args[1:])
+	case "referrers":
+		referrersCommand(args[1:])
+	case "save":
+		saveCommand(args[1:])
+	default:
+		fmt.Println(usage)
 		os.Exit(1)
 	}
-
-	cmd = exec.Command(command, args...)
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: syscall.CLONE_NEWPID,
-	}
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err = cmd.Run()
-	if err != nil {
-		fmt.Printf("Err: %v", err)
-		os.Exit(cmd.ProcessState.ExitCode())
-	}
 }
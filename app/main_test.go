@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// captureStderr returns what f writes to os.Stderr.
+func captureStderr(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stderr
+	os.Stderr = w
+	done := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		done <- string(data)
+	}()
+	defer func() {
+		os.Stderr = saved
+	}()
+	f()
+	w.Close()
+	return <-done
+}
+
+func TestWarnOnTagDigestMismatch(t *testing.T) {
+	pinned := "sha256:" + strings.Repeat("ab", 32)
+	moved := "sha256:" + strings.Repeat("cd", 32)
+	tests := []struct {
+		name string
+		// current is what the tag resolves to, none if empty.
+		current string
+		want    string
+	}{
+		{name: "tag still pinned", current: pinned},
+		{name: "tag moved", current: moved, want: `Warning: tag "latest" now resolves to ` + moved + ", using pinned digest " + pinned + "\n"},
+		{name: "tag gone", want: `Warning: could not verify tag "latest": resolving library/ubuntu:latest: unexpected status 404 Not Found` + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != "HEAD" || r.URL.Path != "/v2/library/ubuntu/manifests/latest" || tt.current == "" {
+					http.NotFound(w, r)
+					return
+				}
+				w.Header().Set("Docker-Content-Digest", tt.current)
+			}))
+			defer srv.Close()
+			useTestRegistry(t, srv)
+			ref := imageRef{Domain: defaultDomain, Repository: "library/ubuntu", Tag: "latest", Digest: pinned}
+			got := captureStderr(t, func() { warnOnTagDigestMismatch(ref, &registryAuth{}) })
+			if got != tt.want {
+				t.Errorf("warned %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
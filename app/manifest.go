@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const (
+	dockerManifestListMediaType     = "application/vnd.docker.distribution.manifest.list.v2+json"
+	dockerManifestV1MediaType       = "application/vnd.docker.distribution.manifest.v1+json"
+	dockerManifestV1SignedMediaType = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+)
+
+// manifestAcceptChain lists the manifest formats accepted, most preferred
+// first. They are asked for all at once, and whatever is served is parsed
+// by its Content-Type; one at a time, in order, only if a registry rejects
+// that.
+var manifestAcceptChain = []string{
+	ociIndexMediaType,
+	dockerManifestListMediaType,
+	ociManifestMediaType,
+	manifestMediaType,
+	dockerManifestV1SignedMediaType + ", " + dockerManifestV1MediaType,
+}
+
+// manifestAcceptAll is the Accept value for requests that must see the
+// manifest the way it is stored, e.g. to learn its digest.
+var manifestAcceptAll = strings.Join(manifestAcceptChain, ", ")
+
+// maxIndexDepth bounds how many levels of nested indexes are followed.
+const maxIndexDepth = 4
+
+// fetchManifestBlob downloads the manifest for reference, accepting every
+// format of manifestAcceptChain at once, as docker does, and returns the raw
+// manifest and its Content-Type, which says which one the registry sent.
+// Only a registry that rejects the combined Accept, with 406 or 415, is
+// asked again for one format at a time, in the chain's order.
+func fetchManifestBlob(repository, reference string, auth *registryAuth) ([]byte, string, error) {
+	data, contentType, acceptable, err := requestManifest(repository, reference, manifestAcceptAll, auth)
+	if err != nil || acceptable {
+		return data, contentType, err
+	}
+	for _, accept := range manifestAcceptChain {
+		data, contentType, acceptable, err := requestManifest(repository, reference, accept, auth)
+		if err != nil || acceptable {
+			return data, contentType, err
+		}
+	}
+	return nil, "", fmt.Errorf("fetching manifest %s:%s: registry accepts none of the supported manifest media types", repository, reference)
+}
+
+// requestManifest asks for the manifest for reference with accept. acceptable
+// is false if the registry has no manifest of those media types.
+func requestManifest(repository, reference, accept string, auth *registryAuth) (data []byte, contentType string, acceptable bool, err error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/v2/%s/manifests/%s", registryBase(), repository, reference), nil)
+	if err != nil {
+		return nil, "", false, err
+	}
+	req.Header.Set("Accept", accept)
+	res, err := auth.do(registryClient, req)
+	if err != nil {
+		return nil, "", false, err
+	}
+	defer closeBody(res.Body)
+	if res.StatusCode == http.StatusNotAcceptable || res.StatusCode == http.StatusUnsupportedMediaType {
+		return nil, "", false, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, "", false, fmt.Errorf("fetching manifest %s:%s: unexpected status %s", repository, reference, res.Status)
+	}
+	if data, err = io.ReadAll(res.Body); err != nil {
+		return nil, "", false, err
+	}
+	return data, res.Header.Get("Content-Type"), true, nil
+}
+
+// manifestKind returns the media type of a fetched manifest: its
+// Content-Type if that is one we know, else what the document itself says.
+// Some registries serve everything as application/json.
+func manifestKind(contentType string, data []byte) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case ociIndexMediaType, dockerManifestListMediaType, ociManifestMediaType, manifestMediaType,
+		dockerManifestV1MediaType, dockerManifestV1SignedMediaType:
+		return mediaType
+	}
+	var probe struct {
+		SchemaVersion int             `json:"schemaVersion"`
+		MediaType     string          `json:"mediaType"`
+		Manifests     json.RawMessage `json:"manifests"`
+	}
+	json.Unmarshal(data, &probe)
+	switch {
+	case probe.SchemaVersion == 1:
+		return dockerManifestV1MediaType
+	case probe.MediaType != "":
+		return probe.MediaType
+	case probe.Manifests != nil:
+		return ociIndexMediaType
+	}
+	return manifestMediaType
+}
+
+// schema1Manifest is the legacy v1 manifest format. Layers are listed top
+// first, and instead of a config blob each history entry carries a v1 image
+// JSON, the first of which describes the image itself.
+type schema1Manifest struct {
+	Name     string `json:"name"`
+	Tag      string `json:"tag"`
+	FSLayers []struct {
+		BlobSum string `json:"blobSum"`
+	} `json:"fsLayers"`
+	History []struct {
+		V1Compatibility string `json:"v1Compatibility"`
+	} `json:"history"`
+}
+
+func parseSchema1Manifest(data []byte) (DockerManifestResponse, error) {
+	var v1 schema1Manifest
+	manifest := DockerManifestResponse{SchemaVersion: 1}
+	if err := json.Unmarshal(data, &v1); err != nil {
+		return manifest, fmt.Errorf("parsing schema 1 manifest: %w", err)
+	}
+	manifest.Name, manifest.Tag = v1.Name, v1.Tag
+	for i := len(v1.FSLayers) - 1; i >= 0; i-- {
+		manifest.Layers = append(manifest.Layers, DockerLayer{Digest: v1.FSLayers[i].BlobSum})
+	}
+	if len(v1.History) > 0 {
+		var config ImageConfig
+		if err := json.Unmarshal([]byte(v1.History[0].V1Compatibility), &config); err != nil {
+			return manifest, fmt.Errorf("parsing schema 1 image config: %w", err)
+		}
+		manifest.schema1Config = &config
+	}
+	return manifest, nil
+}
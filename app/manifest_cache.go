@@ -0,0 +1,97 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// maxManifestCacheSize bounds the bytes of manifests and configs
+// registryManifests keeps.
+const maxManifestCacheSize = 8 << 20
+
+// manifestCache keeps the manifests and configs fetched from registries for
+// the rest of the process, so that an image resolved more than once, e.g.
+// prefetched and then run, or sharing a repository with another, is fetched
+// once. Content is keyed by its digest, which it has been verified against,
+// and the least recently used is dropped to stay under maxSize bytes. Tags
+// are remembered as the digest they resolved to: within one invocation, an
+// image is the one it was when first asked for.
+type manifestCache struct {
+	mu      sync.Mutex
+	maxSize int
+	size    int
+	// order has the most recently used entry first.
+	order   *list.List
+	entries map[string]*list.Element
+	tags    map[string]string
+}
+
+type manifestCacheEntry struct {
+	key  string
+	data []byte
+	kind string
+}
+
+var registryManifests = newManifestCache(maxManifestCacheSize)
+
+func newManifestCache(maxSize int) *manifestCache {
+	return &manifestCache{maxSize: maxSize, order: list.New(), entries: map[string]*list.Element{}, tags: map[string]string{}}
+}
+
+// manifestCacheKey names repository's content with digest, or a tag of it,
+// on the registry in use.
+func manifestCacheKey(repository, ref string) string {
+	return registryBase() + "/" + repository + "@" + ref
+}
+
+// get returns the content of repository with digest, and its media type.
+func (c *manifestCache) get(repository, digest string) ([]byte, string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[manifestCacheKey(repository, digest)]
+	if !ok {
+		return nil, "", false
+	}
+	c.order.MoveToFront(e)
+	entry := e.Value.(*manifestCacheEntry)
+	return entry.data, entry.kind, true
+}
+
+// put keeps data, of media type kind, as repository's content with digest,
+// which it must have been verified against.
+func (c *manifestCache) put(repository, digest string, data []byte, kind string) {
+	if len(data) > c.maxSize {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := manifestCacheKey(repository, digest)
+	if e, ok := c.entries[key]; ok {
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&manifestCacheEntry{key: key, data: data, kind: kind})
+	c.size += len(data)
+	for c.size > c.maxSize {
+		oldest := c.order.Back()
+		entry := oldest.Value.(*manifestCacheEntry)
+		c.order.Remove(oldest)
+		delete(c.entries, entry.key)
+		c.size -= len(entry.data)
+	}
+}
+
+// resolveTag returns the digest tag of repository resolved to earlier.
+func (c *manifestCache) resolveTag(repository, tag string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	digest, ok := c.tags[manifestCacheKey(repository, tag)]
+	return digest, ok
+}
+
+// putTag records that tag of repository resolved to digest.
+func (c *manifestCache) putTag(repository, tag, digest string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tags[manifestCacheKey(repository, tag)] = digest
+}
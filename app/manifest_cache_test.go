@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestManifestCache(t *testing.T) {
+	c := newManifestCache(10)
+	c.put("app", "sha256:a", []byte("aaaa"), "a")
+	c.put("app", "sha256:b", []byte("bbbb"), "b")
+	// Using a makes b the least recently used, and dropped for c.
+	if data, kind, ok := c.get("app", "sha256:a"); !ok || string(data) != "aaaa" || kind != "a" {
+		t.Errorf("get(a) = %q, %q, %v", data, kind, ok)
+	}
+	c.put("app", "sha256:c", []byte("cccc"), "c")
+	for _, tt := range []struct {
+		repository, digest string
+		want               bool
+	}{
+		{"app", "sha256:a", true},
+		{"app", "sha256:b", false},
+		{"app", "sha256:c", true},
+		// Content is kept per repository.
+		{"other", "sha256:a", false},
+	} {
+		if _, _, ok := c.get(tt.repository, tt.digest); ok != tt.want {
+			t.Errorf("get(%s@%s) found: %v, want %v", tt.repository, tt.digest, ok, tt.want)
+		}
+	}
+	// What doesn't fit at all isn't kept, nor does it push anything out.
+	c.put("app", "sha256:d", []byte("ddddddddddd"), "d")
+	if _, _, ok := c.get("app", "sha256:d"); ok {
+		t.Error("kept content bigger than the cache")
+	}
+	if _, _, ok := c.get("app", "sha256:a"); !ok {
+		t.Error("content bigger than the cache pushed out a")
+	}
+	if c.size != 8 {
+		t.Errorf("the cache holds %d bytes, want 8", c.size)
+	}
+
+	c.putTag("app", "latest", "sha256:a")
+	if digest, ok := c.resolveTag("app", "latest"); !ok || digest != "sha256:a" {
+		t.Errorf("resolveTag(latest) = %q, %v", digest, ok)
+	}
+	if _, ok := c.resolveTag("app", "v1"); ok {
+		t.Error("resolved a tag that wasn't put")
+	}
+}
+
+// TestInspectManifestCache inspects an image more than once in one process,
+// and checks only the first time asks the registry for anything.
+func TestInspectManifestCache(t *testing.T) {
+	layout := filepath.Join(t.TempDir(), "layout")
+	desc := writeTestImage(t, layout, "latest", testLayer(t, testEntry{name: "f"}))
+	serve := ociLayoutHandler(layout)
+	var mu sync.Mutex
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		serve(w, r)
+	}))
+	defer srv.Close()
+	useTestRegistry(t, srv)
+	saved := registryManifests
+	registryManifests = newManifestCache(maxManifestCacheSize)
+	defer func() { registryManifests = saved }()
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(requests)
+	}
+
+	if _, err := fetchImageMetadata("app", defaultScopeActions); err != nil {
+		t.Fatal(err)
+	}
+	first := count()
+	if first == 0 {
+		t.Fatal("the first inspect asked the registry for nothing")
+	}
+	for _, image := range []string{"app", "app:latest", "app@" + desc.Digest} {
+		if _, err := fetchImageMetadata(image, defaultScopeActions); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fetchRawImageConfig("app", defaultScopeActions); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) != first {
+		t.Errorf("inspecting again asked the registry for %s", strings.Join(requests[first:], ", "))
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// useTestRegistry sends registry requests to srv for the rest of the test.
+func useTestRegistry(t *testing.T, srv *httptest.Server) {
+	t.Helper()
+	saved := globalSettings
+	globalSettings.RegistryMirror = srv.URL
+	t.Cleanup(func() { globalSettings = saved })
+}
+
+func TestFetchManifestBlobAccept(t *testing.T) {
+	index := `{"schemaVersion":2,"mediaType":"` + ociIndexMediaType + `","manifests":[]}`
+	schema1 := `{"schemaVersion":1,"name":"x","tag":"latest","fsLayers":[],"history":[]}`
+	tests := []struct {
+		name string
+		// serve answers a request with the Accept header accept.
+		serve        func(w http.ResponseWriter, accept string)
+		wantType     string
+		wantRequests int
+		wantErr      bool
+	}{
+		{
+			name: "one request for every format",
+			serve: func(w http.ResponseWriter, accept string) {
+				w.Header().Set("Content-Type", ociIndexMediaType)
+				w.Write([]byte(index))
+			},
+			wantType:     ociIndexMediaType,
+			wantRequests: 1,
+		},
+		{
+			// Distribution downconverts to schema1 for clients that
+			// don't accept the manifest's own format.
+			name: "no downconversion",
+			serve: func(w http.ResponseWriter, accept string) {
+				if !strings.Contains(accept, ociIndexMediaType) {
+					w.Header().Set("Content-Type", dockerManifestV1SignedMediaType)
+					w.Write([]byte(schema1))
+					return
+				}
+				w.Header().Set("Content-Type", ociIndexMediaType)
+				w.Write([]byte(index))
+			},
+			wantType:     ociIndexMediaType,
+			wantRequests: 1,
+		},
+		{
+			name: "one format at a time after 406",
+			serve: func(w http.ResponseWriter, accept string) {
+				if accept != manifestMediaType {
+					w.WriteHeader(http.StatusNotAcceptable)
+					return
+				}
+				w.Header().Set("Content-Type", manifestMediaType)
+				w.Write([]byte(`{"schemaVersion":2}`))
+			},
+			wantType:     manifestMediaType,
+			wantRequests: 1 + 4,
+		},
+		{
+			name: "415 for everything",
+			serve: func(w http.ResponseWriter, accept string) {
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+			},
+			wantErr:      true,
+			wantRequests: 1 + len(manifestAcceptChain),
+		},
+		{
+			name: "not found is not retried",
+			serve: func(w http.ResponseWriter, accept string) {
+				w.WriteHeader(http.StatusNotFound)
+			},
+			wantErr:      true,
+			wantRequests: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				tt.serve(w, r.Header.Get("Accept"))
+			}))
+			defer srv.Close()
+			useTestRegistry(t, srv)
+			_, contentType, err := fetchManifestBlob("library/test", "latest", &registryAuth{})
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if contentType != tt.wantType {
+				t.Errorf("Content-Type = %q, want %q", contentType, tt.wantType)
+			}
+			if requests != tt.wantRequests {
+				t.Errorf("%d requests, want %d", requests, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestResolveManifestByDigest(t *testing.T) {
+	manifest := `{"schemaVersion":2,"mediaType":"` + ociManifestMediaType + `","layers":[]}`
+	tampered := `{"schemaVersion":2,"mediaType":"` + ociManifestMediaType + `","layers":[{}]}`
+	manifestDigest := sha256Digest([]byte(manifest))
+	index := `{"schemaVersion":2,"mediaType":"` + ociIndexMediaType + `","manifests":[{"mediaType":"` + ociManifestMediaType +
+		`","digest":"` + manifestDigest + `","size":1,"platform":{"os":"linux","architecture":"` + runtime.GOARCH + `"}}]}`
+	tests := []struct {
+		name string
+		ref  string
+		// served is what the registry answers for each reference.
+		served       map[string]string
+		wantMismatch bool
+	}{
+		{name: "pinned", ref: manifestDigest, served: map[string]string{manifestDigest: manifest}},
+		{name: "tampered", ref: manifestDigest, served: map[string]string{manifestDigest: tampered}, wantMismatch: true},
+		{
+			name:   "through an index",
+			ref:    sha256Digest([]byte(index)),
+			served: map[string]string{sha256Digest([]byte(index)): index, manifestDigest: manifest},
+		},
+		{
+			// The index is as pinned, but not the manifest it names.
+			name:         "tampered under an index",
+			ref:          sha256Digest([]byte(index)),
+			served:       map[string]string{sha256Digest([]byte(index)): index, manifestDigest: tampered},
+			wantMismatch: true,
+		},
+		// Tags aren't pinned.
+		{name: "tag", ref: "latest", served: map[string]string{"latest": tampered}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repository := fmt.Sprintf("library/pinned%d", i)
+			var requested []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ref := strings.TrimPrefix(r.URL.Path, "/v2/"+repository+"/manifests/")
+				body, ok := tt.served[ref]
+				if !ok {
+					return
+				}
+				requested = append(requested, ref)
+				w.Header().Set("Content-Type", ociManifestMediaType)
+				if strings.Contains(body, ociIndexMediaType) {
+					w.Header().Set("Content-Type", ociIndexMediaType)
+				}
+				w.Write([]byte(body))
+			}))
+			defer srv.Close()
+			useTestRegistry(t, srv)
+			src := &registrySource{repository: repository, auth: &registryAuth{}}
+
+			// Content that doesn't match is asked for again, not cached.
+			for attempt := 1; attempt <= 2; attempt++ {
+				data, _, err := resolveManifest(src, tt.ref)
+				if tt.wantMismatch {
+					var mismatch *digestMismatchError
+					if !errors.As(err, &mismatch) {
+						t.Fatalf("attempt %d: err = %v, want a digest mismatch", attempt, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := tt.served[manifestDigest]; tt.ref != "latest" && string(data) != want {
+					t.Errorf("resolved to %s, want %s", data, want)
+				}
+			}
+			if !tt.wantMismatch {
+				// Once verified, manifests by digest come from the cache.
+				if len(requested) > len(tt.served) {
+					t.Errorf("requested %q, want each of %d references once at most", requested, len(tt.served))
+				}
+				return
+			}
+			mismatched := 0
+			for _, ref := range requested {
+				if ref == manifestDigest {
+					mismatched++
+				}
+			}
+			if mismatched != 2 {
+				t.Errorf("requested %q, want the mismatched manifest asked for on each attempt", requested)
+			}
+		})
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// mountSpec describes a mount into the container. By the time it reaches the
+// child every mount is either a bind of an absolute host path or a tmpfs;
+// named volumes are resolved to their host directory by the parent.
+type mountSpec struct {
+	Type     string `json:"type"`
+	Source   string `json:"source,omitempty"`
+	Target   string `json:"target"`
+	ReadOnly bool   `json:"readonly,omitempty"`
+	// TmpfsSize and TmpfsMode only apply to tmpfs mounts. Zero means the
+	// kernel default.
+	TmpfsSize int64       `json:"tmpfs_size,omitempty"`
+	TmpfsMode os.FileMode `json:"tmpfs_mode,omitempty"`
+}
+
+const (
+	mountTypeBind   = "bind"
+	mountTypeVolume = "volume"
+	mountTypeTmpfs  = "tmpfs"
+)
+
+// defaultShmSize is the size of /dev/shm without --shm-size, as in Docker.
+const defaultShmSize = 64 << 20
+
+// shmMount is the tmpfs at /dev/shm. Like /tmp, everyone may create files in
+// it, but only remove their own.
+func shmMount(size int64) mountSpec {
+	return mountSpec{Type: mountTypeTmpfs, Target: "/dev/shm", TmpfsSize: size, TmpfsMode: 0o1777}
+}
+
+// hasMountAt reports whether one of mounts is at the container path target.
+func hasMountAt(mounts []mountSpec, target string) bool {
+	for _, m := range mounts {
+		if filepath.Clean(m.Target) == target {
+			return true
+		}
+	}
+	return false
+}
+
+// parseVolumeFlag parses a `-v source:target[:ro|rw]` flag. A source
+// containing a slash is a host path to bind mount; anything else names a
+// volume.
+func parseVolumeFlag(value string) (mountSpec, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return mountSpec{}, fmt.Errorf("invalid volume %q: expected source:target[:ro|rw]", value)
+	}
+	m := mountSpec{Source: parts[0], Target: parts[1]}
+	if len(parts) == 3 {
+		switch parts[2] {
+		case "ro":
+			m.ReadOnly = true
+		case "rw":
+		default:
+			return mountSpec{}, fmt.Errorf("invalid volume %q: unknown mode %q", value, parts[2])
+		}
+	}
+	if m.Source == "" || !filepath.IsAbs(m.Target) {
+		return mountSpec{}, fmt.Errorf("invalid volume %q: target must be an absolute path", value)
+	}
+	if strings.Contains(m.Source, "/") || m.Source == "." || m.Source == ".." {
+		m.Type = mountTypeBind
+		abs, err := filepath.Abs(m.Source)
+		if err != nil {
+			return mountSpec{}, err
+		}
+		m.Source = abs
+		return m, nil
+	}
+	if !validVolumeName(m.Source) {
+		return mountSpec{}, fmt.Errorf("invalid volume name %q: must match %s", m.Source, volumeNamePattern)
+	}
+	m.Type = mountTypeVolume
+	return m, nil
+}
+
+// parseTmpfsFlag parses Docker's `--tmpfs path[:options]`, options being a
+// comma-separated list of ro, rw, size=<size> and mode=<octal mode>.
+func parseTmpfsFlag(value string) (mountSpec, error) {
+	target, options, _ := strings.Cut(value, ":")
+	m := mountSpec{Type: mountTypeTmpfs, Target: target}
+	if !filepath.IsAbs(target) {
+		return mountSpec{}, fmt.Errorf("invalid tmpfs %q: the path must be absolute", value)
+	}
+	if options == "" {
+		return m, nil
+	}
+	for _, option := range strings.Split(options, ",") {
+		key, val, _ := strings.Cut(option, "=")
+		switch key {
+		case "ro":
+			m.ReadOnly = true
+		case "rw":
+			m.ReadOnly = false
+		case "size":
+			size, err := parseSize(val)
+			if err != nil {
+				return mountSpec{}, fmt.Errorf("invalid tmpfs %q: %w", value, err)
+			}
+			m.TmpfsSize = size
+		case "mode":
+			mode, err := strconv.ParseUint(val, 8, 32)
+			if err != nil {
+				return mountSpec{}, fmt.Errorf("invalid tmpfs %q: invalid mode %q", value, val)
+			}
+			m.TmpfsMode = os.FileMode(mode)
+		default:
+			return mountSpec{}, fmt.Errorf("invalid tmpfs %q: unknown option %q", value, option)
+		}
+	}
+	return m, nil
+}
+
+// parseMountFlag parses Docker's `--mount` syntax, a comma-separated list of
+// key=value pairs such as
+//
+//	type=bind,source=/h,target=/c,readonly
+//	type=tmpfs,target=/tmp,tmpfs-size=64m
+//	type=volume,source=vol,target=/data
+func parseMountFlag(value string) (mountSpec, error) {
+	m := mountSpec{Type: mountTypeVolume}
+	for _, field := range strings.Split(value, ",") {
+		key, val, hasValue := strings.Cut(field, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		switch key {
+		case "type":
+			m.Type = val
+		case "source", "src":
+			m.Source = val
+		case "target", "destination", "dst":
+			m.Target = val
+		case "readonly", "ro":
+			if !hasValue {
+				m.ReadOnly = true
+				break
+			}
+			ro, err := strconv.ParseBool(val)
+			if err != nil {
+				return mountSpec{}, fmt.Errorf("invalid mount %q: invalid value for %s: %q", value, key, val)
+			}
+			m.ReadOnly = ro
+		case "tmpfs-size":
+			size, err := parseSize(val)
+			if err != nil {
+				return mountSpec{}, fmt.Errorf("invalid mount %q: %w", value, err)
+			}
+			m.TmpfsSize = size
+		case "tmpfs-mode":
+			mode, err := strconv.ParseUint(val, 8, 32)
+			if err != nil {
+				return mountSpec{}, fmt.Errorf("invalid mount %q: invalid tmpfs-mode %q", value, val)
+			}
+			m.TmpfsMode = os.FileMode(mode)
+		default:
+			return mountSpec{}, fmt.Errorf("invalid mount %q: unknown option %q", value, key)
+		}
+	}
+
+	if !filepath.IsAbs(m.Target) {
+		return mountSpec{}, fmt.Errorf("invalid mount %q: target must be an absolute path", value)
+	}
+	if m.Type != mountTypeTmpfs && (m.TmpfsSize != 0 || m.TmpfsMode != 0) {
+		return mountSpec{}, fmt.Errorf("invalid mount %q: tmpfs options require type=tmpfs", value)
+	}
+	switch m.Type {
+	case mountTypeBind:
+		if m.Source == "" {
+			return mountSpec{}, fmt.Errorf("invalid mount %q: bind mounts need a source", value)
+		}
+		abs, err := filepath.Abs(m.Source)
+		if err != nil {
+			return mountSpec{}, err
+		}
+		m.Source = abs
+	case mountTypeVolume:
+		if !validVolumeName(m.Source) {
+			return mountSpec{}, fmt.Errorf("invalid mount %q: invalid volume name %q", value, m.Source)
+		}
+	case mountTypeTmpfs:
+		if m.Source != "" {
+			return mountSpec{}, fmt.Errorf("invalid mount %q: tmpfs mounts take no source", value)
+		}
+	default:
+		return mountSpec{}, fmt.Errorf("invalid mount %q: unknown type %q", value, m.Type)
+	}
+	return m, nil
+}
+
+// setupMounts performs the given mounts into rootfs. It must run in the
+// child's private mount namespace, before chrooting. With readOnlyRoot,
+// rootfs is first bind mounted onto itself, for remountRootReadOnly to make
+// read-only once nothing needs writing to it any more; the mounts on top of
+// it keep their own flags.
+func setupMounts(rootfs string, mounts []mountSpec, readOnlyRoot bool) error {
+	// Keep our mounts from propagating back to the host.
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %w", err)
+	}
+	if readOnlyRoot {
+		if err := syscall.Mount(rootfs, rootfs, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("bind mounting the rootfs: %w", err)
+		}
+	}
+	for _, m := range mounts {
+		var err error
+		switch m.Type {
+		case mountTypeBind:
+			err = bindMount(rootfs, m)
+		case mountTypeTmpfs:
+			err = tmpfsMount(rootfs, m)
+		case mountTypeProc:
+			err = kernelMount(rootfs, m, "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+		case mountTypeSysfs:
+			err = kernelMount(rootfs, m, "sysfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+		case mountTypeCgroup:
+			err = kernelMount(rootfs, m, "cgroup2", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+		case mountTypeDev:
+			err = devMount(rootfs, m)
+		case mountTypeDevpts:
+			err = kernelMount(rootfs, m, "devpts", syscall.MS_NOSUID|syscall.MS_NOEXEC, "newinstance,ptmxmode=0666,mode=0620")
+		default:
+			err = fmt.Errorf("unsupported mount type %q", m.Type)
+		}
+		if err != nil {
+			return fmt.Errorf("mounting %s at %s: %w", m.Type, m.Target, err)
+		}
+	}
+	return nil
+}
+
+// remountRootReadOnly makes the bind mount of rootfs setupMounts made
+// read-only. Only that mount changes, not those under it.
+func remountRootReadOnly(rootfs string) error {
+	if err := syscall.Mount("", rootfs, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+		return fmt.Errorf("making the rootfs read-only: %w", err)
+	}
+	return nil
+}
+
+func tmpfsMount(rootfs string, m mountSpec) error {
+	target, err := resolveInRoot(rootfs, m.Target)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(target, 0o755); err != nil {
+		return err
+	}
+	var options []string
+	if m.TmpfsSize > 0 {
+		options = append(options, fmt.Sprintf("size=%d", m.TmpfsSize))
+	}
+	if m.TmpfsMode != 0 {
+		options = append(options, fmt.Sprintf("mode=%o", m.TmpfsMode))
+	}
+	flags := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV)
+	if m.ReadOnly {
+		flags |= syscall.MS_RDONLY
+	}
+	return syscall.Mount("tmpfs", target, "tmpfs", flags, strings.Join(options, ","))
+}
+
+func bindMount(rootfs string, m mountSpec) error {
+	info, err := os.Stat(m.Source)
+	if err != nil {
+		return err
+	}
+	target, err := resolveInRoot(rootfs, m.Target)
+	if err != nil {
+		return err
+	}
+	if err := createMountPoint(target, info.IsDir()); err != nil {
+		return err
+	}
+	if err := syscall.Mount(m.Source, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return err
+	}
+	if m.ReadOnly {
+		// Bind mounts ignore MS_RDONLY on the initial mount; it only takes
+		// effect on a remount.
+		return syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, "")
+	}
+	return nil
+}
+
+// createMountPoint makes sure there is a directory, or for file mounts a
+// file, at target to mount onto.
+func createMountPoint(target string, dir bool) error {
+	if dir {
+		return os.MkdirAll(target, 0o755)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_RDONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
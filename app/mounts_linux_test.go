@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseMountFlag(t *testing.T) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		value   string
+		want    mountSpec
+		wantErr bool
+	}{
+		{value: "type=bind,source=/h,target=/c", want: mountSpec{Type: mountTypeBind, Source: "/h", Target: "/c"}},
+		{value: "type=bind,src=/h,dst=/c,readonly", want: mountSpec{Type: mountTypeBind, Source: "/h", Target: "/c", ReadOnly: true}},
+		{value: "type=bind,source=rel,destination=/c,ro=true", want: mountSpec{Type: mountTypeBind, Source: filepath.Join(cwd, "rel"), Target: "/c", ReadOnly: true}},
+		{value: "type=bind,source=/h,target=/c,readonly=false", want: mountSpec{Type: mountTypeBind, Source: "/h", Target: "/c"}},
+		{value: "type=bind,target=/c", wantErr: true},
+		{value: "type=bind,source=/h,target=/c,readonly=maybe", wantErr: true},
+		{value: "type=volume,source=vol,target=/data", want: mountSpec{Type: mountTypeVolume, Source: "vol", Target: "/data"}},
+		// Docker's default type is volume.
+		{value: "source=vol,target=/data", want: mountSpec{Type: mountTypeVolume, Source: "vol", Target: "/data"}},
+		{value: "Type=volume,Source=vol,Target=/data", want: mountSpec{Type: mountTypeVolume, Source: "vol", Target: "/data"}},
+		{value: "type=volume,source=../vol,target=/data", wantErr: true},
+		{value: "type=tmpfs,target=/tmp", want: mountSpec{Type: mountTypeTmpfs, Target: "/tmp"}},
+		{value: "type=tmpfs,target=/tmp,tmpfs-size=64m,tmpfs-mode=1777", want: mountSpec{Type: mountTypeTmpfs, Target: "/tmp", TmpfsSize: 64 << 20, TmpfsMode: 0o1777}},
+		{value: "type=tmpfs,source=x,target=/tmp", wantErr: true},
+		{value: "type=tmpfs,target=/tmp,tmpfs-size=big", wantErr: true},
+		{value: "type=tmpfs,target=/tmp,tmpfs-mode=999", wantErr: true},
+		{value: "type=bind,source=/h,target=/c,tmpfs-size=1m", wantErr: true},
+		{value: "type=bind,source=/h,target=relative", wantErr: true},
+		{value: "type=npipe,source=/h,target=/c", wantErr: true},
+		{value: "type=bind,source=/h,target=/c,consistency=cached", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseMountFlag(tt.value)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseMountFlag(%q) = %+v, want an error", tt.value, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseMountFlag(%q) = %+v, %v, want %+v", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseVolumeFlag(t *testing.T) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		value   string
+		want    mountSpec
+		wantErr bool
+	}{
+		{value: "/h:/c", want: mountSpec{Type: mountTypeBind, Source: "/h", Target: "/c"}},
+		{value: "/h:/c:ro", want: mountSpec{Type: mountTypeBind, Source: "/h", Target: "/c", ReadOnly: true}},
+		{value: "./h:/c:rw", want: mountSpec{Type: mountTypeBind, Source: filepath.Join(cwd, "h"), Target: "/c"}},
+		{value: ".:/c", want: mountSpec{Type: mountTypeBind, Source: cwd, Target: "/c"}},
+		{value: "data:/data", want: mountSpec{Type: mountTypeVolume, Source: "data", Target: "/data"}},
+		{value: "/c", wantErr: true},
+		{value: "/h:/c:rx", wantErr: true},
+		{value: "/h:c", wantErr: true},
+		{value: ":/c", wantErr: true},
+		{value: "-bad:/c", wantErr: true},
+		{value: "/h:/c:ro:z", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseVolumeFlag(tt.value)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseVolumeFlag(%q) = %+v, want an error", tt.value, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseVolumeFlag(%q) = %+v, %v, want %+v", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseTmpfsFlag(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    mountSpec
+		wantErr bool
+	}{
+		{value: "/var/run", want: mountSpec{Type: mountTypeTmpfs, Target: "/var/run"}},
+		{value: "/tmp:ro", want: mountSpec{Type: mountTypeTmpfs, Target: "/tmp", ReadOnly: true}},
+		{value: "/tmp:ro,rw", want: mountSpec{Type: mountTypeTmpfs, Target: "/tmp"}},
+		{value: "/tmp:size=64m,mode=1777", want: mountSpec{Type: mountTypeTmpfs, Target: "/tmp", TmpfsSize: 64 << 20, TmpfsMode: 0o1777}},
+		{value: "tmp", wantErr: true},
+		{value: "/tmp:size=big", wantErr: true},
+		{value: "/tmp:mode=999", wantErr: true},
+		{value: "/tmp:noexec", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTmpfsFlag(tt.value)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseTmpfsFlag(%q) = %+v, want an error", tt.value, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseTmpfsFlag(%q) = %+v, %v, want %+v", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+// TestRunReadOnly writes in a container with a read-only rootfs, and checks
+// only what's mounted on top of it, and not read-only itself, takes writes.
+func TestRunReadOnly(t *testing.T) {
+	docker, image := runTestImage(t)
+	host := t.TempDir()
+	tests := []struct {
+		name    string
+		flags   []string
+		path    string
+		wantErr bool
+	}{
+		{name: "rootfs", flags: []string{"--read-only"}, path: "/f", wantErr: true},
+		{name: "rootfs without --read-only", path: "/f"},
+		{name: "tmpfs", flags: []string{"--read-only", "--tmpfs", "/var/run"}, path: "/var/run/f"},
+		{name: "read-only tmpfs", flags: []string{"--read-only", "--tmpfs", "/var/run:ro"}, path: "/var/run/f", wantErr: true},
+		{name: "tmpfs mount", flags: []string{"--read-only", "--mount", "type=tmpfs,target=/scratch"}, path: "/scratch/f"},
+		{name: "bind mount", flags: []string{"--read-only", "-v", host + ":/data"}, path: "/data/f"},
+		{name: "read-only bind mount", flags: []string{"--read-only", "-v", host + ":/data:ro"}, path: "/data/g", wantErr: true},
+		{name: "beside a tmpfs", flags: []string{"--read-only", "--tmpfs", "/var/run"}, path: "/var/f", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append(append([]string{"run", "--rm"}, tt.flags...), image, "/probe", "write", tt.path, "x")
+			out, err := docker(args...).CombinedOutput()
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("writing %s succeeded, want it refused", tt.path)
+				} else if !strings.Contains(string(out), "read-only file system") {
+					t.Errorf("writing %s: %v, want it refused as read-only\n%s", tt.path, err, out)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("writing %s: %v\n%s", tt.path, err, out)
+			}
+		})
+	}
+	// The bind mount's write went to the host.
+	if data, err := os.ReadFile(filepath.Join(host, "f")); err != nil || string(data) != "x" {
+		t.Errorf("the host has %q, %v, want the container's write", data, err)
+	}
+	if _, err := docker("run", "--rm", "--read-only", "--no-mount-namespace", image, "/probe", "sleep", "0s").CombinedOutput(); err == nil {
+		t.Error("--read-only ran without a mount namespace")
+	}
+}
+
+// TestShmSize checks the size of the tmpfs a run mounts at /dev/shm.
+func TestShmSize(t *testing.T) {
+	docker, image := runTestImage(t)
+	// tmpfsMagic is TMPFS_MAGIC, the statfs type of a tmpfs.
+	const tmpfsMagic = 0x01021994
+	tests := []struct {
+		flags   []string
+		want    int64
+		wantErr string
+	}{
+		{flags: []string{"--mounts-default=full"}, want: defaultShmSize},
+		{flags: []string{"--mounts-default=full", "--shm-size", "8m"}, want: 8 << 20},
+		{flags: []string{"--mounts-default=full", "--shm-size=1g"}, want: 1 << 30},
+		{flags: []string{"--shm-size", "8m"}, wantErr: "only --mounts-default=full mounts"},
+	}
+	for _, tt := range tests {
+		args := append(append([]string{"run", "--rm"}, tt.flags...), image, "/probe", "statfs", "/dev/shm")
+		out, err := docker(args...).CombinedOutput()
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(string(out), tt.wantErr) {
+				t.Errorf("%q: %v, want it to fail with %q\n%s", tt.flags, err, tt.wantErr, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v\n%s", tt.flags, err, out)
+			continue
+		}
+		if want := fmt.Sprintf("%#x %d\n", tmpfsMagic, tt.want); string(out) != want {
+			t.Errorf("%q: /dev/shm is %q, want %q", tt.flags, out, want)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// cloneFlags returns the namespaces to create for spec's child.
+func cloneFlags(spec containerSpec) uintptr {
+	var flags uintptr
+	if !spec.NoPIDNamespace && spec.PIDNamespace == nil {
+		flags |= syscall.CLONE_NEWPID
+	}
+	if !spec.NoMountNamespace {
+		flags |= syscall.CLONE_NEWNS
+	}
+	if !spec.NoUTSNamespace {
+		flags |= syscall.CLONE_NEWUTS
+	}
+	return flags
+}
+
+// Modes of --pid. A container gets a PID namespace of its own unless one
+// of them is given.
+const (
+	pidModeHost      = "host"
+	pidModeContainer = "container:"
+)
+
+// openPIDNamespace returns the PID namespace --pid mode asks to share, or
+// nil for a new one or the host's, which host mode asks for by doing
+// without one. container:<name|id> is that of a running container, opened
+// here so that it stays the same namespace even if the container exits
+// before ours starts.
+func openPIDNamespace(mode string) (*os.File, error) {
+	if mode == "" || mode == pidModeHost {
+		return nil, nil
+	}
+	if !strings.HasPrefix(mode, pidModeContainer) {
+		return nil, fmt.Errorf("--pid %q: must be %s or %s<name|id>", mode, pidModeHost, pidModeContainer)
+	}
+	target := strings.TrimPrefix(mode, pidModeContainer)
+	state, ok := runningContainer(target)
+	if !ok {
+		return nil, fmt.Errorf("--pid %s: no running container %q", mode, target)
+	}
+	if state.Pid <= 0 {
+		return nil, fmt.Errorf("--pid %s: container %q hasn't started its process yet", mode, target)
+	}
+	f, err := os.Open(fmt.Sprintf("/proc/%d/ns/pid", state.Pid))
+	if err != nil {
+		return nil, fmt.Errorf("--pid %s: %w", mode, err)
+	}
+	return f, nil
+}
+
+// startContainer starts cmd, the child prepared for spec, in
+// spec.PIDNamespace if there is one. Unlike the other namespaces, a process
+// can't move into a PID namespace: joining one only takes effect for the
+// children forked afterwards. So the namespace is joined for the thread the
+// child is forked from, which goes back to ours once it is.
+func startContainer(cmd *exec.Cmd, spec containerSpec) error {
+	if spec.PIDNamespace == nil {
+		return cmd.Start()
+	}
+	own, err := os.Open("/proc/self/ns/pid")
+	if err != nil {
+		return err
+	}
+	defer own.Close()
+	runtime.LockOSThread()
+	if _, _, errno := syscall.RawSyscall(sysSetns, spec.PIDNamespace.Fd(), syscall.CLONE_NEWPID, 0); errno != 0 {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("joining the PID namespace: %w", errno)
+	}
+	err = cmd.Start()
+	if _, _, errno := syscall.RawSyscall(sysSetns, own.Fd(), syscall.CLONE_NEWPID, 0); errno != 0 {
+		// The thread, whose children would go on being started in the
+		// container's namespace, stays locked, and so is never reused.
+		fmt.Fprintf(os.Stderr, "Warning: leaving the PID namespace: %v\n", errno)
+		return err
+	}
+	runtime.UnlockOSThread()
+	return err
+}
+
+// Modes of --cgroupns.
+const (
+	cgroupnsPrivate = "private"
+	cgroupnsHost    = "host"
+)
+
+// unshareCgroupNamespace gives the child a cgroup namespace of its own, rooted
+// at the cgroup it is in, so it has to be called once the child joined the
+// container's. Like joinNetNamespace, it keeps the calling goroutine's
+// thread, which the command is started from.
+func unshareCgroupNamespace() error {
+	runtime.LockOSThread()
+	if err := syscall.Unshare(syscall.CLONE_NEWCGROUP); err != nil {
+		return fmt.Errorf("creating a cgroup namespace: %w", err)
+	}
+	return nil
+}
+
+// canCreateNamespace reports why a namespace of type flag (a CLONE_NEW*
+// flag) can't be created here, e.g. in an unprivileged container, or nil if
+// it can. It tries unsharing one on a thread of its own, which is thrown
+// away afterwards: the thread stays locked, so it exits with the goroutine
+// instead of being reused by other goroutines.
+func canCreateNamespace(flag uintptr) error {
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		errc <- syscall.Unshare(int(flag))
+	}()
+	return <-errc
+}
+
+// explainNamespaceFailure follows up the error of a container that failed to
+// start by naming the namespaces that can't be created here, if any, and the
+// flags that do without them.
+func explainNamespaceFailure(noPID, noMount, noUTS bool) {
+	namespaces := []struct {
+		name    string
+		flag    uintptr
+		skipped bool
+	}{
+		{"pid", syscall.CLONE_NEWPID, noPID},
+		{"mount", syscall.CLONE_NEWNS, noMount},
+		{"uts", syscall.CLONE_NEWUTS, noUTS},
+	}
+	for _, ns := range namespaces {
+		if ns.skipped {
+			continue
+		}
+		if err := canCreateNamespace(ns.flag); err != nil {
+			fmt.Fprintf(os.Stderr, "Creating a %s namespace isn't allowed here (%v); --no-%s-namespace runs without one\n", ns.name, err, ns.name)
+		}
+	}
+}
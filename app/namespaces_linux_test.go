@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestCloneFlags(t *testing.T) {
+	tests := []struct {
+		spec containerSpec
+		want uintptr
+	}{
+		{spec: containerSpec{}, want: syscall.CLONE_NEWPID | syscall.CLONE_NEWNS | syscall.CLONE_NEWUTS},
+		{spec: containerSpec{NoPIDNamespace: true}, want: syscall.CLONE_NEWNS | syscall.CLONE_NEWUTS},
+		{spec: containerSpec{NoMountNamespace: true}, want: syscall.CLONE_NEWPID | syscall.CLONE_NEWUTS},
+		{spec: containerSpec{NoUTSNamespace: true}, want: syscall.CLONE_NEWPID | syscall.CLONE_NEWNS},
+		{spec: containerSpec{NoPIDNamespace: true, NoMountNamespace: true, NoUTSNamespace: true}, want: 0},
+	}
+	for _, tt := range tests {
+		if got := cloneFlags(tt.spec); got != tt.want {
+			t.Errorf("cloneFlags(%+v) = %#x, want %#x", tt.spec, got, tt.want)
+		}
+	}
+}
+
+// runWithoutSysAdmin runs cmd without CAP_SYS_ADMIN, which creating
+// namespaces needs, as in an unprivileged container. The capability is
+// dropped from the bounding set of a thread of its own, which cmd is started
+// from and which exits with its goroutine instead of being reused.
+func runWithoutSysAdmin(cmd *exec.Cmd) error {
+	done := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		const prCapbsetDrop, capSysAdmin = 24, 21
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prCapbsetDrop, capSysAdmin, 0); errno != 0 {
+			done <- errno
+			return
+		}
+		done <- cmd.Run()
+	}()
+	return <-done
+}
+
+// TestRunWithoutNamespaces runs containers without PID and mount
+// namespaces, where they can and where they can't be created.
+func TestRunWithoutNamespaces(t *testing.T) {
+	docker, image := runTestImage(t)
+	tests := []struct {
+		name       string
+		flags      []string
+		noSysAdmin bool
+		// want is in the output of a container that ran, or, with
+		// wantErr, of the failed run; wantStderr is in what it wrote to
+		// stderr.
+		want       []string
+		wantStderr []string
+		wantErr    bool
+	}{
+		{name: "namespaces", want: []string{"pid 1\n"}},
+		{name: "no pid namespace", flags: []string{"--no-pid-namespace"}, want: []string{"Warning: running without a PID namespace"}},
+		{
+			name:       "namespaces not allowed",
+			noSysAdmin: true,
+			wantStderr: []string{
+				"Creating a pid namespace isn't allowed here (operation not permitted); --no-pid-namespace runs without one\n",
+				"Creating a mount namespace isn't allowed here (operation not permitted); --no-mount-namespace runs without one\n",
+			},
+			wantErr: true,
+		},
+		{
+			name:       "mount namespace not allowed",
+			flags:      []string{"--no-pid-namespace"},
+			noSysAdmin: true,
+			wantStderr: []string{"--no-mount-namespace runs without one\n"},
+			wantErr:    true,
+		},
+		{name: "without any", flags: []string{"--no-pid-namespace", "--no-mount-namespace", "--no-uts-namespace", "--cgroupns=host"}, noSysAdmin: true, want: []string{"pid "}},
+		{name: "mounts without a mount namespace", flags: []string{"--no-mount-namespace", "--tmpfs", "/tmp"}, want: []string{"mounts need a mount namespace"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append(append([]string{"run", "--rm"}, tt.flags...), image, "/probe", "pid")
+			cmd := docker(args...)
+			var stdout, stderr bytes.Buffer
+			cmd.Stdout, cmd.Stderr = &stdout, &stderr
+			var err error
+			if tt.noSysAdmin {
+				err = runWithoutSysAdmin(cmd)
+			} else {
+				err = cmd.Run()
+			}
+			out := stdout.String() + stderr.String()
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("%v, want error %v\n%s", err, tt.wantErr, out)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("output %q doesn't say %q", out, want)
+				}
+			}
+			for _, want := range tt.wantStderr {
+				if !strings.Contains(stderr.String(), want) {
+					t.Errorf("stderr %q doesn't say %q", stderr.String(), want)
+				}
+			}
+			if !tt.wantErr && strings.Contains(strings.Join(tt.flags, " "), "--no-pid-namespace") && strings.Contains(string(out), "pid 1\n") {
+				t.Errorf("the container is PID 1 without a PID namespace:\n%s", out)
+			}
+		})
+	}
+}
+
+// TestRunCgroupns checks the cgroups a container's process sees itself in:
+// with a cgroup namespace of its own, the root of every hierarchy, and with
+// the host's, those it is in on the host.
+func TestRunCgroupns(t *testing.T) {
+	docker, image := runTestImage(t)
+	own, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		t.Skip(err)
+	}
+	_, statErr := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	v2 := statErr == nil
+	tests := []struct {
+		flags   []string
+		private bool
+		wantErr bool
+	}{
+		{private: true},
+		{flags: []string{"--cgroupns=private"}, private: true},
+		{flags: []string{"--cgroupns", "host"}},
+		{flags: []string{"--cgroupns=shared"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		args := append(append([]string{"run", "--rm"}, tt.flags...), image, "/probe", "cat", "/proc/self/cgroup")
+		out, err := docker(args...).CombinedOutput()
+		if tt.wantErr {
+			if err == nil || strings.Contains(string(out), "/proc/self/cgroup:") {
+				t.Errorf("%q: %v, want it refused before running\n%s", tt.flags, err, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %v\n%s", tt.flags, err, out)
+		}
+		cgroups := strings.TrimSpace(strings.TrimPrefix(string(out), "/proc/self/cgroup: "))
+		switch {
+		case tt.private:
+			for _, line := range strings.Split(cgroups, "\n") {
+				if !strings.HasSuffix(line, ":/") {
+					t.Errorf("%q: the container sees itself in %q, want the root of each hierarchy\n%s", tt.flags, line, cgroups)
+				}
+			}
+		case v2:
+			// In the cgroup run made for it.
+			if !strings.Contains(cgroups, "/docker-clone/") {
+				t.Errorf("%q: the container sees itself in\n%s\nwant the cgroup made for it", tt.flags, cgroups)
+			}
+		default:
+			// Left in ours, without cgroup v2 to make one of its own.
+			if cgroups != strings.TrimSpace(string(own)) {
+				t.Errorf("%q: the container sees itself in\n%s\nwant ours\n%s", tt.flags, cgroups, own)
+			}
+		}
+	}
+}
+
+// TestRunPIDMode checks which processes a container sees with each --pid:
+// its own, the host's, or those of the container it shares the namespace
+// of.
+func TestRunPIDMode(t *testing.T) {
+	docker, image := runTestImage(t)
+	if out, err := docker("run", "-d", "--name", "target", image, "/probe", "trap").CombinedOutput(); err != nil {
+		t.Fatalf("running the target: %v\n%s", err, out)
+	}
+	t.Cleanup(func() { docker("stop", "target").Run() })
+	if out, err := docker("run", "--name", "exited", image, "/probe", "ids").CombinedOutput(); err != nil {
+		t.Fatalf("running a container to exit: %v\n%s", err, out)
+	}
+	// This test's process is one of the host's.
+	host := fmt.Sprintf("/proc/%d/comm", os.Getpid())
+	comm, err := os.ReadFile(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		flags []string
+		path  string
+		// want, if set, is what the container reads at path; otherwise
+		// it must find nothing there.
+		want    string
+		wantErr string
+	}{
+		{name: "own", path: host},
+		{name: "own init", path: "/proc/1/cmdline", want: "/probe\x00cat\x00/proc/1/cmdline\x00"},
+		{name: "host", flags: []string{"--pid", "host"}, path: host, want: string(comm)},
+		{name: "container", flags: []string{"--pid", "container:target"}, path: "/proc/1/cmdline", want: "/probe\x00trap\x00"},
+		{name: "exited container", flags: []string{"--pid", "container:exited"}, wantErr: `no running container "exited"`},
+		{name: "missing container", flags: []string{"--pid", "container:missing"}, wantErr: `no running container "missing"`},
+		{name: "other mode", flags: []string{"--pid", "private"}, wantErr: "must be host or container:<name|id>"},
+		{name: "without a PID namespace", flags: []string{"--pid", "container:target", "--no-pid-namespace"}, wantErr: "can't be used with --no-pid-namespace"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append(append([]string{"run", "--rm"}, tt.flags...), image, "/probe", "cat", tt.path)
+			if tt.wantErr != "" {
+				out, err := docker(args...).CombinedOutput()
+				if err == nil || !strings.Contains(string(out), tt.wantErr) {
+					t.Errorf("%v, want it to fail with %q\n%s", err, tt.wantErr, out)
+				}
+				return
+			}
+			// Sharing the host's processes is warned about on stderr.
+			out, err := docker(args...).Output()
+			if err != nil {
+				t.Fatalf("%v\n%s", err, out)
+			}
+			if tt.want == "" {
+				if strings.HasPrefix(string(out), tt.path+": ") {
+					t.Errorf("the container sees %q", out)
+				}
+			} else if want := tt.path + ": " + tt.want + "\n"; string(out) != want {
+				t.Errorf("the container reads %q, want %q", out, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// The rtnetlink attributes and values the syscall package lacks, from
+// <linux/if_link.h> and <linux/veth.h>.
+const (
+	iflaInfoKind = 1
+	iflaInfoData = 2
+	vethInfoPeer = 1
+	iflaNetNSFD  = 28
+)
+
+// nativeEndian is the host's byte order, which netlink messages are in.
+var nativeEndian = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// netlinkConn is a NETLINK_ROUTE socket, which configures the links,
+// addresses and routes of the network namespace it was opened in, whichever
+// thread uses it afterwards.
+type netlinkConn struct {
+	fd  int
+	seq uint32
+}
+
+// openNetlink opens a netlink socket in the calling thread's network
+// namespace.
+func openNetlink() (*netlinkConn, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("opening a netlink socket: %w", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("binding a netlink socket: %w", err)
+	}
+	return &netlinkConn{fd: fd}, nil
+}
+
+func (c *netlinkConn) Close() error {
+	return syscall.Close(c.fd)
+}
+
+// netlinkMessage builds a request: a fixed header, such as an ifinfomsg,
+// followed by attributes.
+type netlinkMessage struct {
+	typ   uint16
+	flags uint16
+	data  []byte
+}
+
+// attr appends the attribute typ with value.
+func (m *netlinkMessage) attr(typ uint16, value []byte) {
+	m.data = append(m.data, netlinkAttr(typ, value)...)
+}
+
+// netlinkAttr encodes an rtattr, padded to 4 bytes. Attributes nest by
+// having encoded ones as their value.
+func netlinkAttr(typ uint16, value []byte) []byte {
+	b := make([]byte, syscall.SizeofRtAttr, nlmAlign(syscall.SizeofRtAttr+len(value)))
+	nativeEndian.PutUint16(b[0:], uint16(syscall.SizeofRtAttr+len(value)))
+	nativeEndian.PutUint16(b[2:], typ)
+	b = append(b, value...)
+	return append(b, make([]byte, nlmAlign(len(b))-len(b))...)
+}
+
+func nlmAlign(n int) int {
+	return (n + syscall.NLMSG_ALIGNTO - 1) &^ (syscall.NLMSG_ALIGNTO - 1)
+}
+
+// cString is s NUL-terminated, as names are sent.
+func cString(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+func uint32Bytes(v uint32) []byte {
+	b := make([]byte, 4)
+	nativeEndian.PutUint32(b, v)
+	return b
+}
+
+// ifInfo encodes an ifinfomsg for the link with index, 0 to name it by
+// IFLA_IFNAME instead, changing the flags in change to flags.
+func ifInfo(index int32, flags, change uint32) []byte {
+	msg := syscall.IfInfomsg{Family: syscall.AF_UNSPEC, Index: index, Flags: flags, Change: change}
+	return (*[syscall.SizeofIfInfomsg]byte)(unsafe.Pointer(&msg))[:]
+}
+
+// do sends m and waits for the kernel's acknowledgement, returning the
+// replies that came before it, if any.
+func (c *netlinkConn) do(m netlinkMessage) ([][]byte, error) {
+	c.seq++
+	b := make([]byte, syscall.NLMSG_HDRLEN, syscall.NLMSG_HDRLEN+len(m.data))
+	nativeEndian.PutUint32(b[0:], uint32(syscall.NLMSG_HDRLEN+len(m.data)))
+	nativeEndian.PutUint16(b[4:], m.typ)
+	nativeEndian.PutUint16(b[6:], m.flags|syscall.NLM_F_REQUEST|syscall.NLM_F_ACK)
+	nativeEndian.PutUint32(b[8:], c.seq)
+	b = append(b, m.data...)
+	if err := syscall.Sendto(c.fd, b, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+	var replies [][]byte
+	buf := make([]byte, 1<<16)
+	for {
+		n, _, err := syscall.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range msgs {
+			if msg.Header.Seq != c.seq {
+				continue
+			}
+			switch msg.Header.Type {
+			case syscall.NLMSG_ERROR:
+				if len(msg.Data) < 4 {
+					return nil, errors.New("short netlink error")
+				}
+				if errno := int32(nativeEndian.Uint32(msg.Data)); errno != 0 {
+					return nil, syscall.Errno(-errno)
+				}
+				return replies, nil
+			case syscall.NLMSG_DONE:
+				return replies, nil
+			}
+			// Kept past the next read into buf.
+			replies = append(replies, append([]byte(nil), msg.Data...))
+		}
+	}
+}
+
+// linkIndex returns the index of the link name.
+func (c *netlinkConn) linkIndex(name string) (int32, error) {
+	m := netlinkMessage{typ: syscall.RTM_GETLINK, data: ifInfo(0, 0, 0)}
+	m.attr(syscall.IFLA_IFNAME, cString(name))
+	replies, err := c.do(m)
+	if err != nil {
+		return 0, fmt.Errorf("looking up link %s: %w", name, err)
+	}
+	for _, reply := range replies {
+		if len(reply) >= syscall.SizeofIfInfomsg {
+			return int32(nativeEndian.Uint32(reply[4:])), nil
+		}
+	}
+	return 0, fmt.Errorf("looking up link %s: no reply", name)
+}
+
+// createBridge creates the bridge name, if there isn't one.
+func (c *netlinkConn) createBridge(name string) error {
+	m := netlinkMessage{typ: syscall.RTM_NEWLINK, flags: syscall.NLM_F_CREATE | syscall.NLM_F_EXCL, data: ifInfo(0, 0, 0)}
+	m.attr(syscall.IFLA_IFNAME, cString(name))
+	m.attr(syscall.IFLA_LINKINFO, netlinkAttr(iflaInfoKind, []byte("bridge")))
+	if _, err := c.do(m); err != nil && err != syscall.EEXIST {
+		return fmt.Errorf("creating bridge %s: %w", name, err)
+	}
+	return nil
+}
+
+// createVeth creates a veth pair: name here, and peer in the network
+// namespace open on nsFD.
+func (c *netlinkConn) createVeth(name, peer string, nsFD int) error {
+	peerInfo := ifInfo(0, 0, 0)
+	peerInfo = append(peerInfo, netlinkAttr(syscall.IFLA_IFNAME, cString(peer))...)
+	peerInfo = append(peerInfo, netlinkAttr(iflaNetNSFD, uint32Bytes(uint32(nsFD)))...)
+	info := netlinkAttr(iflaInfoKind, []byte("veth"))
+	info = append(info, netlinkAttr(iflaInfoData, netlinkAttr(vethInfoPeer, peerInfo))...)
+	m := netlinkMessage{typ: syscall.RTM_NEWLINK, flags: syscall.NLM_F_CREATE | syscall.NLM_F_EXCL, data: ifInfo(0, 0, 0)}
+	m.attr(syscall.IFLA_IFNAME, cString(name))
+	m.attr(syscall.IFLA_LINKINFO, info)
+	if _, err := c.do(m); err != nil {
+		return fmt.Errorf("creating veth pair %s: %w", name, err)
+	}
+	return nil
+}
+
+// setLinkUp brings the link name up, attached to the bridge with index
+// master unless that is 0.
+func (c *netlinkConn) setLinkUp(name string, master int32) error {
+	m := netlinkMessage{typ: syscall.RTM_NEWLINK, data: ifInfo(0, syscall.IFF_UP, syscall.IFF_UP)}
+	m.attr(syscall.IFLA_IFNAME, cString(name))
+	if master != 0 {
+		m.attr(syscall.IFLA_MASTER, uint32Bytes(uint32(master)))
+	}
+	if _, err := c.do(m); err != nil {
+		return fmt.Errorf("bringing up %s: %w", name, err)
+	}
+	return nil
+}
+
+// addAddress gives the link with index the IPv4 address addr in network,
+// which it may already have.
+func (c *netlinkConn) addAddress(index int32, addr net.IP, network *net.IPNet) error {
+	prefix, _ := network.Mask.Size()
+	msg := syscall.IfAddrmsg{Family: syscall.AF_INET, Prefixlen: uint8(prefix), Index: uint32(index)}
+	m := netlinkMessage{
+		typ:   syscall.RTM_NEWADDR,
+		flags: syscall.NLM_F_CREATE | syscall.NLM_F_EXCL,
+		data:  append([]byte(nil), (*[syscall.SizeofIfAddrmsg]byte)(unsafe.Pointer(&msg))[:]...),
+	}
+	m.attr(syscall.IFA_LOCAL, addr.To4())
+	m.attr(syscall.IFA_ADDRESS, addr.To4())
+	if _, err := c.do(m); err != nil && err != syscall.EEXIST {
+		return fmt.Errorf("adding address %s: %w", addr, err)
+	}
+	return nil
+}
+
+// addDefaultRoute routes everything through gateway, over the link with
+// index.
+func (c *netlinkConn) addDefaultRoute(index int32, gateway net.IP) error {
+	msg := syscall.RtMsg{
+		Family:   syscall.AF_INET,
+		Table:    syscall.RT_TABLE_MAIN,
+		Protocol: syscall.RTPROT_BOOT,
+		Scope:    syscall.RT_SCOPE_UNIVERSE,
+		Type:     syscall.RTN_UNICAST,
+	}
+	m := netlinkMessage{
+		typ:   syscall.RTM_NEWROUTE,
+		flags: syscall.NLM_F_CREATE | syscall.NLM_F_EXCL,
+		data:  append([]byte(nil), (*[syscall.SizeofRtMsg]byte)(unsafe.Pointer(&msg))[:]...),
+	}
+	m.attr(syscall.RTA_GATEWAY, gateway.To4())
+	m.attr(syscall.RTA_OIF, uint32Bytes(uint32(index)))
+	if _, err := c.do(m); err != nil {
+		return fmt.Errorf("adding the default route: %w", err)
+	}
+	return nil
+}
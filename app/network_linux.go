@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// netNamespaceFD is the file descriptor on which the child gets the network
+// namespace to join, if any, after the spec's.
+const netNamespaceFD = specFD + 1
+
+// Modes of --net, besides netModeBridge. Containers have no network
+// namespace of their own unless asked, so by default they share the host's.
+const (
+	netModeHost      = "host"
+	netModeContainer = "container:"
+)
+
+// openNetNamespace returns the network namespace --net mode asks to join for
+// the container self, or nil for the host's, which the container is in
+// anyway, and the container's address on the bridge, if it is on it.
+// bridge is a new namespace on the bridge. container:<name|id> is that of a
+// running container, opened here so that it stays the same namespace even
+// if the container exits before ours starts.
+func openNetNamespace(mode string, self containerState) (*os.File, string, error) {
+	if mode == "" || mode == netModeHost {
+		return nil, "", nil
+	}
+	if mode == netModeBridge {
+		ip, err := leaseBridgeAddress(self.key())
+		if err != nil {
+			return nil, "", fmt.Errorf("--net %s: leasing an address: %w", mode, err)
+		}
+		f, err := createBridgeNamespace(self.ID, ip)
+		if err != nil {
+			return nil, "", fmt.Errorf("--net %s: %w", mode, explainBridgeFailure(err))
+		}
+		return f, ip.String(), nil
+	}
+	if !strings.HasPrefix(mode, netModeContainer) {
+		return nil, "", fmt.Errorf("--net %q: must be %s, %s or %s<name|id>", mode, netModeHost, netModeBridge, netModeContainer)
+	}
+	target := strings.TrimPrefix(mode, netModeContainer)
+	state, ok := runningContainer(target)
+	if !ok {
+		return nil, "", fmt.Errorf("--net %s: no running container %q", mode, target)
+	}
+	if state.Pid <= 0 {
+		return nil, "", fmt.Errorf("--net %s: container %q hasn't started its process yet", mode, target)
+	}
+	f, err := os.Open(fmt.Sprintf("/proc/%d/ns/net", state.Pid))
+	if err != nil {
+		return nil, "", fmt.Errorf("--net %s: %w", mode, err)
+	}
+	return f, state.IPAddress, nil
+}
+
+// joinNetNamespace moves the child into the network namespace open on fd.
+// Namespaces are joined per thread, so the calling goroutine keeps its
+// thread from then on: the command is executed, or with --init started, from
+// it, and gets its namespaces.
+func joinNetNamespace(fd int) error {
+	runtime.LockOSThread()
+	if _, _, errno := syscall.RawSyscall(sysSetns, uintptr(fd), syscall.CLONE_NEWNET, 0); errno != 0 {
+		return fmt.Errorf("joining the network namespace: %w", errno)
+	}
+	syscall.Close(fd)
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestRunNetContainer runs a server on the bridge, in a network namespace
+// of its own, and checks a container joining that namespace with
+// --net=container: reaches it on localhost, and that only running
+// containers can be joined.
+func TestRunNetContainer(t *testing.T) {
+	if c, err := openNetlink(); err != nil {
+		t.Skip(err)
+	} else {
+		err = c.createBridge(bridgeName)
+		c.Close()
+		if err != nil {
+			t.Skipf("can't create the bridge: %v", err)
+		}
+	}
+	docker, image := runTestImage(t)
+	if out, err := docker("run", "-d", "--name", "server", "--net", "bridge", image, "/probe", "serve", "server").CombinedOutput(); err != nil {
+		t.Fatalf("running the server: %v\n%s", err, out)
+	}
+	t.Cleanup(func() { docker("stop", "server").Run() })
+	// One without a name is found by its ID.
+	out, err := docker("run", "-d", "--net", "bridge", image, "/probe", "serve", "unnamed").Output()
+	if err != nil {
+		t.Fatalf("running the unnamed server: %v", err)
+	}
+	id := strings.TrimSpace(string(out))
+	t.Cleanup(func() { docker("stop", id).Run() })
+	if out, err := docker("run", "--name", "exited", image, "/probe", "ids").CombinedOutput(); err != nil {
+		t.Fatalf("running a container to exit: %v\n%s", err, out)
+	}
+
+	tests := []struct {
+		net     string
+		want    string
+		wantErr string
+	}{
+		{net: "container:server", want: "127.0.0.1 hello from server\n"},
+		{net: "container:" + id, want: "127.0.0.1 hello from unnamed\n"},
+		{net: "container:exited", wantErr: `no running container "exited"`},
+		{net: "container:missing", wantErr: `no running container "missing"`},
+		{net: "server", wantErr: "must be host"},
+	}
+	for _, tt := range tests {
+		out, err := docker("run", "--rm", "--net", tt.net, image, "/probe", "fetch", "127.0.0.1").CombinedOutput()
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(string(out), tt.wantErr) {
+				t.Errorf("--net %s: %v, want it to fail with %q\n%s", tt.net, err, tt.wantErr, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("--net %s: %v\n%s", tt.net, err, out)
+		}
+		if string(out) != tt.want {
+			t.Errorf("--net %s: fetched %q, want %q", tt.net, out, tt.want)
+		}
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	ociLayoutPrefix = "oci:"
+
+	ociIndexMediaType    = "application/vnd.oci.image.index.v1+json"
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+)
+
+// ociDescriptor is a content descriptor as used in OCI indexes and manifests.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+}
+
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// parseOCILayoutRef splits "oci:/path/to/layout[:tag]" into the layout
+// directory and the tag, which may be empty.
+func parseOCILayoutRef(image string) (dir, tag string) {
+	dir = strings.TrimPrefix(image, ociLayoutPrefix)
+	if i := strings.LastIndex(dir, ":"); i > strings.LastIndex(dir, "/") {
+		dir, tag = dir[:i], dir[i+1:]
+	}
+	return dir, tag
+}
+
+// ociBlobPath is where a layout stores the blob with the given digest. The
+// digest, which may come from the layout's own files, is checked whole
+// before it names a path, so that neither part can leave blobs/.
+func ociBlobPath(layout, digest string) (string, error) {
+	if err := validateDigest(digest); err != nil {
+		return "", err
+	}
+	algorithm, hex, _ := strings.Cut(digest, ":")
+	return filepath.Join(layout, "blobs", algorithm, hex), nil
+}
+
+// readOCIBlob reads a blob of the layout, such as a manifest or config, and
+// verifies it against its digest.
+func readOCIBlob(layout, digest string) ([]byte, error) {
+	path, err := ociBlobPath(layout, digest)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyDigest("blob", data, digest); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func readOCIBlobJSON(layout, digest string, v interface{}) error {
+	data, err := readOCIBlob(layout, digest)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// readOCIIndex reads the index.json of layout.
+func readOCIIndex(layout string) (ociIndex, error) {
+	var index ociIndex
+	if _, err := os.Stat(filepath.Join(layout, "oci-layout")); err != nil {
+		return index, fmt.Errorf("%s is not an OCI image layout: %w", layout, err)
+	}
+	data, err := os.ReadFile(filepath.Join(layout, "index.json"))
+	if err != nil {
+		return index, err
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return index, fmt.Errorf("parsing index.json: %w", err)
+	}
+	return index, nil
+}
+
+// resolveOCILayoutDescriptor finds the descriptor of the image manifest for
+// tag in the layout's index.json, descending into nested image indexes by
+// platform.
+func resolveOCILayoutDescriptor(layout, tag string) (ociDescriptor, error) {
+	index, err := readOCIIndex(layout)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	desc, err := selectOCIRef(index, tag)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	for desc.MediaType == ociIndexMediaType {
+		var nested ociIndex
+		if err := readOCIBlobJSON(layout, desc.Digest, &nested); err != nil {
+			return ociDescriptor{}, err
+		}
+		if desc, err = selectOCIPlatform(nested); err != nil {
+			return ociDescriptor{}, err
+		}
+	}
+	return desc, nil
+}
+
+// selectOCIRef picks the index entry annotated with tag. Without a tag, a
+// layout holding a single image is unambiguous; otherwise "latest" is used.
+func selectOCIRef(index ociIndex, tag string) (ociDescriptor, error) {
+	if tag == "" && len(index.Manifests) == 1 {
+		return index.Manifests[0], nil
+	}
+	if tag == "" {
+		tag = "latest"
+	}
+	for _, desc := range index.Manifests {
+		if desc.Annotations[ociRefNameAnnotation] == tag {
+			return desc, nil
+		}
+	}
+	return ociDescriptor{}, fmt.Errorf("tag %q not found in OCI layout", tag)
+}
+
+// selectOCIPlatform picks the targetPlatform image from index. Without a
+// variant, that is the best one for the host of the variants there are,
+// e.g. linux/arm/v6 for a v6 host of an index with v6 and v7 images. If
+// there is none, the error lists the platforms there are, so a typo or an
+// image that was never built for the platform is obvious.
+func selectOCIPlatform(index ociIndex) (ociDescriptor, error) {
+	host := hostVariant(targetPlatform.Architecture)
+	best := -1
+	for i, desc := range index.Manifests {
+		if !targetPlatform.matches(desc.Platform) {
+			continue
+		}
+		if targetPlatform.Variant != "" {
+			return desc, nil
+		}
+		if best < 0 || betterVariant(desc.Platform, index.Manifests[best].Platform, host) {
+			best = i
+		}
+	}
+	if best >= 0 {
+		return index.Manifests[best], nil
+	}
+	available := indexPlatforms(index)
+	if len(available) == 0 {
+		return ociDescriptor{}, fmt.Errorf("platform %s not available; the image index lists no platforms", targetPlatform)
+	}
+	return ociDescriptor{}, fmt.Errorf("platform %s not available; available: %s", targetPlatform, strings.Join(available, ", "))
+}
+
+// ociLayoutFile is the content of the oci-layout file marking a directory as
+// an OCI image layout.
+const ociLayoutFile = `{"imageLayoutVersion":"1.0.0"}`
+
+// initOCILayout creates an empty OCI image layout at dir, unless there is one
+// already.
+func initOCILayout(dir string) error {
+	if err := os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0o755); err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(dir, "index.json")); os.IsNotExist(err) {
+		data, err := json.Marshal(ociIndex{SchemaVersion: 2, MediaType: ociIndexMediaType, Manifests: []ociDescriptor{}})
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(filepath.Join(dir, "index.json"), data); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(filepath.Join(dir, "oci-layout"), []byte(ociLayoutFile))
+}
+
+// writeFileAtomic replaces the file at path with data, so that readers see
+// either the old content or the new one.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// writeOCIBlob stores data as a blob of the layout and returns its
+// descriptor.
+func writeOCIBlob(layout, mediaType string, data []byte) (ociDescriptor, error) {
+	desc := ociDescriptor{MediaType: mediaType, Digest: sha256Digest(data), Size: int64(len(data))}
+	path, err := ociBlobPath(layout, desc.Digest)
+	if err != nil {
+		return desc, err
+	}
+	if hasOCIBlob(layout, desc.Digest, nil) {
+		return desc, nil
+	}
+	return desc, writeFileAtomic(path, data)
+}
+
+// storeOCIBlobFile stores the file at src, whose content has digest, as a
+// blob of the layout, unless the layout has it intact already. It's
+// hard-linked when possible and otherwise copied, verifying the digest on
+// the way.
+func storeOCIBlobFile(layout, digest, src string, buf []byte) error {
+	path, err := ociBlobPath(layout, digest)
+	if err != nil {
+		return err
+	}
+	if hasOCIBlob(layout, digest, buf) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if err := os.Link(src, path); err == nil || os.IsExist(err) {
+		return nil
+	}
+	d, err := newDigester("layer", digest)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.CreateTemp(filepath.Dir(path), "blob-")
+	if err != nil {
+		return err
+	}
+	_, err = copyBuffer(io.MultiWriter(out, d), in, buf)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = d.verify()
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), path)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+	}
+	return err
+}
+
+// hasOCIBlob reports whether the layout has the blob with digest intact. A
+// copy that doesn't match its digest is removed, to be stored again.
+func hasOCIBlob(layout, digest string, buf []byte) bool {
+	path, err := ociBlobPath(layout, digest)
+	if err != nil {
+		return false
+	}
+	if _, err := os.Stat(path); err != nil {
+		return false
+	}
+	err = verifyFile("blob", path, digest, buf)
+	var mismatch *digestMismatchError
+	if errors.As(err, &mismatch) {
+		os.Remove(path)
+	}
+	return err == nil
+}
+
+// tagOCIManifest points tag at the manifest desc in the layout's index.json,
+// replacing whatever the tag pointed at before.
+func tagOCIManifest(layout string, desc ociDescriptor, tag string) error {
+	path := filepath.Join(layout, "index.json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var index ociIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return fmt.Errorf("parsing index.json: %w", err)
+	}
+	manifests := []ociDescriptor{}
+	for _, m := range index.Manifests {
+		if m.Annotations[ociRefNameAnnotation] != tag {
+			manifests = append(manifests, m)
+		}
+	}
+	desc.Annotations = map[string]string{ociRefNameAnnotation: tag}
+	index.Manifests = append(manifests, desc)
+	if data, err = json.Marshal(index); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// untagOCIManifest removes tag from the layout's index.json.
+func untagOCIManifest(layout, tag string) error {
+	index, err := readOCIIndex(layout)
+	if err != nil {
+		return err
+	}
+	manifests := []ociDescriptor{}
+	for _, m := range index.Manifests {
+		if m.Annotations[ociRefNameAnnotation] != tag {
+			manifests = append(manifests, m)
+		}
+	}
+	if len(manifests) == len(index.Manifests) {
+		return fmt.Errorf("no image tagged %q in %s", tag, layout)
+	}
+	index.Manifests = manifests
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(layout, "index.json"), data)
+}
+
+// pruneOCIBlobs deletes the blobs of the layout that no manifest in its
+// index.json refers to any more, and returns their digests.
+func pruneOCIBlobs(layout string) ([]string, error) {
+	index, err := readOCIIndex(layout)
+	if err != nil {
+		return nil, err
+	}
+	used := map[string]bool{}
+	for _, desc := range index.Manifests {
+		if err := markOCIBlobs(layout, desc, used); err != nil {
+			return nil, err
+		}
+	}
+	var pruned []string
+	algorithms, err := os.ReadDir(filepath.Join(layout, "blobs"))
+	if err != nil {
+		return nil, err
+	}
+	for _, algorithm := range algorithms {
+		dir := filepath.Join(layout, "blobs", algorithm.Name())
+		blobs, err := os.ReadDir(dir)
+		if err != nil {
+			return pruned, err
+		}
+		for _, blob := range blobs {
+			digest := algorithm.Name() + ":" + blob.Name()
+			if used[digest] {
+				continue
+			}
+			if err := os.Remove(filepath.Join(dir, blob.Name())); err != nil {
+				return pruned, err
+			}
+			pruned = append(pruned, digest)
+		}
+	}
+	return pruned, nil
+}
+
+// markOCIBlobs adds the digests of desc and of everything it refers to, down
+// through nested indexes to configs and layers, to used.
+func markOCIBlobs(layout string, desc ociDescriptor, used map[string]bool) error {
+	if used[desc.Digest] {
+		return nil
+	}
+	used[desc.Digest] = true
+	switch desc.MediaType {
+	case ociIndexMediaType, dockerManifestListMediaType:
+		var nested ociIndex
+		if err := readOCIBlobJSON(layout, desc.Digest, &nested); err != nil {
+			return err
+		}
+		for _, m := range nested.Manifests {
+			if err := markOCIBlobs(layout, m, used); err != nil {
+				return err
+			}
+		}
+	default:
+		var manifest DockerManifestResponse
+		if err := readOCIBlobJSON(layout, desc.Digest, &manifest); err != nil {
+			return err
+		}
+		used[manifest.Config.Digest] = true
+		for _, layer := range manifest.Layers {
+			used[layer.Digest] = true
+		}
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testEntry is a tar entry of a test layer. A zero typeflag is a regular
+// file holding body.
+type testEntry struct {
+	name     string
+	typeflag byte
+	mode     int64
+	body     string
+	linkname string
+}
+
+// testLayer returns the uncompressed tar of entries.
+func testLayer(t testing.TB, entries ...testEntry) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Mode: e.mode, Linkname: e.linkname}
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(e.body))
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0o644
+			if hdr.Typeflag == tar.TypeDir {
+				hdr.Mode = 0o755
+			}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// gzipLayer compresses layer, the same way every time, as writeTestImage
+// stores it.
+func gzipLayer(t testing.TB, layer []byte) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	zw.Write(layer)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// writeTestImage stores an image of layers, uncompressed tars, for the
+// host's platform in the OCI image layout at layout, tagged tag.
+func writeTestImage(t *testing.T, layout, tag string, layers ...[]byte) ociDescriptor {
+	t.Helper()
+	if err := initOCILayout(layout); err != nil {
+		t.Fatal(err)
+	}
+	manifest := ociManifest{SchemaVersion: 2, MediaType: ociManifestMediaType, Layers: []ociDescriptor{}}
+	var diffIDs []string
+	for _, layer := range layers {
+		desc, err := writeOCIBlob(layout, ociLayerMediaType, gzipLayer(t, layer))
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest.Layers = append(manifest.Layers, desc)
+		diffIDs = append(diffIDs, sha256Digest(layer))
+	}
+	config, err := json.Marshal(map[string]interface{}{
+		"architecture": runtime.GOARCH,
+		"os":           "linux",
+		"config":       map[string]interface{}{"Env": []string{"PATH=/bin:/usr/bin"}},
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Config, err = writeOCIBlob(layout, ociImageConfigMediaType, config); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, err := writeOCIBlob(layout, ociManifestMediaType, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tagOCIManifest(layout, desc, tag); err != nil {
+		t.Fatal(err)
+	}
+	return desc
+}
+
+// serveOCILayout starts a registry serving the images of the OCI image
+// layout at layout as those of every repository.
+func serveOCILayout(t *testing.T, layout string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(ociLayoutHandler(layout))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// ociLayoutHandler is the handler of serveOCILayout.
+func ociLayoutHandler(layout string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
+			return
+		}
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) < 4 {
+			http.NotFound(w, r)
+			return
+		}
+		kind, ref := parts[len(parts)-2], parts[len(parts)-1]
+		mediaType := ""
+		switch kind {
+		case "manifests":
+			if !isDigest(ref) {
+				desc, err := resolveOCILayoutDescriptor(layout, ref)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusNotFound)
+					return
+				}
+				ref, mediaType = desc.Digest, desc.MediaType
+			}
+		case "blobs":
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		data, err := readOCIBlob(layout, ref)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if kind == "manifests" {
+			if mediaType == "" {
+				mediaType = manifestKind("", data)
+			}
+			w.Header().Set("Content-Type", mediaType)
+			w.Header().Set("Docker-Content-Digest", ref)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}
+}
+
+func TestPullFromOCILayout(t *testing.T) {
+	layout := filepath.Join(t.TempDir(), "layout")
+	latest := writeTestImage(t, layout, "latest", testLayer(t, testEntry{name: "f", body: "latest"}))
+	writeTestImage(t, layout, "v1", testLayer(t, testEntry{name: "f", body: "v1"}), testLayer(t, testEntry{name: "g", body: "v1"}))
+
+	// An index of the host's image and one for another platform.
+	index, err := json.Marshal(ociIndex{SchemaVersion: 2, MediaType: ociIndexMediaType, Manifests: []ociDescriptor{
+		{MediaType: ociManifestMediaType, Digest: sha256Digest([]byte("elsewhere")), Size: 9, Platform: &ociPlatform{OS: "linux", Architecture: "s390x"}},
+		{MediaType: ociManifestMediaType, Digest: latest.Digest, Size: latest.Size, Platform: &ociPlatform{OS: "linux", Architecture: runtime.GOARCH}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexDesc, err := writeOCIBlob(layout, ociIndexMediaType, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tagOCIManifest(layout, indexDesc, "multi"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ref     string
+		want    map[string]string
+		wantErr bool
+	}{
+		{ref: "latest", want: map[string]string{"f": "latest", "g": ""}},
+		{ref: "v1", want: map[string]string{"f": "v1", "g": "v1"}},
+		// With more than one image, no tag is latest.
+		{ref: "", want: map[string]string{"f": "latest"}},
+		{ref: "multi", want: map[string]string{"f": "latest"}},
+		{ref: latest.Digest, want: map[string]string{"f": "latest"}},
+		{ref: "v2", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "rootfs")
+			if err := os.Mkdir(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			meta, err := pullFromSource(dir, ociLayoutSource{dir: layout}, tt.ref, pullOptions{})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(meta.Config.Config.Env) != 1 || meta.Config.Config.Env[0] != "PATH=/bin:/usr/bin" {
+				t.Errorf("config Env %q, want the image's", meta.Config.Config.Env)
+			}
+			wantTree(t, dir, tt.want)
+		})
+	}
+}
+
+func TestParseOCILayoutRef(t *testing.T) {
+	tests := []struct {
+		image, dir, tag string
+	}{
+		{image: "oci:/images/app", dir: "/images/app"},
+		{image: "oci:/images/app:v1", dir: "/images/app", tag: "v1"},
+		{image: "oci:relative:latest", dir: "relative", tag: "latest"},
+		{image: "oci:/a:b/app", dir: "/a:b/app"},
+	}
+	for _, tt := range tests {
+		if dir, tag := parseOCILayoutRef(tt.image); dir != tt.dir || tag != tt.tag {
+			t.Errorf("parseOCILayoutRef(%q) = %q, %q, want %q, %q", tt.image, dir, tag, tt.dir, tt.tag)
+		}
+	}
+}
+
+// TestDigestPaths checks digests are validated whole before naming a blob of
+// a layout or an entry of the cache, so that no part of one leaves the
+// directory.
+func TestDigestPaths(t *testing.T) {
+	dir := t.TempDir()
+	cache := &layerCache{mode: cacheModeCompressed, dir: dir, inUse: map[string]bool{}}
+	hex := strings.Repeat("ab", 32)
+	tests := []struct {
+		digest  string
+		wantErr bool
+	}{
+		{digest: "sha256:" + hex},
+		{digest: "sha512:" + hex + hex},
+		{digest: "../../x:abcd", wantErr: true},
+		{digest: "../sha256:" + hex, wantErr: true},
+		{digest: "sha256/..:" + hex, wantErr: true},
+		{digest: "sha256:../" + hex, wantErr: true},
+		{digest: "sha256:" + hex[:63], wantErr: true},
+		{digest: "sha256:" + strings.ToUpper(hex), wantErr: true},
+		{digest: "sha512:" + hex, wantErr: true},
+		{digest: "md5:" + hex[:32], wantErr: true},
+		{digest: "sha256", wantErr: true},
+		{digest: ":" + hex, wantErr: true},
+	}
+	for _, tt := range tests {
+		paths := map[string]func() (string, error){
+			"ociBlobPath": func() (string, error) { return ociBlobPath(dir, tt.digest) },
+			"entryPath":   func() (string, error) { return cache.entryPath("blobs", tt.digest) },
+		}
+		for name, path := range paths {
+			got, err := path()
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("%s(%q) = %s, want an error", name, tt.digest, got)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s(%q): %v", name, tt.digest, err)
+			} else if rel, _ := filepath.Rel(dir, got); strings.HasPrefix(rel, "..") || strings.Count(rel, string(filepath.Separator)) != 2 {
+				t.Errorf("%s(%q) = %s, not two levels within %s", name, tt.digest, got, dir)
+			}
+		}
+	}
+}
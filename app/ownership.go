@@ -0,0 +1,196 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ownershipSuffix names the file recorded next to a rootfs extracted by a
+// user other than root. Such a user can't give files away or create device
+// nodes, so every file is theirs and devices are missing; the file keeps
+// what the layers asked for, for export, or a later privileged step, to
+// restore.
+const ownershipSuffix = ".ownership"
+
+// ownershipEntry is one line of an ownership file: the owner a file should
+// have had, a device node that should have been created, or the removal of
+// whatever was recorded at or under a path. Entries are in extraction order,
+// so where a path appears more than once the last entry wins.
+type ownershipEntry struct {
+	Path    string `json:"path"`
+	Removed bool   `json:"removed,omitempty"`
+	Uid     int    `json:"uid"`
+	Gid     int    `json:"gid"`
+	// Device is "char" or "block" for a device node that wasn't created.
+	Device string `json:"device,omitempty"`
+	Mode   int64  `json:"mode,omitempty"`
+	Major  int64  `json:"major,omitempty"`
+	Minor  int64  `json:"minor,omitempty"`
+}
+
+// ownershipLog writes an ownership file. All methods are safe to call on a
+// nil receiver, which records nothing.
+type ownershipLog struct {
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	owners  int
+	devices int
+	err     error
+}
+
+func createOwnershipLog(path string) (*ownershipLog, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &ownershipLog{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// unprivilegedExtraction reports whether extraction has to leave ownership
+// and device nodes out. Tests replace it to extract as if they weren't root.
+var unprivilegedExtraction = func() bool {
+	return os.Geteuid() != 0
+}
+
+// owner records that the file at the container path name should belong to
+// hdr's owner, unless it already does.
+func (l *ownershipLog) owner(name string, hdr *tar.Header) {
+	if l == nil || hdr.Uid == os.Geteuid() && hdr.Gid == os.Getegid() {
+		return
+	}
+	l.mu.Lock()
+	l.owners++
+	l.mu.Unlock()
+	l.write(ownershipEntry{Path: name, Uid: hdr.Uid, Gid: hdr.Gid})
+}
+
+// device records the device node at the container path name, which wasn't
+// created.
+func (l *ownershipLog) device(name string, hdr *tar.Header) {
+	if l == nil {
+		return
+	}
+	device := "char"
+	if hdr.Typeflag == tar.TypeBlock {
+		device = "block"
+	}
+	l.mu.Lock()
+	l.devices++
+	l.mu.Unlock()
+	l.write(ownershipEntry{Path: name, Uid: hdr.Uid, Gid: hdr.Gid, Device: device, Mode: hdr.Mode, Major: hdr.Devmajor, Minor: hdr.Devminor})
+}
+
+// removed records that a whiteout removed the container path name and
+// everything under it.
+func (l *ownershipLog) removed(name string) {
+	if l == nil {
+		return
+	}
+	l.write(ownershipEntry{Path: name, Removed: true})
+}
+
+func (l *ownershipLog) write(e ownershipEntry) {
+	data, err := json.Marshal(e)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err == nil {
+		data = append(data, '\n')
+		_, err = l.w.Write(data)
+	}
+	if l.err == nil {
+		l.err = err
+	}
+}
+
+// finish closes the file, removing it if nothing was recorded, and prints
+// the one warning about what was left out, rather than one per file.
+func (l *ownershipLog) finish() error {
+	if l == nil {
+		return nil
+	}
+	err := l.w.Flush()
+	if closeErr := l.f.Close(); err == nil {
+		err = closeErr
+	}
+	if l.err != nil {
+		err = l.err
+	}
+	if err != nil {
+		return fmt.Errorf("recording ownership: %w", err)
+	}
+	if l.owners == 0 && l.devices == 0 {
+		return os.Remove(l.f.Name())
+	}
+	// The file may still be named after a staging directory, so it is only
+	// described.
+	fmt.Fprintf(os.Stderr, "Warning: not running as root, so %d files belong to you instead of their owner in the image", l.owners)
+	if l.devices > 0 {
+		fmt.Fprintf(os.Stderr, " and %d device nodes were left out", l.devices)
+	}
+	fmt.Fprintf(os.Stderr, "; what they should be is recorded next to the rootfs, in its %s file\n", ownershipSuffix)
+	return nil
+}
+
+// discard closes and removes the file, for a failed extraction.
+func (l *ownershipLog) discard() {
+	if l == nil {
+		return
+	}
+	l.f.Close()
+	os.Remove(l.f.Name())
+}
+
+// readOwnership reads the ownership file of rootfs, if it has one: the last
+// entry of each path, and the device nodes in the order they were recorded.
+func readOwnership(rootfs string) (map[string]ownershipEntry, []ownershipEntry, error) {
+	f, err := os.Open(rootfs + ownershipSuffix)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	byPath := map[string]ownershipEntry{}
+	var order []string
+	dec := json.NewDecoder(f)
+	for {
+		var e ownershipEntry
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", f.Name(), err)
+		}
+		if e.Removed {
+			for path := range byPath {
+				if path == e.Path || strings.HasPrefix(path, e.Path+"/") {
+					delete(byPath, path)
+				}
+			}
+			continue
+		}
+		if _, ok := byPath[e.Path]; !ok {
+			order = append(order, e.Path)
+		}
+		byPath[e.Path] = e
+	}
+	var devices []ownershipEntry
+	for _, path := range order {
+		if e, ok := byPath[path]; ok && e.Device != "" {
+			devices = append(devices, e)
+			// A path removed and recorded again is in order twice.
+			delete(byPath, path)
+		}
+	}
+	for _, e := range devices {
+		byPath[e.Path] = e
+	}
+	return byPath, devices, nil
+}
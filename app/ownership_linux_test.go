@@ -0,0 +1,144 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// ownedLayer returns the uncompressed tar of hdrs, which have no content.
+func ownedLayer(t *testing.T, hdrs ...*tar.Header) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, hdr := range hdrs {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// TestUnprivilegedExtraction pulls an image with files of other owners and
+// a device node, as root and as if not, and checks a rootfs extracted
+// without privileges gets one warning and an ownership file that export
+// restores them from, so that both export the same.
+func TestUnprivilegedExtraction(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("comparing with a privileged extraction needs root")
+	}
+	layout := filepath.Join(t.TempDir(), "layout")
+	writeTestImage(t, layout, "latest",
+		ownedLayer(t,
+			&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0o755},
+			&tar.Header{Name: "etc/app.conf", Typeflag: tar.TypeReg, Mode: 0o640, Uid: 1000, Gid: 1001},
+			&tar.Header{Name: "dev/", Typeflag: tar.TypeDir, Mode: 0o755},
+			&tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0o666, Devmajor: 1, Devminor: 3},
+			&tar.Header{Name: "tmp/", Typeflag: tar.TypeDir, Mode: 0o1777},
+			&tar.Header{Name: "tmp/gone", Typeflag: tar.TypeReg, Mode: 0o644, Uid: 2000, Gid: 2000},
+		),
+		ownedLayer(t, &tar.Header{Name: "tmp/.wh.gone", Typeflag: tar.TypeReg, Mode: 0o644}),
+	)
+	// The entries export is to write either way, with a uid:gid, or for a
+	// device its numbers.
+	want := map[string]string{
+		"etc":          "0:0",
+		"etc/app.conf": "1000:1001",
+		"dev":          "0:0",
+		"dev/null":     "char 1:3",
+		"tmp":          "0:0",
+	}
+
+	tests := []struct {
+		name         string
+		unprivileged bool
+		wantWarning  string
+	}{
+		{name: "root"},
+		{name: "unprivileged", unprivileged: true, wantWarning: "Warning: not running as root, so 2 files belong to you instead of their owner in the image and 1 device nodes were left out"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := unprivilegedExtraction
+			unprivilegedExtraction = func() bool { return tt.unprivileged }
+			defer func() { unprivilegedExtraction = saved }()
+
+			dir := filepath.Join(t.TempDir(), "rootfs")
+			if err := os.Mkdir(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			var err error
+			stderr := captureStderr(t, func() {
+				_, err = pullFromSource(dir, ociLayoutSource{dir: layout}, "latest", pullOptions{})
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantWarning == "" {
+				if stderr != "" {
+					t.Errorf("warned %q", stderr)
+				}
+			} else if strings.Count(stderr, "\n") != 1 || !strings.HasPrefix(stderr, tt.wantWarning) {
+				t.Errorf("warned %q, want one line saying %q", stderr, tt.wantWarning)
+			}
+
+			var st syscall.Stat_t
+			if err := syscall.Lstat(filepath.Join(dir, "etc/app.conf"), &st); err != nil {
+				t.Fatal(err)
+			}
+			_, statErr := os.Lstat(filepath.Join(dir, "dev/null"))
+			_, ownershipErr := os.Stat(dir + ownershipSuffix)
+			if tt.unprivileged {
+				if st.Uid != 0 || st.Gid != 0 || !os.IsNotExist(statErr) || ownershipErr != nil {
+					t.Errorf("etc/app.conf is %d:%d, dev/null: %v, ownership file: %v; want the file left ours, the device out and the ownership recorded", st.Uid, st.Gid, statErr, ownershipErr)
+				}
+			} else if st.Uid != 1000 || st.Gid != 1001 || statErr != nil || !os.IsNotExist(ownershipErr) {
+				t.Errorf("etc/app.conf is %d:%d, dev/null: %v, ownership file: %v; want them as in the image, and nothing recorded", st.Uid, st.Gid, statErr, ownershipErr)
+			}
+
+			var b bytes.Buffer
+			if err := writeRootfsTar(dir, &b); err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]string{}
+			tr := tar.NewReader(&b)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				name := strings.TrimSuffix(strings.TrimPrefix(hdr.Name, "./"), "/")
+				if name == "" || name == "." {
+					continue
+				}
+				if hdr.Typeflag == tar.TypeChar {
+					got[name] = fmt.Sprintf("char %d:%d", hdr.Devmajor, hdr.Devminor)
+				} else {
+					got[name] = fmt.Sprintf("%d:%d", hdr.Uid, hdr.Gid)
+				}
+			}
+			for name, owner := range want {
+				if got[name] != owner {
+					t.Errorf("exported %s as %q, want %q", name, got[name], owner)
+				}
+			}
+			for name := range got {
+				if _, ok := want[name]; !ok {
+					t.Errorf("exported %s, which the image doesn't have", name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// targetPlatform is the platform whose image is picked from image indexes
+// and manifest lists. It is the host's unless --platform says otherwise.
+var targetPlatform = ociPlatform{OS: "linux", Architecture: runtime.GOARCH}
+
+// platformArchAliases maps the names uname and some tools use to the GOARCH
+// style names image indexes use.
+var platformArchAliases = map[string]string{
+	"x86_64":  "amd64",
+	"x86-64":  "amd64",
+	"aarch64": "arm64",
+}
+
+func (p ociPlatform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// defaultVariants are the variants index entries of these architectures
+// are taken to be when they leave it out, as containerd takes them.
+var defaultVariants = map[string]string{
+	"arm64": "v8",
+	"arm":   "v7",
+}
+
+// variant is p's variant, or its architecture's default one.
+func (p ociPlatform) variant() string {
+	if p.Variant == "" {
+		return defaultVariants[p.Architecture]
+	}
+	return p.Variant
+}
+
+// matches reports whether an index entry's platform is p. Without a
+// variant, p matches every variant of its architecture.
+func (p ociPlatform) matches(other *ociPlatform) bool {
+	if other == nil || other.OS != p.OS || other.Architecture != p.Architecture {
+		return false
+	}
+	return p.Variant == "" || other.variant() == p.variant()
+}
+
+// variantLevel is the number of a variant such as v7, or -1 for one that
+// isn't numbered.
+func variantLevel(variant string) int {
+	n, err := strconv.Atoi(strings.TrimPrefix(variant, "v"))
+	if err != nil || !strings.HasPrefix(variant, "v") {
+		return -1
+	}
+	return n
+}
+
+// hostVariant is the variant of arch the host runs, if arch is the host's
+// and its variant is known: that of the ARM architecture version
+// /proc/cpuinfo reports for 32-bit ARM, v8 for arm64.
+func hostVariant(arch string) string {
+	if arch != runtime.GOARCH {
+		return ""
+	}
+	switch arch {
+	case "arm64":
+		return "v8"
+	case "arm":
+		data, err := os.ReadFile("/proc/cpuinfo")
+		if err != nil {
+			return ""
+		}
+		return cpuinfoVariant(string(data))
+	}
+	return ""
+}
+
+// cpuinfoVariant is the ARM variant of the architecture version cpuinfo,
+// the content of /proc/cpuinfo, reports, if any.
+func cpuinfoVariant(cpuinfo string) string {
+	for _, line := range strings.Split(cpuinfo, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(key) != "CPU architecture" {
+			continue
+		}
+		// 64-bit CPUs running 32-bit ARM code say AArch64 or 8.
+		value = strings.TrimSpace(value)
+		if value == "AArch64" {
+			value = "8"
+		}
+		if n, err := strconv.Atoi(value); err == nil {
+			return "v" + strconv.Itoa(n)
+		}
+	}
+	return ""
+}
+
+// betterVariant reports whether an index entry's platform is a better
+// pick than best's, both matching a platform without a variant, for a host
+// running variant host, if known. Variants the host can run beat those it
+// can't, and of those, the most recent wins; newer ARM CPUs run the code of
+// older ones. Other architectures' variants aren't ranked, and the first
+// listed stays the pick.
+func betterVariant(platform, best *ociPlatform, host string) bool {
+	if _, ok := defaultVariants[platform.Architecture]; !ok {
+		return false
+	}
+	level, bestLevel := variantLevel(platform.variant()), variantLevel(best.variant())
+	if hostLevel := variantLevel(host); hostLevel >= 0 {
+		if runs, bestRuns := level <= hostLevel, bestLevel <= hostLevel; runs != bestRuns {
+			return runs
+		}
+	}
+	return level > bestLevel
+}
+
+// parsePlatform parses "os/arch[/variant]", as given to --platform.
+func parsePlatform(value string) (ociPlatform, error) {
+	parts := strings.Split(strings.ToLower(value), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" || (len(parts) == 3 && parts[2] == "") {
+		return ociPlatform{}, fmt.Errorf("invalid platform %q (want os/arch[/variant], e.g. linux/arm64)", value)
+	}
+	p := ociPlatform{OS: parts[0], Architecture: parts[1]}
+	if arch, ok := platformArchAliases[p.Architecture]; ok {
+		p.Architecture = arch
+	}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// usePlatform makes value, if set, the platform images are selected for.
+func usePlatform(value string) error {
+	if value == "" {
+		return nil
+	}
+	p, err := parsePlatform(value)
+	if err != nil {
+		return err
+	}
+	targetPlatform = p
+	return nil
+}
+
+// indexPlatforms lists the platforms an image index has images for, in
+// index order. Entries without a platform, and the unknown/unknown entries
+// that carry attestations, aren't images one can pick.
+func indexPlatforms(index ociIndex) []string {
+	var platforms []string
+	seen := map[string]bool{}
+	for _, desc := range index.Manifests {
+		if desc.Platform == nil || desc.Platform.OS == "unknown" {
+			continue
+		}
+		if s := desc.Platform.String(); !seen[s] {
+			seen[s] = true
+			platforms = append(platforms, s)
+		}
+	}
+	return platforms
+}
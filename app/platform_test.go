@@ -0,0 +1,199 @@
+package main
+
+import (
+	"runtime"
+	"testing"
+)
+
+// useTestPlatform selects images for p for the rest of the test.
+func useTestPlatform(t *testing.T, p ociPlatform) {
+	t.Helper()
+	saved := targetPlatform
+	targetPlatform = p
+	t.Cleanup(func() { targetPlatform = saved })
+}
+
+func TestParsePlatform(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    ociPlatform
+		wantErr bool
+	}{
+		{value: "linux/amd64", want: ociPlatform{OS: "linux", Architecture: "amd64"}},
+		{value: "linux/arm/v7", want: ociPlatform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+		{value: "Linux/x86_64", want: ociPlatform{OS: "linux", Architecture: "amd64"}},
+		{value: "linux/aarch64", want: ociPlatform{OS: "linux", Architecture: "arm64"}},
+		{value: "linux", wantErr: true},
+		{value: "linux/", wantErr: true},
+		{value: "/amd64", wantErr: true},
+		{value: "linux/arm/", wantErr: true},
+		{value: "linux/arm/v7/extra", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parsePlatform(tt.value)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parsePlatform(%q) = %v, want an error", tt.value, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parsePlatform(%q) = %v, %v, want %v", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+func TestSelectOCIPlatformUnavailable(t *testing.T) {
+	index := ociIndex{Manifests: []ociDescriptor{
+		{Digest: "sha256:amd64", Platform: &ociPlatform{OS: "linux", Architecture: "amd64"}},
+		{Digest: "sha256:arm64", Platform: &ociPlatform{OS: "linux", Architecture: "arm64"}},
+		{Digest: "sha256:armv7", Platform: &ociPlatform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+		// Attestations, and a second image of a platform, aren't listed.
+		{Digest: "sha256:attestation", Platform: &ociPlatform{OS: "unknown", Architecture: "unknown"}},
+		{Digest: "sha256:amd64-again", Platform: &ociPlatform{OS: "linux", Architecture: "amd64"}},
+		{Digest: "sha256:none"},
+	}}
+	tests := []struct {
+		platform string
+		index    ociIndex
+		want     string
+		wantErr  string
+	}{
+		{platform: "linux/amd64", index: index, want: "sha256:amd64"},
+		{platform: "linux/arm/v7", index: index, want: "sha256:armv7"},
+		{platform: "linux/riscv64", index: index, wantErr: "platform linux/riscv64 not available; available: linux/amd64, linux/arm64, linux/arm/v7"},
+		{platform: "linux/arm/v6", index: index, wantErr: "platform linux/arm/v6 not available; available: linux/amd64, linux/arm64, linux/arm/v7"},
+		{platform: "windows/amd64", index: index, wantErr: "platform windows/amd64 not available; available: linux/amd64, linux/arm64, linux/arm/v7"},
+		{platform: "linux/amd64", index: ociIndex{Manifests: index.Manifests[3:4]}, wantErr: "platform linux/amd64 not available; the image index lists no platforms"},
+	}
+	for _, tt := range tests {
+		p, err := parsePlatform(tt.platform)
+		if err != nil {
+			t.Fatal(err)
+		}
+		useTestPlatform(t, p)
+		desc, err := selectOCIPlatform(tt.index)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("%s: selected %s, %v, want the error %q", tt.platform, desc.Digest, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || desc.Digest != tt.want {
+			t.Errorf("%s: selected %s, %v, want %s", tt.platform, desc.Digest, err, tt.want)
+		}
+	}
+}
+
+func TestSelectOCIPlatformVariant(t *testing.T) {
+	index := ociIndex{Manifests: []ociDescriptor{
+		{Digest: "sha256:armv6", Platform: &ociPlatform{OS: "linux", Architecture: "arm", Variant: "v6"}},
+		{Digest: "sha256:armv7", Platform: &ociPlatform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+		{Digest: "sha256:armv5", Platform: &ociPlatform{OS: "linux", Architecture: "arm", Variant: "v5"}},
+		// An arm64 entry without a variant is v8.
+		{Digest: "sha256:arm64", Platform: &ociPlatform{OS: "linux", Architecture: "arm64"}},
+		{Digest: "sha256:amd64", Platform: &ociPlatform{OS: "linux", Architecture: "amd64", Variant: "v2"}},
+		{Digest: "sha256:amd64-v3", Platform: &ociPlatform{OS: "linux", Architecture: "amd64", Variant: "v3"}},
+	}}
+	tests := []struct {
+		platform string
+		want     string
+		wantErr  bool
+	}{
+		{platform: "linux/arm/v5", want: "sha256:armv5"},
+		{platform: "linux/arm/v6", want: "sha256:armv6"},
+		{platform: "linux/arm/v7", want: "sha256:armv7"},
+		{platform: "linux/arm/v8", wantErr: true},
+		{platform: "linux/arm64/v8", want: "sha256:arm64"},
+		{platform: "linux/arm64", want: "sha256:arm64"},
+		{platform: "linux/arm64/v9", wantErr: true},
+		{platform: "linux/amd64/v3", want: "sha256:amd64-v3"},
+		// Other architectures' variants aren't ranked: the first listed
+		// is taken.
+		{platform: "linux/amd64", want: "sha256:amd64"},
+	}
+	for _, tt := range tests {
+		p, err := parsePlatform(tt.platform)
+		if err != nil {
+			t.Fatal(err)
+		}
+		useTestPlatform(t, p)
+		desc, err := selectOCIPlatform(index)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: selected %s, want an error", tt.platform, desc.Digest)
+			}
+			continue
+		}
+		if err != nil || desc.Digest != tt.want {
+			t.Errorf("%s: selected %s, %v, want %s", tt.platform, desc.Digest, err, tt.want)
+		}
+	}
+	// Without a variant and unless this is an ARM host, the most recent
+	// variant is taken.
+	if runtime.GOARCH != "arm" {
+		useTestPlatform(t, ociPlatform{OS: "linux", Architecture: "arm"})
+		if desc, err := selectOCIPlatform(index); err != nil || desc.Digest != "sha256:armv7" {
+			t.Errorf("linux/arm: selected %s, %v, want sha256:armv7", desc.Digest, err)
+		}
+	}
+}
+
+func TestBetterVariant(t *testing.T) {
+	arm := func(variant string) *ociPlatform {
+		return &ociPlatform{OS: "linux", Architecture: "arm", Variant: variant}
+	}
+	tests := []struct {
+		platform, best *ociPlatform
+		host           string
+		want           bool
+	}{
+		// With the host's variant unknown, the most recent wins.
+		{platform: arm("v7"), best: arm("v6"), want: true},
+		{platform: arm("v6"), best: arm("v7"), want: false},
+		// A v6 host can't run v7 code, but a v7 host runs v6 code.
+		{platform: arm("v7"), best: arm("v6"), host: "v6", want: false},
+		{platform: arm("v6"), best: arm("v7"), host: "v6", want: true},
+		{platform: arm("v7"), best: arm("v6"), host: "v7", want: true},
+		{platform: arm("v6"), best: arm("v5"), host: "v7", want: true},
+		// Of variants the host can't run, the most recent.
+		{platform: arm("v8"), best: arm("v7"), host: "v6", want: true},
+		// An entry without a variant is v7.
+		{platform: arm(""), best: arm("v6"), host: "v7", want: true},
+		{platform: arm("v6"), best: arm(""), host: "v6", want: true},
+		{platform: arm("v7"), best: arm(""), want: false},
+		// Variants that aren't numbered lose.
+		{platform: arm("vfp"), best: arm("v5"), want: false},
+		{platform: arm("v5"), best: arm("vfp"), want: true},
+		{platform: &ociPlatform{OS: "linux", Architecture: "amd64", Variant: "v3"}, best: &ociPlatform{OS: "linux", Architecture: "amd64", Variant: "v2"}, want: false},
+	}
+	for _, tt := range tests {
+		if got := betterVariant(tt.platform, tt.best, tt.host); got != tt.want {
+			t.Errorf("betterVariant(%s, %s, host %q) = %v, want %v", tt.platform, tt.best, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestCPUInfoVariant(t *testing.T) {
+	tests := []struct {
+		cpuinfo, want string
+	}{
+		{cpuinfo: "processor\t: 0\nmodel name\t: ARMv6-compatible processor rev 7 (v6l)\nCPU architecture: 7\nCPU variant\t: 0x0\n", want: "v7"},
+		{cpuinfo: "processor\t: 0\nCPU architecture: 6\n", want: "v6"},
+		{cpuinfo: "processor\t: 0\nCPU architecture: 8\n", want: "v8"},
+		{cpuinfo: "processor\t: 0\nCPU architecture: AArch64\n", want: "v8"},
+		{cpuinfo: "processor\t: 0\nflags\t\t: fpu vme\n", want: ""},
+		{cpuinfo: "CPU architecture: unknown\n", want: ""},
+	}
+	for _, tt := range tests {
+		if got := cpuinfoVariant(tt.cpuinfo); got != tt.want {
+			t.Errorf("cpuinfoVariant(%q) = %q, want %q", tt.cpuinfo, got, tt.want)
+		}
+	}
+	// Only the host's architecture has a variant the host runs.
+	if runtime.GOARCH != "s390x" {
+		if got := hostVariant("s390x"); got != "" {
+			t.Errorf("hostVariant(s390x) = %q on %s, want none", got, runtime.GOARCH)
+		}
+	}
+}
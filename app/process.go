@@ -0,0 +1,15 @@
+package main
+
+import "os"
+
+// processAlive reports whether a process with pid exists. Finding one opens
+// it, which fails for a process that has exited; Unix replaces this in init,
+// since there finding a process always succeeds.
+var processAlive = func(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
@@ -0,0 +1,14 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+func init() {
+	processAlive = unixProcessAlive
+}
+
+func unixProcessAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// progressInterval is how often a layer's line is redrawn while its bytes
+// are coming in. Status changes are always drawn.
+const progressInterval = 100 * time.Millisecond
+
+// pullProgress reports the progress of a pull's layers. On a terminal each
+// layer gets a line of its own that is updated in place, as with
+// `docker pull`; anywhere else only a layer's completion is reported, one line
+// each. Layers are fetched concurrently, so all output goes through mu. All
+// methods are safe to call on a nil receiver, which reports nothing.
+type pullProgress struct {
+	mu       sync.Mutex
+	w        io.Writer
+	terminal bool
+	lines    []*layerProgress
+	byDigest map[string]*layerProgress
+}
+
+// layerProgress is the line of one layer.
+type layerProgress struct {
+	p       *pullProgress
+	index   int
+	id      string
+	status  string
+	current int64
+	total   int64
+	drawn   time.Time
+}
+
+func newPullProgress(w io.Writer, terminal bool) *pullProgress {
+	return &pullProgress{w: w, terminal: terminal, byDigest: map[string]*layerProgress{}}
+}
+
+// stderrProgress reports to stderr, unless onlyTerminal is set and stderr
+// isn't a terminal, or with --quiet.
+func stderrProgress(onlyTerminal bool) *pullProgress {
+	terminal := isTerminal(os.Stderr)
+	if quiet || onlyTerminal && !terminal {
+		return nil
+	}
+	return newPullProgress(os.Stderr, terminal)
+}
+
+// isTerminal reports whether f is a terminal, or at least a character device
+// such as one.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// layer returns the line of the layer with digest, adding one of size bytes
+// if there is none yet.
+func (p *pullProgress) layer(digest string, size int64) *layerProgress {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if l, ok := p.byDigest[digest]; ok {
+		return l
+	}
+	l := &layerProgress{p: p, index: len(p.lines), id: shortImageID(digest), status: "Waiting", total: size}
+	p.lines = append(p.lines, l)
+	p.byDigest[digest] = l
+	if p.terminal {
+		fmt.Fprintf(p.w, "%s\n", l.text())
+	}
+	return l
+}
+
+// lookup returns the line of the layer with digest, or nil if it has none.
+func (p *pullProgress) lookup(digest string) *layerProgress {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.byDigest[digest]
+}
+
+func (l *layerProgress) text() string {
+	if l.status == "Downloading" && l.current > 0 {
+		if l.total > 0 {
+			return fmt.Sprintf("%s: %s %s/%s", l.id, l.status, formatSize(l.current), formatSize(l.total))
+		}
+		return fmt.Sprintf("%s: %s %s", l.id, l.status, formatSize(l.current))
+	}
+	return fmt.Sprintf("%s: %s", l.id, l.status)
+}
+
+// redraw rewrites the line in place: the cursor, which rests below the last
+// line, moves up to it and back down again. p.mu must be held.
+func (l *layerProgress) redraw() {
+	up := len(l.p.lines) - l.index
+	fmt.Fprintf(l.p.w, "\x1b[%dA\r\x1b[2K%s\x1b[%dB\r", up, l.text(), up)
+	l.drawn = time.Now()
+}
+
+// set changes the layer's status. Only terminals see it.
+func (l *layerProgress) set(status string) {
+	if l == nil {
+		return
+	}
+	l.p.mu.Lock()
+	defer l.p.mu.Unlock()
+	l.status = status
+	if l.p.terminal {
+		l.redraw()
+	}
+}
+
+// done reports the layer's final status everywhere. An empty status keeps
+// the current one.
+func (l *layerProgress) done(status string) {
+	if l == nil {
+		return
+	}
+	l.p.mu.Lock()
+	defer l.p.mu.Unlock()
+	if status != "" {
+		l.status = status
+	}
+	if l.p.terminal {
+		l.redraw()
+		return
+	}
+	fmt.Fprintf(l.p.w, "%s\n", l.text())
+}
+
+// reset forgets the bytes counted so far, for a download that starts over.
+func (l *layerProgress) reset() {
+	if l == nil {
+		return
+	}
+	l.p.mu.Lock()
+	defer l.p.mu.Unlock()
+	l.current = 0
+	if l.p.terminal {
+		l.redraw()
+	}
+}
+
+// Write counts downloaded bytes, so a layerProgress can be written to
+// alongside the download's destination.
+func (l *layerProgress) Write(b []byte) (int, error) {
+	if l == nil {
+		return len(b), nil
+	}
+	l.p.mu.Lock()
+	defer l.p.mu.Unlock()
+	l.current += int64(len(b))
+	if l.status != "Downloading" {
+		l.status = "Downloading"
+	} else if time.Since(l.drawn) < progressInterval {
+		return len(b), nil
+	}
+	if l.p.terminal {
+		l.redraw()
+	}
+	return len(b), nil
+}
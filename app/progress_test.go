@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestProgressNotTerminal updates the lines of layers from many goroutines
+// at once and checks that, off a terminal, only each layer's completion is
+// reported, on a line of its own.
+func TestProgressNotTerminal(t *testing.T) {
+	var out bytes.Buffer
+	p := newPullProgress(&out, false)
+	var want []string
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		digest := sha256Digest([]byte{byte(i)})
+		l := p.layer(digest, 1<<20)
+		want = append(want, shortImageID(digest)+": Pull complete")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.set("Pulling fs layer")
+			for j := 0; j < 100; j++ {
+				l.Write(make([]byte, 1<<10))
+			}
+			l.reset()
+			l.Write(make([]byte, 1<<20))
+			l.set("Download complete")
+			l.set("Extracting")
+			l.done("Pull complete")
+		}()
+	}
+	wg.Wait()
+	if strings.Contains(out.String(), "\x1b") {
+		t.Errorf("escape sequences in %q", out.String())
+	}
+	got := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	sort.Strings(got)
+	sort.Strings(want)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("reported\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// TestProgressNilReportsNothing checks that a nil pullProgress, as with
+// --quiet, can be used as any other.
+func TestProgressNilReportsNothing(t *testing.T) {
+	var p *pullProgress
+	l := p.layer("sha256:abc", 10)
+	l.set("Downloading")
+	if n, err := l.Write([]byte("abc")); n != 3 || err != nil {
+		t.Errorf("Write = %d, %v", n, err)
+	}
+	l.reset()
+	l.done("Pull complete")
+	if p.lookup("sha256:abc") != nil {
+		t.Error("lookup found a layer")
+	}
+}
+
+// TestPullProgressNotTerminal pulls an image of several layers at once and
+// checks the report written off a terminal.
+func TestPullProgressNotTerminal(t *testing.T) {
+	layout := filepath.Join(t.TempDir(), "layout")
+	var layers [][]byte
+	var want []string
+	for i := 0; i < 4; i++ {
+		layer := testLayer(t, testEntry{name: fmt.Sprint(i), body: strings.Repeat("x", i<<16)})
+		layers = append(layers, layer)
+		want = append(want, shortImageID(sha256Digest(gzipLayer(t, layer)))+": Pull complete")
+	}
+	writeTestImage(t, layout, "latest", layers...)
+	var out bytes.Buffer
+	dir := filepath.Join(t.TempDir(), "rootfs")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	opts := pullOptions{Progress: newPullProgress(&out, false), MaxConcurrentDownloads: 4, MaxConcurrentExtractions: 4}
+	if _, err := pullFromSource(dir, ociLayoutSource{dir: layout}, "latest", opts); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	sort.Strings(got)
+	sort.Strings(want)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("reported\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// humanDuration describes how long ago something happened, the way
+// `docker ps` does.
+func humanDuration(d time.Duration) string {
+	switch seconds := int(d.Seconds()); {
+	case seconds < 1:
+		return "Less than a second"
+	case seconds == 1:
+		return "1 second"
+	case seconds < 60:
+		return fmt.Sprintf("%d seconds", seconds)
+	}
+	switch minutes := int(d.Minutes()); {
+	case minutes == 1:
+		return "About a minute"
+	case minutes < 60:
+		return fmt.Sprintf("%d minutes", minutes)
+	}
+	switch hours := int(d.Hours() + 0.5); {
+	case hours == 1:
+		return "About an hour"
+	case hours < 48:
+		return fmt.Sprintf("%d hours", hours)
+	case hours < 24*7*2:
+		return fmt.Sprintf("%d days", hours/24)
+	case hours < 24*30*2:
+		return fmt.Sprintf("%d weeks", hours/24/7)
+	case hours < 24*365*2:
+		return fmt.Sprintf("%d months", hours/24/30)
+	default:
+		return fmt.Sprintf("%d years", hours/24/365)
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-1] + "…"
+}
+
+// formatAnnotations renders annotations as sorted key=value pairs.
+func formatAnnotations(annotations map[string]string) string {
+	pairs := make([]string, 0, len(annotations))
+	for k, v := range annotations {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func psCommand(argv []string) {
+	flags := flag.NewFlagSet("ps", flag.ExitOnError)
+	noTrunc := flags.Bool("no-trunc", false, "don't truncate IDs and commands")
+	quiet := flags.Bool("q", false, "only print container IDs")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), psUsage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(argv)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	states, err := listContainers()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	for i := range states {
+		if !*noTrunc {
+			states[i].ID = states[i].ID[:12]
+		}
+	}
+	if *quiet {
+		for _, state := range states {
+			fmt.Println(state.ID)
+		}
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(tw, "CONTAINER ID\tIMAGE\tCOMMAND\tCREATED\tNAMES\tANNOTATIONS")
+	for _, state := range states {
+		command := strconv.Quote(strings.Join(state.Command, " "))
+		if !*noTrunc {
+			command = strconv.Quote(truncate(strings.Join(state.Command, " "), 20))
+		}
+		created := humanDuration(time.Since(state.Created)) + " ago"
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", state.ID, state.Image, command, created, state.Name, formatAnnotations(state.Annotations))
+	}
+	tw.Flush()
+}
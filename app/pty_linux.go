@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"unsafe"
+)
+
+func ioctl(fd, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// openPTY allocates a new pseudo-terminal pair.
+func openPTY() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var unlock int32
+	if err := ioctl(master.Fd(), syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("unlocking pty: %w", err)
+	}
+	var n uint32
+	if err := ioctl(master.Fd(), syscall.TIOCGPTN, unsafe.Pointer(&n)); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("getting pty number: %w", err)
+	}
+	slave, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+type winsize struct {
+	Rows, Cols, XPixel, YPixel uint16
+}
+
+// copyWinsize copies the window size of from onto to, if from is a terminal.
+func copyWinsize(to, from *os.File) {
+	var ws winsize
+	if err := ioctl(from.Fd(), syscall.TIOCGWINSZ, unsafe.Pointer(&ws)); err != nil {
+		return
+	}
+	_ = ioctl(to.Fd(), syscall.TIOCSWINSZ, unsafe.Pointer(&ws))
+}
+
+// makeRaw puts the terminal f into raw mode like cfmakeraw(3) and returns a
+// function restoring its previous state. It fails if f isn't a terminal.
+func makeRaw(f *os.File) (func() error, error) {
+	var old syscall.Termios
+	if err := ioctl(f.Fd(), syscall.TCGETS, unsafe.Pointer(&old)); err != nil {
+		return nil, err
+	}
+	raw := old
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Oflag &^= syscall.OPOST
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := ioctl(f.Fd(), syscall.TCSETS, unsafe.Pointer(&raw)); err != nil {
+		return nil, err
+	}
+	return func() error {
+		return ioctl(f.Fd(), syscall.TCSETS, unsafe.Pointer(&old))
+	}, nil
+}
+
+// ttySession connects a container to a freshly allocated pseudo-terminal
+// and proxies it to our own stdin, if attached, and to output.
+type ttySession struct {
+	master, slave *os.File
+	output        io.Writer
+	restore       func() error
+	winch         chan os.Signal
+	outputDone    chan struct{}
+	// input is set if our stdin is attached to the terminal.
+	input bool
+}
+
+// attachTTY allocates a pty and makes it the stdio and controlling terminal
+// of cmd, which must not have been started yet. Everything the container
+// writes to the terminal is copied to output, and with input what we read
+// from our stdin to the terminal.
+func attachTTY(cmd *exec.Cmd, output io.Writer, input bool) (*ttySession, error) {
+	master, slave, err := openPTY()
+	if err != nil {
+		return nil, fmt.Errorf("allocating tty: %w", err)
+	}
+	copyWinsize(master, os.Stdin)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Ctty = 0 // the child's stdin
+	return &ttySession{master: master, slave: slave, output: output, input: input, outputDone: make(chan struct{})}, nil
+}
+
+// start begins proxying once cmd has started. If our stdin is attached and
+// a terminal it is switched to raw mode, so that keys like ^C reach the
+// container's terminal instead of being interpreted by ours.
+func (s *ttySession) start() {
+	// Only the child should hold the slave, so that reads from the master
+	// end once the container exits.
+	s.slave.Close()
+	if s.input {
+		if restore, err := makeRaw(os.Stdin); err == nil {
+			s.restore = restore
+		}
+	}
+	s.winch = make(chan os.Signal, 1)
+	signal.Notify(s.winch, syscall.SIGWINCH)
+	go func() {
+		for range s.winch {
+			copyWinsize(s.master, os.Stdin)
+		}
+	}()
+	if s.input {
+		go io.Copy(s.master, os.Stdin)
+	}
+	go func() {
+		// Reading the master fails with EIO once the slave is closed.
+		io.Copy(s.output, s.master)
+		close(s.outputDone)
+	}()
+}
+
+// wait blocks until all of the container's output has been copied.
+func (s *ttySession) wait() {
+	<-s.outputDone
+}
+
+// close restores our terminal and releases the pty.
+func (s *ttySession) close() error {
+	if s.winch != nil {
+		signal.Stop(s.winch)
+		close(s.winch)
+		s.winch = nil
+	}
+	var err error
+	if s.restore != nil {
+		err = s.restore()
+		s.restore = nil
+	}
+	s.slave.Close()
+	s.master.Close()
+	return err
+}
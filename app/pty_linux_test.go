@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestMakeRaw(t *testing.T) {
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Skipf("no pty: %v", err)
+	}
+	defer master.Close()
+	defer slave.Close()
+	termios := func() syscall.Termios {
+		var tio syscall.Termios
+		if err := ioctl(slave.Fd(), syscall.TCGETS, unsafe.Pointer(&tio)); err != nil {
+			t.Fatal(err)
+		}
+		return tio
+	}
+	before := termios()
+	if before.Lflag&(syscall.ECHO|syscall.ICANON) == 0 {
+		t.Fatalf("a new pty has lflag %#x, want it cooked", before.Lflag)
+	}
+	restore, err := makeRaw(slave)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw := termios(); raw.Lflag&(syscall.ECHO|syscall.ICANON|syscall.ISIG) != 0 || raw.Oflag&syscall.OPOST != 0 {
+		t.Errorf("raw mode has lflag %#x, oflag %#x", raw.Lflag, raw.Oflag)
+	}
+	if err := restore(); err != nil {
+		t.Fatal(err)
+	}
+	if after := termios(); after != before {
+		t.Errorf("restored %+v, want %+v", after, before)
+	}
+	f, err := os.CreateTemp(t.TempDir(), "plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := makeRaw(f); err == nil {
+		t.Error("makeRaw took a file that isn't a terminal")
+	}
+}
+
+// TestRunAllocatesTTY runs `run -it` on a terminal of the test's own, as a
+// shell would, and talks to the container through it.
+func TestRunAllocatesTTY(t *testing.T) {
+	docker, image := runTestImage(t)
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Skipf("no pty: %v", err)
+	}
+	defer master.Close()
+	ws := winsize{Rows: 33, Cols: 120}
+	if err := ioctl(slave.Fd(), syscall.TIOCSWINSZ, unsafe.Pointer(&ws)); err != nil {
+		t.Fatal(err)
+	}
+	cmd := docker("run", "--rm", "-it", image, "/probe", "tty")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	slave.Close()
+
+	var out bytes.Buffer
+	copied := make(chan struct{})
+	go func() {
+		// Reading fails with EIO once the run's side is closed.
+		io.Copy(&out, master)
+		close(copied)
+	}()
+	time.Sleep(500 * time.Millisecond)
+	master.Write([]byte("hi\r"))
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err = <-done:
+	case <-time.After(20 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("the container never exited")
+	}
+	<-copied
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out.String())
+	}
+	// The container's terminal translates newlines, and echoes input.
+	got := strings.ReplaceAll(out.String(), "\r\n", "\n")
+	for _, want := range []string{"terminal 33 120\n", "hi\n", "read hi\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("terminal showed %q, want %q in it", got, want)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// prefetcher pulls the layers of several images into the layer cache at
+// once. Downloads of all the images share one set of slots, and a layer that
+// several of them have is only downloaded once.
+type prefetcher struct {
+	opts    pullOptions
+	slots   chan struct{}
+	buffers sync.Pool
+
+	mu     sync.Mutex
+	layers map[string]*layerPrefetch
+}
+
+// layerPrefetch is a layer download that pulls of other images may wait on.
+type layerPrefetch struct {
+	done chan struct{}
+	err  error
+}
+
+func newPrefetcher(opts pullOptions) *prefetcher {
+	downloads := opts.MaxConcurrentDownloads
+	if downloads <= 0 {
+		downloads = defaultConcurrentDownloads
+	}
+	bufferSize := opts.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultBufferSize
+	}
+	return &prefetcher{
+		opts:    opts,
+		slots:   make(chan struct{}, downloads),
+		buffers: sync.Pool{New: func() interface{} { return make([]byte, bufferSize) }},
+		layers:  map[string]*layerPrefetch{},
+	}
+}
+
+// pull caches image's config and layers and returns its image ID.
+func (p *prefetcher) pull(image string) (string, error) {
+	if strings.HasPrefix(image, ociLayoutPrefix) {
+		return "", fmt.Errorf("%s is an OCI image layout, which is always local", image)
+	}
+	if strings.HasPrefix(image, dockerArchivePrefix) {
+		return "", fmt.Errorf("%s is a docker save archive, which is always local", image)
+	}
+	ref, err := parseImageRef(image)
+	if err != nil {
+		return "", err
+	}
+	auth, err := newRegistryAuth(ref.Repository, p.opts.ScopeActions)
+	if err != nil {
+		return "", err
+	}
+	src := &registrySource{repository: ref.Repository, auth: auth}
+	manifest, err := fetchManifest(src, ref.Reference())
+	if err != nil {
+		return "", err
+	}
+	if err := checkRunnable(manifest); err != nil {
+		return "", err
+	}
+	if _, err := fetchConfig(src, manifest, p.opts.Cache); err != nil {
+		return "", err
+	}
+	for _, layer := range manifest.Layers {
+		if _, err := layerCompression(layer.MediaType); err != nil {
+			return "", fmt.Errorf("layer %s: %w", layer.Digest, err)
+		}
+	}
+	for _, layer := range manifest.Layers {
+		p.opts.Progress.layer(layer.Digest, layer.Size)
+	}
+	fetch := sourceLayerFetcher(src, p.opts)
+	errs := make([]error, len(manifest.Layers))
+	var wg sync.WaitGroup
+	for i, layer := range manifest.Layers {
+		wg.Add(1)
+		go func(i int, layer DockerLayer) {
+			defer wg.Done()
+			errs[i] = p.layer(layer, fetch)
+		}(i, layer)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return "", fmt.Errorf("layer %s: %w", manifest.Layers[i].Digest, err)
+		}
+	}
+	return manifest.Config.Digest, nil
+}
+
+// layer caches layer, or waits for the pull of another image that is
+// already caching it.
+func (p *prefetcher) layer(layer DockerLayer, fetch layerFetcher) error {
+	p.mu.Lock()
+	if l, ok := p.layers[layer.Digest]; ok {
+		p.mu.Unlock()
+		<-l.done
+		return l.err
+	}
+	l := &layerPrefetch{done: make(chan struct{})}
+	p.layers[layer.Digest] = l
+	p.mu.Unlock()
+	defer close(l.done)
+	defer func() {
+		// A failed layer is tried again if the pull is.
+		if l.err != nil {
+			p.mu.Lock()
+			delete(p.layers, layer.Digest)
+			p.mu.Unlock()
+		}
+	}()
+
+	p.slots <- struct{}{}
+	defer func() { <-p.slots }()
+	buf := p.buffers.Get().([]byte)
+	defer p.buffers.Put(buf)
+	// With a cache, the fetcher leaves nothing in its work directory.
+	if _, l.err = fetch(layer, "", buf); l.err == nil {
+		// A layer that is only cached ends as downloaded, or as already
+		// there.
+		p.opts.Progress.lookup(layer.Digest).done("")
+	}
+	return l.err
+}
+
+func pullCommand(argv []string) {
+	flags := flag.NewFlagSet("pull", flag.ExitOnError)
+	cacheMode := cacheModeFlag(cacheModeCompressed)
+	flags.Var(&cacheMode, "cache-mode", "cache layers as downloaded (`compressed`, saves disk) or unpacked (extracted, saves CPU); use the mode later runs will")
+	verifyCache := flags.Bool("verify-cache", false, "hash cached layers again even if they were verified since they last changed")
+	var cacheMaxSize sizeFlag
+	flags.Var(&cacheMaxSize, "cache-max-size", "evict the least recently used cached layers to keep the cache under `size`, e.g. 10g; those of running containers are kept")
+	maxDownloads := flags.Int("max-concurrent-downloads", defaultConcurrentDownloads, "maximum number of layers to download at once, across all images")
+	stallTimeout := flags.Duration("stall-timeout", defaultStallTimeout, "retry a layer download that receives nothing for `duration`, resuming where it stopped; 0 never does")
+	bufferSize := sizeFlag(defaultBufferSize)
+	flags.Var(&bufferSize, "download-buffer-size", "copy buffer `size` for layer downloads")
+	var downloadRate sizeFlag
+	flags.Var(&downloadRate, "download-rate", "limit aggregate layer download bandwidth to `rate` bytes per second, e.g. 10m")
+	scopeActions := flags.String("registry-scope", defaultScopeActions, "comma-separated `actions` to request in the registry token scope")
+	var caCerts stringsFlag
+	flags.Var(&caCerts, "ca-cert", "also trust the CA certificates in PEM `file`, or in the .pem/.crt/.cert files of a directory, for registry TLS (repeatable)")
+	timeouts := httpTimeoutFlags(flags)
+	platform := flags.String("platform", targetPlatform.String(), "pick the image for `os/arch[/variant]` from multi-platform images")
+	downloadChunks := flags.Int("download-chunks", 1, "download each layer in up to `n` byte ranges at once, where the registry allows it")
+	retries := flags.Int("pull-retries", 0, "attempt a pull that failed up to `n` more times, reusing the layers earlier attempts got")
+	rootfsDir := flags.String("rootfs-dir", "", "also extract the image into `dir`, e.g. to chroot into; it must be empty or not exist (requires a single image)")
+	force := flags.Bool("force", false, "with --rootfs-dir, replace the contents of a directory that isn't empty")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), pullUsage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(argv)
+	if flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	if err := useCACerts(caCerts); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	if err := useHTTPTimeouts(timeouts); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	if err := usePlatform(*platform); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	var limiter *rateLimiter
+	if downloadRate > 0 {
+		limiter = newRateLimiter(int64(downloadRate))
+	}
+	opts := pullOptions{
+		BufferSize:             int(bufferSize),
+		ScopeActions:           *scopeActions,
+		RateLimit:              limiter,
+		StallTimeout:           *stallTimeout,
+		Retries:                *retries,
+		DownloadChunks:         *downloadChunks,
+		Cache:                  newLayerCache(string(cacheMode), int64(cacheMaxSize), *verifyCache),
+		MaxConcurrentDownloads: *maxDownloads,
+		Progress:               stderrProgress(false),
+	}
+	if *rootfsDir != "" {
+		if flags.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "Err: --rootfs-dir takes a single image")
+			os.Exit(1)
+		}
+		pullIntoDir(flags.Arg(0), *rootfsDir, *force, opts)
+		return
+	}
+	p := newPrefetcher(opts)
+
+	images := flags.Args()
+	ids := make([]string, len(images))
+	errs := make([]error, len(images))
+	var wg sync.WaitGroup
+	for i, image := range images {
+		wg.Add(1)
+		go func(i int, image string) {
+			defer wg.Done()
+			for attempt := 1; ; attempt++ {
+				if ids[i], errs[i] = p.pull(image); errs[i] == nil || attempt > *retries {
+					return
+				}
+				fmt.Fprintf(os.Stderr, "Warning: pulling %s, attempt %d of %d failed: %v; retrying\n", image, attempt, *retries+1, errs[i])
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+		}(i, image)
+	}
+	wg.Wait()
+
+	failed := 0
+	for i, image := range images {
+		if errs[i] != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "Err pulling %s: %v\n", image, errs[i])
+			continue
+		}
+		if quiet {
+			fmt.Println(ids[i])
+			continue
+		}
+		fmt.Printf("%s: pulled %s\n", image, shortImageID(ids[i]))
+	}
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d images failed to pull\n", failed, len(images))
+		os.Exit(1)
+	}
+}
+
+// pullIntoDir is pull --rootfs-dir: it extracts image into dir, caching
+// its layers on the way.
+func pullIntoDir(image, dir string, force bool, opts pullOptions) {
+	dir, err := rootfsDirPath(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	var meta imageMetadata
+	err = populateRootfsDir(dir, force, func(dir string) error {
+		var err error
+		meta, err = pullDockerImage(dir, image, opts)
+		return err
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err pulling %s: %v\n", image, err)
+		os.Exit(1)
+	}
+	if quiet {
+		fmt.Println(meta.Manifest.Config.Digest)
+		return
+	}
+	fmt.Printf("%s: pulled %s into %s\n", image, shortImageID(meta.Manifest.Config.Digest), dir)
+}
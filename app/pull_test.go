@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestPrefetchImages pulls two images at once into the cache, and one that
+// isn't there.
+func TestPrefetchImages(t *testing.T) {
+	t.Setenv("DOCKER_CLONE_HOME", t.TempDir())
+	layout := filepath.Join(t.TempDir(), "layout")
+	shared := testLayer(t, testEntry{name: "shared", body: "in both"})
+	images := map[string]ociDescriptor{
+		"app:a": writeTestImage(t, layout, "a", shared, testLayer(t, testEntry{name: "a", body: "only in a"})),
+		"app:b": writeTestImage(t, layout, "b", shared, testLayer(t, testEntry{name: "b", body: "only in b"})),
+	}
+
+	// Layer requests are held until a manifest of each image has been
+	// asked for, which they only both are if the pulls run at once.
+	var mu sync.Mutex
+	manifests := map[string]bool{}
+	blobRequests := map[string]int{}
+	both := make(chan struct{})
+	serve := ociLayoutHandler(layout)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ref := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		mu.Lock()
+		switch {
+		case strings.Contains(r.URL.Path, "/manifests/") && !isDigest(ref):
+			manifests[ref] = true
+			if manifests["a"] && manifests["b"] && len(manifests) == 3 {
+				close(both)
+			}
+		case strings.Contains(r.URL.Path, "/blobs/") && r.Method == http.MethodGet:
+			blobRequests[ref]++
+		}
+		mu.Unlock()
+		if strings.Contains(r.URL.Path, "/blobs/") {
+			select {
+			case <-both:
+			case <-time.After(5 * time.Second):
+				http.Error(w, "the other images were never asked for", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		serve(w, r)
+	}))
+	defer srv.Close()
+	useTestRegistry(t, srv)
+
+	cache := newLayerCache(cacheModeCompressed, 0, false)
+	p := newPrefetcher(pullOptions{Cache: cache})
+	pulls := []string{"app:a", "app:b", "app:missing"}
+	ids := make([]string, len(pulls))
+	errs := make([]error, len(pulls))
+	var wg sync.WaitGroup
+	for i, image := range pulls {
+		wg.Add(1)
+		go func(i int, image string) {
+			defer wg.Done()
+			ids[i], errs[i] = p.pull(image)
+		}(i, image)
+	}
+	wg.Wait()
+
+	if errs[2] == nil {
+		t.Error("pulling app:missing succeeded")
+	}
+	for i, image := range pulls[:2] {
+		if errs[i] != nil {
+			t.Errorf("pulling %s: %v", image, errs[i])
+			continue
+		}
+		var manifest ociManifest
+		if err := readOCIBlobJSON(layout, images[image].Digest, &manifest); err != nil {
+			t.Fatal(err)
+		}
+		if ids[i] != manifest.Config.Digest {
+			t.Errorf("%s pulled as %s, want %s", image, ids[i], manifest.Config.Digest)
+		}
+		config, err := cache.entryPath("configs", manifest.Config.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(config); err != nil {
+			t.Errorf("%s: config not cached: %v", image, err)
+		}
+		for _, layer := range manifest.Layers {
+			path, err := cache.path(layer.Digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(path); err != nil {
+				t.Errorf("%s: layer %s not cached: %v", image, shortImageID(layer.Digest), err)
+			}
+			if n := blobRequests[layer.Digest]; n != 1 {
+				t.Errorf("%s: layer %s downloaded %d times, want once", image, shortImageID(layer.Digest), n)
+			}
+		}
+	}
+}
+
+// TestPullTampered pulls images one of whose manifest, config and layer blobs
+// isn't what its digest says, from a registry and from an OCI layout, and
+// checks each pull fails on that blob.
+func TestPullTampered(t *testing.T) {
+	for _, source := range []string{"registry", "layout"} {
+		for _, target := range []string{"manifest", "config", "layer"} {
+			t.Run(source+"/"+target, func(t *testing.T) {
+				layout := filepath.Join(t.TempDir(), "layout")
+				// Contents of their own keep cached blobs of other
+				// subtests out of it.
+				desc := writeTestImage(t, layout, "latest", testLayer(t, testEntry{name: "f", body: t.Name()}))
+				var manifest ociManifest
+				if err := readOCIBlobJSON(layout, desc.Digest, &manifest); err != nil {
+					t.Fatal(err)
+				}
+				digest := map[string]string{"manifest": desc.Digest, "config": manifest.Config.Digest, "layer": manifest.Layers[0].Digest}[target]
+				path, err := ociBlobPath(layout, digest)
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// A manifest stays valid JSON, and a layer the size the
+				// manifest says.
+				tampered := append(append([]byte{}, data...), ' ')
+				if target == "layer" {
+					tampered = append([]byte{}, data...)
+					tampered[len(tampered)-1] ^= 0xff
+				}
+
+				image := "oci:" + layout
+				if source == "registry" {
+					// The registry serves the tampered blob; the layout
+					// on disk is left as it was.
+					serve := ociLayoutHandler(layout)
+					srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						if !strings.HasSuffix(r.URL.Path, "/"+digest) {
+							serve(w, r)
+							return
+						}
+						if target == "manifest" {
+							w.Header().Set("Content-Type", ociManifestMediaType)
+						}
+						w.Write(tampered)
+					}))
+					defer srv.Close()
+					useTestRegistry(t, srv)
+					// Only a manifest asked for by digest can be checked.
+					image = "app@" + desc.Digest
+				} else if err := os.WriteFile(path, tampered, 0o644); err != nil {
+					t.Fatal(err)
+				}
+
+				dir := filepath.Join(t.TempDir(), "rootfs")
+				if err := os.Mkdir(dir, 0o755); err != nil {
+					t.Fatal(err)
+				}
+				_, err = pullDockerImage(dir, image, pullOptions{})
+				var mismatch *digestMismatchError
+				if !errors.As(err, &mismatch) || mismatch.Expected != digest {
+					t.Fatalf("pull: %v, want a digest mismatch for %s", err, digest)
+				}
+				wantTree(t, dir, map[string]string{"f": ""})
+			})
+		}
+	}
+}
+
+// TestPullRetries pulls an image whose last layer is served corrupted the
+// first time, and checks a retried pull fetches only that layer again.
+func TestPullRetries(t *testing.T) {
+	layout := filepath.Join(t.TempDir(), "layout")
+	var layers [][]byte
+	var digests []string
+	for _, name := range []string{"a", "b", "c"} {
+		layer := testLayer(t, testEntry{name: name, body: name})
+		layers = append(layers, layer)
+		digests = append(digests, sha256Digest(gzipLayer(t, layer)))
+	}
+	writeTestImage(t, layout, "latest", layers...)
+	last := digests[len(digests)-1]
+
+	tests := []struct {
+		retries  int
+		wantGets []int
+		wantErr  bool
+	}{
+		{retries: 0, wantGets: []int{1, 1, 1}, wantErr: true},
+		{retries: 1, wantGets: []int{1, 1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.retries), func(t *testing.T) {
+			t.Setenv("DOCKER_CLONE_HOME", t.TempDir())
+			serve := ociLayoutHandler(layout)
+			var mu sync.Mutex
+			gets := map[string]int{}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "GET" {
+					for _, digest := range digests {
+						if !strings.HasSuffix(r.URL.Path, "/blobs/"+digest) {
+							continue
+						}
+						mu.Lock()
+						gets[digest]++
+						first := gets[digest] == 1
+						mu.Unlock()
+						if digest == last && first {
+							data, err := readOCIBlob(layout, digest)
+							if err != nil {
+								t.Error(err)
+							}
+							data[len(data)-1] ^= 0xff
+							w.Write(data)
+							return
+						}
+					}
+				}
+				serve(w, r)
+			}))
+			defer srv.Close()
+			useTestRegistry(t, srv)
+
+			dir := t.TempDir()
+			var err error
+			stderr := captureStderr(t, func() {
+				// One download at a time, so the earlier layers are in
+				// before the last one fails.
+				_, err = pullDockerImage(dir, "app", pullOptions{Retries: tt.retries, MaxConcurrentDownloads: 1})
+			})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("pull succeeded with a corrupted layer")
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else {
+				wantTree(t, dir, map[string]string{"a": "a", "b": "b", "c": "c"})
+				want := "2 layers reused from earlier attempts, 1 fetched again (" + shortImageID(last) + ")"
+				if !strings.Contains(stderr, "pull attempt 1 of 2 failed") || !strings.Contains(stderr, want) {
+					t.Errorf("stderr %q doesn't report the retry, or %q", stderr, want)
+				}
+			}
+			for i, digest := range digests {
+				if gets[digest] != tt.wantGets[i] {
+					t.Errorf("layer %d fetched %d times, want %d", i, gets[digest], tt.wantGets[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket limiting throughput to a number of bytes per
+// second. One limiter is shared by all layer downloads of a pull, so the
+// limit applies to their aggregate bandwidth.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter allows bytesPerSecond on average, with bursts of up to a
+// tenth of a second's worth of data.
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	rate := float64(bytesPerSecond)
+	burst := rate / 10
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// maxChunk is the most a single read may take from the bucket, so that one
+// reader can't starve the others sharing the limiter.
+func (l *rateLimiter) maxChunk() int {
+	return int(l.burst)
+}
+
+// wait blocks until n bytes' worth of tokens are available and takes them.
+// Tokens may go negative; the debt is paid off by sleeping, which keeps
+// concurrent callers fair without a queue.
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(delay)
+}
+
+type rateLimitedReader struct {
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+// limitReader throttles r through limiter. A nil limiter returns r as is.
+func limitReader(r io.Reader, limiter *rateLimiter) io.Reader {
+	if limiter == nil {
+		return r
+	}
+	return &rateLimitedReader{r: r, limiter: limiter}
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if max := r.limiter.maxChunk(); len(p) > max {
+		p = p[:max]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.limiter.wait(n)
+	}
+	return n, err
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestRateLimit reads through one limiter from several readers at once, and
+// checks the reads take as long as the limit says, give or take.
+func TestRateLimit(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits on the limit")
+	}
+	const rate = 1 << 20
+	tests := []struct {
+		name    string
+		readers int
+		size    int
+	}{
+		{name: "one reader", readers: 1, size: 512 << 10},
+		// The limit is on the readers together.
+		{name: "three readers", readers: 3, size: 200 << 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := newRateLimiter(rate)
+			data := make([]byte, tt.size)
+			start := time.Now()
+			var wg sync.WaitGroup
+			for i := 0; i < tt.readers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					n, err := io.Copy(io.Discard, limitReader(bytes.NewReader(data), limiter))
+					if err != nil || n != int64(len(data)) {
+						t.Errorf("read %d, %v", n, err)
+					}
+				}()
+			}
+			wg.Wait()
+			// The first tenth of a second's worth comes at once.
+			total := float64(tt.readers * tt.size)
+			want := time.Duration((total - rate/10) / rate * float64(time.Second))
+			if elapsed := time.Since(start); elapsed < want*8/10 || elapsed > want*2 {
+				t.Errorf("read %.0f bytes in %v, want about %v", total, elapsed, want)
+			}
+		})
+	}
+}
+
+func TestRateLimitedDownload(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits on the limit")
+	}
+	data := make([]byte, 300<<10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
+			return
+		}
+		w.Write(data)
+	}))
+	defer srv.Close()
+	useTestRegistry(t, srv)
+	const rate = 512 << 10
+	layer := DockerLayer{Digest: sha256Digest(data), Size: int64(len(data))}
+	src := &registrySource{repository: "library/test", auth: &registryAuth{}}
+	opts := pullOptions{RateLimit: newRateLimiter(rate)}
+	start := time.Now()
+	if _, err := sourceLayerFetcher(src, opts)(layer, t.TempDir(), make([]byte, 32<<10)); err != nil {
+		t.Fatal(err)
+	}
+	want := time.Duration((float64(len(data)) - rate/10) / rate * float64(time.Second))
+	if elapsed := time.Since(start); elapsed < want*8/10 || elapsed > want*2 {
+		t.Errorf("downloaded %d bytes in %v, want about %v", len(data), elapsed, want)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Docker Hub's names. References without a domain are on defaultDomain,
+// where single-component repositories are official images under library/.
+const (
+	defaultDomain   = "docker.io"
+	officialRepoDir = "library/"
+	// maxNameLength bounds domain and repository together.
+	maxNameLength = 255
+)
+
+// hubDomains are the other names Docker Hub is known by. index.docker.io is
+// the legacy name Docker itself folds into docker.io; registry-1.docker.io
+// is the API host this tool talks to.
+var hubDomains = map[string]bool{
+	"index.docker.io":      true,
+	"registry-1.docker.io": true,
+}
+
+// The grammar of github.com/distribution/reference.
+const (
+	domainComponentPattern = `(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])`
+	pathComponentPattern   = `[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*`
+)
+
+var (
+	domainRegexp         = regexp.MustCompile(`^(?:` + domainComponentPattern + `(?:\.` + domainComponentPattern + `)*|\[[a-fA-F0-9:]+\])(?::[0-9]+)?$`)
+	repositoryNameRegexp = regexp.MustCompile(`^` + pathComponentPattern + `(?:/` + pathComponentPattern + `)*$`)
+	tagRegexp            = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	digestRegexp         = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]+$`)
+)
+
+// imageRef is a parsed image reference such as "ubuntu", "ubuntu:22.04" or
+// "ubuntu:latest@sha256:...". When a digest is present it is authoritative
+// and the tag, if any, is only informational.
+type imageRef struct {
+	// Domain is the registry, defaultDomain for Docker Hub.
+	Domain string
+	// Repository is the path within the registry, e.g. library/ubuntu.
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// Reference returns the manifest reference to fetch: the digest when pinned,
+// otherwise the tag.
+func (r imageRef) Reference() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+// String returns the canonical form of the reference, with its domain.
+func (r imageRef) String() string {
+	s := r.Domain + "/" + r.Repository
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// normalizeImageRef parses a reference the way Docker does. The first path
+// component is a domain if it contains a "." or ":", is "localhost", or has
+// upper case letters; anything else is a repository on Docker Hub. Hub's
+// other names are normalized to docker.io, and official images get their
+// library/ prefix. Without a tag or digest, the tag is "latest".
+func normalizeImageRef(image string) (imageRef, error) {
+	var ref imageRef
+	name := image
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, ref.Digest = name[:i], name[i+1:]
+		if err := validateDigest(ref.Digest); err != nil {
+			return ref, fmt.Errorf("invalid reference %q: %w", image, err)
+		}
+	}
+	// A colon after the last slash separates the tag; one before it would be
+	// part of a registry host:port.
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, ref.Tag = name[:i], name[i+1:]
+		if !tagRegexp.MatchString(ref.Tag) {
+			return ref, fmt.Errorf("invalid reference %q: invalid tag %q", image, ref.Tag)
+		}
+	}
+	if name == "" {
+		return ref, fmt.Errorf("invalid reference %q", image)
+	}
+
+	ref.Domain, ref.Repository = defaultDomain, name
+	if i := strings.Index(name, "/"); i >= 0 {
+		first := name[:i]
+		if strings.ContainsAny(first, ".:") || first == "localhost" || strings.ToLower(first) != first {
+			ref.Domain, ref.Repository = first, name[i+1:]
+		}
+	}
+	if !domainRegexp.MatchString(ref.Domain) {
+		return ref, fmt.Errorf("invalid reference %q: invalid domain %q", image, ref.Domain)
+	}
+	if hubDomains[ref.Domain] {
+		ref.Domain = defaultDomain
+	}
+	if strings.ToLower(ref.Repository) != ref.Repository {
+		return ref, fmt.Errorf("invalid reference %q: repository name must be lowercase", image)
+	}
+	if !repositoryNameRegexp.MatchString(ref.Repository) {
+		return ref, fmt.Errorf("invalid reference %q: invalid repository name %q", image, ref.Repository)
+	}
+	if ref.Domain == defaultDomain && !strings.Contains(ref.Repository, "/") {
+		ref.Repository = officialRepoDir + ref.Repository
+	}
+	if len(ref.Domain)+1+len(ref.Repository) > maxNameLength {
+		return ref, fmt.Errorf("invalid reference %q: name longer than %d characters", image, maxNameLength)
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
+	}
+	return ref, nil
+}
+
+// validateDigest checks that digest is well formed and uses an algorithm we
+// can verify.
+func validateDigest(digest string) error {
+	if !digestRegexp.MatchString(digest) {
+		return fmt.Errorf("invalid digest %q", digest)
+	}
+	algorithm, hex, _ := strings.Cut(digest, ":")
+	newHash, ok := digestHashes[algorithm]
+	if !ok {
+		return fmt.Errorf("unsupported digest algorithm %q", algorithm)
+	}
+	n := 2 * newHash().Size()
+	if len(hex) != n || strings.Trim(hex, "0123456789abcdef") != "" {
+		return fmt.Errorf("invalid %s digest %q: want %d lowercase hex digits", algorithm, digest, n)
+	}
+	return nil
+}
+
+// isDigest reports whether ref, a reference to ask a Source for, is a digest
+// rather than a tag, which in a `docker save` archive can be a whole
+// repository:tag.
+func isDigest(ref string) bool {
+	algorithm, _, ok := strings.Cut(ref, ":")
+	_, known := digestHashes[algorithm]
+	return ok && known
+}
+
+// parseImageRef is normalizeImageRef for references this tool can pull,
+// which, as every request goes to Docker Hub, must be on docker.io.
+func parseImageRef(image string) (imageRef, error) {
+	ref, err := normalizeImageRef(image)
+	if err != nil {
+		return ref, err
+	}
+	if ref.Domain != defaultDomain {
+		return ref, fmt.Errorf("%s: registry %s is not supported, only Docker Hub (%s) is", image, ref.Domain, defaultDomain)
+	}
+	return ref, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeImageRef(t *testing.T) {
+	sha256 := "sha256:" + strings.Repeat("ab", 32)
+	sha512 := "sha512:" + strings.Repeat("cd", 64)
+	tests := []struct {
+		image   string
+		want    imageRef
+		wantErr bool
+	}{
+		{image: "ubuntu", want: imageRef{Domain: "docker.io", Repository: "library/ubuntu", Tag: "latest"}},
+		{image: "docker.io/library/ubuntu", want: imageRef{Domain: "docker.io", Repository: "library/ubuntu", Tag: "latest"}},
+		{image: "docker.io/ubuntu", want: imageRef{Domain: "docker.io", Repository: "library/ubuntu", Tag: "latest"}},
+		{image: "index.docker.io/ubuntu", want: imageRef{Domain: "docker.io", Repository: "library/ubuntu", Tag: "latest"}},
+		{image: "registry-1.docker.io/library/ubuntu:22.04", want: imageRef{Domain: "docker.io", Repository: "library/ubuntu", Tag: "22.04"}},
+		{image: "bitnami/redis", want: imageRef{Domain: "docker.io", Repository: "bitnami/redis", Tag: "latest"}},
+		// Only a domain-looking first component is a domain.
+		{image: "localhost/x", want: imageRef{Domain: "localhost", Repository: "x", Tag: "latest"}},
+		{image: "localhost:5000/x", want: imageRef{Domain: "localhost:5000", Repository: "x", Tag: "latest"}},
+		{image: "ghcr.io/o/r/app:v1.2_rc-3", want: imageRef{Domain: "ghcr.io", Repository: "o/r/app", Tag: "v1.2_rc-3"}},
+		{image: "Registry/x", want: imageRef{Domain: "Registry", Repository: "x", Tag: "latest"}},
+		{image: "[::1]:5000/x", want: imageRef{Domain: "[::1]:5000", Repository: "x", Tag: "latest"}},
+		{image: "my-org/my__app.v2", want: imageRef{Domain: "docker.io", Repository: "my-org/my__app.v2", Tag: "latest"}},
+		{image: "repo@" + sha512, want: imageRef{Domain: "docker.io", Repository: "library/repo", Digest: sha512}},
+		{image: "localhost:5000/x@" + sha512, want: imageRef{Domain: "localhost:5000", Repository: "x", Digest: sha512}},
+		{image: "Ubuntu", wantErr: true},
+		{image: "docker.io/Library/ubuntu", wantErr: true},
+		{image: "ubuntu:", wantErr: true},
+		{image: "ubuntu:-x", wantErr: true},
+		{image: "ubuntu:" + strings.Repeat("t", 129), wantErr: true},
+		{image: "ubuntu:.x", wantErr: true},
+		{image: "my_/app", wantErr: true},
+		{image: "a//b", wantErr: true},
+		{image: "-x.io/app", wantErr: true},
+		{image: "", wantErr: true},
+		{image: "example.com/" + strings.Repeat("a", 250), wantErr: true},
+		{image: "repo@md5:" + strings.Repeat("ab", 16), wantErr: true},
+		{image: "repo@sha512:" + strings.Repeat("ab", 32), wantErr: true},
+		{image: "repo@sha256:" + strings.Repeat("AB", 32), wantErr: true},
+		{image: "ubuntu:22.04", want: imageRef{Domain: "docker.io", Repository: "library/ubuntu", Tag: "22.04"}},
+		{image: "ubuntu@" + sha256, want: imageRef{Domain: "docker.io", Repository: "library/ubuntu", Digest: sha256}},
+		// The tag of a tag@digest reference is kept, to be checked.
+		{image: "ubuntu:latest@" + sha256, want: imageRef{Domain: "docker.io", Repository: "library/ubuntu", Tag: "latest", Digest: sha256}},
+		{image: "localhost:5000/x:v1@" + sha256, want: imageRef{Domain: "localhost:5000", Repository: "x", Tag: "v1", Digest: sha256}},
+		{image: "ubuntu:latest@sha256:abc", wantErr: true},
+		{image: "ubuntu:bad tag@" + sha256, wantErr: true},
+		{image: "ubuntu:latest@", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeImageRef(tt.image)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("normalizeImageRef(%q) = %+v, want an error", tt.image, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("normalizeImageRef(%q) = %+v, %v, want %+v", tt.image, got, err, tt.want)
+		}
+	}
+}
+
+func TestImageRefReference(t *testing.T) {
+	sha256 := "sha256:" + strings.Repeat("ab", 32)
+	tests := []struct {
+		ref       imageRef
+		reference string
+		str       string
+	}{
+		{ref: imageRef{Domain: "docker.io", Repository: "library/ubuntu", Tag: "latest"}, reference: "latest", str: "docker.io/library/ubuntu:latest"},
+		// The digest is what is fetched.
+		{ref: imageRef{Domain: "docker.io", Repository: "library/ubuntu", Tag: "latest", Digest: sha256}, reference: sha256, str: "docker.io/library/ubuntu:latest@" + sha256},
+		{ref: imageRef{Domain: "docker.io", Repository: "library/ubuntu", Digest: sha256}, reference: sha256, str: "docker.io/library/ubuntu@" + sha256},
+	}
+	for _, tt := range tests {
+		if got := tt.ref.Reference(); got != tt.reference {
+			t.Errorf("%+v.Reference() = %q, want %q", tt.ref, got, tt.reference)
+		}
+		if got := tt.ref.String(); got != tt.str {
+			t.Errorf("%+v.String() = %q, want %q", tt.ref, got, tt.str)
+		}
+	}
+}
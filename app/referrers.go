@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// Artifacts such as signatures, SBOMs and attestations refer to the image
+// they are about, their subject, by its manifest digest. Registries with the
+// OCI referrers API list them at /v2/<repository>/referrers/<digest>. Those
+// without it are found by the tag-schema: an image index tagged
+// <algorithm>-<hex> listing them, and cosign's <algorithm>-<hex>.sig, .att
+// and .sbom tags.
+
+// cosignTagSuffixes are the suffixes of the tags cosign stores the
+// signatures, attestations and SBOMs of a digest under.
+var cosignTagSuffixes = []string{".sig", ".att", ".sbom"}
+
+// referrer is an artifact referring to an image.
+type referrer struct {
+	MediaType    string            `json:"mediaType"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	// Tag is the tag-schema tag the referrer was found by, if it wasn't
+	// listed by the referrers API.
+	Tag string `json:"-"`
+}
+
+// referrersIndex is the image index listing referrers, as the referrers API
+// and the tag-schema's <algorithm>-<hex> tag serve it.
+type referrersIndex struct {
+	Manifests []referrer `json:"manifests"`
+}
+
+// errNoReferrersAPI reports a registry without the referrers API.
+var errNoReferrersAPI = errors.New("the registry has no referrers API")
+
+// listReferrers returns the artifacts referring to the manifest with digest
+// in repository, from the referrers API or, if the registry has none, the
+// tag-schema.
+func listReferrers(repository, digest string, auth *registryAuth) ([]referrer, error) {
+	referrers, err := fetchReferrers(repository, digest, auth)
+	if err == errNoReferrersAPI {
+		return tagSchemaReferrers(repository, digest, auth)
+	}
+	return referrers, err
+}
+
+// fetchReferrers asks the referrers API of the registry, following its Link
+// header pagination.
+func fetchReferrers(repository, digest string, auth *registryAuth) ([]referrer, error) {
+	next, err := url.Parse(fmt.Sprintf("%s/v2/%s/referrers/%s", registryBase(), repository, digest))
+	if err != nil {
+		return nil, err
+	}
+	var referrers []referrer
+	for next != nil {
+		req, err := http.NewRequest("GET", next.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", ociIndexMediaType)
+		res, err := auth.do(registryClient, req)
+		if err != nil {
+			return nil, err
+		}
+		// A registry with the API answers 200, with an empty index if
+		// nothing refers to digest; one without it doesn't know the path.
+		if res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusMethodNotAllowed {
+			closeBody(res.Body)
+			return nil, errNoReferrersAPI
+		}
+		if res.StatusCode != http.StatusOK {
+			closeBody(res.Body)
+			return nil, fmt.Errorf("listing referrers of %s@%s: unexpected status %s", repository, digest, res.Status)
+		}
+		var page referrersIndex
+		err = json.NewDecoder(res.Body).Decode(&page)
+		closeBody(res.Body)
+		if err != nil {
+			return nil, fmt.Errorf("parsing referrers of %s@%s: %w", repository, digest, err)
+		}
+		referrers = append(referrers, page.Manifests...)
+		m := linkNextPattern.FindStringSubmatch(res.Header.Get("Link"))
+		if m == nil {
+			break
+		}
+		if next, err = next.Parse(m[1]); err != nil {
+			return nil, fmt.Errorf("invalid pagination link %q: %w", m[1], err)
+		}
+	}
+	return referrers, nil
+}
+
+// tagSchemaReferrers finds the referrers of digest by the tags the
+// tag-schema and cosign store them under.
+func tagSchemaReferrers(repository, digest string, auth *registryAuth) ([]referrer, error) {
+	tags, err := listTags(repository, auth)
+	if err != nil {
+		return nil, err
+	}
+	exists := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		exists[tag] = true
+	}
+	prefix := strings.Replace(digest, ":", "-", 1)
+	var referrers []referrer
+	// A cosign artifact may be in the tag-schema's index as well as under
+	// its own tag.
+	seen := make(map[string]bool)
+	if exists[prefix] {
+		data, _, err := fetchManifestBlob(repository, prefix, auth)
+		if err != nil {
+			return nil, err
+		}
+		var index referrersIndex
+		if err := json.Unmarshal(data, &index); err != nil {
+			return nil, fmt.Errorf("parsing referrers index %s: %w", prefix, err)
+		}
+		for _, r := range index.Manifests {
+			r.Tag = prefix
+			referrers = append(referrers, r)
+			seen[r.Digest] = true
+		}
+	}
+	for _, suffix := range cosignTagSuffixes {
+		tag := prefix + suffix
+		if !exists[tag] {
+			continue
+		}
+		data, contentType, err := fetchManifestBlob(repository, tag, auth)
+		if err != nil {
+			return nil, err
+		}
+		r, err := taggedReferrer(data, manifestKind(contentType, data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", tag, err)
+		}
+		if !seen[r.Digest] {
+			r.Tag = tag
+			referrers = append(referrers, r)
+			seen[r.Digest] = true
+		}
+	}
+	return referrers, nil
+}
+
+// taggedReferrer describes the artifact manifest data of media type kind,
+// found by a tag. Its artifact type is the one it declares or, as cosign's
+// give their config the image config's type, that of its first layer, such
+// as application/vnd.dev.cosign.simplesigning.v1+json for a signature.
+func taggedReferrer(data []byte, kind string) (referrer, error) {
+	r := referrer{MediaType: kind, Digest: sha256Digest(data), Size: int64(len(data))}
+	manifest, err := parseManifest(data, kind)
+	if err != nil {
+		return r, err
+	}
+	r.Annotations = manifest.Annotations
+	if t, ok := artifactType(manifest); ok {
+		r.ArtifactType = t
+	} else if len(manifest.Layers) > 0 {
+		r.ArtifactType = manifest.Layers[0].MediaType
+	}
+	return r, nil
+}
+
+func referrersCommand(argv []string) {
+	flags := flag.NewFlagSet("referrers", flag.ExitOnError)
+	only := flags.String("artifact-type", "", "only list referrers of artifact `type`, e.g. application/vnd.dev.cosign.simplesigning.v1+json")
+	quiet := flags.Bool("q", false, "only print the referrers' references, repository@digest, e.g. to inspect")
+	scopeActions := flags.String("registry-scope", defaultScopeActions, "comma-separated `actions` to request in the registry token scope")
+	var caCerts stringsFlag
+	flags.Var(&caCerts, "ca-cert", "also trust the CA certificates in PEM `file`, or in the .pem/.crt/.cert files of a directory, for registry TLS (repeatable)")
+	timeouts := httpTimeoutFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), referrersUsage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(argv)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	if err := useCACerts(caCerts); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	if err := useHTTPTimeouts(timeouts); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	ref, err := parseImageRef(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	auth, err := newRegistryAuth(ref.Repository, *scopeActions)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err fetching token: %v\n", err)
+		os.Exit(1)
+	}
+	// Referrers refer to the manifest the reference names, an image index
+	// for multi-platform images, not the platform's image in it.
+	digest := ref.Digest
+	if digest == "" {
+		if digest, err = resolveManifestDigest(ref.Repository, ref.Tag, auth); err != nil {
+			fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	referrers, err := listReferrers(ref.Repository, digest, auth)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	if *only != "" {
+		// The API may ignore the artifactType filter, so none is asked
+		// for and the list is filtered here.
+		kept := referrers[:0]
+		for _, r := range referrers {
+			if r.ArtifactType == *only {
+				kept = append(kept, r)
+			}
+		}
+		referrers = kept
+	}
+	if *quiet {
+		for _, r := range referrers {
+			fmt.Printf("%s@%s\n", ref.Repository, r.Digest)
+		}
+		return
+	}
+	printReferrers(os.Stdout, referrers)
+}
+
+// printReferrers lists referrers as a table.
+func printReferrers(w io.Writer, referrers []referrer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(tw, "DIGEST\tARTIFACT TYPE\tSIZE\tTAG")
+	for _, r := range referrers {
+		artifact := r.ArtifactType
+		if artifact == "" {
+			artifact = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.Digest, artifact, formatSize(r.Size), r.Tag)
+	}
+	tw.Flush()
+}
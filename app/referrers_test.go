@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestListReferrers(t *testing.T) {
+	const subject = "sha256:" + "ab12ab12ab12ab12ab12ab12ab12ab12ab12ab12ab12ab12ab12ab12ab12ab12"
+	const schemaTag = "sha256-ab12ab12ab12ab12ab12ab12ab12ab12ab12ab12ab12ab12ab12ab12ab12ab12"
+	sbom := referrer{MediaType: ociManifestMediaType, Digest: "sha256:" + strings.Repeat("1", 64), Size: 500, ArtifactType: "application/spdx+json"}
+	attestation := referrer{MediaType: ociManifestMediaType, Digest: "sha256:" + strings.Repeat("2", 64), Size: 600, ArtifactType: "application/vnd.in-toto+json"}
+	// A cosign signature, whose config is typed as an image config.
+	signature := `{"schemaVersion":2,"mediaType":"` + ociManifestMediaType + `",` +
+		`"config":{"mediaType":"` + ociImageConfigMediaType + `","digest":"sha256:` + strings.Repeat("3", 64) + `","size":233},` +
+		`"layers":[{"mediaType":"application/vnd.dev.cosign.simplesigning.v1+json","digest":"sha256:` + strings.Repeat("4", 64) + `","size":250,` +
+		`"annotations":{"dev.cosignproject.cosign/signature":"MEUC"}}],"annotations":{"created":"2024"}}`
+	signatureReferrer := referrer{
+		MediaType:    ociManifestMediaType,
+		Digest:       sha256Digest([]byte(signature)),
+		Size:         int64(len(signature)),
+		ArtifactType: "application/vnd.dev.cosign.simplesigning.v1+json",
+		Annotations:  map[string]string{"created": "2024"},
+		Tag:          schemaTag + ".sig",
+	}
+	withTag := func(r referrer, tag string) referrer {
+		r.Tag = tag
+		return r
+	}
+	tests := []struct {
+		name string
+		// pages are the referrers API's pages, served for ?page=0, 1 and
+		// so on, each linking to the next; with none, the registry has no
+		// referrers API.
+		pages [][]referrer
+		// status, if set, is what the referrers API answers instead.
+		status int
+		// tags are the repository's tags and the manifests they name.
+		tags    map[string]string
+		want    []referrer
+		wantErr bool
+	}{
+		{name: "referrers API", pages: [][]referrer{{sbom, attestation}}, want: []referrer{sbom, attestation}},
+		{name: "referrers API, paginated", pages: [][]referrer{{sbom}, {attestation}}, want: []referrer{sbom, attestation}},
+		{
+			// The tag-schema isn't looked at when the API lists nothing.
+			name:  "referrers API, none",
+			pages: [][]referrer{{}},
+			tags:  map[string]string{schemaTag + ".sig": signature},
+		},
+		{
+			name: "tag-schema index",
+			tags: map[string]string{
+				"latest":  "{}",
+				schemaTag: `{"schemaVersion":2,"mediaType":"` + ociIndexMediaType + `","manifests":[` + mustJSON(t, sbom) + `]}`,
+			},
+			want: []referrer{withTag(sbom, schemaTag)},
+		},
+		{
+			name: "cosign tags",
+			tags: map[string]string{"latest": "{}", schemaTag + ".sig": signature, "sha256-other.sig": signature},
+			want: []referrer{signatureReferrer},
+		},
+		{
+			// The signature listed by the tag-schema's index isn't listed
+			// again for its cosign tag.
+			name: "tag-schema index and cosign tags",
+			tags: map[string]string{
+				schemaTag:          `{"schemaVersion":2,"mediaType":"` + ociIndexMediaType + `","manifests":[` + mustJSON(t, signatureReferrer) + `,` + mustJSON(t, sbom) + `]}`,
+				schemaTag + ".sig": signature,
+			},
+			want: []referrer{withTag(signatureReferrer, schemaTag), withTag(sbom, schemaTag)},
+		},
+		{name: "no referrers", tags: map[string]string{"latest": "{}"}},
+		{name: "referrers API failing", status: http.StatusInternalServerError, tags: map[string]string{schemaTag + ".sig": signature}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.URL.Path == "/v2/app/referrers/"+subject:
+					if tt.status != 0 {
+						w.WriteHeader(tt.status)
+						return
+					}
+					page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+					if page >= len(tt.pages) {
+						http.NotFound(w, r)
+						return
+					}
+					if page+1 < len(tt.pages) {
+						w.Header().Set("Link", "</v2/app/referrers/"+subject+"?page="+strconv.Itoa(page+1)+`>; rel="next"`)
+					}
+					w.Header().Set("Content-Type", ociIndexMediaType)
+					json.NewEncoder(w).Encode(referrersIndex{Manifests: tt.pages[page]})
+				case r.URL.Path == "/v2/app/tags/list":
+					list := tagListResponse{Name: "app"}
+					for tag := range tt.tags {
+						list.Tags = append(list.Tags, tag)
+					}
+					json.NewEncoder(w).Encode(list)
+				case strings.HasPrefix(r.URL.Path, "/v2/app/manifests/"):
+					data, ok := tt.tags[strings.TrimPrefix(r.URL.Path, "/v2/app/manifests/")]
+					if !ok {
+						http.NotFound(w, r)
+						return
+					}
+					w.Header().Set("Content-Type", manifestKind("", []byte(data)))
+					w.Write([]byte(data))
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer srv.Close()
+			useTestRegistry(t, srv)
+			got, err := listReferrers("app", subject, &registryAuth{})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("listReferrers = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// No referrers may come back as nil or an empty list.
+			if (len(got) != 0 || len(tt.want) != 0) && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("listReferrers =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrintReferrers(t *testing.T) {
+	var buf bytes.Buffer
+	printReferrers(&buf, []referrer{
+		{Digest: "sha256:1", Size: 2048, ArtifactType: "application/spdx+json"},
+		{Digest: "sha256:2", Size: 10, Tag: "sha256-0.sig"},
+	})
+	want := "DIGEST     ARTIFACT TYPE           SIZE     TAG\n" +
+		"sha256:1   application/spdx+json   2.05kB   \n" +
+		"sha256:2   -                       10B      sha256-0.sig\n"
+	if buf.String() != want {
+		t.Errorf("printReferrers printed\n%q\nwant\n%q", buf.String(), want)
+	}
+}
+
+// mustJSON encodes v, failing t if it can't be.
+func mustJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	dockerHubAuthRealm = "https://auth.docker.io/token"
+	dockerHubService   = "registry.docker.io"
+
+	// defaultScopeActions is all this tool needs, but some registries only
+	// hand out working tokens for a broader scope such as "pull,push".
+	defaultScopeActions = "pull"
+)
+
+// maxDrainBytes bounds how much of an unread response body closeBody reads
+// to keep the connection reusable. Past that, e.g. for an abandoned layer
+// download, a new connection is cheaper.
+const maxDrainBytes = 64 << 10
+
+// closeBody closes a response body after draining what's left of it. The
+// transport only puts a connection back in the pool once its response body
+// was read to the end, so closing error responses and other half-read bodies
+// straight away costs a new connection, and TLS handshake, per request.
+func closeBody(body io.ReadCloser) {
+	io.CopyN(io.Discard, body, maxDrainBytes)
+	body.Close()
+}
+
+func repositoryScope(repository, actions string) string {
+	if actions == "" {
+		actions = defaultScopeActions
+	}
+	return fmt.Sprintf("repository:%s:%s", repository, actions)
+}
+
+// fetchToken requests a bearer token for scope from the token server at
+// realm, reusing a cached token when one is still valid. With credentials
+// in the environment, the token is for their user rather than anonymous.
+func fetchToken(realm, service, scope string) (DockerTokenResponse, error) {
+	var token DockerTokenResponse
+	creds, hasCreds, err := currentCredentials()
+	if err != nil {
+		return token, err
+	}
+	// A token is only good for the registry and token server it came from:
+	// the service may be empty, or the same for several registries. A
+	// user's tokens may have access an anonymous one doesn't, or the other
+	// way around, so they are cached apart too.
+	cacheKey := registryBase() + " " + realm + " " + service
+	if hasCreds {
+		cacheKey = creds.Username + "@" + cacheKey
+	}
+	if cached, ok := registryTokens.get(cacheKey, scope); ok {
+		return cached, nil
+	}
+	u, err := url.Parse(realm)
+	if err != nil {
+		return token, fmt.Errorf("invalid token realm %q: %w", realm, err)
+	}
+	q := u.Query()
+	if service != "" {
+		q.Set("service", service)
+	}
+	q.Set("scope", scope)
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return token, err
+	}
+	if hasCreds {
+		req.SetBasicAuth(creds.Username, creds.Password)
+	}
+	res, err := registryClient.Do(req)
+	if err != nil {
+		return token, err
+	}
+	defer closeBody(res.Body)
+	if hasCreds && res.StatusCode == http.StatusUnauthorized {
+		return token, fmt.Errorf("fetching token for %s: the credentials of user %s from %s were rejected", scope, creds.Username, creds.Source)
+	}
+	if res.StatusCode != http.StatusOK {
+		return token, fmt.Errorf("fetching token for %s: unexpected status %s", scope, res.Status)
+	}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return token, err
+	}
+	registryTokens.put(cacheKey, scope, token)
+	return token, nil
+}
+
+// bearer returns the token to send, which registries may return under either
+// name.
+func (t DockerTokenResponse) bearer() string {
+	if t.Token != "" {
+		return t.Token
+	}
+	return t.AccessToken
+}
+
+// registryAuth holds the bearer token used for one repository's requests. If
+// the registry rejects it with a challenge for a different scope, the token
+// is swapped for one with the challenged scope.
+type registryAuth struct {
+	mu    sync.Mutex
+	token string
+	scope string
+}
+
+// newRegistryAuth gets a token for repository from where the registry's
+// challenge to GET /v2/ points. Registries that don't challenge it need
+// none.
+func newRegistryAuth(repository, actions string) (*registryAuth, error) {
+	scope := repositoryScope(repository, actions)
+	ping, err := pingRegistry(registryBase())
+	if err != nil {
+		return nil, err
+	}
+	switch ping.Challenge.Scheme {
+	case "":
+		return &registryAuth{scope: scope}, nil
+	case "bearer":
+	default:
+		return nil, fmt.Errorf("registry %s asks for %s authentication, which is not supported", registryBase(), ping.Challenge.Scheme)
+	}
+	realm, service := ping.Challenge.Params["realm"], ping.Challenge.Params["service"]
+	if realm == "" {
+		realm, service = dockerHubAuthRealm, dockerHubService
+	}
+	token, err := fetchToken(realm, service, scope)
+	if err != nil {
+		return nil, err
+	}
+	return &registryAuth{token: token.bearer(), scope: scope}, nil
+}
+
+// registryPing is what a registry's answer to GET /v2/ tells about it.
+type registryPing struct {
+	// APIVersion is the Docker-Distribution-Api-Version header, e.g.
+	// "registry/2.0", if the registry sent one.
+	APIVersion string
+	// Challenge is how the registry asks for credentials. Its Scheme is
+	// empty if the registry answered without asking for any.
+	Challenge authChallenge
+}
+
+// registryPings keeps each registry's ping for the rest of the process.
+var registryPings = struct {
+	sync.Mutex
+	byBase map[string]registryPing
+}{byBase: map[string]registryPing{}}
+
+// pingRegistry checks that base, e.g. https://registry-1.docker.io, serves
+// the registry v2 API before anything else is asked of it, since an endpoint
+// that doesn't would fail later with confusing errors about tokens or
+// manifests. A 401 counts: it is how registries that want a token answer,
+// and its challenge says where to get one.
+func pingRegistry(base string) (registryPing, error) {
+	registryPings.Lock()
+	defer registryPings.Unlock()
+	if ping, ok := registryPings.byBase[base]; ok {
+		return ping, nil
+	}
+	res, err := registryClient.Get(base + "/v2/")
+	if err != nil {
+		return registryPing{}, fmt.Errorf("checking registry %s: %w", base, err)
+	}
+	defer closeBody(res.Body)
+	ping := registryPing{APIVersion: res.Header.Get("Docker-Distribution-Api-Version")}
+	notV2 := fmt.Errorf("%s is not a v2 registry: GET /v2/ returned %s", base, res.Status)
+	switch res.StatusCode {
+	case http.StatusOK:
+		// The spec only asks for a JSON body; a web server answering
+		// anything with a page doesn't send one.
+		var body map[string]interface{}
+		if ping.APIVersion == "" && json.NewDecoder(io.LimitReader(res.Body, maxDrainBytes)).Decode(&body) != nil {
+			return ping, fmt.Errorf("%w without the registry API version header", notV2)
+		}
+	case http.StatusUnauthorized:
+		ping.Challenge = parseAuthChallenge(res.Header.Get("WWW-Authenticate"))
+		if ping.APIVersion == "" && ping.Challenge.Scheme != "bearer" {
+			return ping, notV2
+		}
+	default:
+		return ping, notV2
+	}
+	if ping.APIVersion != "" && !strings.HasPrefix(ping.APIVersion, "registry/2.") {
+		return ping, fmt.Errorf("%s speaks registry API %s; only registry/2.0 is supported", base, ping.APIVersion)
+	}
+	registryPings.byBase[base] = ping
+	return ping, nil
+}
+
+func (a *registryAuth) current() (token, scope string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.token, a.scope
+}
+
+// do sends req with the bearer token, if there is one. On a 401 whose
+// challenge asks for a different scope than the one we hold, it fetches a
+// token for that scope and retries once. req must not have a body.
+func (a *registryAuth) do(client *http.Client, req *http.Request) (*http.Response, error) {
+	token, scope := a.current()
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := client.Do(req)
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+	challenge := parseAuthChallenge(res.Header.Get("WWW-Authenticate"))
+	if challenge.Scheme != "bearer" || challenge.Params["scope"] == "" || challenge.Params["scope"] == scope {
+		return res, nil
+	}
+	closeBody(res.Body)
+
+	realm := challenge.Params["realm"]
+	if realm == "" {
+		realm = dockerHubAuthRealm
+	}
+	rescoped, err := fetchToken(realm, challenge.Params["service"], challenge.Params["scope"])
+	if err != nil {
+		return nil, fmt.Errorf("re-scoping token to %q: %w", challenge.Params["scope"], err)
+	}
+	a.mu.Lock()
+	a.token, a.scope = rescoped.bearer(), challenge.Params["scope"]
+	a.mu.Unlock()
+
+	retry := req.Clone(req.Context())
+	retry.Header.Set("Authorization", "Bearer "+rescoped.bearer())
+	return client.Do(retry)
+}
+
+type authChallenge struct {
+	Scheme string
+	Params map[string]string
+}
+
+// parseAuthChallenge parses a WWW-Authenticate header such as
+//
+//	Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/ubuntu:pull"
+//
+// Quoted values may contain commas, as multi-action scopes do.
+func parseAuthChallenge(header string) authChallenge {
+	challenge := authChallenge{Params: map[string]string{}}
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	challenge.Scheme = strings.ToLower(scheme)
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ,")
+		key, after, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		var value string
+		if strings.HasPrefix(after, `"`) {
+			end := strings.Index(after[1:], `"`)
+			if end < 0 {
+				value, rest = after[1:], ""
+			} else {
+				value, rest = after[1:end+1], after[end+2:]
+			}
+		} else {
+			value, rest, _ = strings.Cut(after, ",")
+		}
+		challenge.Params[key] = value
+	}
+	return challenge
+}
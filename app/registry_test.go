@@ -0,0 +1,428 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useTestTokens gives the test a token cache of its own, persisted to path
+// unless that is empty.
+func useTestTokens(t *testing.T, path string) {
+	t.Helper()
+	saved := registryTokens
+	registryTokens = &tokenCache{path: path}
+	t.Cleanup(func() { registryTokens = saved })
+}
+
+// tokenRegistry is a registry that challenges for bearer tokens, which its
+// own /token endpoint hands out for any scope, lasting expiresIn seconds.
+// Requests for anything else go to the serve function newTokenRegistry is
+// given, if any.
+type tokenRegistry struct {
+	*httptest.Server
+	expiresIn int
+
+	mu sync.Mutex
+	// scopes are those tokens were requested for, in order.
+	scopes []string
+}
+
+func newTokenRegistry(t *testing.T, expiresIn int, serve http.HandlerFunc) *tokenRegistry {
+	r := &tokenRegistry{expiresIn: expiresIn}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/v2/":
+			w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+r.URL+`/token",service="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		case "/token":
+			scope := req.URL.Query().Get("scope")
+			r.mu.Lock()
+			r.scopes = append(r.scopes, scope)
+			r.mu.Unlock()
+			json.NewEncoder(w).Encode(DockerTokenResponse{Token: "token for " + scope, ExpiresIn: r.expiresIn})
+		default:
+			if serve == nil {
+				http.NotFound(w, req)
+				return
+			}
+			serve(w, req)
+		}
+	}))
+	t.Cleanup(r.Close)
+	useTestRegistry(t, r.Server)
+	return r
+}
+
+func (r *tokenRegistry) tokenRequests() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.scopes...)
+}
+
+func TestRegistryAuthReusesTokens(t *testing.T) {
+	tests := []struct {
+		name      string
+		expiresIn int
+		// pulls are the repositories pulled one after another.
+		pulls []string
+		// want is the number of tokens fetched.
+		want int
+	}{
+		{name: "same repository", expiresIn: 300, pulls: []string{"library/a", "library/a", "library/a"}, want: 1},
+		{name: "other repository", expiresIn: 300, pulls: []string{"library/a", "library/b", "library/a"}, want: 2},
+		// Within tokenExpiryMargin of expiring, a token isn't used.
+		{name: "expiring", expiresIn: 2, pulls: []string{"library/a", "library/a"}, want: 2},
+		{name: "default lifetime", pulls: []string{"library/a", "library/a"}, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestTokens(t, "")
+			srv := newTokenRegistry(t, tt.expiresIn, nil)
+			for _, repository := range tt.pulls {
+				auth, err := newRegistryAuth(repository, "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if token, scope := auth.current(); token != "token for "+scope || scope != repositoryScope(repository, "") {
+					t.Errorf("pull of %s got %q for %q", repository, token, scope)
+				}
+			}
+			if got := srv.tokenRequests(); len(got) != tt.want {
+				t.Errorf("tokens fetched for %q, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenCacheFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	useTestTokens(t, path)
+	srv := newTokenRegistry(t, 300, nil)
+	if _, err := newRegistryAuth("library/a", ""); err != nil {
+		t.Fatal(err)
+	}
+	// Another invocation reads the cache from the file.
+	useTestTokens(t, path)
+	auth, err := newRegistryAuth("library/a", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token, _ := auth.current(); token != "token for repository:library/a:pull" {
+		t.Errorf("token %q", token)
+	}
+	if got := srv.tokenRequests(); len(got) != 1 {
+		t.Errorf("tokens fetched for %q, want the first invocation's only", got)
+	}
+}
+
+func TestRegistryAuthRescopes(t *testing.T) {
+	const pullPush = "repository:library/test:pull,push"
+	tests := []struct {
+		name string
+		// challenge is the scope rejected requests are challenged for.
+		challenge  string
+		wantStatus int
+		wantScopes []string
+	}{
+		{name: "broader scope", challenge: pullPush, wantStatus: http.StatusOK, wantScopes: []string{"repository:library/test:pull", pullPush}},
+		// A challenge for what the token is already for isn't retried.
+		{name: "same scope", challenge: "repository:library/test:pull", wantStatus: http.StatusUnauthorized, wantScopes: []string{"repository:library/test:pull"}},
+		{name: "no scope", wantStatus: http.StatusUnauthorized, wantScopes: []string{"repository:library/test:pull"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestTokens(t, "")
+			manifests := 0
+			var srv *tokenRegistry
+			srv = newTokenRegistry(t, 300, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v2/library/test/manifests/latest" {
+					http.NotFound(w, r)
+					return
+				}
+				manifests++
+				if r.Header.Get("Authorization") != "Bearer token for "+pullPush {
+					challenge := `Bearer realm="` + srv.URL + `/token",service="test"`
+					if tt.challenge != "" {
+						challenge += `,scope="` + tt.challenge + `"`
+					}
+					w.Header().Set("WWW-Authenticate", challenge)
+					w.WriteHeader(http.StatusUnauthorized)
+				}
+			})
+			auth, err := newRegistryAuth("library/test", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			req, _ := http.NewRequest("GET", srv.URL+"/v2/library/test/manifests/latest", nil)
+			res, err := auth.do(registryClient, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("status %s, want %d", res.Status, tt.wantStatus)
+			}
+			if got := srv.tokenRequests(); !reflect.DeepEqual(got, tt.wantScopes) {
+				t.Errorf("tokens fetched for %q, want %q", got, tt.wantScopes)
+			}
+			if tt.wantStatus == http.StatusOK {
+				if _, scope := auth.current(); scope != pullPush {
+					t.Errorf("scope %q kept, want %q", scope, pullPush)
+				}
+				// Later requests use the re-scoped token straight away.
+				req, _ := http.NewRequest("GET", srv.URL+"/v2/library/test/manifests/latest", nil)
+				if res, err := auth.do(registryClient, req); err != nil || res.StatusCode != http.StatusOK {
+					t.Errorf("second request: %v, %v", res, err)
+				} else {
+					res.Body.Close()
+				}
+				if manifests != 3 {
+					t.Errorf("%d manifest requests, want 3", manifests)
+				}
+			}
+		})
+	}
+}
+
+func TestParseAuthChallenge(t *testing.T) {
+	tests := []struct {
+		header string
+		want   authChallenge
+	}{
+		{
+			header: `Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/ubuntu:pull"`,
+			want:   authChallenge{Scheme: "bearer", Params: map[string]string{"realm": "https://auth.docker.io/token", "service": "registry.docker.io", "scope": "repository:library/ubuntu:pull"}},
+		},
+		{
+			header: `Bearer realm="https://r/token", scope="repository:a:pull,push"`,
+			want:   authChallenge{Scheme: "bearer", Params: map[string]string{"realm": "https://r/token", "scope": "repository:a:pull,push"}},
+		},
+		{
+			header: `Basic realm=Registry`,
+			want:   authChallenge{Scheme: "basic", Params: map[string]string{"realm": "Registry"}},
+		},
+		{header: "", want: authChallenge{Params: map[string]string{}}},
+		{
+			header: `Bearer realm="unterminated`,
+			want:   authChallenge{Scheme: "bearer", Params: map[string]string{"realm": "unterminated"}},
+		},
+	}
+	for _, tt := range tests {
+		if got := parseAuthChallenge(tt.header); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseAuthChallenge(%q) = %+v, want %+v", tt.header, got, tt.want)
+		}
+	}
+}
+
+// slowBody answers with status and a body that stalls halfway for longer
+// than net/http's own draining of closed bodies waits.
+func slowBody(status int) http.HandlerFunc {
+	page := strings.Repeat("<p>not here</p>\n", 512)
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(page)))
+		w.WriteHeader(status)
+		io.WriteString(w, page[:len(page)/2])
+		w.(http.Flusher).Flush()
+		time.Sleep(100 * time.Millisecond)
+		io.WriteString(w, page[len(page)/2:])
+	}
+}
+
+func TestRegistryReusesConnections(t *testing.T) {
+	digest := sha256Digest([]byte("blob"))
+	tests := []struct {
+		name string
+		// serve answers every request but the ping.
+		serve http.HandlerFunc
+		// request is made, and expected to fail, a few times over.
+		request func(src *registrySource) error
+	}{
+		{
+			name:    "manifest not found",
+			serve:   slowBody(http.StatusNotFound),
+			request: func(src *registrySource) error { _, _, err := src.Manifest("latest"); return err },
+		},
+		{
+			name:    "manifest formats refused",
+			serve:   slowBody(http.StatusNotAcceptable),
+			request: func(src *registrySource) error { _, _, err := src.Manifest("latest"); return err },
+		},
+		{
+			name:    "blob not found",
+			serve:   slowBody(http.StatusNotFound),
+			request: func(src *registrySource) error { _, err := src.Blob(digest); return err },
+		},
+		{
+			name:  "ranges unsupported",
+			serve: slowBody(http.StatusOK),
+			request: func(src *registrySource) error {
+				_, err := src.BlobRange(digest, 0, 10)
+				return err
+			},
+		},
+		{
+			name:    "blob size",
+			serve:   slowBody(http.StatusNotFound),
+			request: func(src *registrySource) error { _, err := src.BlobSize(digest); return err },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			conns := 0
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/v2/" {
+					w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
+					return
+				}
+				tt.serve(w, r)
+			}))
+			srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					mu.Lock()
+					conns++
+					mu.Unlock()
+				}
+			}
+			srv.Start()
+			defer srv.Close()
+			useTestRegistry(t, srv)
+			src := &registrySource{repository: "library/test", auth: &registryAuth{}}
+			for i := 0; i < 3; i++ {
+				if err := tt.request(src); err == nil {
+					t.Fatal("expected an error")
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if conns != 1 {
+				t.Errorf("%d connections, want the first reused for every request", conns)
+			}
+		})
+	}
+}
+
+func TestPingRegistry(t *testing.T) {
+	tests := []struct {
+		name    string
+		serve   http.HandlerFunc
+		want    registryPing
+		wantErr string
+	}{
+		{
+			name: "v2",
+			serve: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
+				w.Write([]byte("{}"))
+			},
+			want: registryPing{APIVersion: "registry/2.0"},
+		},
+		{
+			name:  "v2 without the header",
+			serve: func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("{}")) },
+		},
+		{
+			name: "token challenge",
+			serve: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="https://auth.example.com/token",service="registry.example.com"`)
+				w.WriteHeader(http.StatusUnauthorized)
+			},
+			want: registryPing{Challenge: authChallenge{Scheme: "bearer", Params: map[string]string{"realm": "https://auth.example.com/token", "service": "registry.example.com"}}},
+		},
+		{
+			name: "web page",
+			serve: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				w.Write([]byte("<html>welcome</html>"))
+			},
+			wantErr: "is not a v2 registry: GET /v2/ returned 200 OK without the registry API version header",
+		},
+		{
+			name:    "not found",
+			serve:   http.NotFound,
+			wantErr: "is not a v2 registry: GET /v2/ returned 404 Not Found",
+		},
+		{
+			name: "basic auth",
+			serve: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="files"`)
+				w.WriteHeader(http.StatusUnauthorized)
+			},
+			wantErr: "is not a v2 registry: GET /v2/ returned 401 Unauthorized",
+		},
+		{
+			name: "other API version",
+			serve: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Docker-Distribution-Api-Version", "registry/3.0")
+			},
+			wantErr: "speaks registry API registry/3.0; only registry/2.0 is supported",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if r.URL.Path != "/v2/" {
+					t.Errorf("requested %s", r.URL.Path)
+				}
+				tt.serve(w, r)
+			}))
+			defer srv.Close()
+			for i := 0; i < 2; i++ {
+				got, err := pingRegistry(srv.URL)
+				if tt.wantErr != "" {
+					if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+						t.Fatalf("pingRegistry = %v, want an error saying %q", err, tt.wantErr)
+					}
+					continue
+				}
+				if err != nil || !reflect.DeepEqual(got, tt.want) {
+					t.Fatalf("pingRegistry = %+v, %v, want %+v", got, err, tt.want)
+				}
+			}
+			// A registry is pinged once; an endpoint that isn't one is
+			// asked again.
+			if want := map[bool]int{true: 1, false: 2}[tt.wantErr == ""]; requests != want {
+				t.Errorf("%d requests, want %d", requests, want)
+			}
+		})
+	}
+
+	// Nothing listening.
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	if _, err := pingRegistry(srv.URL); err == nil || !strings.Contains(err.Error(), "checking registry") {
+		t.Errorf("pingRegistry of a closed port = %v", err)
+	}
+}
+
+// TestPullFromNonRegistry checks that a pull from an endpoint that isn't a
+// v2 registry fails before asking it for anything else.
+func TestPullFromNonRegistry(t *testing.T) {
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Write([]byte("<html>welcome</html>"))
+	}))
+	defer srv.Close()
+	useTestRegistry(t, srv)
+	_, err := pullDockerImage(t.TempDir(), "app", pullOptions{})
+	if err == nil || !strings.Contains(err.Error(), "is not a v2 registry") {
+		t.Fatalf("pull: %v, want it to fail on the ping", err)
+	}
+	if !reflect.DeepEqual(paths, []string{"/v2/"}) {
+		t.Errorf("requested %q, want only /v2/", paths)
+	}
+}
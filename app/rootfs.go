@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// readyMarkerSuffix names the marker written next to a rootfs once it has
+// been fully populated.
+const readyMarkerSuffix = ".ready"
+
+// prepareRootfs populates a rootfs at parent/rootfs atomically: populate
+// works in a staging directory, which only becomes the rootfs and gets its
+// ready marker once populate succeeded. A failed or interrupted extraction
+// never leaves something that looks like a usable rootfs behind.
+func prepareRootfs(parent string, populate func(staging string) error) (string, error) {
+	staging := filepath.Join(parent, "rootfs.staging")
+	rootfs := filepath.Join(parent, "rootfs")
+	if err := os.MkdirAll(staging, 0o755); err != nil {
+		return "", err
+	}
+	if err := populate(staging); err != nil {
+		os.RemoveAll(staging)
+		return "", err
+	}
+	if err := os.Rename(staging, rootfs); err != nil {
+		os.RemoveAll(staging)
+		os.Remove(staging + ownershipSuffix)
+		return "", err
+	}
+	if err := os.Rename(staging+ownershipSuffix, rootfs+ownershipSuffix); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	f, err := os.Create(rootfs + readyMarkerSuffix)
+	if err != nil {
+		return "", err
+	}
+	return rootfs, f.Close()
+}
+
+// checkRootfsReady refuses rootfs directories that weren't completed by
+// prepareRootfs.
+func checkRootfsReady(rootfs string) error {
+	if _, err := os.Stat(rootfs + readyMarkerSuffix); err != nil {
+		return fmt.Errorf("rootfs %s is incomplete: extraction did not finish", rootfs)
+	}
+	return nil
+}
+
+// populateRootfsDir populates the caller's directory dir as a rootfs, for
+// --rootfs-dir. dir is created if it doesn't exist; one that isn't empty is
+// only emptied and reused with force. If populate fails, dir is emptied
+// again, or removed if it was created, rather than left half-populated.
+func populateRootfsDir(dir string, force bool, populate func(dir string) error) error {
+	created := false
+	entries, err := os.ReadDir(dir)
+	switch {
+	case os.IsNotExist(err):
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+		created = true
+	case err != nil:
+		return err
+	case len(entries) > 0 && !force:
+		return fmt.Errorf("%s is not empty; use --force to replace its contents", dir)
+	case len(entries) > 0:
+		if err := emptyDir(dir); err != nil {
+			return err
+		}
+	}
+	// A rootfs of a previous pull may have left its ownership file.
+	os.Remove(dir + ownershipSuffix)
+	if err := populate(dir); err != nil {
+		if created {
+			os.RemoveAll(dir)
+		} else {
+			emptyDir(dir)
+		}
+		return err
+	}
+	return nil
+}
+
+// rootfsDirPath cleans up a --rootfs-dir path. The host's root directory is
+// refused outright: --force would wipe it.
+func rootfsDirPath(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	if abs == filepath.Dir(abs) {
+		return "", fmt.Errorf("refusing to use %s as a rootfs directory", abs)
+	}
+	return abs, nil
+}
+
+func emptyDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
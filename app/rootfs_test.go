@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPrepareRootfs(t *testing.T) {
+	tests := []struct {
+		name     string
+		populate func(staging string) error
+		wantErr  bool
+	}{
+		{
+			name: "populated",
+			populate: func(staging string) error {
+				return os.WriteFile(filepath.Join(staging, "f"), []byte("f"), 0o644)
+			},
+		},
+		{
+			name: "fails midway",
+			populate: func(staging string) error {
+				if err := os.WriteFile(filepath.Join(staging, "f"), []byte("f"), 0o644); err != nil {
+					return err
+				}
+				return errors.New("layer 2 is corrupt")
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := t.TempDir()
+			rootfs, err := prepareRootfs(parent, tt.populate)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				// Nothing that could pass for a rootfs is left.
+				if entries, _ := os.ReadDir(parent); len(entries) > 0 {
+					t.Errorf("left %s behind", entries[0].Name())
+				}
+				if err := checkRootfsReady(filepath.Join(parent, "rootfs")); err == nil {
+					t.Error("the failed rootfs counts as ready")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := checkRootfsReady(rootfs); err != nil {
+				t.Error(err)
+			}
+			wantTree(t, rootfs, map[string]string{"f": "f"})
+			if _, err := os.Stat(filepath.Join(parent, "rootfs.staging")); !os.IsNotExist(err) {
+				t.Errorf("staging directory left behind: %v", err)
+			}
+		})
+	}
+}
+
+func TestPrepareRootfsCorruptLayer(t *testing.T) {
+	layout := filepath.Join(t.TempDir(), "layout")
+	second := testLayer(t, testEntry{name: "g", body: "second"})
+	writeTestImage(t, layout, "latest", testLayer(t, testEntry{name: "f", body: "first"}), second)
+	// Cut the second layer short, after the first is extracted.
+	blob, err := ociBlobPath(layout, sha256Digest(gzipLayer(t, second)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(blob, data[:len(data)/2], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	parent := t.TempDir()
+	_, err = prepareRootfs(parent, func(staging string) error {
+		_, err := pullFromSource(staging, ociLayoutSource{dir: layout}, "latest", pullOptions{})
+		return err
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if entries, _ := os.ReadDir(parent); len(entries) > 0 {
+		t.Errorf("left %s behind", entries[0].Name())
+	}
+}
+
+func TestPopulateRootfsDir(t *testing.T) {
+	populate := func(dir string) error {
+		return os.WriteFile(filepath.Join(dir, "f"), []byte("new"), 0o644)
+	}
+	failing := func(dir string) error {
+		if err := populate(dir); err != nil {
+			return err
+		}
+		return errors.New("layer 2 is corrupt")
+	}
+	tests := []struct {
+		name     string
+		existing map[string]string // nil for no directory at all
+		force    bool
+		populate func(dir string) error
+		wantErr  bool
+		want     map[string]string
+	}{
+		{name: "missing", populate: populate, want: map[string]string{"f": "new"}},
+		{name: "empty", existing: map[string]string{}, populate: populate, want: map[string]string{"f": "new"}},
+		{
+			name:     "not empty",
+			existing: map[string]string{"old": "old"},
+			populate: populate,
+			wantErr:  true,
+			want:     map[string]string{"old": "old", "f": ""},
+		},
+		{
+			name:     "not empty with --force",
+			existing: map[string]string{"old": "old", "sub/old": "old"},
+			force:    true,
+			populate: populate,
+			want:     map[string]string{"f": "new", "old": "", "sub": ""},
+		},
+		{name: "missing and failing", populate: failing, wantErr: true},
+		{
+			name:     "empty and failing",
+			existing: map[string]string{},
+			populate: failing,
+			wantErr:  true,
+			want:     map[string]string{"f": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "a", "rootfs")
+			if tt.existing != nil {
+				for path, content := range tt.existing {
+					if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0o755); err != nil {
+						t.Fatal(err)
+					}
+					if err := os.WriteFile(filepath.Join(dir, path), []byte(content), 0o644); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := os.MkdirAll(dir, 0o755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := populateRootfsDir(dir, tt.force, tt.populate)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			_, statErr := os.Stat(dir)
+			if tt.existing == nil && tt.wantErr {
+				// A directory it created does not outlive the failure.
+				if !os.IsNotExist(statErr) {
+					t.Errorf("%s left behind: %v", dir, statErr)
+				}
+				return
+			}
+			if statErr != nil {
+				t.Fatal(statErr)
+			}
+			wantTree(t, dir, tt.want)
+		})
+	}
+}
+
+func TestRootfsDirPath(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		dir     string
+		want    string
+		wantErr bool
+	}{
+		{dir: "/srv/rootfs/", want: "/srv/rootfs"},
+		{dir: "rootfs", want: filepath.Join(wd, "rootfs")},
+		{dir: "/", wantErr: true},
+		{dir: "/srv/..", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := rootfsDirPath(tt.dir)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("rootfsDirPath(%q) = %q, want an error", tt.dir, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("rootfsDirPath(%q) = %q, %v, want %q", tt.dir, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,761 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// linuxRuntime runs containers in their own PID and mount namespaces,
+// chrooted into the image's rootfs.
+type linuxRuntime struct{}
+
+func init() {
+	newRuntime = func() Runtime { return linuxRuntime{} }
+}
+
+func (linuxRuntime) Run(argv []string) {
+	runCommand(argv)
+}
+
+func (linuxRuntime) Stop(argv []string) {
+	stopCommand(argv)
+}
+
+func (linuxRuntime) Child() int {
+	return runChild()
+}
+
+func runCommand(argv []string) {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	allocateTTY := flags.Bool("t", false, "allocate a pseudo-TTY")
+	// STDIN is attached unless -a leaves it out; -i and -it are accepted so
+	// that Docker muscle memory keeps working.
+	flags.Bool("i", false, "keep STDIN attached (always on unless -a leaves it out)")
+	flags.BoolVar(allocateTTY, "it", false, "shorthand for -i -t")
+	var attachFlags stringsFlag
+	flags.Var(&attachFlags, "a", "attach `stream`, stdin, stdout or stderr, to ours; the others go to /dev/null (repeatable, default: all three)")
+	flags.Var(&attachFlags, "attach", "same as -a")
+	detach := flags.Bool("detach", false, "run the container in the background and print its ID; its output goes to its logs")
+	flags.BoolVar(detach, "d", false, "shorthand for --detach")
+	autoRemove := flags.Bool("rm", true, "remove the container's filesystem when it exits; with --rm=false it is kept for commit")
+	keepOnError := flags.Bool("keep-on-error", false, "keep the container's filesystem, and print where it is, if the command exits non-zero")
+	workdirFlag := flags.String("workdir", "", "run the command in `dir`, created if it doesn't exist (default: the image's WorkingDir, or /)")
+	flags.StringVar(workdirFlag, "w", "", "shorthand for --workdir")
+	entrypointFlag := flags.String("entrypoint", "", "override the image's Entrypoint with `command`; an empty one clears it")
+	noPIDNamespace := flags.Bool("no-pid-namespace", false, "run without a PID namespace, e.g. where creating one isn't allowed; the container sees the host's processes")
+	pidMode := flags.String("pid", "", "the PID namespace to run in: a new one by default, the `host`'s, or container:<name|id> to share a running container's")
+	noMountNamespace := flags.Bool("no-mount-namespace", false, "run without a mount namespace, e.g. where creating one isn't allowed; no mounts, including /proc, can be made")
+	cgroupns := flags.String("cgroupns", cgroupnsPrivate, "cgroup namespace: `private`, where the container's cgroup is the root, or the host's")
+	noUTSNamespace := flags.Bool("no-uts-namespace", false, "run without a UTS namespace, e.g. where creating one isn't allowed; the container has the host's hostname")
+	netMode := flags.String("net", netModeHost, "the network namespace to run in: `host`'s, bridge for one of its own on the containers' bridge, or container:<name|id> to share a running container's")
+	flags.StringVar(netMode, "network", netModeHost, "same as --net")
+	hostname := flags.String("hostname", "", "the container's `name` as a host, also written to its /etc/hostname (default: the short container ID)")
+	domainname := flags.String("domainname", "", "the container's NIS domain `name`")
+	var dnsServers stringsFlag
+	flags.Var(&dnsServers, "dns", "resolve names with the nameserver at `ip` instead of the host's (repeatable)")
+	noResolvMount := flags.Bool("no-resolv-mount", false, "keep the image's /etc/resolv.conf instead of mounting the host's over it read-only")
+	var networkAliases stringsFlag
+	flags.Var(&networkAliases, "network-alias", "also let other containers reach this one as `name`, through their /etc/hosts (repeatable)")
+	useInit := flags.Bool("init", false, "run an init process as PID 1 that forwards signals and reaps zombies")
+	stopSignalFlag := flags.String("stop-signal", "", "`signal` to stop the container with (default: the image's StopSignal, or SIGTERM)")
+	var envFlags, envFiles stringsFlag
+	flags.Var(&envFlags, "e", "set an environment variable: `key=value`, or key to pass ours on (repeatable)")
+	flags.Var(&envFlags, "env", "same as -e")
+	flags.Var(&envFiles, "env-file", "read environment variables from a `file` of key=value or key lines (repeatable)")
+	var labelFlags, labelFiles stringsFlag
+	flags.Var(&labelFlags, "label", "set a container label: `key=value` (repeatable)")
+	flags.Var(&labelFiles, "label-file", "read container labels from a `file` of key=value lines (repeatable)")
+	var annotationFlags stringsFlag
+	flags.Var(&annotationFlags, "annotation", "record an OCI annotation on the container: `key=value` (repeatable)")
+	cidFile := flags.String("cidfile", "", "write the container ID to `file` while the container runs")
+	name := flags.String("name", "", "assign a `name` to the container; its output is then logged for the logs command")
+	var logOptFlags stringsFlag
+	flags.Var(&logOptFlags, "log-opt", "rotate the container's logs: max-size=`size`, e.g. 10m, and max-file=n, the files kept per stream (repeatable)")
+	var volumes stringsFlag
+	flags.Var(&volumes, "v", "bind mount a host path or named volume: `source:target[:ro]` (repeatable)")
+	var mountFlags, tmpfsFlags stringsFlag
+	flags.Var(&tmpfsFlags, "tmpfs", "mount a tmpfs at `path[:options]`, options being ro, rw, size=<size> and mode=<mode> (repeatable)")
+	readOnly := flags.Bool("read-only", false, "mount the container's root filesystem read-only; mounts on top of it stay writable unless read-only themselves")
+	flags.Var(&mountFlags, "mount", "attach a mount: `type=bind|volume|tmpfs,source=...,target=...[,readonly]` (repeatable)")
+	var ulimitFlags stringsFlag
+	flags.Var(&ulimitFlags, "ulimit", "set a resource limit on the container: `name=soft[:hard]`, e.g. nofile=1024:2048 (repeatable)")
+	var groupAddFlags stringsFlag
+	flags.Var(&groupAddFlags, "group-add", "add the container's process to a supplementary group: a `gid` or a group name from the image's /etc/group (repeatable)")
+	var securityOptFlags stringsFlag
+	flags.Var(&securityOptFlags, "security-opt", "set a security `option`: no-new-privileges[:true|false] (repeatable)")
+	cpusetCPUs := flags.String("cpuset-cpus", "", "pin the container to the `cpus` in a list such as 0-3,8 (requires cgroup v2)")
+	cpus := flags.String("cpus", "", "limit the container to `number` CPUs' worth of time, e.g. 1.5 (requires cgroup v2)")
+	cpuPeriod := flags.Int64("cpu-period", 0, "CPU bandwidth period in `microseconds` (default 100000, requires cgroup v2)")
+	cpuQuota := flags.Int64("cpu-quota", 0, "CPU time in `microseconds` the container may use per period, -1 for no limit (requires cgroup v2)")
+	cpusetMems := flags.String("cpuset-mems", "", "restrict the container to the memory `nodes` in a list such as 0 (requires cgroup v2)")
+	mountsDefault := flags.String("mounts-default", mountsMinimal, "kernel filesystems to mount: `none`, minimal (/proc) or full (/proc, a read-only /sys, /dev with the standard nodes, /dev/pts and /dev/shm)")
+	shmSize := sizeFlag(defaultShmSize)
+	flags.Var(&shmSize, "shm-size", "`size` of the tmpfs mounted at /dev/shm with --mounts-default=full, e.g. 1g")
+	var memoryReservation sizeFlag
+	flags.Var(&memoryReservation, "memory-reservation", "soft memory limit: reclaim spares the container while it uses less than `size`, e.g. 256m (requires cgroup v2)")
+	var deviceFlags stringsFlag
+	flags.Var(&deviceFlags, "device", "add a host device to the container: `host[:container][:rwm]` (repeatable, requires root)")
+	var timingsOutput timingsFlag
+	scopeActions := flags.String("registry-scope", defaultScopeActions, "comma-separated `actions` to request in the registry token scope")
+	var caCerts stringsFlag
+	flags.Var(&caCerts, "ca-cert", "also trust the CA certificates in PEM `file`, or in the .pem/.crt/.cert files of a directory, for registry TLS (repeatable)")
+	timeouts := httpTimeoutFlags(flags)
+	platform := flags.String("platform", targetPlatform.String(), "pick the image for `os/arch[/variant]` from multi-platform images")
+	bufferSize := sizeFlag(defaultBufferSize)
+	flags.Var(&bufferSize, "download-buffer-size", "copy buffer `size` for layer downloads and extraction")
+	var downloadRate sizeFlag
+	flags.Var(&downloadRate, "download-rate", "limit aggregate layer download bandwidth to `rate` bytes per second, e.g. 10m")
+	maxDownloads := flags.Int("max-concurrent-downloads", defaultConcurrentDownloads, "maximum number of layers to download at once")
+	downloadChunks := flags.Int("download-chunks", 1, "download each layer in up to `n` byte ranges at once, where the registry allows it")
+	retries := flags.Int("pull-retries", 0, "attempt a pull that failed up to `n` more times, reusing the layers earlier attempts got")
+	stallTimeout := flags.Duration("stall-timeout", defaultStallTimeout, "retry a layer download that receives nothing for `duration`, resuming where it stopped; 0 never does")
+	maxExtractions := flags.Int("max-concurrent-extractions", defaultConcurrentExtractions, "maximum number of layers to extract at once; above 1, layers are unpacked in parallel and then moved into place in order")
+	var cacheMode cacheModeFlag
+	flags.Var(&cacheMode, "cache-mode", "cache pulled layers as downloaded (`compressed`, saves disk) or unpacked (extracted, saves CPU)")
+	verifyCache := flags.Bool("verify-cache", false, "hash cached layers again even if they were verified since they last changed")
+	var cacheMaxSize sizeFlag
+	flags.Var(&cacheMaxSize, "cache-max-size", "evict the least recently used cached layers to keep the cache under `size`, e.g. 10g; those of running containers are kept")
+	flags.Var(&timingsOutput, "timings", "print a breakdown of pull time; use --timings=json for JSON output")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), runUsage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(argv)
+	if flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	if err := useCACerts(caCerts); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	if err := useHTTPTimeouts(timeouts); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	if err := usePlatform(*platform); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	ready := detachedReadyPipe()
+	if *detach && *allocateTTY {
+		fmt.Fprintf(os.Stderr, "Err: -t can't be combined with --detach\n")
+		os.Exit(1)
+	}
+	if *detach && len(attachFlags) > 0 {
+		fmt.Fprintf(os.Stderr, "Err: -a can't be combined with --detach\n")
+		os.Exit(1)
+	}
+	attach, err := parseAttach(attachFlags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	logOpts, err := parseLogOpts(logOptFlags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	if len(logOptFlags) > 0 && *name == "" && !*detach {
+		fmt.Fprintln(os.Stderr, "Err: --log-opt needs --name or --detach, without which nothing is logged")
+		os.Exit(1)
+	}
+	if *detach && ready == nil {
+		startDetached(argv)
+	}
+	image := flags.Arg(0)
+	userArgs := flags.Args()[1:]
+	var entrypoint *string
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "entrypoint" {
+			entrypoint = entrypointFlag
+		}
+	})
+
+	if *stopSignalFlag != "" {
+		if _, err := parseSignal(*stopSignalFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "Err: --stop-signal: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	userLabels, err := parseLabels(labelFlags, labelFiles)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	userEnv, err := parseUserEnv(envFlags, envFiles)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	annotations, err := parseAnnotations(annotationFlags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+
+	cleanup := &teardownStack{}
+	var container *os.Process
+	stopSignal := syscall.SIGTERM
+	var containerMu sync.Mutex
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range signals {
+			// Once the container runs it decides how to react; we clean
+			// up after it exits. Before that there's nothing to wait for.
+			containerMu.Lock()
+			p, stop := container, stopSignal
+			containerMu.Unlock()
+			if p != nil {
+				// SIGTERM is how supervisors ask us to stop, so it's
+				// translated into the container's stop signal.
+				if sig == syscall.SIGTERM {
+					sig = stop
+				}
+				p.Signal(sig)
+				continue
+			}
+			cleanup.exit(128 + int(sig.(syscall.Signal)))
+		}
+	}()
+
+	containerID, err := generateContainerID()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err generating container ID: %v\n", err)
+		cleanup.exit(1)
+	}
+	if *name != "" && !validContainerName(*name) {
+		fmt.Fprintf(os.Stderr, "Err: invalid container name %q: must match %s\n", *name, containerNamePattern)
+		cleanup.exit(1)
+	}
+	state := containerState{ID: containerID, Name: *name, Annotations: annotations, NetworkAliases: networkAliases}
+	lock, err := claimContainer(state.key())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		cleanup.exit(1)
+	}
+	cleanup.push("container lock", lock.Close)
+	cleanup.push("container state", func() error { return removeContainerState(state) })
+
+	var stdout, stderr io.Writer
+	if attach.stdout {
+		stdout = os.Stdout
+	}
+	if attach.stderr {
+		stderr = os.Stderr
+	}
+	if *name != "" || *detach {
+		stdoutLog, stderrLog, err := createContainerLogs(state.key(), logOpts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Err opening container logs: %v\n", err)
+			cleanup.exit(1)
+		}
+		cleanup.push("container logs", func() error {
+			stdoutLog.Close()
+			return stderrLog.Close()
+		})
+		// The output still goes to our own stdio too, so it is shown live,
+		// unless nobody is watching.
+		stdout, stderr = teeToLog(stdout, stdoutLog), teeToLog(stderr, stderrLog)
+		if *detach {
+			stdout, stderr = stdoutLog, stderrLog
+		}
+	}
+
+	var mounts []mountSpec
+	for _, v := range volumes {
+		m, err := parseVolumeFlag(v)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+			cleanup.exit(1)
+		}
+		mounts = append(mounts, m)
+	}
+	for _, v := range mountFlags {
+		m, err := parseMountFlag(v)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+			cleanup.exit(1)
+		}
+		mounts = append(mounts, m)
+	}
+	for _, v := range tmpfsFlags {
+		m, err := parseTmpfsFlag(v)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+			cleanup.exit(1)
+		}
+		mounts = append(mounts, m)
+	}
+	if *pidMode == pidModeHost {
+		*noPIDNamespace = true
+	} else if *pidMode != "" && *noPIDNamespace {
+		fmt.Fprintf(os.Stderr, "Err: --pid %s can't be used with --no-pid-namespace\n", *pidMode)
+		cleanup.exit(1)
+	}
+	pidNamespace, err := openPIDNamespace(*pidMode)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		cleanup.exit(1)
+	}
+	if pidNamespace != nil {
+		cleanup.push("PID namespace", pidNamespace.Close)
+	}
+	if *noPIDNamespace {
+		fmt.Fprintln(os.Stderr, "Warning: running without a PID namespace; the container can see and signal the host's processes")
+	}
+	if *noMountNamespace && len(mounts) > 0 {
+		fmt.Fprintln(os.Stderr, "Err: mounts need a mount namespace, so they can't be used with --no-mount-namespace")
+		cleanup.exit(1)
+	}
+	if *noMountNamespace && *readOnly {
+		fmt.Fprintln(os.Stderr, "Err: --read-only needs a mount namespace, so it can't be used with --no-mount-namespace")
+		cleanup.exit(1)
+	}
+	if *noUTSNamespace && (*hostname != "" || *domainname != "") {
+		fmt.Fprintln(os.Stderr, "Err: --hostname and --domainname need a UTS namespace, so they can't be used with --no-uts-namespace")
+		cleanup.exit(1)
+	}
+	if *cgroupns != cgroupnsPrivate && *cgroupns != cgroupnsHost {
+		fmt.Fprintf(os.Stderr, "Err: --cgroupns %q: must be %s or %s\n", *cgroupns, cgroupnsPrivate, cgroupnsHost)
+		cleanup.exit(1)
+	}
+	netNamespace, ipAddress, err := openNetNamespace(*netMode, state)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		cleanup.exit(1)
+	}
+	if netNamespace != nil {
+		cleanup.push("network namespace", netNamespace.Close)
+	}
+	state.IPAddress = ipAddress
+	if *netMode == netModeBridge {
+		// The bridge's nameserver answers as long as any container on it
+		// runs; another's may already serve it, so failing to is no reason
+		// not to run, and /etc/hosts names the containers anyway.
+		if dns, err := serveBridgeDNS(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: serving DNS on the bridge: %v\n", err)
+		} else {
+			cleanup.push("DNS server", dns.Close)
+		}
+	}
+	if !*noUTSNamespace && *hostname == "" {
+		// Like Docker's.
+		*hostname = containerID[:12]
+	}
+	for name, value := range map[string]string{"hostname": *hostname, "domainname": *domainname} {
+		if value == "" {
+			continue
+		}
+		if err := validateHostname(name, value); err != nil {
+			fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+			cleanup.exit(1)
+		}
+	}
+	if *noResolvMount && len(dnsServers) > 0 {
+		fmt.Fprintln(os.Stderr, "Err: --dns replaces the image's /etc/resolv.conf, so it can't be used with --no-resolv-mount")
+		cleanup.exit(1)
+	}
+	if err := validateNetworkAliases(networkAliases); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		cleanup.exit(1)
+	}
+	if err := validateDNSServers(dnsServers); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		cleanup.exit(1)
+	}
+	explicit := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	if *noMountNamespace {
+		if explicit["mounts-default"] && *mountsDefault != mountsNone {
+			fmt.Fprintln(os.Stderr, "Err: --mounts-default needs a mount namespace, so only none can be used with --no-mount-namespace")
+			cleanup.exit(1)
+		}
+		*mountsDefault = mountsNone
+	}
+	if explicit["shm-size"] && *mountsDefault != mountsFull {
+		fmt.Fprintln(os.Stderr, "Err: --shm-size sizes the /dev/shm that only --mounts-default=full mounts")
+		cleanup.exit(1)
+	}
+	defaults, err := defaultMounts(*mountsDefault, int64(shmSize), mounts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		cleanup.exit(1)
+	}
+	mounts = append(defaults, mounts...)
+	for i, m := range mounts {
+		if m.Type == mountTypeVolume {
+			// The lock is held until teardown, marking the volume as in use.
+			dir, lock, err := acquireVolume(m.Source)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Err on volume %s: %v\n", m.Source, err)
+				cleanup.exit(1)
+			}
+			cleanup.push("volume lock "+m.Source, lock.Close)
+			mounts[i].Type, mounts[i].Source = mountTypeBind, dir
+		}
+	}
+
+	var devices []deviceSpec
+	if len(deviceFlags) > 0 && os.Geteuid() != 0 {
+		fmt.Fprintf(os.Stderr, "Err: --device requires root privileges\n")
+		cleanup.exit(1)
+	}
+	for _, value := range deviceFlags {
+		d, err := parseDeviceFlag(value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+			cleanup.exit(1)
+		}
+		devices = append(devices, d)
+	}
+
+	var security securityOpts
+	for _, value := range securityOptFlags {
+		if err := parseSecurityOpt(&security, value); err != nil {
+			fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+			cleanup.exit(1)
+		}
+	}
+
+	var cgroupSettings []cgroupSetting
+	if *cpusetCPUs != "" {
+		if err := validateCpuset("cpuset-cpus", *cpusetCPUs, onlineCPUsPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+			cleanup.exit(1)
+		}
+		cgroupSettings = append(cgroupSettings, cgroupSetting{"cpuset.cpus", *cpusetCPUs})
+	}
+	if *cpusetMems != "" {
+		if err := validateCpuset("cpuset-mems", *cpusetMems, onlineNodesPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+			cleanup.exit(1)
+		}
+		cgroupSettings = append(cgroupSettings, cgroupSetting{"cpuset.mems", *cpusetMems})
+	}
+	if limit, err := cpuMax(*cpus, *cpuPeriod, *cpuQuota, runtime.NumCPU()); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		cleanup.exit(1)
+	} else if limit != "" {
+		cgroupSettings = append(cgroupSettings, cgroupSetting{"cpu.max", limit})
+	}
+	if memoryReservation > 0 {
+		// Like Docker on cgroup v2, the reservation is memory.low: best-effort
+		// protection from reclaim below it, never a cap. memory.high would
+		// throttle the container above it instead.
+		cgroupSettings = append(cgroupSettings, cgroupSetting{"memory.low", strconv.FormatInt(int64(memoryReservation), 10)})
+	}
+
+	var ulimits []ulimitSpec
+	for _, value := range ulimitFlags {
+		u, err := parseUlimitFlag(value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+			cleanup.exit(1)
+		}
+		ulimits = append(ulimits, u)
+	}
+
+	// A kept rootfs lives in the container's directory, next to its state.
+	sandboxDir := containerDir(state.key())
+	keepSandbox := false
+	if *autoRemove {
+		if sandboxDir, err = os.MkdirTemp("", "chroot"); err != nil {
+			fmt.Fprintf(os.Stderr, "Err MkdirTemp: %v\n", err)
+			cleanup.exit(1)
+		}
+		cleanup.push("sandbox "+sandboxDir, func() error {
+			if keepSandbox {
+				return nil
+			}
+			return os.RemoveAll(sandboxDir)
+		})
+	} else if _, err := os.Lstat(filepath.Join(sandboxDir, "rootfs")); err == nil {
+		fmt.Fprintf(os.Stderr, "Err: container %s already has a kept filesystem in %s\n", state.key(), sandboxDir)
+		cleanup.exit(1)
+	}
+
+	var timings *pullTimings
+	if timingsOutput.format != "" {
+		timings = &pullTimings{}
+	}
+	var limiter *rateLimiter
+	if downloadRate > 0 {
+		limiter = newRateLimiter(int64(downloadRate))
+	}
+	var imageMeta imageMetadata
+	rootfs, err := prepareRootfs(sandboxDir, func(staging string) error {
+		var err error
+		imageMeta, err = pullDockerImage(staging, image, pullOptions{
+			Timings:                  timings,
+			BufferSize:               int(bufferSize),
+			ScopeActions:             *scopeActions,
+			RateLimit:                limiter,
+			StallTimeout:             *stallTimeout,
+			Retries:                  *retries,
+			DownloadChunks:           *downloadChunks,
+			Cache:                    newLayerCache(string(cacheMode), int64(cacheMaxSize), *verifyCache),
+			MaxConcurrentDownloads:   *maxDownloads,
+			MaxConcurrentExtractions: *maxExtractions,
+			Progress:                 stderrProgress(true),
+		})
+		return err
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err on pulling image: %v\n", err)
+		cleanup.exit(1)
+	}
+	if !*autoRemove {
+		// Only a container that actually ran is worth keeping.
+		cleanup.push("rootfs "+rootfs, func() error {
+			if state.Rootfs != "" {
+				return nil
+			}
+			os.Remove(rootfs + readyMarkerSuffix)
+			os.Remove(rootfs + ownershipSuffix)
+			os.Remove(rootfs + resolvConfSuffix)
+			return os.RemoveAll(rootfs)
+		})
+	}
+	if timings != nil {
+		timingsOutput.write(os.Stderr, timings)
+	}
+	commandLine, err := resolveCommand(imageMeta.Config.Config, userArgs, entrypoint)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		cleanup.exit(1)
+	}
+	resolvedStopSignal, err := resolveStopSignal(*stopSignalFlag, imageMeta.Config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		cleanup.exit(1)
+	}
+	workdir, err := resolveWorkdir(*workdirFlag, imageMeta.Config.Config)
+	if err == nil {
+		err = ensureWorkdir(rootfs, workdir, imageMeta.Config.Config.User)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		cleanup.exit(1)
+	}
+	// Like Docker, the container gets HOSTNAME, and TERM with a terminal,
+	// unless the image or the user set them.
+	var baseEnv []string
+	if *hostname != "" {
+		baseEnv = append(baseEnv, "HOSTNAME="+*hostname)
+	}
+	if *allocateTTY {
+		baseEnv = append(baseEnv, "TERM=xterm")
+	}
+	env := mergeEnv(append(baseEnv, imageMeta.Config.Config.Env...), userEnv)
+	groups, err := resolveGroups(rootfs, groupAddFlags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		cleanup.exit(1)
+	}
+	if *hostname != "" {
+		if err := writeHostnameFile(rootfs, *hostname); err != nil {
+			fmt.Fprintf(os.Stderr, "Err writing /etc/hostname: %v\n", err)
+			cleanup.exit(1)
+		}
+	}
+	// A container sharing the host's network can use the host's resolver
+	// configuration, unlike whatever the image ships; one on the bridge
+	// asks the bridge's nameserver. A mount the user asked for at
+	// /etc/resolv.conf replaces ours.
+	if !*noResolvMount && !hasMountAt(mounts, "/etc/resolv.conf") {
+		source := hostResolvConf
+		servers := dnsServers
+		if len(servers) == 0 && state.IPAddress != "" {
+			servers = []string{bridgeGateway.String()}
+		}
+		if len(servers) > 0 {
+			source = rootfs + resolvConfSuffix
+			data, err := resolvConf(servers)
+			if err == nil {
+				err = os.WriteFile(source, data, 0o644)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Err writing resolv.conf: %v\n", err)
+				cleanup.exit(1)
+			}
+		}
+		// A host without one keeps the image's.
+		if _, err := os.Stat(source); err == nil {
+			if *noMountNamespace {
+				if err := copyResolvConf(rootfs, source); err != nil {
+					fmt.Fprintf(os.Stderr, "Err writing /etc/resolv.conf: %v\n", err)
+					cleanup.exit(1)
+				}
+			} else {
+				mounts = append([]mountSpec{resolvConfMount(source)}, mounts...)
+			}
+		}
+	}
+	// Other containers are found by name through /etc/hosts; see
+	// hosts_linux.go. Without a mount namespace the container gets the names
+	// of those running now, written into its rootfs, and no updates.
+	if !hasMountAt(mounts, "/etc/hosts") {
+		source := containerHostsPath(state.key())
+		if *noMountNamespace {
+			var err error
+			if source, err = resolveInRoot(rootfs, "/etc/hosts"); err == nil {
+				err = os.MkdirAll(filepath.Dir(source), 0o755)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Err writing /etc/hosts: %v\n", err)
+				cleanup.exit(1)
+			}
+		} else {
+			cleanup.push("hosts file", func() error { return os.Remove(source) })
+			mounts = append([]mountSpec{hostsMount(source)}, mounts...)
+		}
+		if err := writeContainerHosts(source, state); err != nil {
+			fmt.Fprintf(os.Stderr, "Err writing /etc/hosts: %v\n", err)
+			cleanup.exit(1)
+		}
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", fmt.Sprintf("mkdir -p %s/usr/local/bin && cp /usr/local/bin/docker-explorer %s/usr/local/bin/docker-explorer", rootfs, rootfs))
+	err = cmd.Run()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err on setting up sandbox: %v\n", err)
+		cleanup.exit(1)
+	}
+
+	var cgroup string
+	if len(cgroupSettings) > 0 {
+		if cgroup, err = createCgroup(containerID, cgroupSettings); err != nil {
+			fmt.Fprintf(os.Stderr, "Err creating cgroup: %v\n", err)
+			cleanup.exit(1)
+		}
+		cleanup.push("cgroup "+cgroup, func() error { return removeCgroup(cgroup) })
+	}
+
+	spec := containerSpec{
+		Rootfs:          rootfs,
+		Args:            commandLine,
+		WorkingDir:      workdir,
+		Env:             env,
+		Init:            *useInit,
+		Mounts:          mounts,
+		Devices:         devices,
+		Ulimits:         ulimits,
+		NoNewPrivileges: security.NoNewPrivileges,
+		Cgroup:          cgroup,
+		Groups:          groups,
+		Hostname:        *hostname,
+		Domainname:      *domainname,
+		NetNamespace:    netNamespace,
+
+		NoPIDNamespace:   *noPIDNamespace,
+		NoMountNamespace: *noMountNamespace,
+		NoUTSNamespace:   *noUTSNamespace,
+		CgroupNamespace:  *cgroupns == cgroupnsPrivate,
+		ReadOnlyRootfs:   *readOnly,
+		PIDNamespace:     pidNamespace,
+	}
+	cmd, err = containerCommand(spec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err preparing container: %v\n", err)
+		cleanup.exit(1)
+	}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	if !attach.stdin {
+		cmd.Stdin = nil
+	}
+	var tty *ttySession
+	if *allocateTTY {
+		// A terminal has a single output stream, so all of it is logged as
+		// stdout, and shown if stdout is attached.
+		ttyOutput := stdout
+		if ttyOutput == nil {
+			ttyOutput = io.Discard
+		}
+		if tty, err = attachTTY(cmd, ttyOutput, attach.stdin); err != nil {
+			fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+			cleanup.exit(1)
+		}
+		cleanup.push("tty", tty.close)
+	}
+	if *cidFile != "" {
+		// Claim the file before starting so two containers can't share it.
+		if err := createCIDFile(*cidFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+			cleanup.exit(1)
+		}
+		cleanup.push("cidfile", func() error { return os.Remove(*cidFile) })
+	}
+	containerMu.Lock()
+	err = startContainer(cmd, spec)
+	container, stopSignal = cmd.Process, resolvedStopSignal
+	containerMu.Unlock()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		explainNamespaceFailure(*noPIDNamespace || pidNamespace != nil, *noMountNamespace, *noUTSNamespace)
+		cleanup.exit(1)
+	}
+	if tty != nil {
+		tty.start()
+	}
+	state.Image = image
+	state.Command = commandLine
+	state.Pid = cmd.Process.Pid
+	state.Created = time.Now().UTC()
+	state.ImageID = imageMeta.Manifest.Config.Digest
+	for _, layer := range imageMeta.Manifest.Layers {
+		state.Layers = append(state.Layers, layer.Digest)
+	}
+	state.StopSignal = int(resolvedStopSignal)
+	if !*autoRemove {
+		state.Rootfs = rootfs
+	}
+	state.Labels = mergeLabels(imageMeta.Config.Config.Labels, imageMeta.Manifest.Annotations, userLabels)
+	if err := saveContainerState(state); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: saving container state: %v\n", err)
+	}
+	// The other containers' hosts files gain this one's names now, and lose
+	// them when it exits, before its state goes.
+	if err := refreshHostsFiles(""); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: updating the containers' hosts files: %v\n", err)
+	}
+	cleanup.push("hosts entries", func() error { return refreshHostsFiles(state.key()) })
+	if *cidFile != "" {
+		if err := writeCIDFile(*cidFile, containerID); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: writing cidfile: %v\n", err)
+		}
+	}
+	if ready != nil {
+		if err := reportDetached(ready, containerID); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: detaching: %v\n", err)
+		}
+	}
+	err = cmd.Wait()
+	if tty != nil {
+		tty.wait()
+		tty.close()
+	}
+	if err != nil {
+		if *keepOnError && *autoRemove {
+			// Everything else is still torn down; mounts went with the
+			// container's mount namespace.
+			keepSandbox = true
+			fmt.Fprintf(os.Stderr, "Kept the container's filesystem in %s\n", rootfs)
+		}
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		cleanup.exit(cmd.ProcessState.ExitCode())
+	}
+	cleanup.run()
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testProbe is the program the images of the tests that run containers
+// hold, at /probe. Its first argument says what it is to do inside the
+// container. It resolves names with the Go resolver, which follows the
+// image's nsswitch.conf, if any.
+const testProbe = `package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+func fail(err error) {
+	fmt.Println(err)
+	os.Exit(1)
+}
+
+// command runs the probe again with args. The image has no /dev/null for
+// exec to open in place of missing streams.
+func command(args ...string) *exec.Cmd {
+	cmd := exec.Command("/probe", args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd
+}
+
+func main() {
+	switch os.Args[1] {
+	case "serve":
+		l, err := net.Listen("tcp", ":8080")
+		if err != nil {
+			fail(err)
+		}
+		for {
+			c, err := l.Accept()
+			if err == nil {
+				io.WriteString(c, "hello from "+os.Args[2])
+				c.Close()
+			}
+		}
+	case "fetch":
+		var err error
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+			var addrs []string
+			if addrs, err = net.LookupHost(os.Args[2]); err != nil {
+				continue
+			}
+			var c net.Conn
+			if c, err = net.Dial("tcp", net.JoinHostPort(addrs[0], "8080")); err != nil {
+				continue
+			}
+			b, _ := io.ReadAll(c)
+			fmt.Println(addrs[0], string(b))
+			return
+		}
+		fail(err)
+	case "resolve":
+		addrs, err := net.LookupHost(os.Args[2])
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println(os.Args[2], addrs)
+	case "streams":
+		// Echoes stdin to stdout, and says so on stderr.
+		in, _ := io.ReadAll(os.Stdin)
+		fmt.Printf("out %s\n", in)
+		fmt.Fprintln(os.Stderr, "err")
+	case "orphan":
+		// Leaves a child behind that exits once its parent has, then
+		// counts the zombies left.
+		if err := command("fork", "200ms").Run(); err != nil {
+			fail(err)
+		}
+		time.Sleep(time.Second)
+		zombies := 0
+		stats, _ := filepath.Glob("/proc/[0-9]*/stat")
+		for _, stat := range stats {
+			data, err := os.ReadFile(stat)
+			if err != nil {
+				continue
+			}
+			if fields := strings.Fields(string(data[strings.LastIndexByte(string(data), ')')+1:])); len(fields) > 0 && fields[0] == "Z" {
+				zombies++
+			}
+		}
+		fmt.Println(zombies, "zombies")
+	case "fork":
+		if err := command("sleep", os.Args[2]).Start(); err != nil {
+			fail(err)
+		}
+	case "trap":
+		// Reports the first signal it gets, and exits.
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals)
+		fmt.Println("ready")
+		for sig := range signals {
+			// The Go runtime preempts goroutines with SIGURG.
+			if sig != syscall.SIGURG {
+				fmt.Println("got", sig)
+				return
+			}
+		}
+	case "tty":
+		// Reports whether its stdio is a terminal, and its size, then
+		// echoes a line of input.
+		var ws [4]uint16
+		for fd := uintptr(0); fd <= 2; fd++ {
+			if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws))); errno != 0 {
+				fail(fmt.Errorf("fd %d: %v", fd, errno))
+			}
+		}
+		fmt.Println("terminal", ws[0], ws[1])
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println("read", strings.TrimSpace(line))
+	case "write":
+		if err := os.WriteFile(os.Args[2], []byte(os.Args[3]), 0o644); err != nil {
+			fail(err)
+		}
+	case "remove":
+		if err := os.Remove(os.Args[2]); err != nil {
+			fail(err)
+		}
+	case "cat":
+		for _, name := range os.Args[2:] {
+			data, err := os.ReadFile(name)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Printf("%s: %s\n", name, data)
+		}
+	case "ids":
+		fmt.Println("uid", os.Getuid(), "euid", os.Geteuid())
+	case "pid":
+		fmt.Println("pid", os.Getpid())
+	case "groups":
+		// Reports its supplementary groups.
+		groups, err := os.Getgroups()
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println("groups", groups)
+	case "as":
+		// Runs a program as another user, in a group of the same ID.
+		uid, err := strconv.Atoi(os.Args[2])
+		if err != nil {
+			fail(err)
+		}
+		cmd := exec.Command(os.Args[3], os.Args[4:]...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(uid)}}
+		if err := cmd.Run(); err != nil {
+			fail(err)
+		}
+	case "rlimit":
+		// Reports its open file limits.
+		var lim syscall.Rlimit
+		if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+			fail(err)
+		}
+		fmt.Println("nofile", lim.Cur, lim.Max)
+	case "statfs":
+		// Reports the type and size of the filesystem at a path.
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(os.Args[2], &st); err != nil {
+			fail(err)
+		}
+		fmt.Printf("%#x %d\n", st.Type, st.Blocks*uint64(st.Bsize))
+	case "mounts":
+		// Reports the statfs type of each path that is a mount point, and
+		// "-" for one that isn't, or isn't there.
+		for _, path := range os.Args[2:] {
+			var st, parent syscall.Stat_t
+			var fs syscall.Statfs_t
+			if syscall.Stat(path, &st) != nil || syscall.Stat(filepath.Dir(path), &parent) != nil || st.Dev == parent.Dev || syscall.Statfs(path, &fs) != nil {
+				fmt.Println(path, "-")
+				continue
+			}
+			fmt.Printf("%s %#x\n", path, fs.Type)
+		}
+	case "sleep":
+		d, err := time.ParseDuration(os.Args[2])
+		if err != nil {
+			fail(err)
+		}
+		time.Sleep(d)
+	default:
+		fail(fmt.Errorf("unknown probe %q", os.Args[1]))
+	}
+}
+`
+
+// runTestImage builds docker-clone, and an image holding testProbe and
+// extra, skipping the test where containers can't be run. It returns a
+// command running the tool, with a home of its own that the test also uses,
+// and the image's reference.
+func runTestImage(t *testing.T, extra ...testEntry) (docker func(args ...string) *exec.Cmd, image string) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("running containers needs root")
+	}
+	if testing.Short() {
+		t.Skip("builds and runs containers")
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("needs the go tool to build the probe")
+	}
+	if _, err := os.Stat("/" + explorerPath); err != nil {
+		t.Skip("run needs docker-explorer")
+	}
+
+	dir := t.TempDir()
+	tool := filepath.Join(dir, "docker-clone")
+	if out, err := exec.Command(goTool, "build", "-o", tool, ".").CombinedOutput(); err != nil {
+		t.Fatalf("building docker-clone: %v\n%s", err, out)
+	}
+	src := filepath.Join(dir, "probe.go")
+	if err := os.WriteFile(src, []byte(testProbe), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	probe := filepath.Join(dir, "probe")
+	build := exec.Command(goTool, "build", "-o", probe, src)
+	build.Env = append(os.Environ(), "CGO_ENABLED=0")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("building the probe: %v\n%s", err, out)
+	}
+	probeData, err := os.ReadFile(probe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout := filepath.Join(dir, "layout")
+	entries := append([]testEntry{{name: "probe", mode: 0o755, body: string(probeData)}}, extra...)
+	writeTestImage(t, layout, "latest", testLayer(t, entries...))
+
+	home := filepath.Join(dir, "home")
+	t.Setenv("DOCKER_CLONE_HOME", home)
+	return func(args ...string) *exec.Cmd {
+		cmd := exec.Command(tool, args...)
+		cmd.Env = append(os.Environ(), "DOCKER_CLONE_HOME="+home)
+		return cmd
+	}, "oci:" + layout
+}
+
+// TestRunCleansUpAfterSetupFailure fails a run once the image is pulled and
+// a volume is in use, and checks nothing of the container is left behind.
+func TestRunCleansUpAfterSetupFailure(t *testing.T) {
+	docker, image := runTestImage(t)
+	tmp := t.TempDir()
+	for _, flags := range [][]string{{"--name", "x"}, {"--rm"}} {
+		args := append(append([]string{"run"}, flags...), "-v", "data:/data", "--group-add", "nosuchgroup", image, "/probe", "sleep", "0s")
+		cmd := docker(args...)
+		cmd.Env = append(cmd.Env, "TMPDIR="+tmp)
+		out, err := cmd.CombinedOutput()
+		if err == nil || !strings.Contains(string(out), "nosuchgroup") {
+			t.Fatalf("%q: %v, want it to fail on the group\n%s", args, err, out)
+		}
+		// A named container's logs are kept, as of one that ran.
+		names, _ := filepath.Glob(filepath.Join(containersDir(), "*", "*"))
+		var left []string
+		for _, name := range names {
+			if rel, _ := filepath.Rel(containersDir(), name); rel != "x/.lock" && rel != "x/stdout.log" && rel != "x/stderr.log" {
+				left = append(left, rel)
+			}
+		}
+		if len(left) > 0 {
+			t.Errorf("%q left %q behind", args, left)
+		}
+		if names, _ := filepath.Glob(filepath.Join(tmp, "*")); len(names) > 0 {
+			t.Errorf("%q left %q behind", args, names)
+		}
+		if err := removeVolume("data"); err != nil {
+			t.Errorf("%q: %v", args, err)
+		}
+	}
+	// The name is free again.
+	if out, err := docker("run", "--name", "x", image, "/probe", "sleep", "0s").CombinedOutput(); err != nil {
+		t.Fatalf("running x again: %v\n%s", err, out)
+	}
+}
+
+// TestRunAbortsOnFailedExtraction checks a run whose image can't be fully
+// extracted never starts the container.
+func TestRunAbortsOnFailedExtraction(t *testing.T) {
+	docker, image := runTestImage(t)
+	layout := strings.TrimPrefix(image, ociLayoutPrefix)
+	broken := testLayer(t, testEntry{name: "broken", body: strings.Repeat("x", 10000)})
+	writeTestImage(t, layout, "broken", testLayer(t, testEntry{name: "probe", body: "not run"}), broken)
+	blob, err := ociBlobPath(layout, sha256Digest(gzipLayer(t, broken)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(blob, gzipLayer(t, broken)[:20], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := docker("run", "--name", "x", image+":broken", "/probe", "sleep", "0s").CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "Err on pulling image") {
+		t.Fatalf("run: %v, want it to fail pulling\n%s", err, out)
+	}
+	if names, _ := filepath.Glob(filepath.Join(containerDir("x"), "rootfs*")); len(names) > 0 {
+		t.Errorf("left %q behind", names)
+	}
+}
+
+// TestQuiet checks that with --quiet a run prints only the container's
+// output, and a pull only the image's digest, while errors are still
+// reported.
+func TestQuiet(t *testing.T) {
+	docker, image := runTestImage(t, testEntry{name: "f", body: "hello"})
+	srv := serveOCILayout(t, strings.TrimPrefix(image, ociLayoutPrefix))
+	tests := []struct {
+		args       []string
+		wantStdout string
+		wantStderr string
+		wantErr    bool
+		// loud is whether the command prints more without --quiet.
+		loud bool
+	}{
+		{args: []string{"run", "--rm", "app", "/probe", "cat", "/f"}, wantStdout: `^/f: hello\n$`, wantStderr: `^$`},
+		{args: []string{"pull", "app"}, wantStdout: `^sha256:[0-9a-f]{64}\n$`, wantStderr: `^$`, loud: true},
+		{args: []string{"pull", "app:missing"}, wantStdout: `^$`, wantStderr: `Err pulling app:missing`, wantErr: true},
+	}
+	for _, tt := range tests {
+		output := map[bool]string{}
+		for _, q := range []bool{true, false} {
+			args := append([]string{"--registry-mirror", srv.URL}, tt.args...)
+			if q {
+				args = append([]string{"-q"}, args...)
+			}
+			var stdout, stderr strings.Builder
+			cmd := docker(args...)
+			cmd.Stdout, cmd.Stderr = &stdout, &stderr
+			if err := cmd.Run(); (err != nil) != tt.wantErr {
+				t.Fatalf("%q: %v, want an error %v\n%s", args, err, tt.wantErr, stderr.String())
+			}
+			output[q] = stdout.String() + stderr.String()
+			if !q {
+				continue
+			}
+			if !regexp.MustCompile(tt.wantStdout).MatchString(stdout.String()) {
+				t.Errorf("%q: stdout %q, want it to match %s", args, stdout.String(), tt.wantStdout)
+			}
+			if !regexp.MustCompile(tt.wantStderr).MatchString(stderr.String()) {
+				t.Errorf("%q: stderr %q, want it to match %s", args, stderr.String(), tt.wantStderr)
+			}
+		}
+		if tt.loud && output[false] == output[true] {
+			t.Errorf("%q prints %q with --quiet or without it, want more without", tt.args, output[true])
+		}
+	}
+}
+
+// TestDetach runs a container in the background, finds it with ps, and stops
+// it.
+func TestDetach(t *testing.T) {
+	docker, image := runTestImage(t)
+	out, err := docker("run", "-d", "--name", "bg", image, "/probe", "trap").Output()
+	if err != nil {
+		t.Fatalf("run -d: %v", err)
+	}
+	id := strings.TrimSpace(string(out))
+	if len(id) < 12 || strings.Contains(id, "\n") {
+		t.Fatalf("run -d printed %q, want the container's ID", out)
+	}
+	ps := func() string {
+		t.Helper()
+		out, err := docker("ps", "-q", "--no-trunc").Output()
+		if err != nil {
+			t.Fatalf("ps: %v", err)
+		}
+		return string(out)
+	}
+	if got := ps(); got != id+"\n" {
+		t.Errorf("ps -q lists %q, want %q", got, id)
+	}
+	// The container's output goes to its log.
+	log := containerLogPath("bg", "stdout")
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		if data, _ := os.ReadFile(log); strings.HasPrefix(string(data), "ready\n") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the probe never got ready")
+		}
+	}
+	if out, err := docker("stop", "bg").CombinedOutput(); err != nil || string(out) != "bg\n" {
+		t.Fatalf("stop: %q, %v", out, err)
+	}
+	if got := ps(); got != "" {
+		t.Errorf("ps -q lists %q after stop", got)
+	}
+	if out, err := docker("stop", "bg").CombinedOutput(); err == nil || !strings.Contains(string(out), "no such running container") {
+		t.Errorf("stopping it again: %q, %v, want an error", out, err)
+	}
+}
+
+// TestRunLookPath runs commands by name, and checks they are found in the
+// container's PATH in its root, not the host's.
+func TestRunLookPath(t *testing.T) {
+	docker, image := runTestImage(t,
+		// The image's PATH is /bin:/usr/bin; what's in /bin can't be run.
+		testEntry{name: "bin/probe-tool", mode: 0o644, body: "not executable"},
+		testEntry{name: "usr/bin/probe-tool", typeflag: tar.TypeSymlink, linkname: "/probe"},
+		testEntry{name: "opt/tools/other-tool", typeflag: tar.TypeSymlink, linkname: "/probe"},
+	)
+	tests := []struct {
+		flags   []string
+		command string
+		wantErr string
+	}{
+		{command: "probe-tool"},
+		{flags: []string{"-e", "PATH=/opt/tools"}, command: "other-tool"},
+		{command: "other-tool", wantErr: `executable "other-tool" not found in the container's PATH (searched /bin, /usr/bin)`},
+		{flags: []string{"-e", "PATH=/opt/tools"}, command: "probe-tool", wantErr: `executable "probe-tool" not found in the container's PATH (searched /opt/tools)`},
+		// go is in the host's PATH, as it built the probe, but not the
+		// container's.
+		{command: "go", wantErr: `executable "go" not found`},
+		{flags: []string{"--init"}, command: "probe-tool"},
+	}
+	for _, tt := range tests {
+		args := append(append([]string{"run", "--rm"}, tt.flags...), image, tt.command, "pid")
+		out, err := docker(args...).CombinedOutput()
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(string(out), tt.wantErr) {
+				t.Errorf("%q %s: %v, want it to fail with %q\n%s", tt.flags, tt.command, err, tt.wantErr, out)
+			}
+			continue
+		}
+		if err != nil || !strings.HasPrefix(string(out), "pid ") {
+			t.Errorf("%q %s: %v, want it run\n%s", tt.flags, tt.command, err, out)
+		}
+	}
+}
+
+// TestRunCopyOnWrite checks a container's writes land in its own rootfs,
+// which --rm removes, and never in the extracted layers of the cache that
+// every run's rootfs is made from.
+func TestRunCopyOnWrite(t *testing.T) {
+	docker, image := runTestImage(t,
+		testEntry{name: "f", body: "image"},
+		testEntry{name: "d/", typeflag: tar.TypeDir, mode: 0o755},
+		testEntry{name: "d/g", body: "image"},
+	)
+	// Images from layouts aren't cached, so the image is pulled from a
+	// registry serving the layout.
+	srv := serveOCILayout(t, strings.TrimPrefix(image, ociLayoutPrefix))
+	image = "app"
+	tmp := t.TempDir()
+	run := func(args ...string) string {
+		t.Helper()
+		cmd := docker(append([]string{"run", "--cache-mode", "extracted"}, args...)...)
+		// The sandboxes of --rm runs are made in TMPDIR.
+		cmd.Env = append(cmd.Env, "DOCKER_CLONE_REGISTRY_MIRROR="+srv.URL, "TMPDIR="+tmp)
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("run %q: %v\n%s", args, err, out)
+		}
+		return string(out)
+	}
+	// snapshot describes every file of the cache's extracted layers.
+	snapshot := func() map[string]string {
+		t.Helper()
+		files := map[string]string{}
+		err := filepath.Walk(filepath.Join(cacheDir(), "layers"), func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			desc := fmt.Sprintf("%v %d %v", info.Mode(), info.Size(), info.ModTime())
+			if info.Mode().IsRegular() {
+				data, err := os.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				desc += " " + sha256Digest(data)
+			}
+			files[path] = desc
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return files
+	}
+
+	run("--rm", image, "/probe", "cat", "/f")
+	cache := snapshot()
+	if len(cache) < 5 {
+		t.Fatalf("the cache has %d files, want the extracted layer", len(cache))
+	}
+	// A kept container's writes are in its rootfs.
+	run("--name", "kept", "--rm=false", image, "/probe", "write", "/f", "kept")
+	if data, err := os.ReadFile(filepath.Join(containerDir("kept"), "rootfs", "f")); err != nil || string(data) != "kept" {
+		t.Errorf("the kept rootfs has %q, %v, want the container's write", data, err)
+	}
+	for _, args := range [][]string{
+		{"write", "/f", "changed"},
+		{"write", "/d/h", "new"},
+		{"remove", "/d/g"},
+	} {
+		run(append([]string{"--rm", image, "/probe"}, args...)...)
+	}
+	// Each run starts from the image.
+	if out, want := run("--rm", image, "/probe", "cat", "/f", "/d/g", "/d/h"), "/f: image\n/d/g: image\nopen /d/h: no such file or directory\n"; out != want {
+		t.Errorf("a later run sees %q, want %q", out, want)
+	}
+	if got := snapshot(); !reflect.DeepEqual(got, cache) {
+		t.Errorf("the runs changed the cache from\n%q\nto\n%q", cache, got)
+	}
+	if left, err := os.ReadDir(tmp); err != nil || len(left) != 0 {
+		t.Errorf("--rm runs left %v behind, %v", left, err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// Runtime runs containers. Pulling, inspecting and exporting images only
+// needs HTTP and tar, so that works on any platform; running a container
+// needs namespaces, chroot and mounts, which only Linux provides. Each
+// platform supplies its Runtime by replacing newRuntime in init.
+type Runtime interface {
+	// Run implements the run subcommand.
+	Run(argv []string)
+	// Stop implements the stop subcommand.
+	Stop(argv []string)
+	// Child is the entry point of the process re-exec'd inside the
+	// container's namespaces. It only returns, with an exit code, if the
+	// container's command couldn't be started.
+	Child() int
+}
+
+// childCommand is the hidden argument used to re-exec this binary inside the
+// container's namespaces. The parent stays on the host filesystem so it can
+// clean up after the container; the child does the container-side setup and
+// then becomes (or, with --init, supervises) the user's command.
+const childCommand = "__child"
+
+const errContainersNeedLinux = "container execution requires Linux"
+
+// unsupportedRuntime is used where containers can't run. It fails clearly
+// instead of the whole tool refusing to build.
+type unsupportedRuntime struct{}
+
+// newRuntime returns this platform's Runtime.
+var newRuntime = func() Runtime {
+	return unsupportedRuntime{}
+}
+
+func (unsupportedRuntime) Run(argv []string) {
+	fmt.Fprintf(os.Stderr, "Err: %s, but this is %s. The tags, inspect and export commands work here; to run containers, use this tool inside a Linux VM (e.g. Lima, Colima or WSL 2).\n", errContainersNeedLinux, runtime.GOOS)
+	os.Exit(1)
+}
+
+func (unsupportedRuntime) Stop(argv []string) {
+	fmt.Fprintf(os.Stderr, "Err: %s, but this is %s.\n", errContainersNeedLinux, runtime.GOOS)
+	os.Exit(1)
+}
+
+func (unsupportedRuntime) Child() int {
+	fmt.Fprintf(os.Stderr, "Err: %s\n", errContainersNeedLinux)
+	return 1
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// saveTag is the tag an image is saved under when --tag isn't given: the one
+// it was named by, or latest.
+func saveTag(image string) string {
+	var tag string
+	switch {
+	case strings.HasPrefix(image, ociLayoutPrefix):
+		_, tag = parseOCILayoutRef(image)
+	case strings.HasPrefix(image, dockerArchivePrefix):
+		// The archive's tag may be a whole repository:tag.
+		_, tag = parseDockerArchiveRef(image)
+		if i := strings.LastIndex(tag, ":"); i > strings.LastIndex(tag, "/") {
+			tag = tag[i+1:]
+		}
+	default:
+		name, _, _ := strings.Cut(image, "@")
+		if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+			tag = name[i+1:]
+		}
+	}
+	if !tagRegexp.MatchString(tag) {
+		return "latest"
+	}
+	return tag
+}
+
+// saveImage writes image into the OCI image layout at layout, tagged tag,
+// and checks every blob of it there by reading the image back from the
+// layout. Blobs the layout already has intact, e.g. from a save that was
+// interrupted, are kept; ones that fail the check are removed, so that
+// saving again replaces them.
+func saveImage(image, layout, tag string, opts pullOptions) (ociDescriptor, error) {
+	if err := initOCILayout(layout); err != nil {
+		return ociDescriptor{}, err
+	}
+	desc, err := importImage(image, layout, opts)
+	if err != nil {
+		return desc, err
+	}
+	if err := tagOCIManifest(layout, desc, tag); err != nil {
+		return desc, err
+	}
+	v := &imageVerifier{buf: make([]byte, defaultBufferSize)}
+	failed := 0
+	for _, r := range v.verify(ociLayoutPrefix+layout+":"+tag, "") {
+		if r.Result == verifyOK {
+			continue
+		}
+		failed++
+		fmt.Fprintf(os.Stderr, "Warning: %s %s: %s: %v\n", r.Component, shortDigest(r.Digest), r.Result, r.Err)
+		if path, err := ociBlobPath(layout, r.Digest); r.Digest != "" && err == nil {
+			os.Remove(path)
+		}
+	}
+	if failed > 0 {
+		return desc, fmt.Errorf("%d blobs of the saved image failed verification and were removed; save it again", failed)
+	}
+	return desc, nil
+}
+
+func saveCommand(argv []string) {
+	flags := flag.NewFlagSet("save", flag.ExitOnError)
+	layout := flags.String("oci-layout", "", "write the image into the OCI image layout at `dir`, creating it if need be (required)")
+	tag := flags.String("tag", "", "`tag` the image in the layout, by default the one it was named by, or latest")
+	scopeActions := flags.String("registry-scope", defaultScopeActions, "comma-separated `actions` to request in the registry token scope")
+	var caCerts stringsFlag
+	flags.Var(&caCerts, "ca-cert", "also trust the CA certificates in PEM `file`, or in the .pem/.crt/.cert files of a directory, for registry TLS (repeatable)")
+	timeouts := httpTimeoutFlags(flags)
+	platform := flags.String("platform", targetPlatform.String(), "pick the image for `os/arch[/variant]` from multi-platform images")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), saveUsage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(argv)
+	if flags.NArg() != 1 || *layout == "" {
+		flags.Usage()
+		os.Exit(1)
+	}
+	if *tag == "" {
+		*tag = saveTag(flags.Arg(0))
+	} else if !tagRegexp.MatchString(*tag) {
+		fmt.Fprintf(os.Stderr, "Err: invalid tag %q\n", *tag)
+		os.Exit(1)
+	}
+	if err := useCACerts(caCerts); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	if err := useHTTPTimeouts(timeouts); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	if err := usePlatform(*platform); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	// Layers earlier pulls downloaded are taken from the layer cache, and
+	// those this one downloads are kept there.
+	desc, err := saveImage(flags.Arg(0), *layout, *tag, pullOptions{
+		ScopeActions: *scopeActions,
+		Cache:        newLayerCache(cacheModeCompressed, 0, false),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err saving %s: %v\n", flags.Arg(0), err)
+		os.Exit(1)
+	}
+	if !quiet {
+		fmt.Fprintf(os.Stderr, "Saved %s to %s as %s\n", flags.Arg(0), *layout, *tag)
+	}
+	fmt.Println(desc.Digest)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSaveTag(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "image.tar")
+	if err := os.WriteFile(archive, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		image, want string
+	}{
+		{image: "alpine", want: "latest"},
+		{image: "alpine:3.19", want: "3.19"},
+		{image: "localhost:5000/app", want: "latest"},
+		{image: "localhost:5000/app:v2", want: "v2"},
+		{image: "app@sha256:" + strings.Repeat("a", 64), want: "latest"},
+		{image: "app:v1@sha256:" + strings.Repeat("a", 64), want: "v1"},
+		{image: "oci:" + dir + "/layout", want: "latest"},
+		{image: "oci:" + dir + "/layout:v3", want: "v3"},
+		{image: "docker-archive:" + archive, want: "latest"},
+		{image: "docker-archive:" + archive + ":v4", want: "v4"},
+		{image: "docker-archive:" + archive + ":library/app:v5", want: "v5"},
+		{image: "docker-archive:" + archive + ":library/app", want: "latest"},
+	}
+	for _, tt := range tests {
+		if got := saveTag(tt.image); got != tt.want {
+			t.Errorf("saveTag(%q) = %q, want %q", tt.image, got, tt.want)
+		}
+	}
+}
+
+// TestSaveImage saves images from each kind of source into an OCI layout,
+// and pulls them back from it through the OCI layout source.
+func TestSaveImage(t *testing.T) {
+	t.Setenv("DOCKER_CLONE_HOME", t.TempDir())
+	layers := [][]byte{
+		testLayer(t, testEntry{name: "etc/", typeflag: '5', mode: 0o755}, testEntry{name: "etc/os-release", body: "saved"}),
+		testLayer(t, testEntry{name: "app", mode: 0o755, body: "#!/bin/sh\n"}),
+	}
+	want := map[string]string{"etc": "/", "etc/os-release": "saved", "app": "#!/bin/sh\n"}
+	dir := t.TempDir()
+	layout := filepath.Join(dir, "layout")
+	writeTestImage(t, layout, "latest", layers...)
+	archive := filepath.Join(dir, "image.tar")
+	writeDockerArchive(t, archive, false, savedImage{tags: []string{"app:latest"}, layers: layers})
+	useTestRegistry(t, serveOCILayout(t, layout))
+
+	for _, image := range []string{"app", "oci:" + layout, "docker-archive:" + archive} {
+		t.Run(image, func(t *testing.T) {
+			saved := filepath.Join(t.TempDir(), "saved")
+			desc, err := saveImage(image, saved, "v1", pullOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(filepath.Join(saved, "oci-layout")); err != nil {
+				t.Error(err)
+			}
+			// Every blob is stored under its digest.
+			blobs, err := filepath.Glob(filepath.Join(saved, "blobs", "sha256", "*"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(blobs) != len(layers)+2 {
+				t.Errorf("the layout has %d blobs, want the manifest, config and %d layers", len(blobs), len(layers))
+			}
+			for _, blob := range blobs {
+				if err := verifyFile("blob", blob, "sha256:"+filepath.Base(blob), nil); err != nil {
+					t.Error(err)
+				}
+			}
+			readBack := func() {
+				t.Helper()
+				rootfs := t.TempDir()
+				if _, err := pullFromSource(rootfs, ociLayoutSource{dir: saved}, "v1", pullOptions{}); err != nil {
+					t.Fatalf("pulling the saved image: %v", err)
+				}
+				wantTree(t, rootfs, want)
+			}
+			readBack()
+
+			// Saving again keeps the blobs that are intact, and replaces
+			// those that aren't.
+			data, err := readOCIBlob(saved, desc.Digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var manifest ociManifest
+			if err := json.Unmarshal(data, &manifest); err != nil {
+				t.Fatal(err)
+			}
+			kept, err := ociBlobPath(saved, manifest.Layers[0].Digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			corrupted, err := ociBlobPath(saved, manifest.Layers[1].Digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			before, err := os.Stat(kept)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Blobs from a layout may be hard links to its own, so the
+			// corrupted copy replaces the file rather than changing it.
+			blob, err := os.ReadFile(corrupted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			blob[len(blob)-1] ^= 0xff
+			if err := os.Remove(corrupted); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(corrupted, blob, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			again, err := saveImage(image, saved, "v1", pullOptions{})
+			if err != nil {
+				t.Fatalf("saving again: %v", err)
+			}
+			if again.Digest != desc.Digest {
+				t.Errorf("saved again as %s, want %s", again.Digest, desc.Digest)
+			}
+			if after, err := os.Stat(kept); err != nil || !os.SameFile(before, after) {
+				t.Errorf("an intact blob was replaced: %v", err)
+			}
+			if err := verifyFile("blob", corrupted, manifest.Layers[1].Digest, nil); err != nil {
+				t.Errorf("the corrupted blob wasn't replaced: %v", err)
+			}
+			readBack()
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"archive/tar"
+	"strings"
+	"testing"
+)
+
+func TestParseSecurityOpt(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    securityOpts
+		wantErr bool
+	}{
+		{value: "no-new-privileges", want: securityOpts{NoNewPrivileges: true}},
+		{value: "no-new-privileges:true", want: securityOpts{NoNewPrivileges: true}},
+		{value: "no-new-privileges=true", want: securityOpts{NoNewPrivileges: true}},
+		{value: "no-new-privileges:false", want: securityOpts{}},
+		{value: "no-new-privileges=0", want: securityOpts{}},
+		{value: "no-new-privileges:maybe", wantErr: true},
+		{value: "seccomp=unconfined", wantErr: true},
+		{value: "apparmor:docker-default", wantErr: true},
+	}
+	for _, tt := range tests {
+		var got securityOpts
+		err := parseSecurityOpt(&got, tt.value)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseSecurityOpt(%q) = %+v, want an error", tt.value, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseSecurityOpt(%q) = %+v, %v, want %+v", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+// TestNoNewPrivileges has an unprivileged user in the container run a
+// setuid root program, which only gains root without no-new-privileges.
+func TestNoNewPrivileges(t *testing.T) {
+	// A hard link's mode is that of the file it links to.
+	docker, image := runTestImage(t, testEntry{name: "suid", typeflag: tar.TypeLink, mode: 0o4755, linkname: "probe"})
+	tests := []struct {
+		opt  string
+		want string
+	}{
+		{opt: "no-new-privileges:false", want: "uid 1000 euid 0"},
+		{opt: "no-new-privileges", want: "uid 1000 euid 1000"},
+	}
+	for _, tt := range tests {
+		out, err := docker("run", "--rm", "--security-opt", tt.opt, image, "/probe", "as", "1000", "/suid", "ids").CombinedOutput()
+		if err != nil {
+			t.Fatalf("--security-opt %s: %v\n%s", tt.opt, err, out)
+		}
+		if got := strings.TrimSpace(string(out)); got != tt.want {
+			t.Errorf("--security-opt %s: the setuid program reports %q, want %q", tt.opt, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import "runtime"
+
+// sysSetns is setns(2). Package syscall has no number for it on amd64 and
+// 386, so the numbers are spelled out for each architecture.
+var sysSetns = map[string]uintptr{
+	"386":      346,
+	"amd64":    308,
+	"arm":      375,
+	"arm64":    268,
+	"loong64":  268,
+	"mips":     4344,
+	"mipsle":   4344,
+	"mips64":   5303,
+	"mips64le": 5303,
+	"ppc64":    350,
+	"ppc64le":  350,
+	"riscv64":  268,
+	"s390x":    339,
+}[runtime.GOARCH]
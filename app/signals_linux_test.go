@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestResolveStopSignal(t *testing.T) {
+	withStopSignal := func(s string) ImageConfig {
+		var config ImageConfig
+		config.Config.StopSignal = s
+		return config
+	}
+	tests := []struct {
+		flag    string
+		config  ImageConfig
+		want    syscall.Signal
+		wantErr bool
+	}{
+		{want: syscall.SIGTERM},
+		{config: withStopSignal("SIGQUIT"), want: syscall.SIGQUIT},
+		{config: withStopSignal("quit"), want: syscall.SIGQUIT},
+		{config: withStopSignal("9"), want: syscall.SIGKILL},
+		{config: withStopSignal("SIGRTMIN+3"), wantErr: true},
+		// The flag wins over the image.
+		{flag: "USR1", config: withStopSignal("SIGQUIT"), want: syscall.SIGUSR1},
+		{flag: "sigint", want: syscall.SIGINT},
+		{flag: "64", want: syscall.Signal(64)},
+		{flag: "65", wantErr: true},
+		{flag: "0", wantErr: true},
+		{flag: "NOPE", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := resolveStopSignal(tt.flag, tt.config)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("resolveStopSignal(%q, %q) = %v, want an error", tt.flag, tt.config.Config.StopSignal, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("resolveStopSignal(%q, %q) = %v, %v, want %v", tt.flag, tt.config.Config.StopSignal, got, err, tt.want)
+		}
+	}
+}
+
+// TestStopDeliversStopSignal stops containers and checks which signal each
+// got.
+func TestStopDeliversStopSignal(t *testing.T) {
+	docker, image := runTestImage(t)
+	tests := []struct {
+		name, flag, want string
+	}{
+		{name: "default", want: "got terminated\n"},
+		{name: "usr1", flag: "--stop-signal=SIGUSR1", want: "got user defined signal 1\n"},
+		{name: "number", flag: "--stop-signal=2", want: "got interrupt\n"},
+	}
+	for _, tt := range tests {
+		args := []string{"run", "-d", "--name", tt.name}
+		if tt.flag != "" {
+			args = append(args, tt.flag)
+		}
+		if out, err := docker(append(args, image, "/probe", "trap")...).CombinedOutput(); err != nil {
+			t.Fatalf("%s: %v\n%s", tt.name, err, out)
+		}
+		log := containerLogPath(tt.name, "stdout")
+		for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+			if data, _ := os.ReadFile(log); strings.HasPrefix(string(data), "ready\n") {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: the probe never got ready", tt.name)
+			}
+		}
+		if out, err := docker("stop", "-t", "5", tt.name).CombinedOutput(); err != nil {
+			t.Fatalf("stopping %s: %v\n%s", tt.name, err, out)
+		}
+		data, err := os.ReadFile(log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimPrefix(string(data), "ready\n"); got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,661 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Source is somewhere images are pulled from: a registry, a local OCI image
+// layout or a `docker save` tarball. Whatever the source, images are resolved,
+// verified and extracted the same way.
+type Source interface {
+	// Manifest returns the manifest ref names, by tag or by digest, and its
+	// media type. It may be an image index, which the caller resolves.
+	Manifest(ref string) ([]byte, string, error)
+	// Blob opens the blob with digest, a config or a layer. The caller
+	// verifies its content.
+	Blob(digest string) (io.ReadCloser, error)
+}
+
+// resumableSource is a Source that can open a blob part way through, so that
+// an interrupted download carries on where it stopped.
+type resumableSource interface {
+	Source
+	BlobFrom(digest string, offset int64) (io.ReadCloser, error)
+}
+
+// sizedSource is a Source that can tell whether it has a blob, and its size,
+// without sending it. The size is -1 if the source didn't say.
+type sizedSource interface {
+	Source
+	BlobSize(digest string) (int64, error)
+}
+
+// localBlobSource is a Source keeping its blobs as files, which layers are
+// extracted from in place instead of being copied or cached first.
+type localBlobSource interface {
+	Source
+	blobPath(digest string) (string, error)
+}
+
+// openSource returns the source image is pulled from, and the reference to
+// ask it for. Images in the local store come from their OCI layout.
+func openSource(image, scopeActions string) (Source, string, error) {
+	if local, ok := resolveLocalImage(image); ok {
+		image = local
+	}
+	if strings.HasPrefix(image, ociLayoutPrefix) {
+		layout, tag := parseOCILayoutRef(image)
+		return ociLayoutSource{dir: layout}, tag, nil
+	}
+	if strings.HasPrefix(image, dockerArchivePrefix) {
+		file, tag := parseDockerArchiveRef(image)
+		src, err := openDockerArchive(file)
+		return src, tag, err
+	}
+	ref, err := parseImageRef(image)
+	if err != nil {
+		return nil, "", err
+	}
+	auth, err := newRegistryAuth(ref.Repository, scopeActions)
+	if err != nil {
+		return nil, "", err
+	}
+	if ref.Digest != "" && ref.Tag != "" {
+		warnOnTagDigestMismatch(ref, auth)
+	}
+	return &registrySource{repository: ref.Repository, auth: auth}, ref.Reference(), nil
+}
+
+// registrySource pulls a repository from Docker Hub.
+type registrySource struct {
+	repository string
+	auth       *registryAuth
+}
+
+// Manifest fetches the manifest ref names, unless registryManifests has it.
+func (s *registrySource) Manifest(ref string) ([]byte, string, error) {
+	digest := ref
+	if !isDigest(ref) {
+		digest, _ = registryManifests.resolveTag(s.repository, ref)
+	}
+	if digest != "" {
+		if data, kind, ok := registryManifests.get(s.repository, digest); ok {
+			return data, kind, nil
+		}
+	}
+	data, contentType, err := fetchManifestBlob(s.repository, ref, s.auth)
+	if err != nil {
+		return nil, "", err
+	}
+	kind := manifestKind(contentType, data)
+	switch {
+	case !isDigest(ref):
+		digest = sha256Digest(data)
+		registryManifests.put(s.repository, digest, data, kind)
+		registryManifests.putTag(s.repository, ref, digest)
+	case verifyDigest("manifest", data, ref) == nil:
+		// Anything else is rejected by resolveManifest, and asked for
+		// again if the pull is retried.
+		registryManifests.put(s.repository, ref, data, kind)
+	}
+	return data, kind, nil
+}
+
+func (s *registrySource) Blob(digest string) (io.ReadCloser, error) {
+	return s.BlobFrom(digest, 0)
+}
+
+func (s *registrySource) BlobFrom(digest string, offset int64) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/v2/%s/blobs/%s", registryBase(), s.repository, digest), nil)
+	if err != nil {
+		return nil, err
+	}
+	setRangeFrom(req, offset)
+	setBlobEncoding(req)
+	resp, err := s.auth.do(registryClient, req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := bodyFrom(resp, offset)
+	if err != nil {
+		return nil, fmt.Errorf("fetching blob %s: %w", digest, err)
+	}
+	return body, nil
+}
+
+// BlobSize asks the registry about the blob with digest with a HEAD request.
+// Only a 404 counts against the blob: registries may redirect blob requests
+// to storage that only answers GET, so other failures leave it to the
+// download to find out.
+func (s *registrySource) BlobSize(digest string) (int64, error) {
+	resp, err := s.headBlob(digest)
+	if err != nil {
+		return -1, nil
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// Chunked responses have no Content-Length, and some registries
+		// send 0 for those; either way the size is unknown.
+		if resp.ContentLength <= 0 {
+			return -1, nil
+		}
+		return resp.ContentLength, nil
+	case http.StatusNotFound:
+		return -1, fmt.Errorf("blob %s not found in %s", digest, s.repository)
+	}
+	return -1, nil
+}
+
+// BlobRanges asks the registry with a HEAD request whether it sends the blob
+// with digest in byte ranges.
+func (s *registrySource) BlobRanges(digest string) (int64, bool) {
+	resp, err := s.headBlob(digest)
+	if err != nil || resp.StatusCode != http.StatusOK || resp.ContentLength <= 0 {
+		return -1, false
+	}
+	return resp.ContentLength, resp.Header.Get("Accept-Ranges") == "bytes"
+}
+
+func (s *registrySource) BlobRange(digest string, offset, length int64) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/v2/%s/blobs/%s", registryBase(), s.repository, digest), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	setBlobEncoding(req)
+	resp, err := s.auth.do(registryClient, req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		closeBody(resp.Body)
+		return nil, errRangesUnsupported
+	case resp.StatusCode != http.StatusPartialContent:
+		closeBody(resp.Body)
+		return nil, fmt.Errorf("fetching blob %s: unexpected status %s", digest, resp.Status)
+	case resp.Header.Get("Content-Encoding") != "" && resp.Header.Get("Content-Encoding") != "identity":
+		closeBody(resp.Body)
+		return nil, errRangesUnsupported
+	}
+	return resp.Body, nil
+}
+
+// headBlob sends a HEAD request for the blob with digest. The response has
+// no body left to read.
+func (s *registrySource) headBlob(digest string) (*http.Response, error) {
+	req, err := http.NewRequest("HEAD", fmt.Sprintf("%s/v2/%s/blobs/%s", registryBase(), s.repository, digest), nil)
+	if err != nil {
+		return nil, err
+	}
+	setBlobEncoding(req)
+	resp, err := s.auth.do(registryClient, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// setBlobEncoding asks for a blob as it is. Without an Accept-Encoding of its
+// own, net/http asks for gzip, which would have a server compress layers
+// that are compressed already.
+func setBlobEncoding(req *http.Request) {
+	req.Header.Set("Accept-Encoding", "identity")
+}
+
+// setRangeFrom asks for the content of req from offset on.
+func setRangeFrom(req *http.Request, offset int64) {
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+}
+
+// bodyFrom returns the body of resp, a response to a request made with
+// setRangeFrom, from offset on. Servers may ignore the range and send
+// everything, in which case the bytes before offset are skipped.
+//
+// A server may compress the response even though setBlobEncoding asked it
+// not to; the body is then decompressed, back into the blob.
+func bodyFrom(resp *http.Response, offset int64) (io.ReadCloser, error) {
+	encoding := resp.Header.Get("Content-Encoding")
+	if encoding == "identity" {
+		encoding = ""
+	}
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0 && encoding == "":
+		return resp.Body, nil
+	case resp.StatusCode != http.StatusOK:
+		closeBody(resp.Body)
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	case encoding != "" && encoding != "gzip":
+		closeBody(resp.Body)
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+	}
+	var body io.ReadCloser = resp.Body
+	if encoding == "gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		body = struct {
+			io.Reader
+			io.Closer
+		}{gz, resp.Body}
+	}
+	if _, err := io.CopyN(io.Discard, body, offset); err != nil {
+		body.Close()
+		return nil, err
+	}
+	return body, nil
+}
+
+// ociLayoutSource pulls from the OCI image layout at dir, where tags are the
+// ref.name annotations of index.json.
+type ociLayoutSource struct {
+	dir string
+}
+
+func (s ociLayoutSource) Manifest(ref string) ([]byte, string, error) {
+	var desc ociDescriptor
+	if isDigest(ref) {
+		desc.Digest = ref
+	} else {
+		index, err := readOCIIndex(s.dir)
+		if err != nil {
+			return nil, "", err
+		}
+		if desc, err = selectOCIRef(index, ref); err != nil {
+			return nil, "", err
+		}
+	}
+	data, err := readOCIBlob(s.dir, desc.Digest)
+	if err != nil {
+		return nil, "", err
+	}
+	if desc.MediaType != "" {
+		return data, desc.MediaType, nil
+	}
+	return data, manifestKind("", data), nil
+}
+
+func (s ociLayoutSource) Blob(digest string) (io.ReadCloser, error) {
+	path, err := s.blobPath(digest)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (s ociLayoutSource) blobPath(digest string) (string, error) {
+	return ociBlobPath(s.dir, digest)
+}
+
+// resolveManifest returns the targetPlatform image manifest for ref in src,
+// and its media type, descending through image indexes and Docker manifest
+// lists. Manifests named by digest are verified against it.
+func resolveManifest(src Source, ref string) ([]byte, string, error) {
+	for depth := 0; ; depth++ {
+		data, kind, err := src.Manifest(ref)
+		if err != nil {
+			return nil, "", err
+		}
+		// Content named by digest is pinned: anything else the source
+		// serves is rejected, whatever the transport or a cache in between
+		// did.
+		if isDigest(ref) {
+			if err := verifyDigest("manifest", data, ref); err != nil {
+				return nil, "", err
+			}
+		}
+		if kind != ociIndexMediaType && kind != dockerManifestListMediaType {
+			return data, kind, nil
+		}
+		if depth == maxIndexDepth {
+			return nil, "", fmt.Errorf("image indexes nested too deeply")
+		}
+		var index ociIndex
+		if err := json.Unmarshal(data, &index); err != nil {
+			return nil, "", fmt.Errorf("parsing image index: %w", err)
+		}
+		desc, err := selectOCIPlatform(index)
+		if err != nil {
+			return nil, "", err
+		}
+		ref = desc.Digest
+	}
+}
+
+// fetchManifest is resolveManifest returning the parsed manifest.
+func fetchManifest(src Source, ref string) (DockerManifestResponse, error) {
+	data, kind, err := resolveManifest(src, ref)
+	if err != nil {
+		return DockerManifestResponse{}, err
+	}
+	return parseManifest(data, kind)
+}
+
+// parseManifest parses an image manifest of media type kind.
+func parseManifest(data []byte, kind string) (DockerManifestResponse, error) {
+	var manifest DockerManifestResponse
+	if kind == dockerManifestV1MediaType || kind == dockerManifestV1SignedMediaType {
+		return parseSchema1Manifest(data)
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("parsing manifest (%s): %w", kind, err)
+	}
+	return manifest, nil
+}
+
+// readSourceBlob reads a small blob of src, such as a config, and verifies
+// it against digest. Registry blobs are kept in registryManifests.
+func readSourceBlob(src Source, what, digest string) ([]byte, error) {
+	registry, remote := src.(*registrySource)
+	if remote {
+		if data, _, ok := registryManifests.get(registry.repository, digest); ok {
+			return data, nil
+		}
+	}
+	r, err := src.Blob(digest)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyDigest(what, data, digest); err != nil {
+		return nil, err
+	}
+	if remote {
+		registryManifests.put(registry.repository, digest, data, "")
+	}
+	return data, nil
+}
+
+// fetchConfig returns the image config of manifest, from its config blob,
+// through cache, or, for schema 1 images, from the manifest itself.
+func fetchConfig(src Source, manifest DockerManifestResponse, cache *layerCache) (ImageConfig, error) {
+	var config ImageConfig
+	if manifest.Config.Digest == "" {
+		if manifest.schema1Config != nil {
+			config = *manifest.schema1Config
+		}
+		return config, nil
+	}
+	data, err := cache.config(manifest.Config.Digest, func() ([]byte, error) {
+		return readSourceBlob(src, "image config", manifest.Config.Digest)
+	})
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("decoding image config: %w", err)
+	}
+	return config, nil
+}
+
+// openLayer opens the blob of layer in src, from offset on.
+func openLayer(src Source, layer DockerLayer, offset int64) (io.ReadCloser, error) {
+	if resumable, ok := src.(resumableSource); ok {
+		return resumable.BlobFrom(layer.Digest, offset)
+	}
+	r, err := src.Blob(layer.Digest)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, r, offset); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// downloadForeignLayer downloads a foreign layer, whose content a registry
+// needn't store, from the first of its URLs that serves it intact, and then
+// copies it to w. done is false, with nothing written to w, if none does, and
+// the layer is to be fetched from src instead.
+func downloadForeignLayer(layer DockerLayer, dir string, w io.Writer, progress *layerProgress, opts pullOptions, buf []byte) (done bool, err error) {
+	for _, u := range layer.URLs {
+		f, err := fetchForeignLayer(u, layer, dir, progress, opts, buf)
+		if err != nil {
+			progress.reset()
+			fmt.Fprintf(os.Stderr, "Warning: foreign layer %s: %v\n", u, err)
+			continue
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		_, err = copyBuffer(w, f, buf)
+		return true, err
+	}
+	if len(layer.URLs) > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: foreign layer %s: no URL served it; trying the registry\n", shortImageID(layer.Digest))
+	}
+	return false, nil
+}
+
+// fetchForeignLayer downloads layer from u into a file in dir, which it
+// returns open at the start once the content matches the layer's digest.
+// The URL is sent none of the registry's credentials, which would be no
+// business of its host.
+func fetchForeignLayer(u string, layer DockerLayer, dir string, progress *layerProgress, opts pullOptions, buf []byte) (*os.File, error) {
+	d, err := newDigester("foreign layer", layer.Digest)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	setBlobEncoding(req)
+	resp, err := registryClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := bodyFrom(resp, 0)
+	if err != nil {
+		return nil, err
+	}
+	if opts.StallTimeout > 0 {
+		body = newStallReader(body, opts.StallTimeout)
+	}
+	defer body.Close()
+	f, err := os.CreateTemp(dir, "foreign-")
+	if err != nil {
+		return nil, err
+	}
+	_, err = copyBuffer(io.MultiWriter(f, d, progress), limitReader(body, opts.RateLimit), buf)
+	if err == nil {
+		err = d.verify()
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// sourceLayerFetcher fetches layers from src. They are downloaded into
+// opts.Cache if there is one, or else into the work directory, except from
+// sources whose blobs are already files.
+func sourceLayerFetcher(src Source, opts pullOptions) layerFetcher {
+	return func(layer DockerLayer, work string, buf []byte) (localLayer, error) {
+		progress := opts.Progress.lookup(layer.Digest)
+		if local, ok := src.(localBlobSource); ok {
+			path, err := local.blobPath(layer.Digest)
+			if err != nil {
+				return localLayer{}, err
+			}
+			progress.set("Verifying")
+			// Layers are hashed before use like downloaded ones, so that
+			// the manifest's digest vouches for everything extracted.
+			return localLayer{blob: path}, verifyFile("layer", path, layer.Digest, buf)
+		}
+		dest := work
+		if opts.Cache != nil {
+			dest = opts.Cache.dir
+		}
+		downloaded := false
+		download := func(w io.Writer) error {
+			downloaded = true
+			// Foreign layers are fetched from their URLs first, the
+			// registry only being where they may be as well.
+			if done, err := downloadForeignLayer(layer, dest, w, progress, opts, buf); done || err != nil {
+				return err
+			}
+			if sized, ok := src.(sizedSource); ok {
+				if err := checkLayerSize(sized, layer, dest); err != nil {
+					return err
+				}
+			}
+			if ranged, ok := src.(rangedSource); ok && opts.DownloadChunks > 1 {
+				done, err := downloadChunks(ranged, layer, dest, w, progress, opts, buf)
+				if done || err != nil {
+					return err
+				}
+			}
+			if progress != nil {
+				w = io.MultiWriter(w, progress)
+			}
+			// A download that stalls is retried from where it stopped.
+			var written int64
+			for retries := 0; ; retries++ {
+				r, err := openLayer(src, layer, written)
+				if err != nil {
+					return err
+				}
+				if opts.StallTimeout > 0 {
+					r = newStallReader(r, opts.StallTimeout)
+				}
+				n, err := copyBuffer(w, limitReader(r, opts.RateLimit), buf)
+				r.Close()
+				written += n
+				var stalled errStalled
+				if !errors.As(err, &stalled) || retries == maxStallRetries {
+					return err
+				}
+				fmt.Fprintf(os.Stderr, "Warning: layer %s: %v; retrying from byte %d\n", shortImageID(layer.Digest), err, written)
+			}
+		}
+		if opts.Cache != nil {
+			local, err := opts.Cache.fetch(layer, buf, download)
+			if err == nil {
+				opts.Report.layer(layer.Digest, !downloaded)
+			}
+			if err == nil && !downloaded {
+				progress.set("Already exists")
+			} else if err == nil {
+				progress.set("Download complete")
+			}
+			return local, err
+		}
+		d, err := newDigester("layer", layer.Digest)
+		if err != nil {
+			return localLayer{}, err
+		}
+		file, err := os.CreateTemp(work, "blob-")
+		if err != nil {
+			return localLayer{}, err
+		}
+		err = download(io.MultiWriter(file, d))
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = d.verify()
+		}
+		if err != nil {
+			os.Remove(file.Name())
+			return localLayer{}, err
+		}
+		progress.set("Download complete")
+		opts.Report.layer(layer.Digest, false)
+		return localLayer{blob: file.Name(), temporary: true}, nil
+	}
+}
+
+// checkLayerSize makes sure, before layer is downloaded into dest, that src
+// has it, as big as the manifest says, and that dest has room for it. A
+// download in chunks, which needs room for a second copy, checks for that
+// itself.
+func checkLayerSize(src sizedSource, layer DockerLayer, dest string) error {
+	size, err := src.BlobSize(layer.Digest)
+	if err != nil {
+		return err
+	}
+	if size < 0 {
+		size = layer.Size
+	} else if layer.Size > 0 && size != layer.Size {
+		return fmt.Errorf("layer %s is %d bytes, but the manifest says %d", layer.Digest, size, layer.Size)
+	}
+	// Without a size from anyone there is nothing to check the free space
+	// against.
+	if size <= 0 {
+		return nil
+	}
+	if free, ok := freeSpace(dest); ok && size > free {
+		return fmt.Errorf("layer %s needs %s, but only %s is free in %s", shortImageID(layer.Digest), formatSize(size), formatSize(free), dest)
+	}
+	return nil
+}
+
+// pullFromSource extracts the image ref names in src into dir and returns
+// its manifest and config.
+func pullFromSource(dir string, src Source, ref string, opts pullOptions) (imageMetadata, error) {
+	var meta imageMetadata
+	start := time.Now()
+	cache := opts.Cache
+	if _, ok := src.(localBlobSource); ok {
+		cache = nil
+	}
+	manifest, err := fetchManifest(src, ref)
+	if err != nil {
+		return meta, err
+	}
+	meta.Manifest = manifest
+	if err := checkRunnable(manifest); err != nil {
+		return meta, err
+	}
+	if meta.Config, err = fetchConfig(src, manifest, cache); err != nil {
+		return meta, err
+	}
+	if opts.Timings != nil {
+		opts.Timings.Manifest = time.Since(start)
+	}
+	layers, err := withDiffIDs(manifest.Layers, meta.Config.RootFS.DiffIDs)
+	if err != nil {
+		return meta, err
+	}
+	return meta, pullLayers(dir, layers, opts, sourceLayerFetcher(src, opts))
+}
+
+// withDiffIDs returns a copy of layers with the DiffID of each, from the
+// image config, set, so that extracting them checks their content. Schema 1
+// images have no diff_ids, so their layers are left unchecked.
+func withDiffIDs(layers []DockerLayer, diffIDs []string) ([]DockerLayer, error) {
+	if len(diffIDs) == 0 {
+		return layers, nil
+	}
+	if len(diffIDs) != len(layers) {
+		return nil, fmt.Errorf("image config lists %d diff_ids, the manifest %d layers", len(diffIDs), len(layers))
+	}
+	layers = append([]DockerLayer(nil), layers...)
+	for i := range layers {
+		layers[i].DiffID = diffIDs[i]
+	}
+	return layers, nil
+}
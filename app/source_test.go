@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// blobSource is a Source serving manifests and blobs from memory, counting
+// the requests for each blob. Layers are fetched concurrently, so mu guards
+// the maps while a pull is running.
+type blobSource struct {
+	mu        sync.Mutex
+	manifests map[string][]byte
+	blobs     map[string][]byte
+	requests  map[string]int
+}
+
+func (s *blobSource) Manifest(ref string) ([]byte, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.manifests[ref]
+	if !ok {
+		return nil, "", errors.New("manifest unknown")
+	}
+	return data, manifestKind("", data), nil
+}
+
+func (s *blobSource) Blob(digest string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[digest]++
+	data, ok := s.blobs[digest]
+	if !ok {
+		return nil, errors.New("blob unknown")
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func TestForeignLayerURLs(t *testing.T) {
+	layerData := []byte("foreign layer content")
+	digest := sha256Digest(layerData)
+	var authorized bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			authorized = true
+		}
+		switch r.URL.Path {
+		case "/good":
+			w.Write(layerData)
+		case "/tampered":
+			w.Write([]byte("something else entirely"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name         string
+		urls         []string
+		inRegistry   bool
+		wantErr      bool
+		wantRegistry int
+	}{
+		{name: "url", urls: []string{"/good"}, inRegistry: true, wantRegistry: 0},
+		{name: "first url missing", urls: []string{"/missing", "/good"}, wantRegistry: 0},
+		{name: "tampered url falls back", urls: []string{"/tampered"}, inRegistry: true, wantRegistry: 1},
+		{name: "missing url falls back", urls: []string{"/missing"}, inRegistry: true, wantRegistry: 1},
+		{name: "nowhere", urls: []string{"/missing"}, wantErr: true, wantRegistry: 1},
+		{name: "not foreign", inRegistry: true, wantRegistry: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := &blobSource{blobs: map[string][]byte{}, requests: map[string]int{}}
+			if tt.inRegistry {
+				src.blobs[digest] = layerData
+			}
+			layer := DockerLayer{Digest: digest, Size: int64(len(layerData))}
+			for _, u := range tt.urls {
+				layer.URLs = append(layer.URLs, srv.URL+u)
+			}
+			work := t.TempDir()
+			local, err := sourceLayerFetcher(src, pullOptions{})(layer, work, make([]byte, 4096))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if got, err := os.ReadFile(local.blob); err != nil || !bytes.Equal(got, layerData) {
+				t.Fatalf("layer content = %q, %v", got, err)
+			}
+			if src.requests[digest] != tt.wantRegistry {
+				t.Errorf("registry asked %d times, want %d", src.requests[digest], tt.wantRegistry)
+			}
+		})
+	}
+	if authorized {
+		t.Error("foreign layer URL was sent credentials")
+	}
+}
+
+// TestPullFromSource pulls an image from a Source that is neither a
+// registry nor a file, by tag and by digest.
+func TestPullFromSource(t *testing.T) {
+	layout := filepath.Join(t.TempDir(), "layout")
+	desc := writeTestImage(t, layout, "latest", testLayer(t, testEntry{name: "f", body: "f"}), testLayer(t, testEntry{name: "g", body: "g"}))
+	src := &blobSource{manifests: map[string][]byte{}, blobs: map[string][]byte{}, requests: map[string]int{}}
+	files, err := filepath.Glob(filepath.Join(layout, "blobs", "sha256", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		src.blobs["sha256:"+filepath.Base(file)] = data
+	}
+	src.manifests["latest"] = src.blobs[desc.Digest]
+	src.manifests[desc.Digest] = src.blobs[desc.Digest]
+
+	for _, ref := range []string{"latest", desc.Digest} {
+		dir := filepath.Join(t.TempDir(), "rootfs")
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		meta, err := pullFromSource(dir, src, ref, pullOptions{})
+		if err != nil {
+			t.Fatalf("%s: %v", ref, err)
+		}
+		if len(meta.Config.Config.Env) != 1 || meta.Config.Config.Env[0] != "PATH=/bin:/usr/bin" {
+			t.Errorf("%s: config Env %q, want the image's", ref, meta.Config.Config.Env)
+		}
+		wantTree(t, dir, map[string]string{"f": "f", "g": "g"})
+	}
+	if _, err := pullFromSource(t.TempDir(), src, "v1", pullOptions{}); err == nil {
+		t.Error("pulled a tag the source doesn't have")
+	}
+}
+
+// TestOpenSource checks which Source each kind of reference is pulled from,
+// and what it is asked for.
+func TestOpenSource(t *testing.T) {
+	t.Setenv("DOCKER_CLONE_HOME", t.TempDir())
+	layout := filepath.Join(t.TempDir(), "layout")
+	writeTestImage(t, layout, "latest", testLayer(t, testEntry{name: "f", body: "f"}))
+	useTestRegistry(t, serveOCILayout(t, layout))
+	archive := filepath.Join(t.TempDir(), "image.tar")
+	if err := os.WriteFile(archive, testLayer(t, testEntry{name: "manifest.json", body: "[]"}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	tests := []struct {
+		image   string
+		want    string
+		ref     string
+		wantErr bool
+	}{
+		{image: "ubuntu", want: "*main.registrySource", ref: "latest"},
+		{image: "ubuntu:22.04", want: "*main.registrySource", ref: "22.04"},
+		{image: "ubuntu@" + digest, want: "*main.registrySource", ref: digest},
+		{image: "oci:" + layout, want: "main.ociLayoutSource"},
+		{image: "oci:" + layout + ":v1", want: "main.ociLayoutSource", ref: "v1"},
+		{image: "docker-archive:" + archive, want: "*main.dockerArchiveSource"},
+		{image: "docker-archive:" + archive + ":app:v1", want: "*main.dockerArchiveSource", ref: "app:v1"},
+		{image: "docker-archive:" + layout, wantErr: true},
+		{image: "Ubuntu", wantErr: true},
+	}
+	for _, tt := range tests {
+		src, ref, err := openSource(tt.image, "")
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("openSource(%q) = %T, want an error", tt.image, src)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("openSource(%q): %v", tt.image, err)
+			continue
+		}
+		if got := fmt.Sprintf("%T", src); got != tt.want || ref != tt.ref {
+			t.Errorf("openSource(%q) = %s, %q, want %s, %q", tt.image, got, ref, tt.want, tt.ref)
+		}
+	}
+}
+
+// TestPullBlobHead pulls from a registry answering the HEAD request for a
+// layer in different ways, and checks a missing or misreported layer fails
+// the pull before the layer is downloaded, while a HEAD the registry can't
+// answer is left to the download.
+func TestPullBlobHead(t *testing.T) {
+	layout := filepath.Join(t.TempDir(), "layout")
+	layer := testLayer(t, testEntry{name: "f", body: "f"})
+	writeTestImage(t, layout, "latest", layer)
+	digest := sha256Digest(gzipLayer(t, layer))
+	tests := []struct {
+		name string
+		// head answers the HEAD request for the layer.
+		head     func(w http.ResponseWriter)
+		wantErr  string
+		wantGets int
+	}{
+		{name: "found", wantGets: 1},
+		{name: "missing", head: func(w http.ResponseWriter) { w.WriteHeader(http.StatusNotFound) }, wantErr: "blob " + digest + " not found"},
+		{
+			name: "wrong size",
+			head: func(w http.ResponseWriter) {
+				w.Header().Set("Content-Length", "1")
+				w.WriteHeader(http.StatusOK)
+			},
+			wantErr: "is 1 bytes, but the manifest says",
+		},
+		{name: "not allowed", head: func(w http.ResponseWriter) { w.WriteHeader(http.StatusMethodNotAllowed) }, wantGets: 1},
+		{name: "failing", head: func(w http.ResponseWriter) { w.WriteHeader(http.StatusInternalServerError) }, wantGets: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DOCKER_CLONE_HOME", t.TempDir())
+			serve := ociLayoutHandler(layout)
+			gets := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/blobs/"+digest) {
+					if r.Method == "HEAD" && tt.head != nil {
+						tt.head(w)
+						return
+					}
+					if r.Method == "GET" {
+						gets++
+					}
+				}
+				serve(w, r)
+			}))
+			defer srv.Close()
+			useTestRegistry(t, srv)
+
+			dir := t.TempDir()
+			_, err := pullDockerImage(dir, "app", pullOptions{})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("pull: %v, want an error containing %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else {
+				wantTree(t, dir, map[string]string{"f": "f"})
+			}
+			if gets != tt.wantGets {
+				t.Errorf("%d GET requests for the layer, want %d", gets, tt.wantGets)
+			}
+		})
+	}
+}
+
+// TestPullDiffIDs pulls images whose config lists different diff_ids for
+// their layers, and checks extraction, into the rootfs or the cache, only
+// accepts the digests of the uncompressed tarballs.
+func TestPullDiffIDs(t *testing.T) {
+	first, second := testLayer(t, testEntry{name: "f", body: "f"}), testLayer(t, testEntry{name: "g", body: "g"})
+	compressed := [][]byte{gzipLayer(t, first), gzipLayer(t, second)}
+	tests := []struct {
+		name    string
+		diffIDs []string
+		// wantErr is what the error says, with a diff_id mismatch when
+		// mismatch is set.
+		wantErr  string
+		mismatch bool
+	}{
+		{name: "matching", diffIDs: []string{sha256Digest(first), sha256Digest(second)}},
+		{name: "none", diffIDs: nil},
+		{name: "other content", diffIDs: []string{sha256Digest(first), sha256Digest(first)}, mismatch: true},
+		{name: "compressed digest", diffIDs: []string{sha256Digest(compressed[0]), sha256Digest(second)}, mismatch: true},
+		{name: "too few", diffIDs: []string{sha256Digest(first)}, wantErr: "lists 1 diff_ids, the manifest 2 layers"},
+	}
+	for _, tt := range tests {
+		src := &blobSource{manifests: map[string][]byte{}, blobs: map[string][]byte{}, requests: map[string]int{}}
+		manifest := ociManifest{SchemaVersion: 2, MediaType: ociManifestMediaType}
+		for _, layer := range compressed {
+			digest := sha256Digest(layer)
+			src.blobs[digest] = layer
+			manifest.Layers = append(manifest.Layers, ociDescriptor{MediaType: ociLayerMediaType, Digest: digest, Size: int64(len(layer))})
+		}
+		config, err := json.Marshal(map[string]interface{}{
+			"architecture": runtime.GOARCH,
+			"os":           "linux",
+			"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": tt.diffIDs},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest.Config = ociDescriptor{MediaType: ociImageConfigMediaType, Digest: sha256Digest(config), Size: int64(len(config))}
+		src.blobs[manifest.Config.Digest] = config
+		if src.manifests["latest"], err = json.Marshal(manifest); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, mode := range []string{"uncached", cacheModeExtracted} {
+			t.Run(tt.name+"/"+mode, func(t *testing.T) {
+				t.Setenv("DOCKER_CLONE_HOME", t.TempDir())
+				var cache *layerCache
+				if mode != "uncached" {
+					cache = &layerCache{mode: mode, dir: t.TempDir(), inUse: map[string]bool{}}
+				}
+				dir := filepath.Join(t.TempDir(), "rootfs")
+				if err := os.Mkdir(dir, 0o755); err != nil {
+					t.Fatal(err)
+				}
+				_, err := pullFromSource(dir, src, "latest", pullOptions{Cache: cache})
+				var mismatch *digestMismatchError
+				switch {
+				case tt.mismatch:
+					if !errors.As(err, &mismatch) || mismatch.What != "layer diff_id" {
+						t.Fatalf("pull: %v, want a diff_id mismatch", err)
+					}
+				case tt.wantErr != "":
+					if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+						t.Fatalf("pull: %v, want an error containing %q", err, tt.wantErr)
+					}
+				case err != nil:
+					t.Fatal(err)
+				default:
+					wantTree(t, dir, map[string]string{"f": "f", "g": "g"})
+				}
+				// A tree that didn't check out isn't kept for other pulls.
+				if cache != nil && tt.mismatch {
+					for i, layer := range [][]byte{first, second} {
+						tree, _ := cache.entryPath("layers", sha256Digest(compressed[i]))
+						if _, err := os.Stat(tree); err == nil && sha256Digest(layer) != tt.diffIDs[i] {
+							t.Errorf("the cache kept layer %d, which doesn't match its diff_id", i)
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+// TestPullBlobEncodings pulls from a registry that sends a layer in
+// different ways, and checks each is taken for the blob it stands for.
+func TestPullBlobEncodings(t *testing.T) {
+	layout := filepath.Join(t.TempDir(), "layout")
+	layer := testLayer(t, testEntry{name: "f", body: strings.Repeat("f", 1<<16)})
+	writeTestImage(t, layout, "latest", layer)
+	blob := gzipLayer(t, layer)
+	digest := sha256Digest(blob)
+	tests := []struct {
+		name string
+		// serve answers the requests for the layer.
+		serve   func(w http.ResponseWriter, r *http.Request)
+		wantErr string
+	}{
+		{
+			name: "chunked, without Content-Length",
+			serve: func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "HEAD" {
+					// As some registries say of what they send chunked.
+					w.Header().Set("Content-Length", "0")
+					return
+				}
+				// Flushing before the end has net/http send it chunked.
+				w.Write(blob[:len(blob)/2])
+				w.(http.Flusher).Flush()
+				w.Write(blob[len(blob)/2:])
+			},
+		},
+		{
+			name: "compressed in transit",
+			serve: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Encoding", "gzip")
+				if r.Method == "HEAD" {
+					return
+				}
+				w.Write(gzipLayer(t, blob))
+			},
+		},
+		{
+			name: "identity encoding",
+			serve: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Encoding", "identity")
+				w.Header().Set("Content-Length", fmt.Sprint(len(blob)))
+				if r.Method == "GET" {
+					w.Write(blob)
+				}
+			},
+		},
+		{
+			name: "unsupported encoding",
+			serve: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Encoding", "br")
+				if r.Method == "GET" {
+					w.Write(blob)
+				}
+			},
+			wantErr: `unsupported Content-Encoding "br"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DOCKER_CLONE_HOME", t.TempDir())
+			serve := ociLayoutHandler(layout)
+			var encodings []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !strings.HasSuffix(r.URL.Path, "/blobs/"+digest) {
+					serve(w, r)
+					return
+				}
+				encodings = append(encodings, r.Header.Get("Accept-Encoding"))
+				tt.serve(w, r)
+			}))
+			defer srv.Close()
+			useTestRegistry(t, srv)
+
+			dir := t.TempDir()
+			_, err := pullDockerImage(dir, "app", pullOptions{})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("pull: %v, want an error containing %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else {
+				wantTree(t, dir, map[string]string{"f": strings.Repeat("f", 1<<16)})
+			}
+			// Layers are compressed already.
+			for _, encoding := range encodings {
+				if encoding != "identity" {
+					t.Errorf("asked for the layer with Accept-Encoding %q, want identity", encoding)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultStallTimeout is how long a layer download may go without
+	// receiving a byte before it is retried.
+	defaultStallTimeout = 30 * time.Second
+	// maxStallRetries bounds how often one layer's download is retried
+	// after stalling.
+	maxStallRetries = 3
+)
+
+// errStalled is what reads from a stallReader fail with once it stalled.
+type errStalled struct {
+	timeout time.Duration
+}
+
+func (e errStalled) Error() string {
+	return fmt.Sprintf("no data received for %v", e.timeout)
+}
+
+// stallReader fails a read from r that waits for more than timeout, closing
+// r to unblock it. A hung connection would otherwise hold up its layer until
+// TCP gives up on it, which can take hours. Only time spent inside Read
+// counts, so readers that are slow to come back, e.g. because of a rate
+// limit, don't look stalled.
+type stallReader struct {
+	r       io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	stalled atomic.Bool
+}
+
+func newStallReader(r io.ReadCloser, timeout time.Duration) *stallReader {
+	s := &stallReader{r: r, timeout: timeout}
+	s.timer = time.AfterFunc(timeout, func() {
+		s.stalled.Store(true)
+		r.Close()
+	})
+	s.timer.Stop()
+	return s
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	if s.stalled.Load() {
+		return 0, errStalled{s.timeout}
+	}
+	s.timer.Reset(s.timeout)
+	n, err := s.r.Read(p)
+	s.timer.Stop()
+	if s.stalled.Load() {
+		return n, errStalled{s.timeout}
+	}
+	return n, err
+}
+
+func (s *stallReader) Close() error {
+	s.timer.Stop()
+	return s.r.Close()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestPullStalledLayer pulls from a registry that stops sending a layer
+// halfway through, and checks the download is retried from where it
+// stopped, a limited number of times.
+func TestPullStalledLayer(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		// stalls is how many of the layer's requests stall.
+		stalls       int
+		wantRequests int
+		wantErr      bool
+	}{
+		{name: "once", stalls: 1, wantRequests: 2},
+		{name: "always", stalls: 100, wantRequests: maxStallRetries + 1, wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DOCKER_CLONE_HOME", t.TempDir())
+			layout := filepath.Join(t.TempDir(), "layout")
+			body := tt.name + strings.Repeat("x", 1<<16)
+			tarball := testLayer(t, testEntry{name: "f", body: body})
+			writeTestImage(t, layout, "latest", tarball)
+			layer := gzipLayer(t, tarball)
+			digest := sha256Digest(layer)
+			serve := ociLayoutHandler(layout)
+			var mu sync.Mutex
+			var ranges []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != "GET" || !strings.HasSuffix(r.URL.Path, "/blobs/"+digest) {
+					serve(w, r)
+					return
+				}
+				mu.Lock()
+				ranges = append(ranges, r.Header.Get("Range"))
+				stall := len(ranges) <= tt.stalls
+				mu.Unlock()
+				if !stall {
+					serve(w, r)
+					return
+				}
+				// Send part of what was asked for, then nothing until
+				// the client hangs up.
+				start := 0
+				if rng := r.Header.Get("Range"); rng != "" {
+					start, _ = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+					w.Header().Set("Content-Range", "bytes "+strconv.Itoa(start)+"-"+strconv.Itoa(len(layer)-1)+"/"+strconv.Itoa(len(layer)))
+					w.Header().Set("Content-Length", strconv.Itoa(len(layer)-start))
+					w.WriteHeader(http.StatusPartialContent)
+				} else {
+					w.Header().Set("Content-Length", strconv.Itoa(len(layer)))
+				}
+				w.Write(layer[start : start+(len(layer)-start)/2])
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+			}))
+			defer srv.Close()
+			useTestRegistry(t, srv)
+
+			dir := t.TempDir()
+			var err error
+			stderr := captureStderr(t, func() {
+				_, err = pullDockerImage(dir, "app", pullOptions{StallTimeout: 200 * time.Millisecond})
+			})
+			if tt.wantErr {
+				var stalled errStalled
+				if !errors.As(err, &stalled) {
+					t.Fatalf("pull: %v, want it to fail stalled", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else {
+				wantTree(t, dir, map[string]string{"f": body})
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(ranges) != tt.wantRequests {
+				t.Fatalf("%d requests for the layer, want %d", len(ranges), tt.wantRequests)
+			}
+			// Each retry resumes after what the last one got.
+			received := 0
+			for i, rng := range ranges {
+				if want := "bytes=" + strconv.Itoa(received) + "-"; i > 0 && rng != want {
+					t.Errorf("request %d asked for %q, want %q", i, rng, want)
+				}
+				received += (len(layer) - received) / 2
+			}
+			if want := "retrying from byte " + strconv.Itoa(len(layer)/2); !strings.Contains(stderr, want) {
+				t.Errorf("stderr %q doesn't say %q", stderr, want)
+			}
+		})
+	}
+}
+
+// slowReader returns a byte at a time, after delay.
+type slowReader struct {
+	data  string
+	delay time.Duration
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	if s.data == "" {
+		return 0, io.EOF
+	}
+	time.Sleep(s.delay)
+	p[0], s.data = s.data[0], s.data[1:]
+	return 1, nil
+}
+
+func (s *slowReader) Close() error { return nil }
+
+func TestStallReader(t *testing.T) {
+	// Reads that each come back within the timeout never stall, however
+	// long they take together.
+	r := newStallReader(&slowReader{data: "abcdefghij", delay: 20 * time.Millisecond}, 100*time.Millisecond)
+	if data, err := io.ReadAll(r); err != nil || string(data) != "abcdefghij" {
+		t.Errorf("ReadAll = %q, %v", data, err)
+	}
+	r.Close()
+
+	// A read that doesn't is failed, and unblocked by closing the reader
+	// under it.
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	r = newStallReader(pr, 50*time.Millisecond)
+	start := time.Now()
+	_, err := r.Read(make([]byte, 1))
+	var stalled errStalled
+	if !errors.As(err, &stalled) {
+		t.Errorf("Read = %v, want it stalled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Read took %v", elapsed)
+	}
+	if _, err := r.Read(make([]byte, 1)); !errors.As(err, &stalled) {
+		t.Errorf("Read after stalling = %v, want it stalled", err)
+	}
+}
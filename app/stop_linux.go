@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// stopPollInterval is how often stop checks whether a container has exited.
+const stopPollInterval = 100 * time.Millisecond
+
+// stopContainer sends the container its stop signal and, if it is still
+// running after timeout, SIGKILL. It returns once the run supervising the
+// container has cleaned up after it.
+func stopContainer(state containerState, timeout time.Duration) error {
+	sig := syscall.Signal(state.StopSignal)
+	if sig == 0 {
+		sig = syscall.SIGTERM
+	}
+	if err := syscall.Kill(state.Pid, sig); err != nil && err != syscall.ESRCH {
+		return err
+	}
+	if waitContainerExit(state.key(), timeout) {
+		return nil
+	}
+	if err := syscall.Kill(state.Pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+		return err
+	}
+	// A killed container can't hold on, so the rest is cleanup.
+	waitContainerExit(state.key(), -1)
+	return nil
+}
+
+// waitContainerExit waits up to timeout, forever if it is negative, for the
+// container key to stop running, and reports whether it did.
+func waitContainerExit(key string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for containerRunning(key) {
+		if timeout >= 0 && time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(stopPollInterval)
+	}
+	return true
+}
+
+func stopCommand(argv []string) {
+	flags := flag.NewFlagSet("stop", flag.ExitOnError)
+	seconds := flags.Int("time", 10, "`seconds` to wait for the container to exit before killing it")
+	flags.IntVar(seconds, "t", 10, "shorthand for --time")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), stopUsage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(argv)
+	if flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	failed := false
+	for _, key := range flags.Args() {
+		state, ok := runningContainer(key)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Err: no such running container: %s\n", key)
+			failed = true
+			continue
+		}
+		if err := stopContainer(state, time.Duration(*seconds)*time.Second); err != nil {
+			fmt.Fprintf(os.Stderr, "Err stopping %s: %v\n", key, err)
+			failed = true
+			continue
+		}
+		fmt.Println(key)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
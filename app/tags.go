@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+)
+
+const dockerHubRegistry = "https://registry-1.docker.io"
+
+type tagListResponse struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+// linkNextPattern extracts the target of a `Link: <...>; rel="next"` header.
+var linkNextPattern = regexp.MustCompile(`<([^>]+)>\s*;\s*rel="?next"?`)
+
+// listTags returns every tag of repository, following the registry's Link
+// header pagination when the registry paginates the result.
+func listTags(repository string, auth *registryAuth) ([]string, error) {
+	next, err := url.Parse(fmt.Sprintf("%s/v2/%s/tags/list", registryBase(), repository))
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	for next != nil {
+		page, link, err := fetchTagPage(next.String(), auth)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, page.Tags...)
+		if link == "" {
+			break
+		}
+		// The next link is usually relative to the registry host.
+		if next, err = next.Parse(link); err != nil {
+			return nil, fmt.Errorf("invalid pagination link %q: %w", link, err)
+		}
+	}
+	return tags, nil
+}
+
+func fetchTagPage(pageURL string, auth *registryAuth) (tagListResponse, string, error) {
+	var page tagListResponse
+	req, err := http.NewRequest("GET", pageURL, nil)
+	if err != nil {
+		return page, "", err
+	}
+	res, err := auth.do(registryClient, req)
+	if err != nil {
+		return page, "", err
+	}
+	defer closeBody(res.Body)
+	if res.StatusCode != http.StatusOK {
+		return page, "", fmt.Errorf("listing tags: unexpected status %s", res.Status)
+	}
+	if err := json.NewDecoder(res.Body).Decode(&page); err != nil {
+		return page, "", err
+	}
+	var link string
+	if m := linkNextPattern.FindStringSubmatch(res.Header.Get("Link")); m != nil {
+		link = m[1]
+	}
+	return page, link, nil
+}
+
+func tagsCommand(argv []string) {
+	flags := flag.NewFlagSet("tags", flag.ExitOnError)
+	scopeActions := flags.String("registry-scope", defaultScopeActions, "comma-separated `actions` to request in the registry token scope")
+	var caCerts stringsFlag
+	flags.Var(&caCerts, "ca-cert", "also trust the CA certificates in PEM `file`, or in the .pem/.crt/.cert files of a directory, for registry TLS (repeatable)")
+	timeouts := httpTimeoutFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), tagsUsage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(argv)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	if err := useCACerts(caCerts); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	if err := useHTTPTimeouts(timeouts); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	ref, err := parseImageRef(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	auth, err := newRegistryAuth(ref.Repository, *scopeActions)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err fetching token: %v\n", err)
+		os.Exit(1)
+	}
+	tags, err := listTags(ref.Repository, auth)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	for _, tag := range tags {
+		fmt.Println(tag)
+	}
+}
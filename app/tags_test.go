@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestListTags(t *testing.T) {
+	tests := []struct {
+		name string
+		// pages are served for ?page=0, 1 and so on, each with the Link
+		// header of links at the same index, if any, $srv standing for
+		// the server's URL.
+		pages   [][]string
+		links   []string
+		want    []string
+		wantErr bool
+	}{
+		{name: "one page", pages: [][]string{{"a", "b"}}, want: []string{"a", "b"}},
+		{
+			name:  "two pages, relative link",
+			pages: [][]string{{"a", "b"}, {"c"}},
+			links: []string{`</v2/library/test/tags/list?n=2&last=b&page=1>; rel="next"`},
+			want:  []string{"a", "b", "c"},
+		},
+		{
+			name:  "three pages, absolute links",
+			pages: [][]string{{"a"}, {"b"}, {"c"}},
+			links: []string{"<$srv/v2/library/test/tags/list?page=1>; rel=next", "<$srv/v2/library/test/tags/list?page=2>; rel=next"},
+			want:  []string{"a", "b", "c"},
+		},
+		{
+			name:  "other relations",
+			pages: [][]string{{"a"}, {"b"}},
+			links: []string{`</docs>; rel="help", </v2/library/test/tags/list?page=1>; rel="next"`},
+			want:  []string{"a", "b"},
+		},
+		{
+			name:    "next page missing",
+			pages:   [][]string{{"a"}},
+			links:   []string{`</v2/library/test/tags/list?page=5>; rel="next"`},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var srv *httptest.Server
+			srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+				if r.URL.Path != "/v2/library/test/tags/list" || page >= len(tt.pages) {
+					http.NotFound(w, r)
+					return
+				}
+				if page < len(tt.links) {
+					w.Header().Set("Link", strings.ReplaceAll(tt.links[page], "$srv", srv.URL))
+				}
+				json.NewEncoder(w).Encode(tagListResponse{Name: "library/test", Tags: tt.pages[page]})
+			}))
+			defer srv.Close()
+			useTestRegistry(t, srv)
+			got, err := listTags("library/test", &registryAuth{})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("listTags = %q, want an error", got)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("listTags = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
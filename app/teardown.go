@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// teardownStack collects cleanup functions as resources are set up and runs
+// them in reverse order on the way out. Unlike defer it also runs on error
+// and signal paths that end in os.Exit, so nothing set up before a failure
+// gets leaked.
+type teardownStack struct {
+	mu    sync.Mutex
+	steps []teardownStep
+	done  bool
+}
+
+type teardownStep struct {
+	name string
+	fn   func() error
+}
+
+// push registers fn to undo the resource described by name.
+func (t *teardownStack) push(name string, fn func() error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.steps = append(t.steps, teardownStep{name, fn})
+}
+
+// run unwinds the stack. Failures are reported but don't stop the remaining
+// steps. Only the first call does anything, so racing exit paths (e.g. a
+// signal arriving during a normal exit) can't clean up twice.
+func (t *teardownStack) run() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return
+	}
+	t.done = true
+	for i := len(t.steps) - 1; i >= 0; i-- {
+		if err := t.steps[i].fn(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: cleaning up %s: %v\n", t.steps[i].name, err)
+		}
+	}
+	t.steps = nil
+}
+
+// exit unwinds the stack and exits with code.
+func (t *teardownStack) exit(code int) {
+	t.run()
+	os.Exit(code)
+}
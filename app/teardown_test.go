@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestTeardownStack(t *testing.T) {
+	var ran []string
+	stack := &teardownStack{}
+	for _, name := range []string{"lock", "rootfs", "cgroup"} {
+		name := name
+		stack.push(name, func() error {
+			ran = append(ran, name)
+			if name == "rootfs" {
+				return errors.New("busy")
+			}
+			return nil
+		})
+	}
+	warnings := captureStderr(t, stack.run)
+	// A failed step doesn't stop the ones set up before it.
+	if want := []string{"cgroup", "rootfs", "lock"}; !reflect.DeepEqual(ran, want) {
+		t.Errorf("ran %q, want %q", ran, want)
+	}
+	if want := "Warning: cleaning up rootfs: busy\n"; warnings != want {
+		t.Errorf("warned %q, want %q", warnings, want)
+	}
+	stack.run()
+	if len(ran) != 3 {
+		t.Errorf("a second run ran %q again", ran[3:])
+	}
+}
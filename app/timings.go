@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// pullTimings records where the time of a pull went. All methods are safe to
+// call on a nil receiver so the pull pipeline doesn't need to care whether
+// timings were requested.
+type pullTimings struct {
+	Token    time.Duration
+	Manifest time.Duration
+	Layers   []*layerTiming
+	// FirstLayer is how long after layers started downloading the first
+	// one was applied, i.e. when extraction stopped waiting on the network.
+	FirstLayer time.Duration
+	Total      time.Duration
+
+	// attempt counts the attempts at the pull, with --pull-retries.
+	attempt int
+}
+
+type layerTiming struct {
+	Digest   string
+	Download time.Duration
+	Extract  time.Duration
+
+	attempt int
+}
+
+// newAttempt starts timing another attempt at the pull, whose times replace
+// the failed one's.
+func (t *pullTimings) newAttempt() {
+	if t != nil {
+		t.attempt++
+	}
+}
+
+// layer returns the row timing the layer digest. A layer timed in an earlier
+// attempt keeps its row, started over, so that each layer has one however
+// many attempts there were.
+func (t *pullTimings) layer(digest string) *layerTiming {
+	if t == nil {
+		return nil
+	}
+	for _, l := range t.Layers {
+		if l.Digest == digest && l.attempt < t.attempt {
+			*l = layerTiming{Digest: digest, attempt: t.attempt}
+			return l
+		}
+	}
+	l := &layerTiming{Digest: digest, attempt: t.attempt}
+	t.Layers = append(t.Layers, l)
+	return l
+}
+
+func (t *pullTimings) writeTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STEP\tNETWORK\tEXTRACT")
+	fmt.Fprintf(tw, "token\t%s\t\n", t.Token.Round(time.Millisecond))
+	fmt.Fprintf(tw, "manifest\t%s\t\n", t.Manifest.Round(time.Millisecond))
+	for _, l := range t.Layers {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", shortDigest(l.Digest), l.Download.Round(time.Millisecond), l.Extract.Round(time.Millisecond))
+	}
+	fmt.Fprintf(tw, "first layer\t\t%s\n", t.FirstLayer.Round(time.Millisecond))
+	fmt.Fprintf(tw, "total\t%s\t\n", t.Total.Round(time.Millisecond))
+	return tw.Flush()
+}
+
+func (t *pullTimings) writeJSON(w io.Writer) error {
+	type layerJSON struct {
+		Digest          string  `json:"digest"`
+		DownloadSeconds float64 `json:"download_seconds"`
+		ExtractSeconds  float64 `json:"extract_seconds"`
+	}
+	out := struct {
+		TokenSeconds      float64     `json:"token_seconds"`
+		ManifestSeconds   float64     `json:"manifest_seconds"`
+		Layers            []layerJSON `json:"layers"`
+		FirstLayerSeconds float64     `json:"first_layer_seconds"`
+		TotalSeconds      float64     `json:"total_seconds"`
+	}{
+		TokenSeconds:      t.Token.Seconds(),
+		ManifestSeconds:   t.Manifest.Seconds(),
+		Layers:            []layerJSON{},
+		FirstLayerSeconds: t.FirstLayer.Seconds(),
+		TotalSeconds:      t.Total.Seconds(),
+	}
+	for _, l := range t.Layers {
+		out.Layers = append(out.Layers, layerJSON{l.Digest, l.Download.Seconds(), l.Extract.Seconds()})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// shortDigest abbreviates a digest the way `docker images` does.
+func shortDigest(digest string) string {
+	const n = len("sha256:") + 12
+	if len(digest) > n {
+		return digest[:n]
+	}
+	return digest
+}
+
+// timingsFlag implements --timings, which may be given bare (table output)
+// or as --timings=json.
+type timingsFlag struct {
+	format string
+}
+
+func (f *timingsFlag) String() string { return f.format }
+
+func (f *timingsFlag) IsBoolFlag() bool { return true }
+
+func (f *timingsFlag) Set(value string) error {
+	switch value {
+	case "true", "table":
+		f.format = "table"
+	case "false":
+		f.format = ""
+	case "json":
+		f.format = "json"
+	default:
+		return fmt.Errorf("unknown timings format %q (want table or json)", value)
+	}
+	return nil
+}
+
+func (f *timingsFlag) write(w io.Writer, t *pullTimings) error {
+	if f.format == "json" {
+		return t.writeJSON(w)
+	}
+	return t.writeTable(w)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPullTimingsAttempts(t *testing.T) {
+	tests := []struct {
+		name string
+		// attempts are the layers each attempt timed.
+		attempts [][]string
+		want     []string
+	}{
+		{name: "one attempt", attempts: [][]string{{"a", "b"}}, want: []string{"a", "b"}},
+		{name: "retried", attempts: [][]string{{"a", "b"}, {"a", "b"}, {"a", "b"}}, want: []string{"a", "b"}},
+		{name: "failed partway", attempts: [][]string{{"a"}, {"a", "b"}}, want: []string{"a", "b"}},
+		// A manifest may list the same layer twice.
+		{name: "repeated layer", attempts: [][]string{{"a", "a"}, {"a", "a"}}, want: []string{"a", "a"}},
+	}
+	for _, tt := range tests {
+		timings := &pullTimings{}
+		for i, attempt := range tt.attempts {
+			timings.newAttempt()
+			for _, digest := range attempt {
+				timings.layer(digest).Download = time.Duration(i+1) * time.Second
+			}
+		}
+		var got []string
+		for _, l := range timings.Layers {
+			got = append(got, l.Digest)
+			// Rows are the last attempt's.
+			if want := time.Duration(len(tt.attempts)) * time.Second; l.Download != want {
+				t.Errorf("%s: %s took %s, want the last attempt's %s", tt.name, l.Digest, l.Download, want)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: rows %q, want %q", tt.name, got, tt.want)
+		}
+		var b bytes.Buffer
+		if err := timings.writeJSON(&b); err != nil {
+			t.Fatal(err)
+		}
+		var out struct {
+			Layers []json.RawMessage `json:"layers"`
+		}
+		if err := json.Unmarshal(b.Bytes(), &out); err != nil || len(out.Layers) != len(tt.want) {
+			t.Errorf("%s: JSON has %d layers, %v, want %d", tt.name, len(out.Layers), err, len(tt.want))
+		}
+	}
+}
+
+func TestPullTimingsNil(t *testing.T) {
+	var timings *pullTimings
+	timings.newAttempt()
+	if l := timings.layer("a"); l != nil {
+		t.Errorf("nil timings timed a layer: %+v", l)
+	}
+}
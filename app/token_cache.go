@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Registries are allowed to omit expires_in, in which case the token must be
+// assumed to be valid for 60 seconds.
+const defaultTokenLifetime = 60 * time.Second
+
+// Tokens are treated as expired slightly early so that a request started just
+// before expiry doesn't get rejected mid-flight.
+const tokenExpiryMargin = 5 * time.Second
+
+type cachedToken struct {
+	Token     DockerTokenResponse `json:"token"`
+	ExpiresAt time.Time           `json:"expires_at"`
+}
+
+// tokenCache reuses bearer tokens across pulls within a single process. Tokens
+// are keyed by registry and scope, so two pulls of the same repository share a
+// token while different repositories don't.
+//
+// If DOCKER_CLONE_TOKEN_CACHE names a file, the cache is loaded from and
+// persisted to it, letting a shell session share tokens between invocations.
+type tokenCache struct {
+	mu     sync.Mutex
+	tokens map[string]cachedToken
+	path   string
+	loaded bool
+}
+
+var registryTokens = &tokenCache{path: os.Getenv("DOCKER_CLONE_TOKEN_CACHE")}
+
+func tokenCacheKey(registry, scope string) string {
+	return registry + "|" + scope
+}
+
+func (c *tokenCache) get(registry, scope string) (DockerTokenResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+	entry, ok := c.tokens[tokenCacheKey(registry, scope)]
+	if !ok || time.Now().After(entry.ExpiresAt.Add(-tokenExpiryMargin)) {
+		return DockerTokenResponse{}, false
+	}
+	return entry.Token, true
+}
+
+func (c *tokenCache) put(registry, scope string, token DockerTokenResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+	c.tokens[tokenCacheKey(registry, scope)] = cachedToken{
+		Token:     token,
+		ExpiresAt: tokenExpiry(token),
+	}
+	c.save()
+}
+
+// load reads the on-disk cache the first time it's needed. A missing or
+// unreadable file just means starting with an empty cache.
+func (c *tokenCache) load() {
+	if c.loaded {
+		return
+	}
+	c.loaded = true
+	c.tokens = make(map[string]cachedToken)
+	if c.path == "" {
+		return
+	}
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		return
+	}
+	_ = json.Unmarshal(data, &c.tokens)
+}
+
+func (c *tokenCache) save() {
+	if c.path == "" {
+		return
+	}
+	now := time.Now()
+	for key, entry := range c.tokens {
+		if now.After(entry.ExpiresAt) {
+			delete(c.tokens, key)
+		}
+	}
+	data, err := json.Marshal(c.tokens)
+	if err != nil {
+		return
+	}
+	_ = os.WriteFile(c.path, data, 0o600)
+}
+
+func tokenExpiry(token DockerTokenResponse) time.Time {
+	issuedAt, err := time.Parse(time.RFC3339, token.IssuedAt)
+	if err != nil {
+		issuedAt = time.Now()
+	}
+	lifetime := time.Duration(token.ExpiresIn) * time.Second
+	if lifetime <= 0 {
+		lifetime = defaultTokenLifetime
+	}
+	return issuedAt.Add(lifetime)
+}
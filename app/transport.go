@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Defaults for the registry transport's timeouts. Dialing, TLS handshakes and
+// idle connections get http.DefaultTransport's; it sets no limit on waiting
+// for response headers, which leaves a pull hanging on a registry that
+// accepted the request and never answers, so that gets one too.
+const (
+	defaultDialTimeout           = 30 * time.Second
+	defaultTLSHandshakeTimeout   = 10 * time.Second
+	defaultResponseHeaderTimeout = 30 * time.Second
+	defaultIdleConnTimeout       = 90 * time.Second
+)
+
+// httpTimeouts bound the stages of registry requests. Zero means no limit.
+// Reading the body is bounded by --stall-timeout for layer downloads instead,
+// as a whole layer can take any time to arrive.
+type httpTimeouts struct {
+	// Dial bounds connecting to the registry, DNS lookup included.
+	Dial time.Duration
+	// TLSHandshake bounds the TLS handshake once connected, which some
+	// intercepting proxies are slow at.
+	TLSHandshake time.Duration
+	// ResponseHeader bounds the wait for the response headers once the
+	// request is sent.
+	ResponseHeader time.Duration
+	// IdleConn is how long an unused connection is kept for later requests.
+	IdleConn time.Duration
+}
+
+// httpTimeoutFlags adds the flags setting httpTimeouts to flags.
+func httpTimeoutFlags(flags *flag.FlagSet) *httpTimeouts {
+	t := &httpTimeouts{}
+	flags.DurationVar(&t.Dial, "dial-timeout", defaultDialTimeout, "give up connecting to a registry after `duration`; 0 never does")
+	flags.DurationVar(&t.TLSHandshake, "tls-handshake-timeout", defaultTLSHandshakeTimeout, "give up on a registry's TLS handshake after `duration`; 0 never does")
+	flags.DurationVar(&t.ResponseHeader, "response-header-timeout", defaultResponseHeaderTimeout, "give up on a registry request whose response headers take longer than `duration`; 0 never does")
+	flags.DurationVar(&t.IdleConn, "idle-conn-timeout", defaultIdleConnTimeout, "close registry connections left unused for `duration`; 0 keeps them")
+	return t
+}
+
+// registryTransport returns registryClient's transport, first giving it one
+// of its own, a copy of http.DefaultTransport, if it uses that.
+func registryTransport() *http.Transport {
+	if transport, ok := registryClient.Transport.(*http.Transport); ok {
+		return transport
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	registryClient.Transport = transport
+	return transport
+}
+
+// useHTTPTimeouts makes registryClient's transport use t.
+func useHTTPTimeouts(t *httpTimeouts) error {
+	for _, d := range []struct {
+		flag  string
+		value time.Duration
+	}{
+		{"dial-timeout", t.Dial},
+		{"tls-handshake-timeout", t.TLSHandshake},
+		{"response-header-timeout", t.ResponseHeader},
+		{"idle-conn-timeout", t.IdleConn},
+	} {
+		if d.value < 0 {
+			return fmt.Errorf("--%s %v: must not be negative", d.flag, d.value)
+		}
+	}
+	transport := registryTransport()
+	dialer := &net.Dialer{Timeout: t.Dial, KeepAlive: 30 * time.Second}
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = t.TLSHandshake
+	transport.ResponseHeaderTimeout = t.ResponseHeader
+	transport.IdleConnTimeout = t.IdleConn
+	return nil
+}
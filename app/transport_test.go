@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestHTTPTimeouts parses the timeout flags and checks their values end up
+// in registryClient's transport, and that the response header timeout
+// stops a request to a registry that doesn't answer.
+func TestHTTPTimeouts(t *testing.T) {
+	tests := []struct {
+		args    []string
+		want    httpTimeouts
+		wantErr string
+	}{
+		{
+			want: httpTimeouts{TLSHandshake: defaultTLSHandshakeTimeout, ResponseHeader: defaultResponseHeaderTimeout, IdleConn: defaultIdleConnTimeout},
+		},
+		{
+			args: []string{"--tls-handshake-timeout", "1m", "--response-header-timeout", "100ms", "--idle-conn-timeout", "0"},
+			want: httpTimeouts{TLSHandshake: time.Minute, ResponseHeader: 100 * time.Millisecond},
+		},
+		{args: []string{"--dial-timeout", "-1s"}, wantErr: "--dial-timeout -1s: must not be negative"},
+		{args: []string{"--response-header-timeout", "-1s"}, wantErr: "--response-header-timeout -1s: must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			saved := registryClient
+			registryClient = &http.Client{}
+			t.Cleanup(func() { registryClient = saved })
+
+			flags := flag.NewFlagSet("pull", flag.ContinueOnError)
+			timeouts := httpTimeoutFlags(flags)
+			if err := flags.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			err := useHTTPTimeouts(timeouts)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("useHTTPTimeouts: %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Trusting other CAs keeps the transport, and so the timeouts.
+			registryTLSConfig()
+			transport, ok := registryClient.Transport.(*http.Transport)
+			if !ok {
+				t.Fatalf("registryClient uses a %T", registryClient.Transport)
+			}
+			// The dialer's timeout can't be read back from the transport,
+			// so Dial is left out.
+			got := httpTimeouts{TLSHandshake: transport.TLSHandshakeTimeout, ResponseHeader: transport.ResponseHeaderTimeout, IdleConn: transport.IdleConnTimeout}
+			if got != tt.want {
+				t.Errorf("transport timeouts %+v, want %+v", got, tt.want)
+			}
+			if transport.DialContext == nil {
+				t.Error("the transport has no dialer of ours")
+			}
+		})
+	}
+
+	// A registry that never answers is given up on once the headers are late.
+	saved := registryClient
+	registryClient = &http.Client{}
+	defer func() { registryClient = saved }()
+	if err := useHTTPTimeouts(&httpTimeouts{ResponseHeader: 100 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+	start := time.Now()
+	res, err := registryClient.Get(srv.URL + "/v2/")
+	if err == nil {
+		res.Body.Close()
+		t.Fatal("GET succeeded without an answer")
+	}
+	if !strings.Contains(err.Error(), "timeout awaiting response headers") || time.Since(start) > 5*time.Second {
+		t.Errorf("GET failed after %v with %v, want it to time out waiting for headers", time.Since(start), err)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ulimitResources maps the names --ulimit accepts, as in Docker and
+// ulimit(1), to RLIMIT_* resources. The syscall package only names some of
+// them; the rest are the values from <sys/resource.h>.
+var ulimitResources = map[string]int{
+	"as":         syscall.RLIMIT_AS,
+	"core":       syscall.RLIMIT_CORE,
+	"cpu":        syscall.RLIMIT_CPU,
+	"data":       syscall.RLIMIT_DATA,
+	"fsize":      syscall.RLIMIT_FSIZE,
+	"locks":      10, // RLIMIT_LOCKS
+	"memlock":    8,  // RLIMIT_MEMLOCK
+	"msgqueue":   12, // RLIMIT_MSGQUEUE
+	"nice":       13, // RLIMIT_NICE
+	"nofile":     syscall.RLIMIT_NOFILE,
+	"nproc":      6,  // RLIMIT_NPROC
+	"rss":        5,  // RLIMIT_RSS
+	"rtprio":     14, // RLIMIT_RTPRIO
+	"rttime":     15, // RLIMIT_RTTIME
+	"sigpending": 11, // RLIMIT_SIGPENDING
+	"stack":      syscall.RLIMIT_STACK,
+}
+
+// rlimInfinity is RLIM_INFINITY, written as "unlimited" or -1.
+const rlimInfinity = ^uint64(0)
+
+// ulimitSpec is a resource limit to set on the container's process.
+type ulimitSpec struct {
+	Name     string `json:"name"`
+	Resource int    `json:"resource"`
+	Soft     uint64 `json:"soft"`
+	Hard     uint64 `json:"hard"`
+}
+
+// parseUlimitFlag parses a --ulimit value, name=soft[:hard]. Without a hard
+// limit, both limits are set to soft.
+func parseUlimitFlag(value string) (ulimitSpec, error) {
+	name, limits, ok := strings.Cut(value, "=")
+	if !ok {
+		return ulimitSpec{}, fmt.Errorf("invalid --ulimit %q: want name=soft[:hard]", value)
+	}
+	resource, ok := ulimitResources[name]
+	if !ok {
+		return ulimitSpec{}, fmt.Errorf("invalid --ulimit %q: unknown limit %q (want one of %s)", value, name, strings.Join(ulimitNames(), ", "))
+	}
+	softValue, hardValue, hasHard := strings.Cut(limits, ":")
+	soft, err := parseRlimit(softValue)
+	if err != nil {
+		return ulimitSpec{}, fmt.Errorf("invalid --ulimit %q: %w", value, err)
+	}
+	hard := soft
+	if hasHard {
+		if hard, err = parseRlimit(hardValue); err != nil {
+			return ulimitSpec{}, fmt.Errorf("invalid --ulimit %q: %w", value, err)
+		}
+	}
+	if soft > hard {
+		return ulimitSpec{}, fmt.Errorf("invalid --ulimit %q: soft limit must not exceed the hard limit", value)
+	}
+	return ulimitSpec{Name: name, Resource: resource, Soft: soft, Hard: hard}, nil
+}
+
+func parseRlimit(s string) (uint64, error) {
+	if s == "unlimited" || s == "-1" {
+		return rlimInfinity, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid limit %q: want a non-negative number or \"unlimited\"", s)
+	}
+	return n, nil
+}
+
+func ulimitNames() []string {
+	names := make([]string, 0, len(ulimitResources))
+	for name := range ulimitResources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyUlimits sets the limits on the current process, to be inherited
+// across exec by the container's command.
+func applyUlimits(ulimits []ulimitSpec) error {
+	for _, u := range ulimits {
+		if err := syscall.Setrlimit(u.Resource, &syscall.Rlimit{Cur: u.Soft, Max: u.Hard}); err != nil {
+			return fmt.Errorf("setting ulimit %s: %w", u.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestParseUlimitFlag(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    ulimitSpec
+		wantErr bool
+	}{
+		{value: "nofile=1024:2048", want: ulimitSpec{Name: "nofile", Resource: syscall.RLIMIT_NOFILE, Soft: 1024, Hard: 2048}},
+		{value: "nofile=1024", want: ulimitSpec{Name: "nofile", Resource: syscall.RLIMIT_NOFILE, Soft: 1024, Hard: 1024}},
+		{value: "nproc=10:unlimited", want: ulimitSpec{Name: "nproc", Resource: 6, Soft: 10, Hard: rlimInfinity}},
+		{value: "core=-1", want: ulimitSpec{Name: "core", Resource: syscall.RLIMIT_CORE, Soft: rlimInfinity, Hard: rlimInfinity}},
+		{value: "nofile=2048:1024", wantErr: true},
+		{value: "nofile", wantErr: true},
+		{value: "nofile=", wantErr: true},
+		{value: "nofile=many", wantErr: true},
+		{value: "nofile=1:-2", wantErr: true},
+		{value: "files=1024", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseUlimitFlag(tt.value)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseUlimitFlag(%q) = %+v, want an error", tt.value, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseUlimitFlag(%q) = %+v, %v, want %+v", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+// TestRunSetsUlimit checks the container's command runs with the open file
+// limits --ulimit sets.
+func TestRunSetsUlimit(t *testing.T) {
+	docker, image := runTestImage(t)
+	tests := []struct {
+		ulimit string
+		want   string
+	}{
+		// The probe, a Go program, raises a soft limit below hard-1 to
+		// that at startup, so the soft limits here are as it sees them.
+		{ulimit: "nofile=1023:1024", want: "nofile 1023 1024"},
+		{ulimit: "nofile=512", want: "nofile 512 512"},
+	}
+	for _, tt := range tests {
+		out, err := docker("run", "--rm", "--ulimit", tt.ulimit, image, "/probe", "rlimit").CombinedOutput()
+		if err != nil {
+			t.Fatalf("--ulimit %s: %v\n%s", tt.ulimit, err, out)
+		}
+		if got := strings.TrimSpace(string(out)); got != tt.want {
+			t.Errorf("--ulimit %s: the container reports %q, want %q", tt.ulimit, got, tt.want)
+		}
+	}
+}
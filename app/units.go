@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// parseSize parses a human-readable byte size such as "512", "64k", "1m" or
+// "2g". Suffixes are binary (1k = 1024) and case-insensitive, and an optional
+// trailing "b" is accepted, matching Docker's size flags.
+func parseSize(s string) (int64, error) {
+	value := strings.ToLower(strings.TrimSpace(s))
+	value = strings.TrimSuffix(value, "b")
+	multiplier := int64(1)
+	if n := len(value); n > 0 {
+		switch value[n-1] {
+		case 'k':
+			multiplier = 1 << 10
+		case 'm':
+			multiplier = 1 << 20
+		case 'g':
+			multiplier = 1 << 30
+		case 't':
+			multiplier = 1 << 40
+		}
+		if multiplier != 1 {
+			value = value[:n-1]
+		}
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	// NaN fails every comparison, so it is let through by n < 0.
+	if err != nil || !(n >= 0) || math.IsInf(n, 0) {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	size := n * float64(multiplier)
+	// Converting a float past int64's range gives a garbage, often
+	// negative, size.
+	if size >= math.MaxInt64 {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return int64(size), nil
+}
+
+// sizeFlag is a flag.Value holding a byte size parsed by parseSize.
+type sizeFlag int64
+
+func (f *sizeFlag) String() string { return strconv.FormatInt(int64(*f), 10) }
+
+func (f *sizeFlag) Set(s string) error {
+	n, err := parseSize(s)
+	if err != nil {
+		return err
+	}
+	*f = sizeFlag(n)
+	return nil
+}
+
+// formatSize renders a byte size the way `docker images` does, with decimal
+// units and three significant digits, e.g. "5.61MB".
+func formatSize(n int64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	size, unit := float64(n), 0
+	for size >= 1000 && unit < len(units)-1 {
+		size /= 1000
+		unit++
+	}
+	return fmt.Sprintf("%.3g%s", size, units[unit])
+}
@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    int64
+		wantErr bool
+	}{
+		{s: "512", want: 512},
+		{s: "64k", want: 64 << 10},
+		{s: "1m", want: 1 << 20},
+		{s: "1MB", want: 1 << 20},
+		{s: "2g", want: 2 << 30},
+		{s: "1.5k", want: 1536},
+		{s: " 4K ", want: 4 << 10},
+		{s: "0", want: 0},
+		{s: "", wantErr: true},
+		{s: "k", wantErr: true},
+		{s: "-1m", wantErr: true},
+		{s: "1x", wantErr: true},
+		{s: "nan", wantErr: true},
+		{s: "infm", wantErr: true},
+		{s: "8388607t", want: 8388607 << 40},
+		{s: "8388608t", wantErr: true},
+		{s: "9999999999t", wantErr: true},
+		{s: "1e30", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseSize(tt.s)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseSize(%q) = %d, want an error", tt.s, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d", tt.s, got, err, tt.want)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{n: 0, want: "0B"},
+		{n: 999, want: "999B"},
+		{n: 1000, want: "1kB"},
+		{n: 5_610_000, want: "5.61MB"},
+		{n: 72_800_000_000, want: "72.8GB"},
+	}
+	for _, tt := range tests {
+		if got := formatSize(tt.n); got != tt.want {
+			t.Errorf("formatSize(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+)
+
+// Results of checking one component of an image.
+const (
+	verifyOK      = "ok"
+	verifyFailed  = "FAILED"
+	verifyMissing = "missing"
+	// verifySkipped is for layers cached unpacked, which have no digest
+	// left to check.
+	verifySkipped = "skipped"
+)
+
+// verifyResult is the outcome of checking one of an image's manifest,
+// config and layers.
+type verifyResult struct {
+	Component string
+	Digest    string
+	Result    string
+	Err       error
+}
+
+// imageVerifier checks an image's content where it is kept locally: in its
+// OCI layout or docker save archive, or, for registry images, in the layer
+// cache. Nothing but a registry image's manifest is downloaded.
+type imageVerifier struct {
+	cache *layerCache
+	buf   []byte
+}
+
+func (v *imageVerifier) verify(image, scopeActions string) []verifyResult {
+	var results []verifyResult
+	src, ref, err := openSource(image, scopeActions)
+	if err != nil {
+		return append(results, verifyResult{Component: "manifest", Result: verifyFailed, Err: err})
+	}
+	data, kind, err := resolveManifest(src, ref)
+	if err != nil {
+		return append(results, verifyResult{Component: "manifest", Result: verifyFailed, Err: err})
+	}
+	results = append(results, verifyResult{Component: "manifest", Digest: sha256Digest(data), Result: verifyOK})
+	manifest, err := parseManifest(data, kind)
+	if err != nil {
+		return append(results, verifyResult{Component: "manifest", Result: verifyFailed, Err: err})
+	}
+
+	_, remote := src.(*registrySource)
+	check := func(what, digest string) verifyResult {
+		if remote {
+			return v.checkCached(what, digest)
+		}
+		return v.checkSource(src, what, digest)
+	}
+	if manifest.Config.Digest != "" {
+		results = append(results, check("config", manifest.Config.Digest))
+	}
+	for _, layer := range manifest.Layers {
+		results = append(results, check("layer", layer.Digest))
+	}
+	return results
+}
+
+// checkSource hashes the blob with digest as src has it.
+func (v *imageVerifier) checkSource(src Source, what, digest string) verifyResult {
+	result := verifyResult{Component: what, Digest: digest}
+	d, err := newDigester(what, digest)
+	if err == nil {
+		var r io.ReadCloser
+		if r, err = src.Blob(digest); err == nil {
+			_, err = copyBuffer(d, r, v.buf)
+			r.Close()
+		}
+	}
+	if err == nil {
+		err = d.verify()
+	}
+	return result.with(err)
+}
+
+// checkCached hashes the layer cache's copy of the blob with digest.
+func (v *imageVerifier) checkCached(what, digest string) verifyResult {
+	result := verifyResult{Component: what, Digest: digest}
+	kind := "blobs"
+	if what == "config" {
+		kind = "configs"
+	}
+	path, err := v.cache.entryPath(kind, digest)
+	if err != nil {
+		return result.with(err)
+	}
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		if what == "layer" {
+			if tree, _ := v.cache.entryPath("layers", digest); isDir(tree) {
+				result.Result = verifySkipped
+				return result
+			}
+		}
+		result.Result = verifyMissing
+		return result
+	}
+	return result.with(verifyFile(what, path, digest, v.buf))
+}
+
+func (r verifyResult) with(err error) verifyResult {
+	r.Result, r.Err = verifyOK, err
+	if err != nil {
+		r.Result = verifyFailed
+	}
+	return r
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+func verifyCommand(argv []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	scopeActions := flags.String("registry-scope", defaultScopeActions, "comma-separated `actions` to request in the registry token scope")
+	var caCerts stringsFlag
+	flags.Var(&caCerts, "ca-cert", "also trust the CA certificates in PEM `file`, or in the .pem/.crt/.cert files of a directory, for registry TLS (repeatable)")
+	timeouts := httpTimeoutFlags(flags)
+	platform := flags.String("platform", targetPlatform.String(), "pick the image for `os/arch[/variant]` from multi-platform images")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), verifyUsage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(argv)
+	if flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	if err := useCACerts(caCerts); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	if err := useHTTPTimeouts(timeouts); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+	if err := usePlatform(*platform); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+		os.Exit(1)
+	}
+
+	v := &imageVerifier{
+		cache: &layerCache{dir: cacheDir()},
+		buf:   make([]byte, defaultBufferSize),
+	}
+	failed := 0
+	for _, image := range flags.Args() {
+		results := v.verify(image, *scopeActions)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(tw, "%s\n", image)
+		bad := 0
+		for _, r := range results {
+			result := r.Result
+			if r.Err != nil {
+				result += ": " + r.Err.Error()
+			}
+			if r.Result == verifyFailed || r.Result == verifyMissing {
+				bad++
+			}
+			fmt.Fprintf(tw, "  %s\t%s\t%s\n", r.Component, shortDigest(r.Digest), result)
+		}
+		tw.Flush()
+		if bad > 0 {
+			failed++
+			fmt.Fprintf(os.Stderr, "%s: %d of %d components failed verification\n", image, bad, len(results))
+		}
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
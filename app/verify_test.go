@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestVerify pulls an image from a registry into the layer cache, and
+// checks what verify makes of it once one of its cached blobs is corrupted,
+// removed or unpacked, and of its OCI layout with a blob corrupted.
+func TestVerify(t *testing.T) {
+	t.Setenv("DOCKER_CLONE_HOME", t.TempDir())
+	layout := filepath.Join(t.TempDir(), "layout")
+	desc := writeTestImage(t, layout, "latest", testLayer(t, testEntry{name: "f", body: "f"}), testLayer(t, testEntry{name: "g", body: "g"}))
+	var manifest ociManifest
+	if err := readOCIBlobJSON(layout, desc.Digest, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	config, first, second := manifest.Config.Digest, manifest.Layers[0].Digest, manifest.Layers[1].Digest
+	useTestRegistry(t, serveOCILayout(t, layout))
+
+	tests := []struct {
+		name  string
+		image string
+		// damage does something to the cache, or to the layout.
+		damage func(t *testing.T, cache *layerCache)
+		want   map[string]string
+	}{
+		{
+			name:  "intact",
+			image: "app",
+			want:  map[string]string{config: verifyOK, first: verifyOK, second: verifyOK},
+		},
+		{
+			name:  "corrupt layer",
+			image: "app",
+			damage: func(t *testing.T, c *layerCache) {
+				path, _ := c.entryPath("blobs", second)
+				corruptFile(t, path)
+			},
+			want: map[string]string{config: verifyOK, first: verifyOK, second: verifyFailed},
+		},
+		{
+			name:  "corrupt config",
+			image: "app",
+			damage: func(t *testing.T, c *layerCache) {
+				path, _ := c.entryPath("configs", config)
+				corruptFile(t, path)
+			},
+			want: map[string]string{config: verifyFailed, first: verifyOK, second: verifyOK},
+		},
+		{
+			name:  "missing layer",
+			image: "app",
+			damage: func(t *testing.T, c *layerCache) {
+				path, _ := c.entryPath("blobs", first)
+				if err := os.Remove(path); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: map[string]string{config: verifyOK, first: verifyMissing, second: verifyOK},
+		},
+		{
+			name:  "unpacked layer",
+			image: "app",
+			damage: func(t *testing.T, c *layerCache) {
+				path, _ := c.entryPath("blobs", first)
+				tree, _ := c.entryPath("layers", first)
+				if err := os.Remove(path); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.MkdirAll(tree, 0o755); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: map[string]string{config: verifyOK, first: verifySkipped, second: verifyOK},
+		},
+		// Last, as it damages the layout the registry serves.
+		{
+			name:  "corrupt layout blob",
+			image: "oci:" + layout,
+			damage: func(t *testing.T, c *layerCache) {
+				path, _ := ociBlobPath(layout, first)
+				corruptFile(t, path)
+			},
+			want: map[string]string{config: verifyOK, first: verifyFailed, second: verifyOK},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := &layerCache{mode: cacheModeCompressed, dir: t.TempDir(), inUse: map[string]bool{}}
+			if _, err := pullDockerImage(t.TempDir(), "app", pullOptions{Cache: cache}); err != nil {
+				t.Fatal(err)
+			}
+			if tt.damage != nil {
+				tt.damage(t, cache)
+			}
+			v := &imageVerifier{cache: cache, buf: make([]byte, 4096)}
+			results := v.verify(tt.image, "")
+			if len(results) != 4 || results[0].Component != "manifest" || results[0].Result != verifyOK {
+				t.Fatalf("verify = %+v, want the manifest and 3 blobs checked", results)
+			}
+			for _, r := range results[1:] {
+				if r.Result != tt.want[r.Digest] {
+					t.Errorf("%s %s: %s, %v, want %s", r.Component, r.Digest, r.Result, r.Err, tt.want[r.Digest])
+				}
+			}
+		})
+	}
+}
+
+// corruptFile flips the last byte of the file at path.
+func corruptFile(t *testing.T, path string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
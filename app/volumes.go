@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var errLocked = errors.New("file is locked")
+
+// The locks on volumes and other shared state. Unix replaces them in init
+// with flock(2); elsewhere containers can't run, so nothing is ever in use
+// and they are no-ops.
+var (
+	// lockShared takes a shared lock on f, waiting for any exclusive
+	// holder.
+	lockShared = func(f *os.File) error { return nil }
+	// lockExclusive takes an exclusive lock on f, waiting for any other
+	// holder.
+	lockExclusive = func(f *os.File) error { return nil }
+	// tryLockExclusive takes an exclusive lock on f, failing with
+	// errLocked instead of waiting if anyone else holds a lock on it.
+	tryLockExclusive = func(f *os.File) error { return nil }
+)
+
+const volumeNamePattern = `[a-zA-Z0-9][a-zA-Z0-9_.-]*`
+
+var volumeNameRegexp = regexp.MustCompile(`^` + volumeNamePattern + `$`)
+
+func validVolumeName(name string) bool {
+	return volumeNameRegexp.MatchString(name)
+}
+
+func volumesDir() string {
+	return filepath.Join(homeDir(), "volumes")
+}
+
+// volumeDir is where the data of a named volume lives.
+func volumeDir(name string) string {
+	return filepath.Join(volumesDir(), name)
+}
+
+// Each volume has a lock file next to its data directory. Running containers
+// hold a shared lock on it, so removal can detect volumes in use without any
+// bookkeeping that could go stale if a container is killed.
+func volumeLockPath(name string) string {
+	return filepath.Join(volumesDir(), "."+name+".lock")
+}
+
+// createVolume creates the named volume if it doesn't exist yet and returns
+// its data directory.
+func createVolume(name string) (string, error) {
+	if !validVolumeName(name) {
+		return "", fmt.Errorf("invalid volume name %q: must match %s", name, volumeNamePattern)
+	}
+	dir := volumeDir(name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// acquireVolume creates the named volume if needed and marks it in use for
+// as long as the returned file stays open.
+func acquireVolume(name string) (string, *os.File, error) {
+	dir, err := createVolume(name)
+	if err != nil {
+		return "", nil, err
+	}
+	lock, err := os.OpenFile(volumeLockPath(name), os.O_CREATE|os.O_RDONLY, 0o644)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := lockShared(lock); err != nil {
+		lock.Close()
+		return "", nil, err
+	}
+	return dir, lock, nil
+}
+
+// removeVolume deletes a named volume and its data, refusing while any
+// container is using it.
+func removeVolume(name string) error {
+	if _, err := os.Stat(volumeDir(name)); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no such volume: %s", name)
+		}
+		return err
+	}
+	lock, err := os.OpenFile(volumeLockPath(name), os.O_CREATE|os.O_RDONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := tryLockExclusive(lock); err != nil {
+		if err == errLocked {
+			return fmt.Errorf("volume %s is in use", name)
+		}
+		return err
+	}
+	if err := os.RemoveAll(volumeDir(name)); err != nil {
+		return err
+	}
+	return os.Remove(volumeLockPath(name))
+}
+
+func listVolumes() ([]string, error) {
+	entries, err := os.ReadDir(volumesDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func volumeCommand(argv []string) {
+	if len(argv) < 1 {
+		fmt.Println(volumeUsage)
+		os.Exit(1)
+	}
+	switch argv[0] {
+	case "ls":
+		names, err := listVolumes()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+			os.Exit(1)
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+	case "create":
+		if len(argv) != 2 {
+			fmt.Println(volumeUsage)
+			os.Exit(1)
+		}
+		if _, err := createVolume(argv[1]); err != nil {
+			fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(argv[1])
+	case "rm":
+		if len(argv) < 2 {
+			fmt.Println(volumeUsage)
+			os.Exit(1)
+		}
+		failed := false
+		for _, name := range argv[1:] {
+			if err := removeVolume(name); err != nil {
+				fmt.Fprintf(os.Stderr, "Err: %v\n", err)
+				failed = true
+				continue
+			}
+			fmt.Println(name)
+		}
+		if failed {
+			os.Exit(1)
+		}
+	default:
+		fmt.Println(volumeUsage)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,79 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestVolumes(t *testing.T) {
+	t.Setenv("DOCKER_CLONE_HOME", t.TempDir())
+	dir, lock, err := acquireVolume("data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "kept"), []byte("from the first run"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	lock.Close()
+
+	// A later run gets the same data, alongside another run using it.
+	again, lock, err := acquireVolume("data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, otherLock, err := acquireVolume("data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != dir || other != dir {
+		t.Errorf("volume in %s, then %s and %s", dir, again, other)
+	}
+	if got, err := os.ReadFile(filepath.Join(again, "kept")); err != nil || string(got) != "from the first run" {
+		t.Errorf("kept = %q, %v", got, err)
+	}
+	if _, err := createVolume("empty"); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := listVolumes(); err != nil || !reflect.DeepEqual(names, []string{"data", "empty"}) {
+		t.Errorf("listVolumes = %q, %v", names, err)
+	}
+
+	if err := removeVolume("data"); err == nil {
+		t.Fatal("removed a volume in use")
+	}
+	lock.Close()
+	if err := removeVolume("data"); err == nil {
+		t.Fatal("removed a volume still in use by the other run")
+	}
+	otherLock.Close()
+	if err := removeVolume("data"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("volume data left behind: %v", err)
+	}
+	if err := removeVolume("data"); err == nil {
+		t.Error("removed a volume twice")
+	}
+	if names, err := listVolumes(); err != nil || !reflect.DeepEqual(names, []string{"empty"}) {
+		t.Errorf("listVolumes = %q, %v", names, err)
+	}
+}
+
+func TestCreateVolumeNames(t *testing.T) {
+	t.Setenv("DOCKER_CLONE_HOME", t.TempDir())
+	for _, name := range []string{"a", "my-volume_1.0", "A9"} {
+		if _, err := createVolume(name); err != nil {
+			t.Errorf("createVolume(%q): %v", name, err)
+		}
+	}
+	for _, name := range []string{"", ".hidden", "-a", "a/b", "../up", "a b"} {
+		if _, err := createVolume(name); err == nil {
+			t.Errorf("createVolume(%q) succeeded", name)
+		}
+	}
+}
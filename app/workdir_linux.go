@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// resolveWorkdir returns the directory the command runs in: --workdir, which
+// has to be absolute, if set, else the image's WorkingDir, else /.
+func resolveWorkdir(flag string, config ContainerConfig) (string, error) {
+	if flag != "" {
+		if !filepath.IsAbs(flag) {
+			return "", fmt.Errorf("--workdir %q: must be an absolute path", flag)
+		}
+		return filepath.Clean(flag), nil
+	}
+	// Docker takes a relative WorkingDir to be relative to /.
+	return filepath.Clean("/" + config.WorkingDir), nil
+}
+
+// ensureWorkdir creates the working directory dir in rootfs if it doesn't
+// exist, as Docker does, with the directories missing on the way to it.
+// Docker gives them to the container's user, the image's User, so that it
+// can write to them; that is only done as root, since no one else can give
+// files away. Otherwise the user running us creates them, and owns them.
+func ensureWorkdir(rootfs, dir, user string) error {
+	path, err := resolveInRoot(rootfs, dir)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	switch {
+	case err == nil && !info.IsDir():
+		return fmt.Errorf("working directory %s is not a directory", dir)
+	case err == nil:
+		return nil
+	case !os.IsNotExist(err):
+		return err
+	}
+	uid, gid, err := resolveUser(rootfs, user)
+	if err != nil {
+		return fmt.Errorf("creating working directory %s: %w", dir, err)
+	}
+	// The directories missing are created top down, from the deepest one
+	// that exists.
+	var missing []string
+	for p := path; p != rootfs && p != filepath.Dir(p); p = filepath.Dir(p) {
+		if _, err := os.Lstat(p); err == nil {
+			break
+		}
+		missing = append(missing, p)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := os.Mkdir(missing[i], 0o755); err != nil && !os.IsExist(err) {
+			return err
+		}
+		if os.Geteuid() == 0 {
+			if err := os.Lchown(missing[i], int(uid), int(gid)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
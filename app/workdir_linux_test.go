@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// testRootfs makes a rootfs with /etc/passwd and /etc/group.
+func testRootfs(t *testing.T) string {
+	t.Helper()
+	rootfs := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"etc/passwd": "root:x:0:0:root:/root:/bin/sh\napp:x:1000:1001::/home/app:/bin/sh\napp:x:2000:2000:duplicate:/:/bin/sh\nsvc:x:1500:44::/:/bin/sh\n",
+		"etc/group":  "root:x:0:\nvideo:x:44:\napp:x:1001:\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(rootfs, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rootfs
+}
+
+func TestResolveUser(t *testing.T) {
+	rootfs := testRootfs(t)
+	tests := []struct {
+		user     string
+		uid, gid uint32
+		wantErr  bool
+	}{
+		{user: "", uid: 0, gid: 0},
+		{user: "root", uid: 0, gid: 0},
+		{user: "app", uid: 1000, gid: 1001},
+		{user: "app:video", uid: 1000, gid: 44},
+		{user: "app:7", uid: 1000, gid: 7},
+		{user: "1500", uid: 1500, gid: 44},
+		{user: "4242", uid: 4242, gid: 0},
+		{user: "4242:4343", uid: 4242, gid: 4343},
+		{user: "4242:video", uid: 4242, gid: 44},
+		{user: "nobody", wantErr: true},
+		{user: "app:nogroup", wantErr: true},
+		{user: ":44", wantErr: true},
+		{user: "4294967295", wantErr: true},
+	}
+	for _, tt := range tests {
+		uid, gid, err := resolveUser(rootfs, tt.user)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("resolveUser(%q) = %d:%d, want an error", tt.user, uid, gid)
+			}
+			continue
+		}
+		if err != nil || uid != tt.uid || gid != tt.gid {
+			t.Errorf("resolveUser(%q) = %d:%d, %v, want %d:%d", tt.user, uid, gid, err, tt.uid, tt.gid)
+		}
+	}
+}
+
+func TestEnsureWorkdirOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("giving directories away needs root")
+	}
+	tests := []struct {
+		name     string
+		user     string
+		exists   string
+		dir      string
+		uid, gid uint32
+	}{
+		{name: "image user", user: "app", dir: "/srv/app/data", uid: 1000, gid: 1001},
+		{name: "numeric user", user: "4242:video", dir: "/work", uid: 4242, gid: 44},
+		{name: "no user", dir: "/work", uid: 0, gid: 0},
+		{name: "existing parent kept", user: "app", exists: "/srv", dir: "/srv/app", uid: 1000, gid: 1001},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rootfs := testRootfs(t)
+			if tt.exists != "" {
+				if err := os.MkdirAll(filepath.Join(rootfs, tt.exists), 0o755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := ensureWorkdir(rootfs, tt.dir, tt.user); err != nil {
+				t.Fatal(err)
+			}
+			for p := tt.dir; p != "/" && p != tt.exists; p = filepath.Dir(p) {
+				var st syscall.Stat_t
+				if err := syscall.Stat(filepath.Join(rootfs, p), &st); err != nil {
+					t.Fatal(err)
+				}
+				if st.Uid != tt.uid || st.Gid != tt.gid {
+					t.Errorf("%s is owned by %d:%d, want %d:%d", p, st.Uid, st.Gid, tt.uid, tt.gid)
+				}
+			}
+			if tt.exists != "" {
+				var st syscall.Stat_t
+				if err := syscall.Stat(filepath.Join(rootfs, tt.exists), &st); err != nil {
+					t.Fatal(err)
+				}
+				if st.Uid != 0 {
+					t.Errorf("existing %s was given to %d", tt.exists, st.Uid)
+				}
+			}
+		})
+	}
+}